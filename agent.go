@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// An agent checksums the files in a tree on its machine and sends what it
+// finds to a coordinator, which looks for duplicates across machines. This way
+// nothing needs to mount every machine's files in one place.
+//
+// Agents send newline delimited JSON: an agentHeader followed by an
+// agentRecord for each file.
+
+// agentProtocolVersion is the version of the records agents send. We increase
+// it when we change them in a way a coordinator must know about.
+const agentProtocolVersion = 1
+
+// agentPath is where agents send their records on the coordinator.
+const agentPath = "/v1/records"
+
+// agentHeader starts an agent's records.
+type agentHeader struct {
+	Version   int    `json:"version"`
+	Host      string `json:"host"`
+	Dir       string `json:"dir"`
+	Algorithm string `json:"algorithm"`
+}
+
+// agentRecord describes one file. Hash is hex encoded.
+type agentRecord struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Hash    string    `json:"hash"`
+}
+
+// agent implements the agent subcommand.
+func agent(argv []string) error {
+	args := defaultArgs()
+
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	fs.StringVar(&args.Dir, "dir", "", "Directory to search.")
+	coordinator := fs.String("coordinator", "",
+		"URL of the coordinator to send records to, or - to write them to stdout.")
+	host, _ := os.Hostname()
+	fs.StringVar(&host, "host", host,
+		"Name of this machine in the coordinator's report. The default is its hostname.")
+	fs.StringVar(&args.Hash, "hash", args.Hash,
+		fmt.Sprintf("Hash algorithm to use. One of: %s. The coordinator needs every agent to use the same one.",
+			strings.Join(hashAlgorithmNames(), ", ")))
+	fs.IntVar(&args.Workers, "workers", args.Workers,
+		"Number of files to checksum at once.")
+	fs.IntVar(&args.MaxOpen, "max-open-files", args.MaxOpen,
+		"Maximum number of files to have open at once.")
+	fs.IntVar(&args.Retries, "retries", args.Retries,
+		"Number of times to retry opening/reading a file after a transient error.")
+	fs.DurationVar(&args.RetryDelay, "retry-delay", args.RetryDelay,
+		"Delay before the first retry. It doubles with each subsequent retry.")
+	fs.IntVar(&args.BufferSize, "buffer-size", args.BufferSize,
+		"Size in bytes of each read when checksumming files.")
+	fs.BoolVar(&args.Mmap, "mmap", args.Mmap,
+		"Checksum files by mapping them into memory rather than reading them.")
+	fs.Var((*stringsFlag)(&args.Exclude), "exclude",
+		"Skip files and directories matching this pattern. You may give this more than once.")
+	addLogFlags(fs, args)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(),
+			"Usage: %s agent -dir DIR -coordinator URL\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	_ = fs.Parse(argv)
+
+	if args.Dir == "" || *coordinator == "" {
+		fs.Usage()
+		return fmt.Errorf("you must provide a directory and a coordinator")
+	}
+
+	if host == "" {
+		return fmt.Errorf("unable to determine the hostname. Set it with -host")
+	}
+
+	if err := checkArgs(args); err != nil {
+		return err
+	}
+	if err := setupLogFile(args); err != nil {
+		return err
+	}
+
+	if *coordinator != "-" {
+		if err := checkCoordinatorURL(*coordinator); err != nil {
+			return err
+		}
+	}
+
+	if args.MaxOpen > 0 {
+		fds = newFDBudget(args.MaxOpen)
+	}
+
+	// A file on another machine may have any size, so we checksum every file.
+	files, err := checksumTree(args)
+	if err != nil {
+		return err
+	}
+
+	header := agentHeader{
+		Version:   agentProtocolVersion,
+		Host:      host,
+		Dir:       args.Dir,
+		Algorithm: args.Hash,
+	}
+
+	return deliverAgentRecords(*coordinator, header, files)
+}
+
+// checksumTree finds every file under args.Dir and checksums it. Hard links to
+// the same file share one checksum.
+func checksumTree(args *Args) ([]*File, error) {
+	log.Print("Looking for files...")
+	var files []*File
+	if _, err := findFiles(args, args.Dir, args.Exclude, func(file *File) error {
+		files = append(files, file)
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("unable to find files: %s", err)
+	}
+
+	distinct := distinctFiles(files)
+	log.Printf("Calculating checksums of %d files...", len(distinct))
+	if err := calculateChecksums(args, distinct, hashFile); err != nil {
+		return nil, fmt.Errorf("unable to calculate checksums: %s", err)
+	}
+	shareChecksums(files)
+
+	return withoutVanished(args, files), nil
+}
+
+// checkCoordinatorURL checks that the coordinator's URL is one we can post
+// records to.
+func checkCoordinatorURL(coordinator string) error {
+	u, err := url.Parse(coordinator)
+	if err != nil {
+		return fmt.Errorf("invalid coordinator URL: %s", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("the coordinator URL must be an http or https URL")
+	}
+	return nil
+}
+
+// deliverAgentRecords sends the records to the coordinator, or with a
+// coordinator of -, writes them to stdout.
+func deliverAgentRecords(coordinator string, header agentHeader,
+	files []*File) error {
+	if coordinator == "-" {
+		w := bufio.NewWriter(os.Stdout)
+		if err := writeAgentRecords(w, header, files); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+
+	log.Printf("Sending %d records to %s...", len(files), coordinator)
+	if err := sendAgentRecords(coordinator, header, files); err != nil {
+		return err
+	}
+	log.Printf("Sent.")
+	return nil
+}
+
+// writeAgentRecords writes the header and then a record for each file.
+func writeAgentRecords(w io.Writer, header agentHeader, files []*File) error {
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(header); err != nil {
+		return fmt.Errorf("unable to write records: %s", err)
+	}
+
+	for _, file := range files {
+		if err := encoder.Encode(agentRecord{
+			Path:    file.Path,
+			Size:    file.Size,
+			ModTime: file.ModTime,
+			Hash:    hex.EncodeToString(file.Hash),
+		}); err != nil {
+			return fmt.Errorf("unable to write records: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// sendAgentRecords posts the records to the coordinator. We encode them as
+// the request goes out, so a large tree's records never have to fit in memory
+// all at once as JSON.
+func sendAgentRecords(coordinator string, header agentHeader,
+	files []*File) error {
+	endpoint, err := url.Parse(coordinator)
+	if err != nil {
+		return fmt.Errorf("invalid coordinator URL: %s", err)
+	}
+	// The coordinator may be behind a proxy serving it beneath a path.
+	endpoint.Path = path.Join("/", endpoint.Path, agentPath)
+
+	r, w := io.Pipe()
+	go func() {
+		bw := bufio.NewWriter(w)
+		err := writeAgentRecords(bw, header, files)
+		if err == nil {
+			err = bw.Flush()
+		}
+		_ = w.CloseWithError(err)
+	}()
+
+	resp, err := http.Post(endpoint.String(), "application/x-ndjson", r)
+	if err != nil {
+		_ = r.Close()
+		return fmt.Errorf("unable to send records: %s", err)
+	}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err := resp.Body.Close(); err != nil {
+		return fmt.Errorf("unable to send records: %s", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("coordinator responded with %s: %s", resp.Status, body)
+	}
+
+	return nil
+}
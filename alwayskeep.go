@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// always_keep lists files we never remove, whatever the rules, the decide
+// script, or the default action say, such as *.xmp or */originals/*. It is a
+// safety net over the rules like protected, but its patterns need not be
+// absolute paths:
+//
+//   - A pattern without a / matches the name of the file or of a directory
+//     it is in, so *.xmp matches every XMP file and originals everything in
+//     a directory called originals.
+//   - A pattern starting with / matches the full path of the file or of a
+//     directory it is in, as in protected.
+//   - Other patterns match the end of the path of the file or of a directory
+//     it is in, so */originals/* matches everything in a directory called
+//     originals, however deep.
+//   - A pattern starting with regexp: is a regular expression matching
+//     anywhere in the full path.
+
+// alwaysKeepRegexp is the prefix of always_keep entries that are regular
+// expressions.
+const alwaysKeepRegexp = "regexp:"
+
+// alwaysKeepPattern is an always_keep entry. re is set for regular
+// expressions.
+type alwaysKeepPattern struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+// compileAlwaysKeep compiles the always_keep entries.
+func compileAlwaysKeep(patterns []string) ([]alwaysKeepPattern, []error) {
+	var compiled []alwaysKeepPattern
+	var errs []error
+	for i, pattern := range patterns {
+		field := fmt.Sprintf("always_keep[%d]", i)
+		if expr := strings.TrimPrefix(pattern, alwaysKeepRegexp); expr != pattern {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				errs = append(errs, fieldError{field,
+					fmt.Sprintf("invalid regular expression: %s", err)})
+				continue
+			}
+			compiled = append(compiled, alwaysKeepPattern{pattern: pattern, re: re})
+			continue
+		}
+
+		if pattern == "" {
+			errs = append(errs, fieldError{field, "missing"})
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs,
+				fieldError{field, fmt.Sprintf("invalid pattern: %s", err)})
+			continue
+		}
+		if strings.HasPrefix(pattern, "/") {
+			pattern = canonicalPattern(pattern)
+		}
+		compiled = append(compiled, alwaysKeepPattern{pattern: pattern})
+	}
+	return compiled, errs
+}
+
+// isAlwaysKept checks whether an always_keep pattern matches the file. It
+// returns the pattern if one does.
+func isAlwaysKept(patterns []alwaysKeepPattern, filePath string) (string,
+	bool) {
+	// Patterns are for the path on whichever machine the file is.
+	if _, local := splitHost(filePath); local != "" {
+		filePath = local
+	}
+
+	for _, pattern := range patterns {
+		if pattern.re != nil {
+			if pattern.re.MatchString(filePath) {
+				return pattern.pattern, true
+			}
+			continue
+		}
+
+		parts := strings.Count(strings.Trim(pattern.pattern, "/"), "/") + 1
+		for p := filePath; p != "/" && p != "."; p = path.Dir(p) {
+			// We validated the patterns when loading them.
+			var matched bool
+			if strings.HasPrefix(pattern.pattern, "/") {
+				matched, _ = path.Match(pattern.pattern, p)
+			} else {
+				matched, _ = path.Match(pattern.pattern, lastParts(p, parts))
+			}
+			if matched {
+				return pattern.pattern, true
+			}
+		}
+	}
+	return "", false
+}
+
+// lastParts returns the last n elements of the path.
+func lastParts(p string, n int) string {
+	i := len(p)
+	for ; n > 0 && i > 0; n-- {
+		i = strings.LastIndex(p[:i], "/")
+		if i == -1 {
+			return p
+		}
+	}
+	return p[i+1:]
+}
+
+// protectedBy checks whether protected or always_keep says we must not
+// remove the file. It returns the entry that does.
+func protectedBy(config *Config, filePath string) (string, bool) {
+	// We match the path rules see, so that a relative -dir or a symbolic link
+	// in the path gets nowhere. If we can't tell where the file really is, it
+	// may be somewhere protected.
+	if host, _ := splitHost(filePath); host == "" {
+		canonical, ok := canonicalPath(filePath)
+		if !ok {
+			return "(unable to resolve its path)", true
+		}
+		filePath = canonical
+	}
+
+	if pattern, ok := isProtected(config.Protected, filePath); ok {
+		return pattern, true
+	}
+	return isAlwaysKept(config.alwaysKeep, filePath)
+}
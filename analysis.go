@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// With -analyze, we write an analysis of the files and duplicates we found:
+// how many files there are of each size, how many copies the duplicates have,
+// and how much of each directory at the top of the tree is duplicated. This
+// shows where removing duplicates would pay off before writing any rules.
+
+// Analysis is what -analyze writes.
+type Analysis struct {
+	FileSizes   []SizeBucket        `json:"file_sizes"`
+	GroupSizes  []GroupBucket       `json:"group_sizes"`
+	Directories []DirectoryAnalysis `json:"directories"`
+}
+
+// SizeBucket counts the files with sizes in a range. Duplicates counts those
+// with an identical copy elsewhere.
+type SizeBucket struct {
+	Sizes      string `json:"sizes"`
+	Files      int    `json:"files"`
+	Bytes      int64  `json:"bytes"`
+	Duplicates int    `json:"duplicates"`
+}
+
+// GroupBucket counts the groups of duplicates with a number of copies in a
+// range. WastedBytes is what removing all but one copy in each would free.
+type GroupBucket struct {
+	Copies      string `json:"copies"`
+	Groups      int    `json:"groups"`
+	WastedBytes int64  `json:"wasted_bytes"`
+}
+
+// DirectoryAnalysis says how much of a directory at the top of the tree is
+// duplicated. DuplicatedBytes is the size of its files with an identical copy
+// anywhere, including in the same directory. Files directly in the top of the
+// tree are under ".".
+type DirectoryAnalysis struct {
+	Dir             string  `json:"dir"`
+	Files           int     `json:"files"`
+	Bytes           int64   `json:"bytes"`
+	DuplicatedBytes int64   `json:"duplicated_bytes"`
+	Percent         float64 `json:"percent"`
+}
+
+// sizeBucketLimits are the limits of the file size buckets, after the bucket
+// for empty files. Each bucket holds sizes up to but not including its limit,
+// and a last bucket holds everything larger.
+var sizeBucketLimits = []int64{
+	4 << 10,
+	64 << 10,
+	1 << 20,
+	16 << 20,
+	256 << 20,
+	4 << 30,
+}
+
+// groupBucketLimits are the upper limits of the buckets for the number of
+// copies. A last bucket holds everything larger.
+var groupBucketLimits = []int{2, 3, 4, 9, 99}
+
+// analysis gathers what -analyze writes as we find files.
+type analysis struct {
+	dir         string
+	sizes       []SizeBucket
+	directories map[string]*DirectoryAnalysis
+
+	// groups holds every group of duplicates, including those -top leaves
+	// out.
+	groups [][]*File
+}
+
+// newAnalysis starts an analysis of the tree at dir.
+func newAnalysis(dir string) *analysis {
+	a := &analysis{
+		dir:         dir,
+		sizes:       []SizeBucket{{Sizes: "0 bytes"}},
+		directories: make(map[string]*DirectoryAnalysis),
+	}
+	var lower int64
+	for _, limit := range sizeBucketLimits {
+		sizes := "under " + formatSize(limit)
+		if lower > 0 {
+			sizes = fmt.Sprintf("%s to %s", formatSize(lower), formatSize(limit))
+		}
+		a.sizes = append(a.sizes, SizeBucket{Sizes: sizes})
+		lower = limit
+	}
+	a.sizes = append(a.sizes, SizeBucket{
+		Sizes: fmt.Sprintf("%s and up", formatSize(lower)),
+	})
+	return a
+}
+
+// formatSize writes a size in the largest binary unit it is a whole number
+// of, such as 4 KiB.
+func formatSize(size int64) string {
+	units := []string{"bytes", "KiB", "MiB", "GiB"}
+	unit := 0
+	for unit < len(units)-1 && size >= 1024 && size%1024 == 0 {
+		size /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%d %s", size, units[unit])
+}
+
+// sizeBucket returns the index of the file size bucket for the size.
+func sizeBucket(size int64) int {
+	if size == 0 {
+		return 0
+	}
+	for i, limit := range sizeBucketLimits {
+		if size < limit {
+			return i + 1
+		}
+	}
+	return len(sizeBucketLimits) + 1
+}
+
+// topDir returns the directory at the top of the tree the file is in.
+func (a *analysis) topDir(file *File) string {
+	rel, err := filepath.Rel(a.dir, file.Path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return file.Path
+	}
+	parts := strings.SplitN(filepath.ToSlash(rel), "/", 2)
+	if len(parts) < 2 {
+		return "."
+	}
+	return parts[0]
+}
+
+// addFile counts a file we found.
+func (a *analysis) addFile(file *File) {
+	bucket := &a.sizes[sizeBucket(file.Size)]
+	bucket.Files++
+	bucket.Bytes += file.Size
+
+	name := a.topDir(file)
+	dir, ok := a.directories[name]
+	if !ok {
+		dir = &DirectoryAnalysis{Dir: name}
+		a.directories[name] = dir
+	}
+	dir.Files++
+	dir.Bytes += file.Size
+}
+
+// finish builds the analysis from the files and the groups of duplicates we
+// found among them.
+func (a *analysis) finish() *Analysis {
+	result := &Analysis{
+		FileSizes:   append([]SizeBucket{}, a.sizes...),
+		Directories: []DirectoryAnalysis{},
+	}
+
+	lower := 2
+	for _, limit := range groupBucketLimits {
+		copies := strconv.Itoa(limit)
+		if limit > lower {
+			copies = fmt.Sprintf("%d to %d", lower, limit)
+		}
+		result.GroupSizes = append(result.GroupSizes, GroupBucket{Copies: copies})
+		lower = limit + 1
+	}
+	result.GroupSizes = append(result.GroupSizes, GroupBucket{
+		Copies: fmt.Sprintf("%d and up", lower),
+	})
+
+	for _, group := range a.groups {
+		bucket := len(groupBucketLimits)
+		for i, limit := range groupBucketLimits {
+			if len(group) <= limit {
+				bucket = i
+				break
+			}
+		}
+		result.GroupSizes[bucket].Groups++
+		result.GroupSizes[bucket].WastedBytes += int64(len(group)-1) * group[0].Size
+
+		for _, file := range group {
+			result.FileSizes[sizeBucket(file.Size)].Duplicates++
+			if dir, ok := a.directories[a.topDir(file)]; ok {
+				dir.DuplicatedBytes += file.Size
+			}
+		}
+	}
+
+	for _, dir := range a.directories {
+		if dir.Bytes > 0 {
+			dir.Percent = float64(dir.DuplicatedBytes) * 100 / float64(dir.Bytes)
+		}
+		result.Directories = append(result.Directories, *dir)
+	}
+	sort.Slice(result.Directories, func(i, j int) bool {
+		if result.Directories[i].DuplicatedBytes !=
+			result.Directories[j].DuplicatedBytes {
+			return result.Directories[i].DuplicatedBytes >
+				result.Directories[j].DuplicatedBytes
+		}
+		return result.Directories[i].Dir < result.Directories[j].Dir
+	})
+
+	return result
+}
+
+// writeAnalysis writes the analysis in the format, which is one of the
+// -format formats.
+func writeAnalysis(w io.Writer, format string, result *Analysis) error {
+	switch format {
+	case reportText:
+		return writeAnalysisText(w, result)
+	case reportCSV:
+		return writeAnalysisCSV(w, result)
+	case reportJSON:
+		buf, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return fmt.Errorf("unable to encode analysis: %s", err)
+		}
+		if _, err := w.Write(append(buf, '\n')); err != nil {
+			return fmt.Errorf("unable to write analysis: %s", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown report format: %s", format)
+	}
+}
+
+// analysisBarWidth is how wide the longest bar in a text histogram is.
+const analysisBarWidth = 40
+
+// histogramBar draws a bar for n out of the largest of the histogram, after a
+// space, or nothing for 0.
+func histogramBar(n, largest int64) string {
+	if largest <= 0 || n <= 0 {
+		return ""
+	}
+	width := int(n * analysisBarWidth / largest)
+	if width == 0 {
+		width = 1
+	}
+	return " " + strings.Repeat("#", width)
+}
+
+// writeAnalysisText writes each histogram as a table, with bars for the
+// bytes each row holds.
+func writeAnalysisText(w io.Writer, result *Analysis) error {
+	var b strings.Builder
+
+	var maxBytes int64
+	for _, bucket := range result.FileSizes {
+		if bucket.Bytes > maxBytes {
+			maxBytes = bucket.Bytes
+		}
+	}
+	b.WriteString("File sizes:\n")
+	for _, bucket := range result.FileSizes {
+		fmt.Fprintf(&b, "  %-18s %10d files %16d bytes %10d duplicates%s\n",
+			bucket.Sizes, bucket.Files, bucket.Bytes, bucket.Duplicates,
+			histogramBar(bucket.Bytes, maxBytes))
+	}
+
+	maxBytes = 0
+	for _, bucket := range result.GroupSizes {
+		if bucket.WastedBytes > maxBytes {
+			maxBytes = bucket.WastedBytes
+		}
+	}
+	b.WriteString("\nCopies of each duplicate:\n")
+	for _, bucket := range result.GroupSizes {
+		fmt.Fprintf(&b, "  %-10s %10d groups %16d bytes wasted%s\n",
+			bucket.Copies, bucket.Groups, bucket.WastedBytes,
+			histogramBar(bucket.WastedBytes, maxBytes))
+	}
+
+	b.WriteString("\nDuplication by directory:\n")
+	for _, dir := range result.Directories {
+		fmt.Fprintf(&b, "  %5.1f%% %s (%d of %d bytes in %d files)\n",
+			dir.Percent, dir.Dir, dir.DuplicatedBytes, dir.Bytes, dir.Files)
+	}
+
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return fmt.Errorf("unable to write analysis: %s", err)
+	}
+	return nil
+}
+
+// writeAnalysisCSV writes a row for each row of each histogram. section says
+// which histogram a row is from, and the columns mean different things in
+// each, as in the JSON format.
+func writeAnalysisCSV(w io.Writer, result *Analysis) error {
+	cw := csv.NewWriter(w)
+
+	rows := [][]string{{"section", "name", "count", "bytes", "duplicates"}}
+	for _, bucket := range result.FileSizes {
+		rows = append(rows, []string{"file_sizes", bucket.Sizes,
+			strconv.Itoa(bucket.Files), strconv.FormatInt(bucket.Bytes, 10),
+			strconv.Itoa(bucket.Duplicates)})
+	}
+	for _, bucket := range result.GroupSizes {
+		rows = append(rows, []string{"group_sizes", bucket.Copies,
+			strconv.Itoa(bucket.Groups), strconv.FormatInt(bucket.WastedBytes, 10),
+			""})
+	}
+	for _, dir := range result.Directories {
+		rows = append(rows, []string{"directories", dir.Dir,
+			strconv.Itoa(dir.Files), strconv.FormatInt(dir.Bytes, 10),
+			strconv.FormatInt(dir.DuplicatedBytes, 10)})
+	}
+
+	if err := cw.WriteAll(rows); err != nil {
+		return fmt.Errorf("unable to write analysis: %s", err)
+	}
+	return nil
+}
+
+// saveAnalysis writes the analysis to the file, or to stdout if the file is
+// -.
+func saveAnalysis(output, format string, result *Analysis) error {
+	var buf bytes.Buffer
+	if err := writeAnalysis(&buf, format, result); err != nil {
+		return err
+	}
+
+	if output == "-" {
+		if _, err := os.Stdout.Write(buf.Bytes()); err != nil {
+			return fmt.Errorf("unable to write analysis: %s", err)
+		}
+		return nil
+	}
+
+	if err := writeFileAtomically(output, buf.Bytes()); err != nil {
+		return fmt.Errorf("unable to write analysis: %s", err)
+	}
+	return nil
+}
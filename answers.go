@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// An answers file records the choices made with -interactive and
+// -delete-prompt, so that a long review can be done once and applied later,
+// or on another machine, with -answers. Each answer is for a group of
+// duplicates, identified by its checksum and size, and lists the paths to keep
+// and those to remove. Answers decide before rules do, as they are what the
+// user chose.
+
+// answersVersion is the version of the answers file format.
+const answersVersion = 1
+
+// answerFile is the contents of an answers file. Answers only make sense with
+// the hash algorithm that found them.
+type answerFile struct {
+	Version   int      `json:"version"`
+	Algorithm string   `json:"algorithm"`
+	Answers   []answer `json:"answers"`
+}
+
+// answer is a choice about some of the files in a group of duplicates. A
+// choice to leave two files alone keeps both.
+type answer struct {
+	Hash   string   `json:"hash"`
+	Size   int64    `json:"size"`
+	Keep   []string `json:"keep"`
+	Remove []string `json:"remove"`
+}
+
+// answerBook holds the answers in a file.
+type answerBook struct {
+	file    string
+	answers answerFile
+}
+
+// loadAnswers reads an answers file. If missing is true, a file that doesn't
+// exist yet has no answers.
+func loadAnswers(name, algorithm string, missing bool) (*answerBook, error) {
+	book := &answerBook{
+		file: name,
+		answers: answerFile{
+			Version:   answersVersion,
+			Algorithm: algorithm,
+			Answers:   []answer{},
+		},
+	}
+
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		if missing && os.IsNotExist(err) {
+			return book, nil
+		}
+		return nil, fmt.Errorf("unable to read answers: %s", err)
+	}
+
+	if err := json.Unmarshal(buf, &book.answers); err != nil {
+		return nil, fmt.Errorf("unable to parse answers: %s: %s", name, err)
+	}
+	if book.answers.Version != answersVersion {
+		return nil, fmt.Errorf("%s: unsupported answers version %d", name,
+			book.answers.Version)
+	}
+	if book.answers.Algorithm != algorithm {
+		return nil, fmt.Errorf("%s holds answers for -hash %s, not %s", name,
+			book.answers.Algorithm, algorithm)
+	}
+
+	return book, nil
+}
+
+// record adds an answer about the group and saves the file. We save after
+// each answer so that an interrupted review loses nothing.
+func (b *answerBook) record(group []*File, keep, remove []*File) error {
+	a := answer{
+		Hash:   hex.EncodeToString(group[0].Hash),
+		Size:   group[0].Size,
+		Keep:   []string{},
+		Remove: []string{},
+	}
+	for _, file := range keep {
+		a.Keep = append(a.Keep, file.Path)
+	}
+	for _, file := range remove {
+		a.Remove = append(a.Remove, file.Path)
+	}
+	b.answers.Answers = append(b.answers.Answers, a)
+
+	buf, err := json.MarshalIndent(b.answers, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode answers: %s", err)
+	}
+	if err := writeFileAtomically(b.file, append(buf, '\n')); err != nil {
+		return fmt.Errorf("unable to save answers: %s", err)
+	}
+	return nil
+}
+
+// decide looks up what the answers say to do with two duplicate files. It
+// returns the file to keep and the file to remove. If an answer names both
+// files but doesn't keep one over the other, as when the user skipped them or
+// chose to delete both in favour of a third, it returns nils to leave them
+// alone, and true to say that the answers cover them.
+func (b *answerBook) decide(file1, file2 *File) (*File, *File, bool) {
+	hash := hex.EncodeToString(file1.Hash)
+	covered := false
+	for _, a := range b.answers.Answers {
+		if a.Hash != hash || a.Size != file1.Size {
+			continue
+		}
+		keep1, remove1 := a.has(file1.Path)
+		keep2, remove2 := a.has(file2.Path)
+		if keep1 && remove2 {
+			return file1, file2, true
+		}
+		if keep2 && remove1 {
+			return file2, file1, true
+		}
+		if (keep1 || remove1) && (keep2 || remove2) {
+			covered = true
+		}
+	}
+	return nil, nil, covered
+}
+
+// covers checks whether any answer is about one of the group's files.
+func (b *answerBook) covers(group []*File) bool {
+	hash := hex.EncodeToString(group[0].Hash)
+	for _, a := range b.answers.Answers {
+		if a.Hash != hash || a.Size != group[0].Size {
+			continue
+		}
+		for _, file := range group {
+			if keep, remove := a.has(file.Path); keep || remove {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// has checks whether the answer keeps or removes the path.
+func (a answer) has(filePath string) (bool, bool) {
+	for _, p := range a.Keep {
+		if p == filePath {
+			return true, false
+		}
+	}
+	for _, p := range a.Remove {
+		if p == filePath {
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// recordPair records what the user chose to do with two of the group's files
+// with -interactive. If they kept neither over the other, we keep both.
+func recordPair(book *answerBook, group []*File, file1, file2, keep,
+	remove *File) error {
+	if keep == nil {
+		return book.record(group, []*File{file1, file2}, nil)
+	}
+	return book.record(group, []*File{keep}, []*File{remove})
+}
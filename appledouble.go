@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// On filesystems without native support for macOS metadata, such as FAT and
+// network shares, macOS keeps each file's Finder information and resource
+// fork in an AppleDouble file beside it, named with a ._ prefix. These belong
+// to their data files rather than being files in their own right. Many are
+// identical, so comparing them would find lots of meaningless duplicates.
+//
+// We skip AppleDouble files when looking for duplicates. When we delete a data
+// file, we delete its AppleDouble file too, since it would describe nothing.
+
+// appleDoubleMagic starts every AppleDouble file.
+var appleDoubleMagic = []byte{0x00, 0x05, 0x16, 0x07}
+
+// appleDoublePath returns where the AppleDouble file for the file would be.
+func appleDoublePath(filePath string) string {
+	dir, name := path.Split(filePath)
+	return dir + "._" + name
+}
+
+// isAppleDouble checks whether the file is an AppleDouble file. Its name
+// starts with ._, and it starts with the AppleDouble magic number. Checking
+// the contents means we don't skip a file that merely has such a name.
+func isAppleDouble(filePath string) bool {
+	if !strings.HasPrefix(path.Base(filePath), "._") {
+		return false
+	}
+
+	fh, err := fds.open(filePath)
+	if err != nil {
+		return false
+	}
+	defer func() { _ = fds.close(fh) }()
+
+	magic := make([]byte, len(appleDoubleMagic))
+	if _, err := io.ReadFull(fh, magic); err != nil {
+		return false
+	}
+	return bytes.Equal(magic, appleDoubleMagic)
+}
+
+// appleDoubleFor returns the path of the file's AppleDouble file, if it has
+// one.
+func appleDoubleFor(filePath string) (string, bool) {
+	sidecar := appleDoublePath(filePath)
+	fi, err := os.Lstat(sidecar)
+	if err != nil || !fi.Mode().IsRegular() {
+		return "", false
+	}
+	return sidecar, isAppleDouble(sidecar)
+}
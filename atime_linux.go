@@ -0,0 +1,16 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// accessTime returns when the file was last accessed, if we can tell.
+func accessTime(fi os.FileInfo) (time.Time, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(st.Atim.Sec), int64(st.Atim.Nsec)), true
+}
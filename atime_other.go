@@ -0,0 +1,15 @@
+//go:build !darwin && !linux && !windows
+// +build !darwin,!linux,!windows
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// accessTime returns when the file was last accessed, if we can tell. We don't
+// know how to on this platform.
+func accessTime(fi os.FileInfo) (time.Time, bool) {
+	return time.Time{}, false
+}
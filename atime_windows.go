@@ -0,0 +1,19 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// accessTime returns when the file was last accessed, if we can tell.
+func accessTime(fi os.FileInfo) (time.Time, bool) {
+	data, ok := fi.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, data.LastAccessTime.Nanoseconds()), true
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"path"
+	"strings"
+)
+
+// The lossless and highest-bitrate keep strategies choose the better of two
+// recordings of the same music, such as a FLAC copy over an MP3 one. Identical
+// files are the same recording, so these are for groups a matcher plugin (see
+// plugins.go) found by fingerprinting the audio.
+//
+// We read the bitrate from the file itself for MP3, FLAC, and WAV files. For
+// files with a variable bitrate, it is the average over the whole file.
+
+// losslessExtensions are the extensions of lossless audio formats. .m4a may
+// be lossless ALAC or lossy AAC, so we count it as neither.
+var losslessExtensions = map[string]bool{
+	".flac": true,
+	".wav":  true,
+	".aif":  true,
+	".aiff": true,
+	".ape":  true,
+	".wv":   true,
+}
+
+// lossyExtensions are the extensions of lossy audio formats.
+var lossyExtensions = map[string]bool{
+	".mp3":  true,
+	".mp2":  true,
+	".aac":  true,
+	".ogg":  true,
+	".opus": true,
+	".wma":  true,
+}
+
+// keepLossless keeps the file in a lossless format over one in a lossy
+// format. If neither or both are, it keeps the one with the higher bitrate.
+func keepLossless(file1, file2 *File) (*File, *File, error) {
+	ext1 := strings.ToLower(path.Ext(file1.Basename))
+	ext2 := strings.ToLower(path.Ext(file2.Basename))
+	if lossyExtensions[ext1] && losslessExtensions[ext2] {
+		return file2, file1, nil
+	}
+	if losslessExtensions[ext1] && lossyExtensions[ext2] {
+		return file1, file2, nil
+	}
+	return keepHighestBitrate(file1, file2)
+}
+
+// keepHighestBitrate keeps the file with the higher bitrate. If we can't tell
+// the bitrate of either, it keeps the first.
+func keepHighestBitrate(file1, file2 *File) (*File, *File, error) {
+	if audioBitrate(file2) > audioBitrate(file1) {
+		return file2, file1, nil
+	}
+	return file1, file2, nil
+}
+
+// audioHeaderSize is how much of the start of a file we read to find its
+// bitrate. It is enough for the headers of the formats we understand, after
+// a typical ID3 tag, though not one holding large cover art.
+const audioHeaderSize = 256 << 10
+
+// audioBitrate returns the file's bitrate in bits per second, or 0 if we
+// can't tell.
+func audioBitrate(file *File) int64 {
+	fh, err := fds.open(file.Path)
+	if err != nil {
+		return 0
+	}
+	defer func() { _ = fds.close(fh) }()
+
+	buf := make([]byte, audioHeaderSize)
+	n, err := io.ReadFull(fh, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0
+	}
+	buf = buf[:n]
+
+	switch {
+	case bytes.HasPrefix(buf, []byte("RIFF")) && len(buf) >= 12 &&
+		bytes.Equal(buf[8:12], []byte("WAVE")):
+		return wavBitrate(buf)
+	}
+
+	// FLAC and MP3 files may start with an ID3 tag.
+	offset := id3v2Size(buf)
+	if offset >= len(buf) {
+		return 0
+	}
+	if bytes.HasPrefix(buf[offset:], []byte("fLaC")) {
+		return flacBitrate(buf[offset:], file.Size-int64(offset))
+	}
+	// Other data may look like an MP3 frame, so we only look for one in files
+	// that say they're MP3s.
+	ext := strings.ToLower(path.Ext(file.Basename))
+	if offset > 0 || ext == ".mp3" || ext == ".mp2" {
+		return mp3Bitrate(buf[offset:], file.Size-int64(offset))
+	}
+	return 0
+}
+
+// id3v2Size returns the size of the ID3v2 tag at the start of the buffer, or
+// 0 if there isn't one.
+func id3v2Size(buf []byte) int {
+	if len(buf) < 10 || !bytes.HasPrefix(buf, []byte("ID3")) {
+		return 0
+	}
+	// The size is in seven bit bytes, and leaves out the header and footer.
+	size := int(buf[6])<<21 | int(buf[7])<<14 | int(buf[8])<<7 | int(buf[9])
+	size += 10
+	if buf[5]&0x10 != 0 {
+		size += 10
+	}
+	return size
+}
+
+// wavBitrate returns the bitrate from a WAV file's fmt chunk.
+func wavBitrate(buf []byte) int64 {
+	for i := 12; i+8 <= len(buf); {
+		id := string(buf[i : i+4])
+		size := int(binary.LittleEndian.Uint32(buf[i+4 : i+8]))
+		if id == "fmt " {
+			if i+20 > len(buf) {
+				return 0
+			}
+			byteRate := binary.LittleEndian.Uint32(buf[i+16 : i+20])
+			return int64(byteRate) * 8
+		}
+		// Chunks are padded to an even size.
+		i += 8 + size + size%2
+	}
+	return 0
+}
+
+// flacBitrate returns the average bitrate of a FLAC file from the length its
+// STREAMINFO block gives. size is the size of the file from the fLaC marker.
+func flacBitrate(buf []byte, size int64) int64 {
+	// STREAMINFO is always the first block. After its 4 byte header, the
+	// sample rate is 20 bits at byte 10, and the number of samples 36 bits
+	// ending at byte 18.
+	if len(buf) < 4+4+18 || buf[4]&0x7f != 0 {
+		return 0
+	}
+	info := buf[8:]
+	rate := int64(info[10])<<12 | int64(info[11])<<4 | int64(info[12])>>4
+	samples := int64(info[13]&0x0f)<<32 |
+		int64(binary.BigEndian.Uint32(info[14:18]))
+	if rate == 0 || samples == 0 {
+		return 0
+	}
+	return size * 8 * rate / samples
+}
+
+// MP3 bitrates in kbps by version and layer, indexed by the header's bitrate
+// index. Index 0 is free format, which we don't handle.
+var (
+	mpeg1Bitrates = [3][15]int64{
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	}
+	mpeg2Bitrates = [3][15]int64{
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	}
+)
+
+// mp3SampleRates are the sample rates by version, indexed by the header's
+// sample rate index.
+var mp3SampleRates = map[int][3]int64{
+	3: {44100, 48000, 32000}, // MPEG 1
+	2: {22050, 24000, 16000}, // MPEG 2
+	0: {11025, 12000, 8000},  // MPEG 2.5
+}
+
+// mp3Bitrate returns the bitrate of an MP3 file from its first frame. size is
+// the size of the file from the start of the buffer. If the frame holds a
+// Xing or VBRI header, the file has a variable bitrate, and the header says
+// how many frames there are, so we work out the average.
+func mp3Bitrate(buf []byte, size int64) int64 {
+	for i := 0; i+4 <= len(buf); i++ {
+		if buf[i] != 0xff || buf[i+1]&0xe0 != 0xe0 {
+			continue
+		}
+		version := int(buf[i+1]>>3) & 3
+		layer := int(buf[i+1]>>1) & 3
+		bitrateIndex := int(buf[i+2] >> 4)
+		rateIndex := int(buf[i+2]>>2) & 3
+		if version == 1 || layer == 0 || bitrateIndex == 0 ||
+			bitrateIndex == 15 || rateIndex == 3 {
+			continue
+		}
+
+		// Layers are numbered backwards in the header.
+		table := mpeg2Bitrates
+		if version == 3 {
+			table = mpeg1Bitrates
+		}
+		bitrate := table[3-layer][bitrateIndex] * 1000
+		rate := mp3SampleRates[version][rateIndex]
+
+		samplesPerFrame := int64(1152)
+		if layer == 3 {
+			samplesPerFrame = 384
+		} else if layer == 1 && version != 3 {
+			samplesPerFrame = 576
+		}
+
+		// The Xing header follows the side information, whose size depends
+		// on the version and whether the frame is mono. The VBRI header is
+		// always 32 bytes after the frame header.
+		mono := buf[i+3]>>6 == 3
+		side := 32
+		switch {
+		case version == 3 && mono:
+			side = 17
+		case version != 3 && !mono:
+			side = 17
+		case version != 3 && mono:
+			side = 9
+		}
+		var frames int64
+		if x := i + 4 + side; x+12 <= len(buf) &&
+			(bytes.Equal(buf[x:x+4], []byte("Xing")) ||
+				bytes.Equal(buf[x:x+4], []byte("Info"))) &&
+			buf[x+7]&1 != 0 {
+			frames = int64(binary.BigEndian.Uint32(buf[x+8 : x+12]))
+		} else if v := i + 4 + 32; v+18 <= len(buf) &&
+			bytes.Equal(buf[v:v+4], []byte("VBRI")) {
+			frames = int64(binary.BigEndian.Uint32(buf[v+14 : v+18]))
+		}
+		if frames > 0 {
+			return (size - int64(i)) * 8 * rate / (frames * samplesPerFrame)
+		}
+		return bitrate
+	}
+	return 0
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// With -backup, we copy each file to a directory before removing it. The copy
+// goes at the file's absolute path under the directory, so /srv/a/1.jpg backed
+// up to /backup is /backup/srv/a/1.jpg. Copying rather than moving means the
+// directory can be on another filesystem, such as a cheaper disk.
+
+// backupPath says where in the backup directory the file goes.
+func backupPath(dir, filePath string) (string, error) {
+	abs, err := filepath.Abs(filePath)
+	if err != nil {
+		return "", fmt.Errorf("unable to find the absolute path: %s", err)
+	}
+
+	// On Windows, C:\a\1.jpg becomes DIR\C\a\1.jpg.
+	volume := filepath.VolumeName(abs)
+	rest := abs[len(volume):]
+	volume = strings.TrimRight(strings.Replace(volume, ":", "", -1), `\`)
+	return filepath.Join(dir, volume, rest), nil
+}
+
+// backupFile copies the file into the backup directory and returns where it
+// put it. The copy keeps the file's permissions and modification time. We
+// write it beside where it goes and rename it into place, so a backup that
+// exists is complete. One from an earlier run at the same path is replaced.
+func backupFile(dir string, file *File) (string, error) {
+	dest, err := backupPath(dir, file.Path)
+	if err != nil {
+		return "", err
+	}
+
+	src, err := fds.open(file.Path)
+	if err != nil {
+		return "", err
+	}
+
+	fi, err := src.Stat()
+	if err != nil {
+		_ = fds.close(src)
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		_ = fds.close(src)
+		return "", err
+	}
+
+	tmp := dest + ".dupefile-backup"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+		fi.Mode().Perm())
+	if err != nil {
+		_ = fds.close(src)
+		return "", err
+	}
+
+	n, err := io.Copy(dst, src)
+	_ = fds.close(src)
+	if err == nil && n != file.Size {
+		err = fmt.Errorf("copied %d bytes but expected %d", n, file.Size)
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(tmp, fi.ModTime(), fi.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(tmp, dest)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return "", err
+	}
+
+	return dest, nil
+}
+
+// isWithin checks whether the path is the directory or is under it.
+func isWithin(filePath, dir string) bool {
+	rel, err := filepath.Rel(dir, filePath)
+	if err != nil {
+		return false
+	}
+	return rel == "." ||
+		(rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
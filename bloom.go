@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// A Bloom filter of files that an earlier run found to have no duplicates,
+// even though other files had the same size and quick checksum. These are the
+// files that cost the most for nothing: we read them in full every run only to
+// find out again that they are unique.
+//
+// A file's signature is its size, quick checksum, modification time, and path,
+// so changing a file in any of those ways makes it new to the filter. If every
+// file in a group of candidates is in the filter, we skip checksumming them.
+//
+// A false positive means we miss a duplicate rather than remove a file that is
+// not one. Missing a duplicate is the safe way to be wrong.
+
+// bloomMagic starts a Bloom filter file.
+const bloomMagic = "dupefile-bloom-1"
+
+// Bits per file and hash functions. These give about a 1% false positive
+// rate.
+const (
+	bloomBitsPerFile = 10
+	bloomHashes      = 7
+)
+
+// bloomFilter is a set of signatures that may have false positives but no
+// false negatives.
+type bloomFilter struct {
+	bits []uint64
+}
+
+// newBloomFilter creates an empty filter sized for count signatures.
+func newBloomFilter(count int) *bloomFilter {
+	words := (count*bloomBitsPerFile + 63) / 64
+	if words < 1 {
+		words = 1
+	}
+	return &bloomFilter{bits: make([]uint64, words)}
+}
+
+// positions returns the bits a signature sets. We derive the hash functions
+// from two halves of one checksum.
+func (b *bloomFilter) positions(signature uint64) [bloomHashes]uint64 {
+	var positions [bloomHashes]uint64
+	h1, h2 := signature&math.MaxUint32, signature>>32|1
+	n := uint64(len(b.bits) * 64)
+	for i := range positions {
+		positions[i] = (h1 + uint64(i)*h2) % n
+	}
+	return positions
+}
+
+func (b *bloomFilter) add(signature uint64) {
+	for _, pos := range b.positions(signature) {
+		b.bits[pos/64] |= 1 << (pos % 64)
+	}
+}
+
+func (b *bloomFilter) contains(signature uint64) bool {
+	for _, pos := range b.positions(signature) {
+		if b.bits[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// fileSignature identifies the file's path and contents to the filter.
+func fileSignature(file *File) uint64 {
+	var buf [24]byte
+	binary.BigEndian.PutUint64(buf[0:], uint64(file.Size))
+	binary.BigEndian.PutUint64(buf[8:], file.prefix)
+	binary.BigEndian.PutUint64(buf[16:], uint64(file.ModTime.UnixNano()))
+
+	hasher := xxhash.New()
+	_, _ = hasher.Write(buf[:])
+	_, _ = hasher.WriteString(file.Path)
+	return hasher.Sum64()
+}
+
+// knownFiles holds the filter from the last run and the signatures for the
+// next one.
+type knownFiles struct {
+	previous *bloomFilter
+
+	// unique holds the signatures of the files we know to have no duplicates
+	// as of this run.
+	unique []uint64
+}
+
+// loadKnownFiles reads the filter saved by the last run. If there isn't one
+// yet, every file is new.
+func loadKnownFiles(name string) (*knownFiles, error) {
+	contents, err := ioutil.ReadFile(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &knownFiles{}, nil
+		}
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(contents, []byte(bloomMagic)) ||
+		(len(contents)-len(bloomMagic))%8 != 0 ||
+		len(contents) == len(bloomMagic) {
+		return nil, fmt.Errorf("%s is not a Bloom filter file", name)
+	}
+	contents = contents[len(bloomMagic):]
+
+	filter := &bloomFilter{bits: make([]uint64, len(contents)/8)}
+	for i := range filter.bits {
+		filter.bits[i] = binary.BigEndian.Uint64(contents[i*8:])
+	}
+	return &knownFiles{previous: filter}, nil
+}
+
+// skipKnown sets aside each group of candidates with the same size and quick
+// checksum whose files are all in the last run's filter. It returns the rest.
+func (k *knownFiles) skipKnown(files []*File) []*File {
+	if k.previous == nil {
+		return files
+	}
+
+	type key struct {
+		size   int64
+		prefix uint64
+	}
+
+	unknown := make(map[key]bool)
+	for _, file := range files {
+		if file.networkFS != "" || !k.previous.contains(fileSignature(file)) {
+			unknown[key{file.Size, file.prefix}] = true
+		}
+	}
+
+	var candidates []*File
+	for _, file := range files {
+		if unknown[key{file.Size, file.prefix}] {
+			candidates = append(candidates, file)
+			continue
+		}
+		k.unique = append(k.unique, fileSignature(file))
+	}
+	return candidates
+}
+
+// recordUnique remembers the files that turned out to have no duplicates: we
+// have their full checksum, and no other file has it. We go by checksum
+// rather than the groups, as the groups leave out files that vanished and
+// with -strict-identity split identical files with different owners.
+func (k *knownFiles) recordUnique(files []*File) {
+	counts := make(map[string]int)
+	for _, file := range files {
+		if len(file.Hash) > 0 {
+			counts[string(file.Hash)+string(file.SecondHash)]++
+		}
+	}
+
+	for _, file := range files {
+		if file.vanished || len(file.Hash) == 0 {
+			continue
+		}
+		if counts[string(file.Hash)+string(file.SecondHash)] == 1 {
+			k.unique = append(k.unique, fileSignature(file))
+		}
+	}
+}
+
+// save writes a filter of the files we know to have no duplicates for the
+// next run. It replaces rather than adds to the last filter so that files we
+// no longer see don't fill it up.
+func (k *knownFiles) save(name string) error {
+	filter := newBloomFilter(len(k.unique))
+	for _, signature := range k.unique {
+		filter.add(signature)
+	}
+
+	contents := make([]byte, len(bloomMagic)+len(filter.bits)*8)
+	copy(contents, bloomMagic)
+	for i, word := range filter.bits {
+		binary.BigEndian.PutUint64(contents[len(bloomMagic)+i*8:], word)
+	}
+
+	if err := writeFileAtomically(name, contents); err != nil {
+		return fmt.Errorf("unable to save Bloom filter: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// cache implements the cache subcommand. It says what a -state-file holds,
+// and with -prune, drops the checksums of files that are gone or have changed
+// since we checksummed them. A run drops those of files that are gone itself,
+// but only once it finishes, and a run limited by -max-duration may not for a
+// long time.
+func cache(argv []string) error {
+	fs := flag.NewFlagSet("cache", flag.ExitOnError)
+	name := fs.String("state-file", "",
+		"Path to a file a run kept checksums in with -state-file.")
+	prune := fs.Bool("prune", false,
+		"Drop the checksums of files that are gone or have changed.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s cache -state-file FILE [-prune]\n",
+			os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	_ = fs.Parse(argv)
+
+	if len(*name) == 0 {
+		fs.Usage()
+		return fmt.Errorf("you must provide a state file")
+	}
+
+	buf, err := ioutil.ReadFile(*name)
+	if err != nil {
+		return fmt.Errorf("unable to read state: %s", err)
+	}
+
+	var contents stateFile
+	if err := json.Unmarshal(buf, &contents); err != nil {
+		return fmt.Errorf("unable to parse state: %s: %s", *name, err)
+	}
+	if contents.Version != stateVersion {
+		return fmt.Errorf("%s: unsupported state version %d", *name,
+			contents.Version)
+	}
+
+	var size int64
+	var gone, changed int
+	var current []stateEntry
+	for _, entry := range contents.Files {
+		size += entry.Size
+
+		fi, err := os.Lstat(entry.Path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return fmt.Errorf("unable to check %s: %s", entry.Path, err)
+			}
+			gone++
+			continue
+		}
+		if fi.Size() != entry.Size || !fi.ModTime().Equal(entry.ModTime) {
+			changed++
+			continue
+		}
+		current = append(current, entry)
+	}
+
+	algorithm := contents.Algorithm
+	if contents.SecondHash != "" {
+		algorithm += " and " + contents.SecondHash
+	}
+	fmt.Printf("%s holds %s checksums of %d files (%d bytes). Since then, gone: %d, changed: %d.\n",
+		*name, algorithm, len(contents.Files), size, gone, changed)
+
+	if !*prune || gone+changed == 0 {
+		return nil
+	}
+
+	contents.Files = current
+	if contents.Files == nil {
+		contents.Files = []stateEntry{}
+	}
+	buf, err = json.Marshal(contents)
+	if err != nil {
+		return fmt.Errorf("unable to encode state: %s", err)
+	}
+	if err := writeFileAtomically(*name, append(buf, '\n')); err != nil {
+		return fmt.Errorf("unable to save state: %s", err)
+	}
+	log.Printf("Dropped the checksums of %d files", gone+changed)
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// How to colour output, as given with -color.
+const (
+	colorAuto   = "auto"
+	colorAlways = "always"
+	colorNever  = "never"
+)
+
+// ANSI colours.
+const (
+	ansiRed    = "31"
+	ansiGreen  = "32"
+	ansiYellow = "33"
+)
+
+// Whether to colour what we write to stdout and to stderr. In auto mode, we
+// colour whichever of them is a terminal.
+var colorStdout, colorStderr bool
+
+// setupColor decides where to use colour.
+func setupColor(mode string) {
+	switch mode {
+	case colorAlways:
+		colorStdout, colorStderr = true, true
+	case colorNever:
+		colorStdout, colorStderr = false, false
+	default:
+		// https://no-color.org
+		if _, ok := os.LookupEnv("NO_COLOR"); ok {
+			return
+		}
+		colorStdout = isTerminal(os.Stdout)
+		colorStderr = isTerminal(os.Stderr)
+	}
+}
+
+func isTerminal(fh *os.File) bool {
+	fi, err := fh.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// colorize wraps s in the colour if on.
+func colorize(on bool, color, s string) string {
+	if !on {
+		return s
+	}
+	return "\x1b[" + color + "m" + s + "\x1b[0m"
+}
+
+// warnf logs a warning, in yellow if stderr is coloured.
+func warnf(format string, v ...interface{}) {
+	message := fmt.Sprintf(format, v...)
+	recordWarning(message)
+	log.Print(colorize(colorStderr, ansiYellow, "WARNING: "+message))
+}
@@ -0,0 +1,1127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the settings from the configuration file.
+type Config struct {
+	// Include lists other configuration files to merge into this one. Relative
+	// paths are relative to the directory of the file including them.
+	Include []string `json:"include" yaml:"include" toml:"include"`
+
+	Rules []Rule `json:"rules" yaml:"rules" toml:"rules"`
+
+	// Variables defines values for variables in rule directories such as
+	// {user}. Values may refer to environment variables.
+	Variables map[string]string `json:"variables" yaml:"variables" toml:"variables"`
+
+	// Protected holds paths we must never delete, whatever the rules say. Each
+	// is a path or a path.Match pattern. It protects the matching path and
+	// everything beneath it.
+	Protected []string `json:"protected" yaml:"protected" toml:"protected"`
+
+	// Sidecars lists the extensions of files beside others that belong to
+	// them, such as .xmp. When we delete a file, we deal with its sidecars
+	// too. See sidecars.go.
+	Sidecars []string `json:"sidecars" yaml:"sidecars" toml:"sidecars"`
+
+	// AlwaysKeep holds patterns of files we must never remove, whatever the
+	// rules say, such as *.xmp. See alwayskeep.go.
+	AlwaysKeep []string `json:"always_keep" yaml:"always_keep" toml:"always_keep"`
+
+	// MinCopies is the fewest copies of a file that resolution may leave. It
+	// defaults to 1.
+	MinCopies int `json:"min_copies" yaml:"min_copies" toml:"min_copies"`
+
+	// DefaultAction is what to do with duplicates no rule covers: report
+	// (the default), delete, hardlink, symlink, or reflink. For all but report,
+	// DefaultKeep names the keepStrategy deciding which copy to keep.
+	DefaultAction string `json:"default_action" yaml:"default_action" toml:"default_action"`
+	DefaultKeep   string `json:"default_keep" yaml:"default_keep" toml:"default_keep"`
+
+	// Decide is a Starlark script deciding what to do with duplicates no rule
+	// covers, and DecideAction what to do with the files it says to remove. It
+	// defaults to delete. See decide.go.
+	Decide       string `json:"decide" yaml:"decide" toml:"decide"`
+	DecideAction string `json:"decide_action" yaml:"decide_action" toml:"decide_action"`
+
+	// LinkMetadata says what to do with metadata when replacing a file with a
+	// link. See metadata.go.
+	LinkMetadata string `json:"link_metadata" yaml:"link_metadata" toml:"link_metadata"`
+
+	// MergeMetadata lists the metadata of the copies we remove to give the
+	// copies we keep, such as the older modification time. See metadata.go.
+	MergeMetadata []string `json:"merge_metadata" yaml:"merge_metadata" toml:"merge_metadata"`
+
+	Hooks Hooks `json:"hooks" yaml:"hooks" toml:"hooks"`
+
+	// Plugins are programs that rules may name as their action, and that
+	// Matchers ask which files are duplicates. See plugins.go.
+	Plugins  map[string]*Plugin `json:"plugins" yaml:"plugins" toml:"plugins"`
+	Matchers []Matcher          `json:"matchers" yaml:"matchers" toml:"matchers"`
+
+	Notifications Notifications `json:"notifications" yaml:"notifications" toml:"notifications"`
+
+	// These settings may also be given on the command line. The command line
+	// takes precedence. See applySettings.
+	Live           *bool     `json:"live" yaml:"live" toml:"live"`
+	Paranoid       *bool     `json:"paranoid" yaml:"paranoid" toml:"paranoid"`
+	Backup         *string   `json:"backup" yaml:"backup" toml:"backup"`
+	Shred          *bool     `json:"shred" yaml:"shred" toml:"shred"`
+	SkipOpen       *bool     `json:"skip_open" yaml:"skip_open" toml:"skip_open"`
+	RewriteLinks   *bool     `json:"rewrite_symlinks" yaml:"rewrite_symlinks" toml:"rewrite_symlinks"`
+	BrokenLinks    *string   `json:"broken_symlinks" yaml:"broken_symlinks" toml:"broken_symlinks"`
+	ListSpecial    *bool     `json:"report_special_files" yaml:"report_special_files" toml:"report_special_files"`
+	Progress       *duration `json:"progress_interval" yaml:"progress_interval" toml:"progress_interval"`
+	StatusListen   *string   `json:"status_listen" yaml:"status_listen" toml:"status_listen"`
+	LogFile        *string   `json:"log_file" yaml:"log_file" toml:"log_file"`
+	LogMaxSize     *int64    `json:"log_max_size" yaml:"log_max_size" toml:"log_max_size"`
+	LogEvery       *duration `json:"log_rotate_every" yaml:"log_rotate_every" toml:"log_rotate_every"`
+	LogKeep        *int      `json:"log_keep" yaml:"log_keep" toml:"log_keep"`
+	MaxFiles       *int      `json:"max_files" yaml:"max_files" toml:"max_files"`
+	MaxBytes       *int64    `json:"max_bytes" yaml:"max_bytes" toml:"max_bytes"`
+	Retries        *int      `json:"retries" yaml:"retries" toml:"retries"`
+	RetryDelay     *duration `json:"retry_delay" yaml:"retry_delay" toml:"retry_delay"`
+	Workers        *int      `json:"workers" yaml:"workers" toml:"workers"`
+	Walkers        *int      `json:"walkers" yaml:"walkers" toml:"walkers"`
+	MaxOpenFiles   *int      `json:"max_open_files" yaml:"max_open_files" toml:"max_open_files"`
+	Hash           *string   `json:"hash" yaml:"hash" toml:"hash"`
+	SecondHash     *string   `json:"second_hash" yaml:"second_hash" toml:"second_hash"`
+	TrustHash      *bool     `json:"trust_hash" yaml:"trust_hash" toml:"trust_hash"`
+	Stages         []string  `json:"stages" yaml:"stages" toml:"stages"`
+	Mmap           *bool     `json:"mmap" yaml:"mmap" toml:"mmap"`
+	BufferSize     *int      `json:"buffer_size" yaml:"buffer_size" toml:"buffer_size"`
+	IOUring        *bool     `json:"io_uring" yaml:"io_uring" toml:"io_uring"`
+	IndexDir       *string   `json:"index_dir" yaml:"index_dir" toml:"index_dir"`
+	IndexType      *string   `json:"index_type" yaml:"index_type" toml:"index_type"`
+	BloomFile      *string   `json:"bloom_file" yaml:"bloom_file" toml:"bloom_file"`
+	StateFile      *string   `json:"state_file" yaml:"state_file" toml:"state_file"`
+	MaxDuration    *duration `json:"max_duration" yaml:"max_duration" toml:"max_duration"`
+	StrictIdentity *bool     `json:"strict_identity" yaml:"strict_identity" toml:"strict_identity"`
+	CompareXattrs  *bool     `json:"compare_xattrs" yaml:"compare_xattrs" toml:"compare_xattrs"`
+	Exclude        []string  `json:"exclude" yaml:"exclude" toml:"exclude"`
+	LocalConfig    *bool     `json:"local_config" yaml:"local_config" toml:"local_config"`
+	RuleMatch      *string   `json:"rule_match" yaml:"rule_match" toml:"rule_match"`
+	Output         *string   `json:"output" yaml:"output" toml:"output"`
+	Analyze        *string   `json:"analyze" yaml:"analyze" toml:"analyze"`
+	SummaryJSON    *string   `json:"summary_json" yaml:"summary_json" toml:"summary_json"`
+	Format         *string   `json:"format" yaml:"format" toml:"format"`
+	LargestFirst   *bool     `json:"largest_first" yaml:"largest_first" toml:"largest_first"`
+	Top            *int      `json:"top" yaml:"top" toml:"top"`
+	Sort           *string   `json:"sort" yaml:"sort" toml:"sort"`
+	Color          *string   `json:"color" yaml:"color" toml:"color"`
+
+	// decider is the compiled Decide script.
+	decider *decider
+
+	// alwaysKeep holds the compiled AlwaysKeep patterns.
+	alwaysKeep []alwaysKeepPattern
+}
+
+// duration is a time.Duration written like "1m30s" in the configuration. It
+// may also be a whole number of days, like "30d".
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	if days := strings.TrimSuffix(string(text), "d"); days != string(text) {
+		if n, err := strconv.Atoi(days); err == nil {
+			d.Duration = time.Duration(n) * 24 * time.Hour
+			return nil
+		}
+	}
+
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// Rule defines what to do with a duplicate file found in two directories.
+type Rule struct {
+	KeepDir   string `json:"keep" yaml:"keep" toml:"keep"`
+	RemoveDir string `json:"remove" yaml:"remove" toml:"remove"`
+
+	// Collapse makes the rule one for duplicates in the same directory, which
+	// it names. Tiebreak is the keep strategy that chooses which copy to keep.
+	// Instead of KeepDir and RemoveDir, such a rule has Collapse. Once we've
+	// validated it, we set both to Collapse. A rule whose KeepDir and RemoveDir
+	// are the same directory and that has a Tiebreak is the same.
+	Collapse string `json:"collapse" yaml:"collapse" toml:"collapse"`
+	Tiebreak string `json:"tiebreak" yaml:"tiebreak" toml:"tiebreak"`
+
+	// Recursive makes the rule apply to files in subdirectories of KeepDir and
+	// RemoveDir as well as to files directly in them.
+	Recursive bool `json:"recursive" yaml:"recursive" toml:"recursive"`
+
+	// Include and Exclude limit the rule to some of the files in its
+	// directories. With Include, the rule applies only if both files match one
+	// of its patterns, and it doesn't apply if either matches one of Exclude's.
+	// A pattern without a / matches the name. Others match the full path.
+	Include []string `json:"include" yaml:"include" toml:"include"`
+	Exclude []string `json:"exclude" yaml:"exclude" toml:"exclude"`
+
+	// MinSize, MaxSize, and OlderThan are conditions the files must meet for
+	// the rule to apply, such as only deleting copies of large files nobody
+	// has changed in a month. Sizes are in bytes, and both copies must have
+	// been modified longer than OlderThan ago.
+	MinSize   *int64    `json:"min_size" yaml:"min_size" toml:"min_size"`
+	MaxSize   *int64    `json:"max_size" yaml:"max_size" toml:"max_size"`
+	OlderThan *duration `json:"older_than" yaml:"older_than" toml:"older_than"`
+
+	// Stages are the stages files must go through for the rule to remove one
+	// of them. If the run skipped byte-compare and the rule has it, we compare
+	// them before acting. See stages.go.
+	Stages []string `json:"stages" yaml:"stages" toml:"stages"`
+
+	// Priority decides between rules that apply to the same files. The rule
+	// with the highest priority wins. See matchRule.
+	Priority int `json:"priority" yaml:"priority" toml:"priority"`
+
+	// DryRun makes the rule only report what it would delete, even in live
+	// mode. This is useful for trying out a new rule alongside established
+	// ones.
+	DryRun bool `json:"dry_run" yaml:"dry_run" toml:"dry_run"`
+
+	// Action is what to do with the file to remove: delete (the default),
+	// hardlink, symlink, reflink, exec, or report.
+	Action string `json:"action" yaml:"action" toml:"action"`
+
+	// Command is the command to run for the exec action. {keep} and {remove}
+	// in its arguments become the paths of the files.
+	Command []string `json:"command" yaml:"command" toml:"command"`
+
+	// Rename is a template for the name of the copy the rule keeps, such as
+	// {stem}{ext} to rename photo (1).jpg to photo.jpg once we've removed
+	// its duplicates. See rename.go.
+	Rename string `json:"rename" yaml:"rename" toml:"rename"`
+
+	// source says where the rule came from, for messages.
+	source string
+
+	// If the directories contain variables, these are their compiled forms.
+	// See templates.go.
+	keepPattern   *dirPattern
+	removePattern *dirPattern
+
+	// If the locations name filesystems, these are them. See locations.go.
+	keepFS   *filesystem
+	removeFS *filesystem
+}
+
+// configFiles holds the contents of configuration files, by path.
+type configFiles map[string][]byte
+
+// readConfig reads and validates the configuration file along with any files
+// it includes.
+func readConfig(configFile string) (*Config, error) {
+	return readConfigFiles(configFile, nil)
+}
+
+// readConfigFiles is readConfig, but it takes the contents of the files from
+// files where it holds them, and adds those it reads to it. That way we can
+// read the same configuration again even if the files have changed since. See
+// serve.go.
+func readConfigFiles(configFile string, files configFiles) (*Config, error) {
+	config, err := loadConfig(configFile, nil, files)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := compileRules(config.Rules, config.Variables); err != nil {
+		return nil, err
+	}
+	resolveFilesystems(config.Rules)
+
+	if err := checkRuleConflicts(config.Rules); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// decides checks whether the configuration says what to do with duplicates:
+// whether it has rules, a decide script, or a default action. One that only
+// holds settings doesn't.
+func (config *Config) decides() bool {
+	return len(config.Rules) > 0 || config.Decide != "" ||
+		(config.DefaultAction != "" && config.DefaultAction != actionReport)
+}
+
+// loadConfig reads one configuration file and merges in the files it
+// includes. including holds the files that led to this one so we can detect
+// include cycles. files is as for readConfigFiles.
+func loadConfig(configFile string, including []string, files configFiles) (
+	*Config,
+	error,
+) {
+	for _, f := range including {
+		if f == configFile {
+			return nil, fmt.Errorf("include cycle: %s -> %s",
+				strings.Join(including, " -> "), configFile)
+		}
+	}
+
+	buf, ok := files[configFile]
+	if !ok {
+		var err error
+		buf, err = ioutil.ReadFile(configFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read config: %s", err)
+		}
+		if files != nil {
+			files[configFile] = buf
+		}
+	}
+
+	config := &Config{}
+	if err := decodeConfig(configFile, buf, config); err != nil {
+		return nil, fmt.Errorf("unable to decode config: %s", err)
+	}
+
+	// If we couldn't expand a path, validating it would only report confusing
+	// follow on problems.
+	errs := expandConfig(config)
+	if len(errs) == 0 {
+		normalizeRuleDirs(configFile, config.Rules)
+		errs = validateConfig(config)
+	}
+	if len(errs) > 0 {
+		var msgs []string
+		for _, err := range errs {
+			msgs = append(msgs, err.Error())
+		}
+		return nil, fmt.Errorf("invalid config:\n  %s", strings.Join(msgs, "\n  "))
+	}
+
+	for i, pattern := range config.Protected {
+		config.Protected[i] = canonicalPattern(pattern)
+	}
+
+	for i := range config.Rules {
+		rule := &config.Rules[i]
+		rule.source = fmt.Sprintf("rules[%d] in %s", i, configFile)
+		if rule.Collapse != "" {
+			rule.KeepDir, rule.RemoveDir = rule.Collapse, rule.Collapse
+		}
+	}
+
+	for _, include := range config.Include {
+		if !path.IsAbs(include) {
+			include = path.Join(path.Dir(configFile), include)
+		}
+
+		included, err := loadConfig(include, append(including, configFile),
+			files)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", include, err)
+		}
+
+		mergeConfig(config, included)
+	}
+
+	return config, nil
+}
+
+// normalizeRuleDirs puts the rules' directories in the form we match them in.
+// See canonicalDir. Relative directories are relative to the directory holding
+// the configuration file, as includes are.
+func normalizeRuleDirs(configFile string, rules []Rule) {
+	configDir := path.Dir(configFile)
+
+	normalize := func(dir string) string {
+		if dir == "" || dir == removeAnywhere || isFilesystemLocation(dir) {
+			return dir
+		}
+		if host, _ := splitHost(dir); host == "" && !path.IsAbs(dir) {
+			dir = path.Join(configDir, dir)
+		}
+		return canonicalDir(dir)
+	}
+
+	for i := range rules {
+		rule := &rules[i]
+		rule.KeepDir = normalize(rule.KeepDir)
+		rule.RemoveDir = normalize(rule.RemoveDir)
+		rule.Collapse = normalize(rule.Collapse)
+	}
+}
+
+// mergeConfig merges an included configuration into the one including it.
+//
+// Rules and lists of paths from the included file come after the including
+// file's. For other settings the including file wins if it has the setting.
+// min_copies is the exception: we take the larger so that splitting rules into
+// several files can never make resolution less cautious.
+func mergeConfig(config, included *Config) {
+	config.Rules = append(config.Rules, included.Rules...)
+	config.Protected = append(config.Protected, included.Protected...)
+	config.AlwaysKeep = append(config.AlwaysKeep, included.AlwaysKeep...)
+	config.Sidecars = append(config.Sidecars, included.Sidecars...)
+	config.alwaysKeep = append(config.alwaysKeep, included.alwaysKeep...)
+
+	for name, value := range included.Variables {
+		if _, ok := config.Variables[name]; ok {
+			continue
+		}
+		if config.Variables == nil {
+			config.Variables = make(map[string]string)
+		}
+		config.Variables[name] = value
+	}
+	if included.Exclude != nil {
+		config.Exclude = append(config.Exclude, included.Exclude...)
+	}
+
+	for name, plugin := range included.Plugins {
+		if _, ok := config.Plugins[name]; ok {
+			continue
+		}
+		if config.Plugins == nil {
+			config.Plugins = make(map[string]*Plugin)
+		}
+		config.Plugins[name] = plugin
+	}
+	config.Matchers = append(config.Matchers, included.Matchers...)
+
+	if included.MinCopies > config.MinCopies {
+		config.MinCopies = included.MinCopies
+	}
+
+	if config.DefaultAction == "" {
+		config.DefaultAction = included.DefaultAction
+		config.DefaultKeep = included.DefaultKeep
+	}
+	if config.Decide == "" {
+		config.Decide = included.Decide
+		config.DecideAction = included.DecideAction
+		config.decider = included.decider
+	}
+	if config.LinkMetadata == "" {
+		config.LinkMetadata = included.LinkMetadata
+	}
+	if config.MergeMetadata == nil {
+		config.MergeMetadata = included.MergeMetadata
+	}
+
+	if config.Hooks.BeforeDelete == nil {
+		config.Hooks.BeforeDelete = included.Hooks.BeforeDelete
+	}
+	if config.Hooks.AfterDelete == nil {
+		config.Hooks.AfterDelete = included.Hooks.AfterDelete
+	}
+	if config.Hooks.OnFinish == nil {
+		config.Hooks.OnFinish = included.Hooks.OnFinish
+	}
+
+	config.Notifications.Webhooks = append(config.Notifications.Webhooks,
+		included.Notifications.Webhooks...)
+	if config.Notifications.Email == nil {
+		config.Notifications.Email = included.Notifications.Email
+	}
+
+	if config.Live == nil {
+		config.Live = included.Live
+	}
+	if config.Paranoid == nil {
+		config.Paranoid = included.Paranoid
+	}
+	if config.Backup == nil {
+		config.Backup = included.Backup
+	}
+	if config.Shred == nil {
+		config.Shred = included.Shred
+	}
+	if config.SkipOpen == nil {
+		config.SkipOpen = included.SkipOpen
+	}
+	if config.RewriteLinks == nil {
+		config.RewriteLinks = included.RewriteLinks
+	}
+	if config.BrokenLinks == nil {
+		config.BrokenLinks = included.BrokenLinks
+	}
+	if config.ListSpecial == nil {
+		config.ListSpecial = included.ListSpecial
+	}
+	if config.Progress == nil {
+		config.Progress = included.Progress
+	}
+	if config.StatusListen == nil {
+		config.StatusListen = included.StatusListen
+	}
+	if config.LogFile == nil {
+		config.LogFile = included.LogFile
+	}
+	if config.LogMaxSize == nil {
+		config.LogMaxSize = included.LogMaxSize
+	}
+	if config.LogEvery == nil {
+		config.LogEvery = included.LogEvery
+	}
+	if config.LogKeep == nil {
+		config.LogKeep = included.LogKeep
+	}
+	if config.MaxFiles == nil {
+		config.MaxFiles = included.MaxFiles
+	}
+	if config.MaxBytes == nil {
+		config.MaxBytes = included.MaxBytes
+	}
+	if config.Retries == nil {
+		config.Retries = included.Retries
+	}
+	if config.RetryDelay == nil {
+		config.RetryDelay = included.RetryDelay
+	}
+	if config.Workers == nil {
+		config.Workers = included.Workers
+	}
+	if config.Walkers == nil {
+		config.Walkers = included.Walkers
+	}
+	if config.MaxOpenFiles == nil {
+		config.MaxOpenFiles = included.MaxOpenFiles
+	}
+	if config.Hash == nil {
+		config.Hash = included.Hash
+	}
+	if config.SecondHash == nil {
+		config.SecondHash = included.SecondHash
+	}
+	if config.TrustHash == nil {
+		config.TrustHash = included.TrustHash
+	}
+	if config.Stages == nil {
+		config.Stages = included.Stages
+	}
+	if config.Mmap == nil {
+		config.Mmap = included.Mmap
+	}
+	if config.BufferSize == nil {
+		config.BufferSize = included.BufferSize
+	}
+	if config.IOUring == nil {
+		config.IOUring = included.IOUring
+	}
+	if config.IndexDir == nil {
+		config.IndexDir = included.IndexDir
+	}
+	if config.IndexType == nil {
+		config.IndexType = included.IndexType
+	}
+	if config.BloomFile == nil {
+		config.BloomFile = included.BloomFile
+	}
+	if config.StateFile == nil {
+		config.StateFile = included.StateFile
+	}
+	if config.MaxDuration == nil {
+		config.MaxDuration = included.MaxDuration
+	}
+	if config.StrictIdentity == nil {
+		config.StrictIdentity = included.StrictIdentity
+	}
+	if config.CompareXattrs == nil {
+		config.CompareXattrs = included.CompareXattrs
+	}
+	if config.LocalConfig == nil {
+		config.LocalConfig = included.LocalConfig
+	}
+	if config.RuleMatch == nil {
+		config.RuleMatch = included.RuleMatch
+	}
+	if config.Output == nil {
+		config.Output = included.Output
+	}
+	if config.Analyze == nil {
+		config.Analyze = included.Analyze
+	}
+	if config.SummaryJSON == nil {
+		config.SummaryJSON = included.SummaryJSON
+	}
+	if config.Format == nil {
+		config.Format = included.Format
+	}
+	if config.LargestFirst == nil {
+		config.LargestFirst = included.LargestFirst
+	}
+	if config.Top == nil {
+		config.Top = included.Top
+	}
+	if config.Sort == nil {
+		config.Sort = included.Sort
+	}
+	if config.Color == nil {
+		config.Color = included.Color
+	}
+}
+
+// expandConfig expands ~ and environment variables in the paths in the
+// configuration, so the same configuration can work for different users and
+// machines.
+func expandConfig(config *Config) []error {
+	var errs []error
+
+	expand := func(field string, p *string) {
+		expanded, err := expandPath(*p)
+		if err != nil {
+			errs = append(errs, fieldError{field, err.Error()})
+			return
+		}
+		*p = expanded
+	}
+
+	for i := range config.Rules {
+		field := fmt.Sprintf("rules[%d]", i)
+		expand(field+".keep", &config.Rules[i].KeepDir)
+		expand(field+".remove", &config.Rules[i].RemoveDir)
+		expand(field+".collapse", &config.Rules[i].Collapse)
+	}
+
+	for i := range config.Protected {
+		expand(fmt.Sprintf("protected[%d]", i), &config.Protected[i])
+	}
+
+	for i := range config.Include {
+		expand(fmt.Sprintf("include[%d]", i), &config.Include[i])
+	}
+
+	for name, value := range config.Variables {
+		expand(fmt.Sprintf("variables.%s", name), &value)
+		config.Variables[name] = value
+	}
+
+	// So the URL, which may hold a secret, can live in the environment.
+	for i := range config.Notifications.Webhooks {
+		expand(fmt.Sprintf("notifications.webhooks[%d].url", i),
+			&config.Notifications.Webhooks[i].URL)
+	}
+	if email := config.Notifications.Email; email != nil {
+		expand("notifications.email.username", &email.Username)
+		expand("notifications.email.password", &email.Password)
+	}
+
+	return errs
+}
+
+// expandPath replaces a leading ~ or ~user with the home directory and
+// $VAR/${VAR} with the environment variable's value. Referring to an unset
+// variable is an error. Silently expanding it to nothing would change which
+// directory the path refers to.
+func expandPath(p string) (string, error) {
+	if strings.HasPrefix(p, "~") {
+		name := p[1:]
+		rest := ""
+		if i := strings.IndexByte(name, '/'); i != -1 {
+			name, rest = name[:i], name[i:]
+		}
+
+		var home string
+		if name == "" {
+			dir, err := os.UserHomeDir()
+			if err != nil {
+				return "", err
+			}
+			home = dir
+		} else {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			home = u.HomeDir
+		}
+
+		p = home + rest
+	}
+
+	var unset []string
+	p = os.Expand(p, func(name string) string {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			unset = append(unset, name)
+		}
+		return value
+	})
+	if len(unset) > 0 {
+		return "", fmt.Errorf("environment variable not set: %s",
+			strings.Join(unset, ", "))
+	}
+
+	return p, nil
+}
+
+// validateCollapse checks a rule for duplicates in one directory, apart from
+// its directory.
+func validateCollapse(field string, rule Rule) []error {
+	var errs []error
+
+	if rule.KeepDir != "" || rule.RemoveDir != "" {
+		errs = append(errs, fieldError{field,
+			"a collapse rule has no keep or remove"})
+	}
+
+	return append(errs, validateTiebreak(field, rule.Tiebreak)...)
+}
+
+// validateSameDir checks the tiebreak of a rule with keep and remove. Only a
+// rule whose keep and remove are the same directory has one, and such a rule
+// needs one, as the directories say nothing about which copy to keep.
+func validateSameDir(field string, rule Rule) []error {
+	if rule.KeepDir == "" || rule.KeepDir != rule.RemoveDir {
+		if rule.Tiebreak != "" {
+			return []error{fieldError{field + ".tiebreak",
+				"only rules for duplicates in one directory have a tiebreak"}}
+		}
+		return nil
+	}
+
+	if rule.Tiebreak == "" {
+		return []error{fieldError{field,
+			"keep and remove are the same directory. Give a tiebreak to choose which copy to keep"}}
+	}
+	return validateTiebreak(field, rule.Tiebreak)
+}
+
+// validateTiebreak checks the tiebreak of a rule for duplicates in one
+// directory. Copies in one directory are on one filesystem, so
+// most-free-space can't choose between them.
+func validateTiebreak(field, tiebreak string) []error {
+	if _, ok := keepStrategies[tiebreak]; !ok || tiebreak == "most-free-space" {
+		return []error{fieldError{field + ".tiebreak",
+			fmt.Sprintf("must be one of: %s", strings.Join(tiebreakNames(), ", "))}}
+	}
+	return nil
+}
+
+// validateFilters checks a rule's include and exclude patterns, its
+// conditions, its stages, and its rename template.
+func validateFilters(field string, rule Rule) []error {
+	errs := validateRename(field, rule.Rename)
+
+	if err := checkStages(rule.Stages); err != nil {
+		errs = append(errs, fieldError{field + ".stages", err.Error()})
+	}
+
+	if rule.MinSize != nil && *rule.MinSize < 0 {
+		errs = append(errs, fieldError{field + ".min_size", "must not be negative"})
+	}
+	if rule.MaxSize != nil && *rule.MaxSize < 0 {
+		errs = append(errs, fieldError{field + ".max_size", "must not be negative"})
+	}
+	if rule.MinSize != nil && rule.MaxSize != nil && *rule.MinSize > *rule.MaxSize {
+		errs = append(errs, fieldError{field + ".max_size",
+			"must not be less than min_size"})
+	}
+	if rule.OlderThan != nil && rule.OlderThan.Duration < 0 {
+		errs = append(errs, fieldError{field + ".older_than",
+			"must not be negative"})
+	}
+
+	for _, list := range []struct {
+		name     string
+		patterns []string
+	}{{"include", rule.Include}, {"exclude", rule.Exclude}} {
+		for i, pattern := range list.patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				errs = append(errs, fieldError{
+					fmt.Sprintf("%s.%s[%d]", field, list.name, i),
+					fmt.Sprintf("invalid pattern: %s", err)})
+			}
+		}
+	}
+	return errs
+}
+
+// minCopies returns the fewest copies of a file that resolution may leave.
+func (c *Config) minCopies() int {
+	if c.MinCopies < 1 {
+		return 1
+	}
+	return c.MinCopies
+}
+
+// fieldError describes a problem with one setting in the configuration. Field
+// is the setting's location, such as rules[3].keep.
+type fieldError struct {
+	Field   string
+	Problem string
+}
+
+func (e fieldError) Error() string {
+	return e.Field + ": " + e.Problem
+}
+
+// validateConfig checks the settings make sense. It reports every problem it
+// finds rather than stopping at the first.
+func validateConfig(config *Config) []error {
+	var errs []error
+
+	for i, rule := range config.Rules {
+		field := fmt.Sprintf("rules[%d]", i)
+		if rule.Collapse != "" {
+			errs = append(errs, validateAbsolute(field+".collapse",
+				rule.Collapse)...)
+			if isFilesystemLocation(rule.Collapse) {
+				errs = append(errs, fieldError{field + ".collapse",
+					"must be a directory rather than a filesystem"})
+			}
+			errs = append(errs, validateCollapse(field, rule)...)
+		} else {
+			if rule.KeepDir == removeAnywhere {
+				errs = append(errs, fieldError{field + ".keep",
+					"only remove may be *"})
+			} else {
+				errs = append(errs, validateAbsolute(field+".keep", rule.KeepDir)...)
+			}
+			if rule.RemoveDir != removeAnywhere {
+				errs = append(errs,
+					validateAbsolute(field+".remove", rule.RemoveDir)...)
+			}
+			errs = append(errs, validateSameDir(field, rule)...)
+		}
+		if _, ok := config.Plugins[rule.Action]; ok {
+			if len(rule.Command) > 0 {
+				errs = append(errs, fieldError{field + ".command",
+					"only allowed with the exec action"})
+			}
+		} else {
+			errs = append(errs, validateAction(field, rule.Action, rule.Command)...)
+		}
+		errs = append(errs, validateFilters(field, rule)...)
+	}
+
+	errs = append(errs, validatePlugins(config)...)
+
+	for name := range config.Variables {
+		if !variableName.MatchString(name) {
+			errs = append(errs, fieldError{fmt.Sprintf("variables.%s", name),
+				"invalid variable name"})
+		}
+	}
+
+	for i, pattern := range config.Protected {
+		field := fmt.Sprintf("protected[%d]", i)
+		errs = append(errs, validateAbsolute(field, pattern)...)
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs,
+				fieldError{field, fmt.Sprintf("invalid pattern: %s", err)})
+		}
+	}
+
+	errs = append(errs, validateSidecars(config.Sidecars)...)
+
+	alwaysKeep, alwaysKeepErrs := compileAlwaysKeep(config.AlwaysKeep)
+	config.alwaysKeep = alwaysKeep
+	errs = append(errs, alwaysKeepErrs...)
+
+	if config.MinCopies < 0 {
+		errs = append(errs, fieldError{"min_copies", "must not be negative"})
+	}
+
+	switch config.DefaultAction {
+	case "", actionReport:
+	case actionDelete, actionHardlink, actionSymlink, actionReflink:
+		if _, ok := keepStrategies[config.DefaultKeep]; !ok {
+			errs = append(errs, fieldError{"default_keep",
+				fmt.Sprintf("must be one of: %s", keepStrategyNames())})
+		}
+		if config.DefaultKeep == "most-free-space" && !freeSpaceSupported {
+			errs = append(errs, fieldError{"default_keep",
+				"most-free-space is not supported on this platform"})
+		}
+	default:
+		errs = append(errs, fieldError{"default_action",
+			fmt.Sprintf("must be one of: %s, %s, %s, %s, %s", actionReport,
+				actionDelete, actionHardlink, actionSymlink, actionReflink)})
+	}
+	if config.DefaultAction == actionReflink && !reflinkSupported {
+		errs = append(errs, fieldError{"default_action",
+			"reflink is not supported on this platform"})
+	}
+
+	if config.Decide != "" {
+		decider, err := compileDecider(config.Decide)
+		if err != nil {
+			errs = append(errs, fieldError{"decide", err.Error()})
+		}
+		config.decider = decider
+	}
+	switch config.DecideAction {
+	case "", actionDelete, actionHardlink, actionSymlink, actionReport:
+	case actionReflink:
+		if !reflinkSupported {
+			errs = append(errs, fieldError{"decide_action",
+				"reflink is not supported on this platform"})
+		}
+	default:
+		errs = append(errs, fieldError{"decide_action",
+			fmt.Sprintf("must be one of: %s, %s, %s, %s, %s", actionDelete,
+				actionHardlink, actionSymlink, actionReflink, actionReport)})
+	}
+
+	switch config.LinkMetadata {
+	case "", metadataNone, metadataReplaced, metadataOldest:
+	default:
+		errs = append(errs, fieldError{"link_metadata",
+			fmt.Sprintf("must be one of: %s", strings.Join(linkMetadataNames(),
+				", "))})
+	}
+
+	for i, what := range config.MergeMetadata {
+		field := fmt.Sprintf("merge_metadata[%d]", i)
+		switch what {
+		case mergeModTime:
+		case mergeXattrs:
+			if !xattrsSupported {
+				errs = append(errs, fieldError{field,
+					"extended attributes are not supported on this platform"})
+			}
+		default:
+			errs = append(errs, fieldError{field,
+				fmt.Sprintf("must be one of: %s", strings.Join(mergeMetadataNames(),
+					", "))})
+		}
+	}
+
+	for i, webhook := range config.Notifications.Webhooks {
+		field := fmt.Sprintf("notifications.webhooks[%d]", i)
+		if u, err := url.Parse(webhook.URL); err != nil ||
+			(u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fieldError{field + ".url",
+				"must be an http or https URL"})
+		}
+		switch webhook.Format {
+		case "", webhookJSON, webhookSlack:
+		default:
+			errs = append(errs, fieldError{field + ".format",
+				fmt.Sprintf("must be one of: %s, %s", webhookJSON, webhookSlack)})
+		}
+	}
+
+	if email := config.Notifications.Email; email != nil {
+		errs = append(errs, validateEmail(email)...)
+	}
+
+	return errs
+}
+
+func validateEmail(email *Email) []error {
+	var errs []error
+
+	if _, _, err := net.SplitHostPort(email.Server); err != nil {
+		errs = append(errs, fieldError{"notifications.email.server",
+			"must be a host and port"})
+	}
+	if email.From == "" {
+		errs = append(errs, fieldError{"notifications.email.from", "missing"})
+	}
+	if len(email.To) == 0 {
+		errs = append(errs, fieldError{"notifications.email.to", "missing"})
+	}
+	for i, format := range email.Attach {
+		if format != reportCSV && format != reportJSON {
+			errs = append(errs, fieldError{
+				fmt.Sprintf("notifications.email.attach[%d]", i),
+				fmt.Sprintf("must be one of: %s, %s", reportCSV, reportJSON)})
+		}
+	}
+
+	return errs
+}
+
+func validateAction(field, action string, command []string) []error {
+	switch action {
+	case "", actionDelete, actionHardlink, actionSymlink, actionReflink,
+		actionReport:
+		if len(command) > 0 {
+			return []error{fieldError{field + ".command",
+				"only allowed with the exec action"}}
+		}
+		if action == actionReflink && !reflinkSupported {
+			return []error{fieldError{field + ".action",
+				"reflink is not supported on this platform"}}
+		}
+	case actionExec:
+		if len(command) == 0 || command[0] == "" {
+			return []error{fieldError{field + ".command",
+				"the exec action needs a command"}}
+		}
+	default:
+		return []error{fieldError{field + ".action",
+			fmt.Sprintf("must be one of: %s, %s, %s, %s, %s, %s", actionDelete,
+				actionHardlink, actionSymlink, actionReflink, actionExec,
+				actionReport)}}
+	}
+	return nil
+}
+
+func validateAbsolute(field, p string) []error {
+	if p == "" {
+		return []error{fieldError{field, "missing"}}
+	}
+	// A location on another machine or a filesystem. See coordinator.go and
+	// locations.go.
+	if _, local := splitHost(p); local != p {
+		p = local
+	}
+	p = filesystemPath(p)
+	if p == "" {
+		return []error{fieldError{field, "missing"}}
+	}
+	if p[0] != '/' {
+		return []error{fieldError{field, "relative path not allowed"}}
+	}
+	return nil
+}
+
+// decodeConfig decodes the configuration file's contents. We decide the format
+// from the file's extension: .yaml/.yml for YAML, .toml for TOML, and JSON for
+// anything else.
+//
+// Keys we don't know about are errors. They are most likely typos, and
+// ignoring a misspelled setting such as a protected path could be dangerous.
+func decodeConfig(configFile string, buf []byte, config *Config) error {
+	switch strings.ToLower(path.Ext(configFile)) {
+	case ".yaml", ".yml":
+		return decodeYAML(buf, config)
+	case ".toml":
+		return decodeTOML(buf, config)
+	default:
+		return decodeJSON(buf, config)
+	}
+}
+
+// Go type names mean nothing to someone writing a config, so we drop them from
+// YAML errors.
+var yamlTypeName = regexp.MustCompile(` in type [\w.]+`)
+
+func decodeYAML(buf []byte, config *Config) error {
+	dec := yaml.NewDecoder(bytes.NewReader(buf))
+	dec.KnownFields(true)
+
+	if err := dec.Decode(config); err != nil && err != io.EOF {
+		return errors.New(yamlTypeName.ReplaceAllString(err.Error(), ""))
+	}
+
+	return nil
+}
+
+func decodeTOML(buf []byte, config *Config) error {
+	md, err := toml.Decode(string(buf), config)
+	if err != nil {
+		return err
+	}
+
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		var keys []string
+		for _, key := range undecoded {
+			keys = append(keys, key.String())
+		}
+		return fmt.Errorf("unknown keys: %s", strings.Join(keys, ", "))
+	}
+
+	return nil
+}
+
+// encoding/json reports array indexes in field names as rules.3.keep.
+var jsonIndex = regexp.MustCompile(`\.(\d+)`)
+
+func decodeJSON(buf []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(v); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return fmt.Errorf("line %d: %s", lineAt(buf, syntaxErr.Offset), err)
+		}
+
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return fmt.Errorf("line %d: %s: found %s, want %s",
+				lineAt(buf, typeErr.Offset),
+				jsonIndex.ReplaceAllString(typeErr.Field, "[$1]"), typeErr.Value,
+				typeErr.Type)
+		}
+
+		// encoding/json doesn't say where an unknown field is. Point at the first
+		// place the key appears.
+		if key := strings.TrimPrefix(err.Error(), "json: unknown field "); key != err.Error() {
+			re := regexp.MustCompile(regexp.QuoteMeta(key) + `\s*:`)
+			if loc := re.FindIndex(buf); loc != nil {
+				return fmt.Errorf("line %d: unknown field %s", lineAt(buf, int64(loc[0])),
+					key)
+			}
+		}
+
+		return err
+	}
+
+	if dec.More() {
+		return fmt.Errorf("line %d: unexpected data after the configuration",
+			lineAt(buf, dec.InputOffset()))
+	}
+
+	return nil
+}
+
+// lineAt returns the line number of the byte at offset.
+func lineAt(buf []byte, offset int64) int {
+	if offset > int64(len(buf)) {
+		offset = int64(len(buf))
+	}
+	return bytes.Count(buf[:offset], []byte("\n")) + 1
+}
+
+// isProtected checks whether the path is or is beneath a protected path. If so,
+// it returns the protected path/pattern that matched.
+//
+// A pattern without a host applies to the path on any machine. See
+// coordinator.go.
+func isProtected(protected []string, filePath string) (string, bool) {
+	if host, local := splitHost(filePath); host != "" {
+		for _, pattern := range protected {
+			if patternHost, _ := splitHost(pattern); patternHost != "" {
+				continue
+			}
+			if _, ok := isProtected([]string{pattern}, local); ok {
+				return pattern, true
+			}
+		}
+	}
+
+	for _, pattern := range protected {
+		for p := filePath; ; p = path.Dir(p) {
+			// We validated the patterns when loading them.
+			if matched, _ := path.Match(pattern, p); matched {
+				return pattern, true
+			}
+			if p == "/" || p == "." {
+				break
+			}
+		}
+	}
+	return "", false
+}
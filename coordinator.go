@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The coordinator gathers records from agents (see agent.go) and looks for
+// duplicates among all of them. It can't reach the files itself, so it never
+// changes anything. Instead it writes a plan for each machine saying what the
+// rules would do there.
+//
+// Files on other machines have paths of the form host:/path, and so may rules
+// and protected paths. A rule or protected path without a host applies on any
+// machine. Machines named dev or mount can't be named this way, as those mean
+// filesystems. See locations.go.
+
+// hostPath matches a path on a named machine, such as backup1:/srv.
+var hostPath = regexp.MustCompile(`^([^/:]+):(/.*)$`)
+
+// splitHost splits a host:/path location into the machine and the path. For a
+// plain path, host is blank.
+func splitHost(location string) (string, string) {
+	if isFilesystemLocation(location) {
+		return "", location
+	}
+	if m := hostPath.FindStringSubmatch(location); m != nil {
+		return m[1], m[2]
+	}
+	return "", location
+}
+
+// agentResults holds what one agent sent.
+type agentResults struct {
+	header  agentHeader
+	records []agentRecord
+}
+
+// coordinator implements the coordinator subcommand.
+func coordinator(argv []string) error {
+	args := defaultArgs()
+
+	fs := flag.NewFlagSet("coordinator", flag.ExitOnError)
+	fs.StringVar(&args.Config, "conf", "",
+		"Configuration file with rules, which may name locations as host:/path. Without one, we only report duplicates.")
+	listen := fs.String("listen", "",
+		"Address to listen on for agents, such as :8000.")
+	agents := fs.Int("agents", 0,
+		"Number of agents to wait for when listening.")
+	var inputs []string
+	fs.Var((*stringsFlag)(&inputs), "input",
+		"File of records an agent wrote with -coordinator -. You may give this more than once.")
+	planDir := fs.String("plan-dir", "",
+		"Directory to write each machine's plan to, as HOST.json.")
+	coverage := fs.String("coverage", "",
+		"Instead of looking for duplicates, list which of this machine's files have copies on other machines. The list goes to stdout in the -format format.")
+	var against []string
+	fs.Var((*stringsFlag)(&against), "against",
+		"With -coverage, only look for copies on this machine. You may give this more than once.")
+	fs.StringVar(&args.Output, "output", args.Output,
+		"Write a report of the duplicates to this file, or to stdout if it is -.")
+	fs.StringVar(&args.Format, "format", args.Format,
+		fmt.Sprintf("Format of the -output report. One of: %s.",
+			strings.Join(reportFormatNames(), ", ")))
+	fs.StringVar(&args.Sort, "sort", args.Sort,
+		fmt.Sprintf("Order to list groups of duplicates in. One of: %s.",
+			groupOrderNames()))
+	fs.IntVar(&args.Top, "top", args.Top, topUsage)
+	fs.StringVar(&args.Color, "color", args.Color,
+		"Whether to colour the listing: auto, always, or never.")
+	fs.StringVar(&args.RuleMatch, "rule-match", args.RuleMatch,
+		fmt.Sprintf("How to choose between rules of equal priority that apply to the same files: %s or %s.",
+			ruleMatchFirst, ruleMatchSpecific))
+	fs.StringVar(&args.StatusListen, "status-listen", args.StatusListen,
+		statusListenUsage+" With -listen, the coordinator serves them there too.")
+	addLogFlags(fs, args)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(),
+			"Usage: %s coordinator [-listen ADDR -agents N] [-input FILE] [-conf FILE]\n",
+			os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	_ = fs.Parse(argv)
+	fs.Visit(func(f *flag.Flag) { args.explicit[f.Name] = true })
+
+	if len(inputs) == 0 && *listen == "" {
+		fs.Usage()
+		return fmt.Errorf("you must provide -input files or -listen")
+	}
+	if len(against) > 0 && *coverage == "" {
+		return fmt.Errorf("-against only applies with -coverage")
+	}
+	if *listen != "" && *agents < 1 {
+		return fmt.Errorf("you must say how many agents to wait for with -agents")
+	}
+
+	startStatus()
+	config := &Config{}
+	if args.Config != "" {
+		var err error
+		config, err = readConfig(args.Config)
+		if err != nil {
+			return fmt.Errorf("unable to read config: %s: %s", args.Config, err)
+		}
+		if !config.decides() && *coverage == "" {
+			return fmt.Errorf("no rules found in %s", args.Config)
+		}
+	} else {
+		args.scanOnly = true
+	}
+
+	// What the flags say, so that a configuration we reload replaces rather
+	// than adds to this one's settings.
+	flagArgs := *args
+
+	// We only plan. Nothing here can reach the files.
+	applySettings(args, config)
+	args.Live = false
+	if err := checkArgs(args); err != nil {
+		return err
+	}
+	setupColor(args.Color)
+	if err := setupLogFile(args); err != nil {
+		return err
+	}
+	if args.StatusListen != "" {
+		if err := serveStatus(args.StatusListen); err != nil {
+			return err
+		}
+	}
+
+	var results []*agentResults
+	for _, input := range inputs {
+		fh, err := os.Open(input)
+		if err != nil {
+			return fmt.Errorf("unable to open records: %s", err)
+		}
+		result, err := readAgentRecords(bufio.NewReader(fh))
+		_ = fh.Close()
+		if err != nil {
+			return fmt.Errorf("unable to read records: %s: %s", input, err)
+		}
+		log.Printf("Read %d records from %s (%s)", len(result.records),
+			result.header.Host, input)
+		results = append(results, result)
+		noteScanned()
+	}
+
+	if *listen != "" {
+		// Waiting for agents may take a while, so we read the configuration
+		// again on SIGHUP, and use what we have once they've all reported.
+		var reloader *configReloader
+		if args.Config != "" {
+			reloader = watchConfigReload(args.Config, &flagArgs, config, nil)
+		}
+
+		startPhase("receive")
+		received, err := receiveAgentRecords(*listen, *agents, results)
+		if reloader != nil {
+			reloader.stop()
+			config, args = reloader.current()
+			args.Live = false
+		}
+		if err != nil {
+			return err
+		}
+		results = append(results, received...)
+	}
+
+	files, err := agentFiles(results)
+	if err != nil {
+		return err
+	}
+
+	if *coverage != "" {
+		report, err := newCoverageReport(*coverage, against, files)
+		if err != nil {
+			return err
+		}
+		return writeCoverageReport(os.Stdout, args.Format, report)
+	}
+
+	groups := groupAgentFiles(files)
+
+	if *planDir != "" {
+		algorithm := args.Hash
+		if len(results) > 0 {
+			algorithm = results[0].header.Algorithm
+		}
+		args.plan = newPlan(algorithm)
+	}
+
+	startPhase("resolve")
+	summary := &Summary{Files: len(files)}
+	log.Print("Reporting/resolving duplicate files...")
+	if err := reportAndResolveDuplicates(args, config, groups,
+		summary); err != nil {
+		return fmt.Errorf("unable to report/resolve duplicates: %s", err)
+	}
+
+	if args.Output != "" {
+		if err := saveReport(args.Output, args.Format,
+			newReport(summary)); err != nil {
+			return err
+		}
+	}
+
+	if *planDir != "" {
+		if err := writePlans(*planDir, args.plan); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readAgentRecords reads an agent's header and records.
+func readAgentRecords(r io.Reader) (*agentResults, error) {
+	decoder := json.NewDecoder(r)
+
+	result := &agentResults{}
+	if err := decoder.Decode(&result.header); err != nil {
+		return nil, fmt.Errorf("invalid header: %s", err)
+	}
+	if result.header.Version != agentProtocolVersion {
+		return nil, fmt.Errorf("unsupported record version %d. We support %d",
+			result.header.Version, agentProtocolVersion)
+	}
+	if result.header.Host == "" || strings.ContainsAny(result.header.Host, ":/") {
+		return nil, fmt.Errorf("invalid host: %q", result.header.Host)
+	}
+
+	for {
+		var record agentRecord
+		if err := decoder.Decode(&record); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("invalid record: %s", err)
+		}
+		if !path.IsAbs(record.Path) {
+			return nil, fmt.Errorf("invalid record: path is not absolute: %s",
+				record.Path)
+		}
+		result.records = append(result.records, record)
+	}
+
+	return result, nil
+}
+
+// receiveAgentRecords listens for agents until count of them have sent their
+// records. earlier holds records we already have, so that we can turn away a
+// machine we've heard from.
+func receiveAgentRecords(
+	listen string,
+	count int,
+	earlier []*agentResults,
+) ([]*agentResults, error) {
+	var mu sync.Mutex
+	hosts := make(map[string]bool)
+	for _, result := range earlier {
+		hosts[result.header.Host] = true
+	}
+	var results []*agentResults
+	done := make(chan struct{})
+	setStatusQueue(count)
+
+	mux := http.NewServeMux()
+	addStatusHandlers(mux)
+	mux.HandleFunc(agentPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "records must be POSTed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		result, err := readAgentRecords(bufio.NewReader(r.Body))
+		if err != nil {
+			log.Printf("Invalid records from %s: %s", r.RemoteAddr, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if len(results) == count {
+			http.Error(w, "we have heard from every agent", http.StatusConflict)
+			return
+		}
+		if hosts[result.header.Host] {
+			http.Error(w, fmt.Sprintf("we already have records from %s",
+				result.header.Host), http.StatusConflict)
+			return
+		}
+		hosts[result.header.Host] = true
+		results = append(results, result)
+		noteScanned()
+		setStatusQueue(count - len(results))
+
+		log.Printf("Received %d records from %s (%d/%d agents)",
+			len(result.records), result.header.Host, len(results), count)
+		fmt.Fprintf(w, "received %d records\n", len(result.records))
+		if len(results) == count {
+			close(done)
+		}
+	})
+
+	server := &http.Server{Addr: listen, Handler: mux}
+	serverErr := make(chan error, 1)
+	go func() { serverErr <- server.ListenAndServe() }()
+	log.Printf("Waiting for %d agents on %s...", count, listen)
+
+	select {
+	case err := <-serverErr:
+		return nil, fmt.Errorf("unable to listen: %s", err)
+	case <-done:
+	}
+
+	// Let the last agent hear that we have its records.
+	if err := server.Shutdown(context.Background()); err != nil {
+		return nil, fmt.Errorf("unable to stop listening: %s", err)
+	}
+
+	return results, nil
+}
+
+// agentFiles turns the agents' records into files with host:/path paths. Every
+// agent must have used the same hash algorithm, or none of their checksums
+// would match.
+func agentFiles(results []*agentResults) ([]*File, error) {
+	var files []*File
+	hosts := make(map[string]bool)
+	for _, result := range results {
+		if hosts[result.header.Host] {
+			return nil, fmt.Errorf("we have records from %s more than once",
+				result.header.Host)
+		}
+		hosts[result.header.Host] = true
+
+		if result.header.Algorithm != results[0].header.Algorithm {
+			return nil, fmt.Errorf("%s used %s but %s used %s. Agents must use the same -hash",
+				result.header.Host, result.header.Algorithm, results[0].header.Host,
+				results[0].header.Algorithm)
+		}
+
+		for _, record := range result.records {
+			hash, err := hex.DecodeString(record.Hash)
+			if err != nil || len(hash) == 0 {
+				return nil, fmt.Errorf("invalid checksum from %s for %s",
+					result.header.Host, record.Path)
+			}
+			files = append(files, &File{
+				Basename: path.Base(record.Path),
+				Path:     result.header.Host + ":" + record.Path,
+				Size:     record.Size,
+				ModTime:  record.ModTime,
+				Hash:     hash,
+			})
+		}
+	}
+	return files, nil
+}
+
+// groupAgentFiles groups the files with the same size and checksum. Unlike
+// with local files, we can't compare them byte by byte, so we trust the
+// checksum.
+func groupAgentFiles(files []*File) [][]*File {
+	type key struct {
+		size int64
+		hash string
+	}
+
+	index := make(map[key]int)
+	var groups [][]*File
+	for _, file := range files {
+		k := key{file.Size, string(file.Hash)}
+		i, ok := index[k]
+		if !ok {
+			index[k] = len(groups)
+			groups = append(groups, []*File{file})
+			continue
+		}
+		groups[i] = append(groups[i], file)
+	}
+
+	var duplicates [][]*File
+	for _, group := range groups {
+		if len(group) > 1 {
+			duplicates = append(duplicates, group)
+		}
+	}
+	return duplicates
+}
+
+// writePlans splits the plan into one for each machine we would change files
+// on, which apply can carry out there. A link can't reach another machine, so
+// we leave out those between machines. A copy kept on another machine goes in
+// the entry's keep_host.
+func writePlans(dir string, plan *Plan) error {
+	hostPlans := make(map[string]*Plan)
+	for _, entry := range plan.Entries {
+		hash, err := hex.DecodeString(entry.Hash)
+		if err != nil {
+			return fmt.Errorf("invalid checksum in plan: %s", entry.Hash)
+		}
+		keepHost, keepPath := splitHost(entry.Keep)
+
+		for _, remove := range entry.Remove {
+			host, removePath := splitHost(remove)
+			if isLinkAction(entry.Action) && keepHost != host {
+				warnf("Leaving out replacing %s with a %s to %s: they are on different machines",
+					remove, entry.Action, entry.Keep)
+				continue
+			}
+
+			hostPlan, ok := hostPlans[host]
+			if !ok {
+				hostPlan = newPlan(plan.Algorithm)
+				hostPlans[host] = hostPlan
+			}
+			// On its own machine, the kept copy is a plain path.
+			keep := &File{Path: entry.Keep, Size: entry.Size, Hash: hash}
+			if keepHost == host {
+				keep.Path = keepPath
+			}
+			hostPlan.add(entry.Group, entry.Action, keep,
+				&File{Path: removePath, Size: entry.Size, Hash: hash})
+		}
+	}
+
+	var hosts []string
+	for host := range hostPlans {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	for _, host := range hosts {
+		hostPlan := hostPlans[host]
+		for i := range hostPlan.Entries {
+			entry := &hostPlan.Entries[i]
+			if keepHost, keepPath := splitHost(entry.Keep); keepHost != "" {
+				entry.Keep, entry.KeepHost = keepPath, keepHost
+			}
+		}
+
+		name := path.Join(dir, host+".json")
+		if err := hostPlan.save(name); err != nil {
+			return err
+		}
+		log.Printf("Wrote the plan for %s to %s (%d entries)", host, name,
+			len(hostPlan.Entries))
+	}
+
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A coverage report says which of one machine's files have copies on other
+// machines. Before wiping a machine, it tells you what you would lose: the
+// files with no copy elsewhere.
+
+// CoverageReport is a coverage report for Host. Against lists the machines we
+// looked for copies on. If it is empty, we looked on every other machine.
+type CoverageReport struct {
+	Host    string          `json:"host"`
+	Against []string        `json:"against,omitempty"`
+	Summary CoverageSummary `json:"summary"`
+	Files   []CoverageFile  `json:"files"`
+}
+
+// CoverageSummary counts the files with and without copies elsewhere.
+type CoverageSummary struct {
+	Files          int   `json:"files"`
+	Bytes          int64 `json:"bytes"`
+	Copied         int   `json:"copied"`
+	CopiedBytes    int64 `json:"copied_bytes"`
+	NotCopied      int   `json:"not_copied"`
+	NotCopiedBytes int64 `json:"not_copied_bytes"`
+}
+
+// CoverageFile is one of the machine's files and where else it is. Copies are
+// host:/path locations.
+type CoverageFile struct {
+	Path   string   `json:"path"`
+	Size   int64    `json:"size"`
+	Copies []string `json:"copies"`
+}
+
+// newCoverageReport finds copies of host's files on the machines in against,
+// or on any other machine if against is empty. files are from agentFiles.
+func newCoverageReport(host string, against []string,
+	files []*File) (*CoverageReport, error) {
+	type key struct {
+		size int64
+		hash string
+	}
+
+	wanted := make(map[string]bool)
+	for _, other := range against {
+		wanted[other] = true
+	}
+
+	known := make(map[string]bool)
+	copies := make(map[key][]string)
+	for _, file := range files {
+		fileHost, _ := splitHost(file.Path)
+		known[fileHost] = true
+		if fileHost == host || (len(against) > 0 && !wanted[fileHost]) {
+			continue
+		}
+		k := key{file.Size, string(file.Hash)}
+		copies[k] = append(copies[k], file.Path)
+	}
+
+	for _, name := range append([]string{host}, against...) {
+		if !known[name] {
+			return nil, fmt.Errorf("we have no records from %s", name)
+		}
+	}
+
+	report := &CoverageReport{
+		Host:    host,
+		Against: against,
+		Files:   []CoverageFile{},
+	}
+	for _, file := range files {
+		fileHost, filePath := splitHost(file.Path)
+		if fileHost != host {
+			continue
+		}
+
+		fileCopies := copies[key{file.Size, string(file.Hash)}]
+		if fileCopies == nil {
+			fileCopies = []string{}
+		}
+		report.Files = append(report.Files, CoverageFile{
+			Path:   filePath,
+			Size:   file.Size,
+			Copies: fileCopies,
+		})
+
+		report.Summary.Files++
+		report.Summary.Bytes += file.Size
+		if len(fileCopies) > 0 {
+			report.Summary.Copied++
+			report.Summary.CopiedBytes += file.Size
+		} else {
+			report.Summary.NotCopied++
+			report.Summary.NotCopiedBytes += file.Size
+		}
+	}
+
+	sort.Slice(report.Files, func(i, j int) bool {
+		return report.Files[i].Path < report.Files[j].Path
+	})
+
+	return report, nil
+}
+
+// writeCoverageReport writes the report in the format, which is one of the
+// -format formats.
+func writeCoverageReport(w io.Writer, format string,
+	report *CoverageReport) error {
+	switch format {
+	case reportText:
+		return writeCoverageText(w, report)
+	case reportCSV:
+		return writeCoverageCSV(w, report)
+	case reportJSON:
+		buf, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return fmt.Errorf("unable to encode coverage report: %s", err)
+		}
+		if _, err := w.Write(append(buf, '\n')); err != nil {
+			return fmt.Errorf("unable to write coverage report: %s", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown report format: %s", format)
+	}
+}
+
+// writeCoverageText lists the files, copies of each beneath it, and then
+// totals.
+func writeCoverageText(w io.Writer, report *CoverageReport) error {
+	var b strings.Builder
+
+	for _, file := range report.Files {
+		if len(file.Copies) == 0 {
+			fmt.Fprintf(&b, "%s (%d bytes): only on %s\n", file.Path, file.Size,
+				report.Host)
+			continue
+		}
+		fmt.Fprintf(&b, "%s (%d bytes): also at\n", file.Path, file.Size)
+		for _, location := range file.Copies {
+			fmt.Fprintf(&b, "  %s\n", location)
+		}
+	}
+
+	elsewhere := "on other machines"
+	if len(report.Against) > 0 {
+		elsewhere = "on " + strings.Join(report.Against, ", ")
+	}
+	fmt.Fprintf(&b, "%d of %d files (%d of %d bytes) on %s have copies %s. %d files (%d bytes) do not.\n",
+		report.Summary.Copied, report.Summary.Files, report.Summary.CopiedBytes,
+		report.Summary.Bytes, report.Host, elsewhere, report.Summary.NotCopied,
+		report.Summary.NotCopiedBytes)
+
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return fmt.Errorf("unable to write coverage report: %s", err)
+	}
+	return nil
+}
+
+// writeCoverageCSV writes a row for each copy of each file. A file with no
+// copies gets one row with a blank copy.
+func writeCoverageCSV(w io.Writer, report *CoverageReport) error {
+	cw := csv.NewWriter(w)
+
+	if err := cw.Write([]string{"path", "size", "copy"}); err != nil {
+		return fmt.Errorf("unable to write coverage report: %s", err)
+	}
+
+	for _, file := range report.Files {
+		size := strconv.FormatInt(file.Size, 10)
+		copies := file.Copies
+		if len(copies) == 0 {
+			copies = []string{""}
+		}
+		for _, location := range copies {
+			if err := cw.Write([]string{file.Path, size, location}); err != nil {
+				return fmt.Errorf("unable to write coverage report: %s", err)
+			}
+		}
+	}
+
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return fmt.Errorf("unable to write coverage report: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// The decide setting is a Starlark script for the policies rules can't
+// express. It defines a function decide(a, b) that we call for each pair of
+// duplicates no rule covers. It returns what to do with a:
+//
+//  - "keep" keeps a and removes b with decide_action.
+//  - "remove" removes a with decide_action and keeps b.
+//  - "skip" leaves both alone.
+//  - None says it has no opinion, so we go on as if there were no script:
+//    we ask the user if we're interactive, or take the default action.
+//
+// Starlark is a small dialect of Python made for configuration. Scripts can't
+// touch files or the network, and we limit how long each call may run, so a
+// script can't do anything but decide.
+
+// Results of decide.
+const (
+	decideKeep   = "keep"
+	decideRemove = "remove"
+	decideSkip   = "skip"
+)
+
+// decideMaxSteps limits how much work a call to decide may do. It is far more
+// than any sensible policy needs, but stops a script that loops forever.
+const decideMaxSteps = 1000000
+
+// decider is a compiled decide script.
+type decider struct {
+	fn starlark.Callable
+}
+
+// compileDecider runs the script and finds its decide function.
+func compileDecider(script string) (*decider, error) {
+	thread := &starlark.Thread{Name: "decide"}
+	thread.SetMaxExecutionSteps(decideMaxSteps)
+	globals, err := starlark.ExecFile(thread, "decide", script, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Freezing the globals lets us call decide from more than one goroutine.
+	globals.Freeze()
+
+	fn, ok := globals["decide"].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("the script must define a decide function")
+	}
+	return &decider{fn: fn}, nil
+}
+
+// decide calls the script's decide function for the pair. It returns the file
+// to keep and the file to remove, and whether the script decided. If it said
+// to skip the pair, both files are nil.
+func (d *decider) decide(file1, file2 *File) (*File, *File, bool, error) {
+	thread := &starlark.Thread{Name: "decide"}
+	thread.SetMaxExecutionSteps(decideMaxSteps)
+	result, err := starlark.Call(thread, d.fn, starlark.Tuple{
+		fileValue(file1),
+		fileValue(file2),
+	}, nil)
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("decide failed for %s and %s: %s",
+			file1.Path, file2.Path, err)
+	}
+
+	if result == starlark.None {
+		return nil, nil, false, nil
+	}
+	s, ok := starlark.AsString(result)
+	if !ok {
+		return nil, nil, false, fmt.Errorf(
+			"decide returned %s for %s and %s, not a string or None", result.Type(),
+			file1.Path, file2.Path)
+	}
+	switch s {
+	case decideKeep:
+		return file1, file2, true, nil
+	case decideRemove:
+		return file2, file1, true, nil
+	case decideSkip:
+		return nil, nil, true, nil
+	default:
+		return nil, nil, false, fmt.Errorf(
+			"decide returned %q for %s and %s. It must return %q, %q, %q, or None",
+			s, file1.Path, file2.Path, decideKeep, decideRemove, decideSkip)
+	}
+}
+
+// fileValue describes a file to a script. mod_time is in seconds since the
+// Unix epoch.
+func fileValue(file *File) starlark.Value {
+	return starlarkstruct.FromStringDict(starlarkstruct.Default,
+		starlark.StringDict{
+			"path":     starlark.String(file.Path),
+			"name":     starlark.String(file.Basename),
+			"dir":      starlark.String(filepath.Dir(file.Path)),
+			"ext":      starlark.String(filepath.Ext(file.Basename)),
+			"size":     starlark.MakeInt64(file.Size),
+			"mod_time": starlark.MakeInt64(file.ModTime.Unix()),
+		})
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The drive subcommand lists the files in a Google Drive account and sends
+// them to a coordinator as an agent would (see agent.go). Drive tells us each
+// file's MD5 checksum, so we don't need to download anything. Along with
+// agents on machines using -hash md5, this finds copies of local files in
+// Drive.
+
+// driveAPI is where we list files.
+const driveAPI = "https://www.googleapis.com/drive/v3/files"
+
+// driveFolderType is the MIME type of Drive folders.
+const driveFolderType = "application/vnd.google-apps.folder"
+
+// driveFile is what Drive tells us about a file or folder. Files Drive makes
+// itself, such as Google Docs, have no size or checksum.
+type driveFile struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	MimeType     string    `json:"mimeType"`
+	Parents      []string  `json:"parents"`
+	Size         string    `json:"size"`
+	MD5Checksum  string    `json:"md5Checksum"`
+	ModifiedTime time.Time `json:"modifiedTime"`
+}
+
+// driveFileList is a page of files.
+type driveFileList struct {
+	NextPageToken string      `json:"nextPageToken"`
+	Files         []driveFile `json:"files"`
+}
+
+// drive implements the drive subcommand.
+func drive(argv []string) error {
+	args := defaultArgs()
+
+	fs := flag.NewFlagSet("drive", flag.ExitOnError)
+	tokenFile := fs.String("token-file", "",
+		"File holding an OAuth 2.0 access token for the Drive API with at least the drive.metadata.readonly scope.")
+	folder := fs.String("folder", "root",
+		"ID of the folder to list. The default is the top of My Drive.")
+	coordinator := fs.String("coordinator", "",
+		"URL of the coordinator to send records to, or - to write them to stdout.")
+	host := fs.String("host", "drive",
+		"Name of the account in the coordinator's report.")
+	fs.IntVar(&args.Retries, "retries", args.Retries,
+		"Number of times to retry a request to Drive after an error.")
+	fs.DurationVar(&args.RetryDelay, "retry-delay", args.RetryDelay,
+		"Delay before the first retry. It doubles with each subsequent retry.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(),
+			"Usage: %s drive -token-file FILE -coordinator URL\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	_ = fs.Parse(argv)
+
+	if *tokenFile == "" || *coordinator == "" {
+		fs.Usage()
+		return fmt.Errorf("you must provide a token file and a coordinator")
+	}
+
+	if *host == "" || strings.ContainsAny(*host, ":/") {
+		return fmt.Errorf("invalid host: %q", *host)
+	}
+
+	if *coordinator != "-" {
+		if err := checkCoordinatorURL(*coordinator); err != nil {
+			return err
+		}
+	}
+
+	buf, err := ioutil.ReadFile(*tokenFile)
+	if err != nil {
+		return fmt.Errorf("unable to read token: %s", err)
+	}
+	token := strings.TrimSpace(string(buf))
+	if token == "" {
+		return fmt.Errorf("%s is empty", *tokenFile)
+	}
+
+	client := &driveClient{
+		args:   args,
+		token:  token,
+		client: &http.Client{Timeout: time.Minute},
+	}
+
+	top, err := client.get(*folder)
+	if err != nil {
+		return err
+	}
+
+	log.Print("Listing files in Drive...")
+	listed, err := client.list()
+	if err != nil {
+		return err
+	}
+
+	files, unchecksummed := driveFiles(top.ID, listed)
+	if unchecksummed > 0 {
+		log.Printf("Skipping %d files without checksums, such as Google Docs",
+			unchecksummed)
+	}
+
+	header := agentHeader{
+		Version:   agentProtocolVersion,
+		Host:      *host,
+		Dir:       "/",
+		Algorithm: "md5",
+	}
+
+	return deliverAgentRecords(*coordinator, header, files)
+}
+
+// driveClient makes requests to the Drive API.
+type driveClient struct {
+	args   *Args
+	token  string
+	client *http.Client
+}
+
+// get asks Drive about one file or folder.
+func (c *driveClient) get(id string) (*driveFile, error) {
+	var file driveFile
+	if err := c.request(driveAPI+"/"+url.PathEscape(id), url.Values{
+		"fields": {"id,name,mimeType"},
+	}, &file); err != nil {
+		return nil, err
+	}
+	if file.MimeType != driveFolderType {
+		return nil, fmt.Errorf("%s is not a folder", id)
+	}
+	return &file, nil
+}
+
+// list lists every file and folder not in the trash, a page at a time.
+func (c *driveClient) list() ([]driveFile, error) {
+	var files []driveFile
+	pageToken := ""
+	for {
+		query := url.Values{
+			"q":        {"trashed = false"},
+			"spaces":   {"drive"},
+			"pageSize": {"1000"},
+			"fields": {
+				"nextPageToken,files(id,name,mimeType,parents,size,md5Checksum,modifiedTime)",
+			},
+		}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+
+		var page driveFileList
+		if err := c.request(driveAPI, query, &page); err != nil {
+			return nil, err
+		}
+		files = append(files, page.Files...)
+
+		if page.NextPageToken == "" {
+			return files, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+// request makes a GET request and decodes the JSON response into v. We retry
+// errors other than being refused access, as Drive turns away requests that
+// come too quickly.
+func (c *driveClient) request(endpoint string, query url.Values,
+	v interface{}) error {
+	return retry(c.args, func() error {
+		req, err := http.NewRequest(http.MethodGet, endpoint+"?"+query.Encode(),
+			nil)
+		if err != nil {
+			return fmt.Errorf("unable to create request: %s", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+c.token)
+
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return fmt.Errorf("unable to query Drive: %s", err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+
+		if resp.StatusCode == http.StatusUnauthorized {
+			return fmt.Errorf("Drive refused the token: %w", os.ErrPermission)
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			body, _ := ioutil.ReadAll(resp.Body)
+			return fmt.Errorf("Drive responded with %s: %s", resp.Status, body)
+		}
+
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			return fmt.Errorf("invalid response from Drive: %s", err)
+		}
+		return nil
+	})
+}
+
+// driveFiles works out the path of each file below the top folder and turns
+// those with checksums into files. It also returns how many files had no
+// checksum.
+//
+// Drive identifies files by ID rather than by path, so two files in a folder
+// may have the same name, and names may contain /. We add the ID to repeated
+// names and replace / with _ so that each file has its own path.
+func driveFiles(top string, listed []driveFile) ([]*File, int) {
+	byID := make(map[string]*driveFile)
+	names := make(map[string]int)
+	for i := range listed {
+		file := &listed[i]
+		byID[file.ID] = file
+		names[driveParent(file)+"/"+file.Name]++
+	}
+
+	name := func(file *driveFile) string {
+		n := strings.Replace(file.Name, "/", "_", -1)
+		if names[driveParent(file)+"/"+file.Name] > 1 {
+			n += " [" + file.ID + "]"
+		}
+		return n
+	}
+
+	// folderPaths caches the paths of folders below top. A blank path means
+	// the folder isn't below top. We record that before looking at a folder's
+	// parent, so that we would stop if Drive ever had a loop.
+	folderPaths := map[string]string{top: "/"}
+	var folderPath func(id string) string
+	folderPath = func(id string) string {
+		if p, ok := folderPaths[id]; ok {
+			return p
+		}
+		folderPaths[id] = ""
+
+		folder, ok := byID[id]
+		if !ok {
+			return ""
+		}
+		parent := folderPath(driveParent(folder))
+		if parent == "" {
+			return ""
+		}
+		p := strings.TrimSuffix(parent, "/") + "/" + name(folder)
+		folderPaths[id] = p
+		return p
+	}
+
+	var files []*File
+	unchecksummed := 0
+	for i := range listed {
+		file := &listed[i]
+		if file.MimeType == driveFolderType {
+			continue
+		}
+
+		parent := folderPath(driveParent(file))
+		if parent == "" {
+			continue
+		}
+
+		if file.MD5Checksum == "" {
+			unchecksummed++
+			continue
+		}
+		hash, err := hex.DecodeString(file.MD5Checksum)
+		if err != nil {
+			log.Printf("Skipping %s: invalid checksum: %s", file.ID, err)
+			continue
+		}
+		size, err := strconv.ParseInt(file.Size, 10, 64)
+		if err != nil {
+			log.Printf("Skipping %s: invalid size: %s", file.ID, err)
+			continue
+		}
+
+		basename := name(file)
+		files = append(files, &File{
+			Basename: basename,
+			Path:     strings.TrimSuffix(parent, "/") + "/" + basename,
+			Size:     size,
+			ModTime:  file.ModifiedTime,
+			Hash:     hash,
+		})
+	}
+
+	return files, unchecksummed
+}
+
+// driveParent returns the ID of the file's folder. A file may once have had
+// several, but Drive now gives each file one.
+func driveParent(file *driveFile) string {
+	if len(file.Parents) == 0 {
+		return ""
+	}
+	return file.Parents[0]
+}
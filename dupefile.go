@@ -2,21 +2,136 @@ package main
 
 import (
 	"bufio"
-	"crypto/md5"
-	"encoding/json"
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"hash"
+	"io"
 	"log"
 	"os"
 	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 // Args holds command line arguments.
 type Args struct {
-	Dir    string
-	Config string
-	Live   bool
+	Dir          string
+	Config       string
+	Live         bool
+	Paranoid     bool
+	Backup       string
+	Shred        bool
+	SkipOpen     bool
+	RewriteLinks bool
+	MaxFiles     int
+	MaxBytes     int64
+	Retries      int
+	RetryDelay   time.Duration
+	Workers      int
+	Walkers      int
+	MaxOpen      int
+	Hash         string
+	SecondHash   string
+	TrustHash    bool
+	Stages       []string
+	Mmap         bool
+	BufferSize   int
+	IOUring      bool
+	IndexDir     string
+	IndexType    string
+	BloomFile    string
+	StateFile    string
+	MaxDuration  time.Duration
+	Strict       bool
+	Xattrs       bool
+	Exclude      []string
+	LocalConfig  bool
+	RuleMatch    string
+	Interactive  bool
+	DeletePrompt bool
+	Answers      string
+	SaveAnswers  string
+	Plan         string
+	Output       string
+	Analyze      string
+	SummaryJSON  string
+	Format       string
+	Sort         string
+	Top          int
+	LargestFirst bool
+	Color        string
+	Porcelain    bool
+	BrokenLinks  string
+	ListSpecial  bool
+	LogFile      string
+	LogMaxSize   int64
+	LogEvery     time.Duration
+	LogKeep      int
+	Progress     time.Duration
+	Events       string
+	StatusListen string
+	Every        time.Duration
+
+	// scanOnly means we report duplicates without trying to resolve them.
+	scanOnly bool
+
+	// analysis gathers what we write with -analyze.
+	analysis *analysis
+
+	// answers holds the decisions to replay, with -answers, and newAnswers
+	// those we record, with -save-answers.
+	answers    *answerBook
+	newAnswers *answerBook
+
+	// plan holds what a live run would do, with -plan.
+	plan *Plan
+
+	// state holds the checksums we keep between runs, with -state-file.
+	state *hashState
+
+	// deadline is when the run's -max-duration is up.
+	deadline time.Time
+
+	// limits holds the -max-files and -max-bytes limits we have told the user
+	// we reached.
+	limits map[string]bool
+
+	// inUse holds the duplicates we didn't remove because other processes had
+	// them open, with -skip-open.
+	inUse []string
+
+	// symlinks holds the symbolic links in the tree, with -rewrite-symlinks.
+	symlinks *symlinkIndex
+
+	// brokenLinks holds the broken symbolic links we found, with
+	// -broken-symlinks.
+	brokenLinks []*symlink
+
+	// specialFiles holds the special files we skipped, with
+	// -report-special-files.
+	specialFiles []*SpecialFile
+
+	// vanished counts the files that vanished after we found them.
+	vanished int
+
+	// known holds the files earlier runs found to be unique, with -bloom-file.
+	known *knownFiles
+
+	// networkFS is the kind of network filesystem Dir is on, if it is on one.
+	// Modification times there may be coarse or out of date, so we don't trust
+	// them to tell us a file is unchanged since an earlier run.
+	networkFS string
+
+	// explicit holds the names of the flags given on the command line. Those
+	// take precedence over settings in the configuration file.
+	explicit map[string]bool
 }
 
 // File holds information about one file.
@@ -24,335 +139,1267 @@ type File struct {
 	Basename string
 	Path     string
 	Size     int64
+	ModTime  time.Time
 	Hash     []byte
+
+	// The file's device and inode, if hasID. See fileID.
+	dev, ino uint64
+	hasID    bool
+
+	// The file's owner and mode bits. See -strict-identity.
+	uid, gid uint32
+	mode     os.FileMode
+
+	// prefix is a quick checksum of the start of the file. See prefixChecksum.
+	prefix uint64
+
+	// SecondHash is the file's checksum with the -second-hash algorithm, if
+	// there is one.
+	SecondHash []byte
+
+	// networkFS is the kind of network filesystem the file is on, if it is on
+	// one. We don't trust its modification time. See Args.networkFS.
+	networkFS string
+
+	// vanished says the file was gone when we went to read it. See
+	// skipVanished.
+	vanished bool
+
+	// matcher is the plugin that found the file a duplicate, if one did. Its
+	// Hash then stands for what the plugin said rather than its contents. See
+	// plugins.go.
+	matcher string
+
+	// remote says the file is on another machine, so we know only its path,
+	// size, and checksum. See PlanEntry.
+	remote bool
 }
 
-// Rule defines what to do with a duplicate file found in two directories.
-type Rule struct {
-	KeepDir   string `json:"keep"`
-	RemoveDir string `json:"remove"`
+// commands holds the subcommands. Each takes the arguments after its name.
+var commands = map[string]func(argv []string) error{
+	"scan":        scan,
+	"resolve":     resolve,
+	"verify":      verify,
+	"explain":     explain,
+	"lint":        lint,
+	"agent":       agent,
+	"coordinator": coordinator,
+	"drive":       drive,
+	"rclone":      rclone,
+	"mount":       mount,
+	"hash":        hashCommand,
+	"apply":       apply,
+	"estimate":    estimate,
+	"cache":       cache,
+	"undo":        undo,
+	"serve":       serve,
 }
 
 func main() {
 	log.SetFlags(0)
 
-	args, err := getArgs()
-	if err != nil {
+	// Without a subcommand, we resolve, as we did before there were
+	// subcommands.
+	name, argv := "resolve", os.Args[1:]
+	if len(argv) > 0 && !strings.HasPrefix(argv[0], "-") {
+		name, argv = argv[0], argv[1:]
+	}
+
+	command, ok := commands[name]
+	if !ok {
+		log.Fatalf("Error: unknown command: %s. Commands are: %s", name,
+			strings.Join(commandNames(), ", "))
+	}
+
+	if err := command(argv); err != nil {
 		log.Fatalf("Error: %s", err)
 	}
+}
 
-	rules, err := readRules(args.Config)
-	if err != nil {
-		log.Fatalf("Unable to read rules from config: %s: %s", args.Config, err)
+func commandNames() []string {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
+}
 
-	log.Print("Looking for files...")
-	files, err := findFiles(args.Dir)
+// scan implements the scan subcommand. It finds and reports duplicates
+// without applying any rules, so it needs no configuration file.
+func scan(argv []string) error {
+	args, err := getArgs("scan", argv)
 	if err != nil {
-		log.Fatalf("Unable to find files: %s", err)
+		return err
 	}
+	args.scanOnly = true
 
-	if len(files) == 0 {
-		log.Printf("No files found.")
+	config := &Config{}
+	if args.Config != "" {
+		config, err = readConfig(args.Config)
+		if err != nil {
+			return fmt.Errorf("unable to read config: %s: %s", args.Config, err)
+		}
 	}
 
-	log.Print("Calculating checksums...")
-	if err := calculateChecksums(files); err != nil {
-		log.Fatalf("Unable to calculate checksums: %s", err)
+	run(args, config)
+	return nil
+}
+
+// resolve implements the resolve subcommand. It finds duplicates and applies
+// the rules to them.
+func resolve(argv []string) error {
+	args, err := getArgs("resolve", argv)
+	if err != nil {
+		return err
 	}
 
-	log.Print("Reporting/resolving duplicate files...")
-	if err := reportAndResolveDuplicates(rules, files, args.Live); err != nil {
-		log.Fatalf("Unable to report/resolve duplicates: %s", err)
+	// With -delete-prompt or -answers, the user rather than rules decides.
+	config := &Config{}
+	if len(args.Config) == 0 && !args.DeletePrompt && args.Answers == "" {
+		return fmt.Errorf("you must provide a configuration file")
+	}
+	if len(args.Config) > 0 {
+		config, err = readConfig(args.Config)
+		if err != nil {
+			return fmt.Errorf("unable to read config: %s: %s", args.Config, err)
+		}
+	}
+	// With -interactive, the user can add rules as we go.
+	if !config.decides() && !args.Interactive && !args.DeletePrompt &&
+		args.Answers == "" {
+		return fmt.Errorf("no rules found in %s", args.Config)
 	}
+
+	run(args, config)
+	return nil
 }
 
-func getArgs() (*Args, error) {
-	dir := flag.String("dir", "", "Directory to examine.")
-	config := flag.String("conf", "", "Path to a configuration file.")
-	live := flag.Bool("live", false, "Enable file deletion.")
+// run finds the duplicates in the directory and reports or resolves them.
+func run(args *Args, config *Config) {
+	startStatus()
+	applySettings(args, config)
+	if args.SummaryJSON != "" {
+		startRunSummary(args.SummaryJSON)
+	}
+	if err := checkArgs(args); err != nil {
+		fatalf("Error: %s", err)
+	}
 
-	flag.Parse()
+	setupColor(args.Color)
+	if err := setupLogFile(args); err != nil {
+		fatalf("Error: %s", err)
+	}
+	if args.StatusListen != "" {
+		if err := serveStatus(args.StatusListen); err != nil {
+			fatalf("Error: %s", err)
+		}
+	}
+	if args.Events != "" {
+		if err := openEvents(args.Events); err != nil {
+			fatalf("Error: %s", err)
+		}
+		command := "resolve"
+		if args.scanOnly {
+			command = "scan"
+		}
+		emit(eventRunStarted, runStartedData{
+			Command: command,
+			Dir:     args.Dir,
+			Live:    args.Live,
+		})
+	}
 
-	if len(*dir) == 0 {
-		flag.PrintDefaults()
-		return nil, fmt.Errorf("you must provide a directory")
+	if args.MaxDuration > 0 {
+		args.deadline = time.Now().Add(args.MaxDuration)
 	}
 
-	if len(*config) == 0 {
-		flag.PrintDefaults()
-		return nil, fmt.Errorf("you must provide a configuration file")
+	if args.MaxOpen > 0 {
+		fds = newFDBudget(args.MaxOpen)
 	}
 
-	return &Args{
-		Dir:    *dir,
-		Config: *config,
-		Live:   *live,
-	}, nil
-}
+	if args.RewriteLinks {
+		args.symlinks = newSymlinkIndex()
+	}
+
+	// With an index, we keep what we know about the files on disk until we know
+	// which might be duplicates.
+	var files []*File
+	var index fileStore
+	found := func(file *File) error {
+		files = append(files, file)
+		return nil
+	}
+	if args.IndexDir != "" {
+		var err error
+		index, err = newFileStore(args.IndexDir, args.IndexType)
+		if err != nil {
+			fatalf("Unable to create index: %s", err)
+		}
+		defer index.remove()
+		found = index.add
+	}
+	if args.Analyze != "" {
+		args.analysis = newAnalysis(args.Dir)
+		store := found
+		found = func(file *File) error {
+			args.analysis.addFile(file)
+			return store(file)
+		}
+	}
+
+	if args.Answers != "" {
+		answers, err := loadAnswers(args.Answers, args.Hash, false)
+		if err != nil {
+			fatalf("Unable to load answers: %s", err)
+		}
+		args.answers = answers
+	}
+	if args.SaveAnswers != "" {
+		answers, err := loadAnswers(args.SaveAnswers, args.Hash, true)
+		if err != nil {
+			fatalf("Unable to load answers: %s", err)
+		}
+		args.newAnswers = answers
+	}
+
+	if args.Plan != "" {
+		args.plan = newPlan(args.Hash)
+	}
 
-func readRules(configFile string) ([]Rule, error) {
-	buf, err := ioutil.ReadFile(configFile)
+	networkFS, err := networkFilesystem(args.Dir)
 	if err != nil {
-		return nil, fmt.Errorf("unable to read config: %s", err)
+		warnf("Unable to tell what filesystem %s is on: %s", args.Dir, err)
 	}
+	args.networkFS = networkFS
 
-	type Config struct {
-		Rules []Rule
+	if args.BloomFile != "" {
+		known, err := loadKnownFiles(args.BloomFile)
+		if err != nil {
+			fatalf("Unable to load Bloom filter: %s", err)
+		}
+		if args.networkFS != "" {
+			warnf("%s is on a network filesystem (%s). Checksumming files the Bloom filter says are unchanged, as we can't trust modification times there",
+				args.Dir, args.networkFS)
+			known.previous = nil
+		}
+		args.known = known
 	}
 
-	config := Config{}
-	if err := json.Unmarshal(buf, &config); err != nil {
-		return nil, fmt.Errorf("unable to decode config: %s", err)
+	if args.StateFile != "" {
+		state, err := loadHashState(args.StateFile, args.Hash, args.SecondHash)
+		if err != nil {
+			fatalf("Unable to load state: %s", err)
+		}
+		if args.networkFS != "" {
+			warnf("%s is on a network filesystem (%s). Checksumming files the state file has checksums for, as we can't trust modification times there",
+				args.Dir, args.networkFS)
+			state.trusted = false
+		}
+		args.state = state
 	}
 
-	if len(config.Rules) == 0 {
-		return nil, fmt.Errorf("no rules found")
+	startPhase("find")
+	log.Print("Looking for files...")
+	localRules, err := findFiles(args, args.Dir, args.Exclude, found)
+	if err != nil {
+		fatalf("Unable to find files: %s", err)
 	}
+	noteScanned()
 
-	for i, rule := range config.Rules {
-		if len(rule.KeepDir) == 0 || len(rule.RemoveDir) == 0 {
-			return nil, fmt.Errorf("rule %d is missing keep/remove directory", i+i)
+	if len(localRules) > 0 {
+		config.Rules = append(config.Rules, localRules...)
+		if err := checkRuleConflicts(config.Rules); err != nil {
+			fatalf("Invalid local config: %s", err)
 		}
-		if rule.KeepDir[0] != '/' || rule.RemoveDir[0] != '/' {
-			return nil,
-				fmt.Errorf("rule %d is has non-absolute keep/remove directory", i+i)
+	}
+
+	var matched [][]*File
+	if len(config.Matchers) > 0 {
+		if index != nil || args.LargestFirst {
+			fatalf("Error: matchers need every file at once, so they don't go with -index-dir or -largest-first")
 		}
-		if rule.KeepDir == rule.RemoveDir {
-			return nil,
-				fmt.Errorf("rule %d is has identical keep/remove directory", i+i)
+		files, matched, err = matchWithPlugins(args, config, files)
+		if err != nil {
+			fatalf("Unable to match files: %s", err)
 		}
 	}
 
-	return config.Rules, nil
-}
+	summary := &Summary{Live: args.Live, Rules: newRuleStats(config.Rules)}
+	setRunCounts(summary)
 
-func findFiles(dir string) ([]*File, error) {
-	fi, err := os.Stat(dir)
-	if err != nil {
-		return nil, fmt.Errorf("stat: %s: %s", dir, err)
+	if args.Porcelain {
+		if err := writePorcelainVersion(os.Stdout); err != nil {
+			fatalf("%s", err)
+		}
 	}
 
-	if !fi.IsDir() {
-		return nil, fmt.Errorf("%s is not a directory", dir)
+	resolveGroups := func(groups [][]*File) error {
+		if args.Xattrs {
+			var differing [][]*File
+			var err error
+			groups, differing, err = splitByXattrs(groups)
+			if err != nil {
+				return fmt.Errorf("unable to compare extended attributes: %s", err)
+			}
+			summary.differing = append(summary.differing, differing...)
+		}
+		return reportAndResolveDuplicates(args, config, groups, summary)
 	}
 
-	dh, err := os.Open(dir)
-	if err != nil {
-		return nil, fmt.Errorf("open: %s: %s", dir, err)
+	startPhase("compare")
+	fileCount := len(files)
+	if index != nil {
+		fileCount = index.len()
+	}
+	summary.Files = fileCount
+	for _, group := range matched {
+		summary.Files += len(group)
 	}
 
-	fis, err := dh.Readdir(0)
+	var groups [][]*File
+	if index != nil {
+		groups, err = index.findDuplicates(args)
+	} else if args.LargestFirst {
+		err = findDuplicatesLargestFirst(args, files, resolveGroups)
+	} else {
+		groups, err = findDuplicatesInTiers(args, files)
+	}
+	if errors.Is(err, errOutOfTime) {
+		stopOutOfTime(args)
+		return
+	}
 	if err != nil {
-		_ = dh.Close()
-		return nil, fmt.Errorf("readdir: %s: %s", dir, err)
+		fatalf("Unable to find duplicates: %s", err)
 	}
+	groups = append(groups, matched...)
 
-	if err := dh.Close(); err != nil {
-		return nil, fmt.Errorf("close: %s: %s", dir, err)
+	if args.state != nil {
+		if err := args.state.save(args.StateFile, true); err != nil {
+			fatalf("%s", err)
+		}
 	}
 
-	foundFiles := []*File{}
+	if fileCount == 0 {
+		log.Printf("No files found.")
+	}
 
-	for _, fi := range fis {
-		if fi.Name() == "." || fi.Name() == ".." {
-			continue
+	if args.known != nil {
+		if err := args.known.save(args.BloomFile); err != nil {
+			fatalf("%s", err)
 		}
+	}
 
-		filePath := path.Join(dir, fi.Name())
+	// With -largest-first, we already have.
+	if !args.LargestFirst {
+		startPhase("resolve")
+		log.Print("Reporting/resolving duplicate files...")
+		if err := resolveGroups(groups); err != nil {
+			fatalf("Unable to report/resolve duplicates: %s", err)
+		}
+	}
 
-		if fi.IsDir() {
-			dirFiles, err := findFiles(filePath)
-			if err != nil {
-				return nil, err
-			}
+	startPhase("finish")
+	stopPlugins(config)
+	summary.Vanished = args.vanished
+	reportInUse(args, summary)
+	dealWithBrokenSymlinks(args, config, summary)
+	reportSpecialFiles(args, summary)
+	reportRuleStats(args, summary)
+
+	if args.plan != nil {
+		if err := args.plan.save(args.Plan); err != nil {
+			fatalf("%s", err)
+		}
+		log.Printf("Wrote the plan to %s (%d entries)", args.Plan,
+			len(args.plan.Entries))
+	}
 
-			foundFiles = append(foundFiles, dirFiles...)
-			continue
+	if args.Porcelain {
+		if err := writePorcelainInUse(os.Stdout, summary); err != nil {
+			fatalf("%s", err)
+		}
+		if err := writePorcelainBrokenSymlinks(os.Stdout, summary); err != nil {
+			fatalf("%s", err)
 		}
+		if err := writePorcelainSpecialFiles(os.Stdout, summary); err != nil {
+			fatalf("%s", err)
+		}
+		if err := writePorcelainSummary(os.Stdout, summary); err != nil {
+			fatalf("%s", err)
+		}
+	}
 
-		foundFiles = append(foundFiles, &File{
-			Basename: fi.Name(),
-			Path:     filePath,
-			Size:     fi.Size(),
-		})
+	if args.Output != "" {
+		if err := saveReport(args.Output, args.Format,
+			newReport(summary)); err != nil {
+			fatalf("%s", err)
+		}
+	}
+
+	if args.analysis != nil {
+		if err := saveAnalysis(args.Analyze, args.Format,
+			args.analysis.finish()); err != nil {
+			fatalf("%s", err)
+		}
+	}
+
+	for _, err := range notify(config, summary) {
+		warnf("%s", err)
 	}
 
-	return foundFiles, nil
+	if err := runHook(config.Hooks.OnFinish, "on_finish", summary); err != nil {
+		fatalf("%s", err)
+	}
+
+	if err := finishRunSummary(nil); err != nil {
+		log.Fatalf("%s", err)
+	}
 }
 
-func calculateChecksums(files []*File) error {
-	fileCount := len(files)
+// defaultArgs returns the settings we use when neither the command line nor
+// the configuration file gives them.
+func defaultArgs() *Args {
+	return &Args{
+		Retries:     3,
+		RetryDelay:  100 * time.Millisecond,
+		Workers:     runtime.NumCPU(),
+		Walkers:     8,
+		Hash:        "md5",
+		BufferSize:  1 << 20,
+		IndexType:   indexBolt,
+		RuleMatch:   ruleMatchFirst,
+		Format:      reportText,
+		Color:       colorAuto,
+		BrokenLinks: brokenSymlinksIgnore,
+		LogMaxSize:  100 << 20,
+		LogKeep:     5,
+		explicit:    make(map[string]bool),
+	}
+}
+
+// addGlobalFlags adds the flags the subcommands that scan share. The flags
+// default to, and set, the fields of args.
+func addGlobalFlags(fs *flag.FlagSet, args *Args) {
+	fs.StringVar(&args.Dir, "dir", args.Dir, "Directory to examine.")
+	fs.StringVar(&args.Config, "conf", args.Config,
+		"Path to a configuration file.")
+	fs.IntVar(&args.Retries, "retries", args.Retries,
+		"Number of times to retry opening/reading a file after a transient error.")
+	fs.DurationVar(&args.RetryDelay, "retry-delay", args.RetryDelay,
+		"Delay before the first retry. It doubles with each subsequent retry.")
+	fs.IntVar(&args.Workers, "workers", args.Workers,
+		"Number of files to hash in parallel.")
+	fs.IntVar(&args.Walkers, "walkers", args.Walkers,
+		"Number of directories to list in parallel while looking for files.")
+	fs.IntVar(&args.MaxOpen, "max-open-files", args.MaxOpen,
+		"Maximum number of files to hold open at once. By default this is based on the file descriptor limit.")
+	fs.StringVar(&args.Hash, "hash", args.Hash,
+		fmt.Sprintf("Hash algorithm to use. One of: %s.",
+			strings.Join(hashAlgorithmNames(), ", ")))
+	fs.StringVar(&args.SecondHash, "second-hash", args.SecondHash,
+		"Also checksum files with this algorithm and treat files as duplicates only if both checksums match. This replaces comparing the files byte by byte.")
+	fs.Var((*stagesFlag)(&args.Stages), "stages",
+		fmt.Sprintf("Comma separated stages to go through to find identical files, in order: %s. %s and %s are required. By default we go through all of them.",
+			strings.Join(stageNames, ", "), stageSize, stageFullHash))
+	fs.BoolVar(&args.TrustHash, "trust-hash", args.TrustHash,
+		fmt.Sprintf("Treat files with the same checksum as duplicates without comparing them byte by byte. This needs a -hash of %s.",
+			strings.Join(trustedHashNames(), " or ")))
+	fs.BoolVar(&args.Mmap, "mmap", args.Mmap,
+		"Hash files by mapping them into memory rather than reading them. This is faster on some systems. A file being truncated while we hash it crashes the program.")
+	fs.IntVar(&args.BufferSize, "buffer-size", args.BufferSize,
+		"Size in bytes of each read when hashing and comparing files. Larger reads can be faster for large files on RAID arrays.")
+	fs.BoolVar(&args.IOUring, "io-uring", args.IOUring,
+		"Read small files in batches using io_uring. Linux only.")
+	fs.StringVar(&args.IndexDir, "index-dir", args.IndexDir,
+		"Keep the list of files in an index in this directory rather than in memory. This bounds memory use for very large trees. We delete the index when we finish.")
+	fs.StringVar(&args.IndexType, "index-type", args.IndexType,
+		fmt.Sprintf("Kind of index to use with -index-dir: %s (a database) or %s (an external merge sort, faster for hundreds of millions of files).",
+			indexBolt, indexSort))
+	fs.StringVar(&args.BloomFile, "bloom-file", args.BloomFile,
+		"Remember in this file which files had no duplicates, and skip checksumming them on later runs while they are unchanged. A false match in the file means missing a duplicate, about 1% of the time for such files.")
+	fs.StringVar(&args.StateFile, "state-file", args.StateFile,
+		"Keep the checksums we calculate in this file, and don't checksum files on later runs while they are unchanged.")
+	fs.DurationVar(&args.MaxDuration, "max-duration", args.MaxDuration,
+		"Stop checksumming after this long, such as 2h, and save what we checksummed to the -state-file for the next run to carry on from.")
+	fs.BoolVar(&args.Strict, "strict-identity", args.Strict,
+		"Only treat files as duplicates if they also have the same owner, group, and permissions.")
+	fs.BoolVar(&args.Xattrs, "compare-xattrs", args.Xattrs,
+		"Only treat files as duplicates if their extended attributes, such as ACLs and SELinux labels, also match. We report files with identical contents but different attributes separately. Linux only.")
+	fs.Var((*stringsFlag)(&args.Exclude), "exclude",
+		"Skip files and directories matching this pattern. Patterns without a / match the name, others the full path. You may give this more than once.")
+	fs.BoolVar(&args.LocalConfig, "local-config", args.LocalConfig,
+		fmt.Sprintf("Read rules and exclude patterns from %s files in the directories we scan. They apply to the directory's subtree.",
+			localConfigName))
+	fs.StringVar(&args.Output, "output", args.Output,
+		"Write a report of the duplicates to this file, or to stdout if it is -. Log messages and progress go to stderr regardless.")
+	fs.StringVar(&args.Analyze, "analyze", args.Analyze,
+		"Write histograms of file sizes and the number of copies of each duplicate, and how much of each directory at the top of the tree is duplicated, to this file in the -format format, or to stdout if it is -.")
+	fs.StringVar(&args.Format, "format", args.Format,
+		fmt.Sprintf("Format of the -output report. One of: %s.",
+			strings.Join(reportFormatNames(), ", ")))
+	fs.StringVar(&args.SummaryJSON, "summary-json", args.SummaryJSON,
+		"Write a summary of the run in JSON to this file when it finishes, including if it fails: counts, how long each phase took, and warnings.")
+	fs.BoolVar(&args.LargestFirst, "largest-first", args.LargestFirst,
+		"Checksum the largest files first, and report and resolve their duplicates as soon as we find them, before moving on to smaller files.")
+	fs.StringVar(&args.Sort, "sort", args.Sort,
+		fmt.Sprintf("Order to list, report and resolve groups of duplicates in. One of: %s. By default it is the order we find them in.",
+			groupOrderNames()))
+	fs.IntVar(&args.Top, "top", args.Top, topUsage)
+	fs.StringVar(&args.Color, "color", args.Color,
+		fmt.Sprintf("Whether to colour output: %s (if it is going to a terminal), %s, or %s.",
+			colorAuto, colorAlways, colorNever))
+	fs.BoolVar(&args.Porcelain, "porcelain", args.Porcelain,
+		"Write the duplicates to stdout in a stable format for scripts, described in the README. Log messages go to stderr.")
+	fs.StringVar(&args.BrokenLinks, "broken-symlinks", args.BrokenLinks,
+		fmt.Sprintf("What to do with symbolic links that point at nothing: %s them, %s them at the end of the run, or with resolve, %s them.",
+			brokenSymlinksIgnore, brokenSymlinksReport, brokenSymlinksDelete))
+	fs.BoolVar(&args.ListSpecial, "report-special-files", args.ListSpecial,
+		"List the named pipes, sockets, and device files we skip at the end of the run.")
+	fs.StringVar(&args.Events, "events", args.Events,
+		"Write a stream of JSON events describing the run, described in the README, to this file, to stdout if it is -, or to the socket unix:PATH or tcp:ADDRESS.")
+	fs.StringVar(&args.StatusListen, "status-listen", args.StatusListen,
+		statusListenUsage)
+	fs.DurationVar(&args.Progress, "progress-interval", args.Progress,
+		fmt.Sprintf("How often to update progress while checksumming. By default this is %s on a terminal and %s otherwise.",
+			terminalProgressInterval, plainProgressInterval))
+	addLogFlags(fs, args)
+}
+
+// addLogFlags adds the flags for logging to a file.
+func addLogFlags(fs *flag.FlagSet, args *Args) {
+	fs.StringVar(&args.LogFile, "log-file", args.LogFile,
+		"Write log messages to this file rather than to stderr.")
+	fs.Int64Var(&args.LogMaxSize, "log-max-size", args.LogMaxSize,
+		"Rotate the -log-file once it would grow past this many bytes. 0 means no limit.")
+	fs.DurationVar(&args.LogEvery, "log-rotate-every", args.LogEvery,
+		"Also rotate the -log-file when a new period of this length, such as 24h, starts.")
+	fs.IntVar(&args.LogKeep, "log-keep", args.LogKeep,
+		"Number of rotated log files to keep.")
+}
+
+// getArgs parses the flags of the scan, resolve, or serve subcommand.
+func getArgs(name string, argv []string) (*Args, error) {
+	args := defaultArgs()
+
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	addGlobalFlags(fs, args)
+
+	showVersion := fs.Bool("version", false,
+		"Print the version and build information and exit.")
+
+	// Only resolving deletes anything or needs to decide what to delete.
+	if name == "resolve" || name == "serve" {
+		fs.BoolVar(&args.Live, "live", args.Live, "Enable file deletion.")
+		fs.BoolVar(&args.Paranoid, "paranoid", args.Paranoid,
+			"Compare each file with the copy we keep again immediately before deleting it.")
+		fs.StringVar(&args.Backup, "backup", args.Backup,
+			"Copy each file to its absolute path under this directory before deleting or replacing it.")
+		fs.BoolVar(&args.Shred, "shred", args.Shred,
+			"Overwrite the contents of files we delete with random data first.")
+		fs.BoolVar(&args.SkipOpen, "skip-open", args.SkipOpen,
+			"Don't remove duplicates that other processes have open or locked. We list them at the end.")
+		fs.BoolVar(&args.RewriteLinks, "rewrite-symlinks", args.RewriteLinks,
+			"When deleting a duplicate, point the symbolic links in the tree that pointed at it at the copy we keep.")
+		fs.IntVar(&args.MaxFiles, "max-files", args.MaxFiles,
+			"Remove at most this many duplicates in this run. This doesn't limit how many files we checksum. 0 means no limit.")
+		fs.Int64Var(&args.MaxBytes, "max-bytes", args.MaxBytes,
+			"Remove at most this many bytes of duplicates in this run. This doesn't limit how much we checksum. 0 means no limit.")
+		fs.StringVar(&args.RuleMatch, "rule-match", args.RuleMatch,
+			fmt.Sprintf("How to choose between rules of equal priority that apply to the same files: %s (the first in the config) or %s (the one naming the deepest directories).",
+				ruleMatchFirst, ruleMatchSpecific))
+		fs.BoolVar(&args.Interactive, "interactive", args.Interactive,
+			"Ask what to do with duplicates that no rule covers. You can choose to add a rule to the configuration file for the pair of directories.")
+		fs.BoolVar(&args.DeletePrompt, "delete-prompt", args.DeletePrompt,
+			"Ask which copies in each group of duplicates to keep, and delete the rest, rather than applying rules. This needs no configuration file.")
+		fs.StringVar(&args.Answers, "answers", args.Answers,
+			"Apply the decisions in this file, saved with -save-answers, rather than asking or applying rules to the duplicates they cover.")
+		fs.StringVar(&args.SaveAnswers, "save-answers", args.SaveAnswers,
+			"Save the decisions you make with -interactive or -delete-prompt to this file. We add to the file if it exists.")
+		fs.StringVar(&args.Plan, "plan", args.Plan,
+			"Write what a live run would do to this file rather than doing it. The apply subcommand carries it out.")
+	}
+	if name == "serve" {
+		fs.DurationVar(&args.Every, "every", args.Every,
+			"How long to wait after each run before resolving again, such as 24h.")
+	}
+
+	_ = fs.Parse(argv)
+
+	if *showVersion {
+		fmt.Print(versionString())
+		os.Exit(0)
+	}
+
+	if len(args.Dir) == 0 {
+		fs.PrintDefaults()
+		return nil, fmt.Errorf("you must provide a directory")
+	}
 
-	for i, file := range files {
-		fh, err := os.Open(file.Path)
+	fs.Visit(func(f *flag.Flag) { args.explicit[f.Name] = true })
+
+	return args, nil
+}
+
+// limitReached says we reached the limit, the first time we do.
+func (args *Args) limitReached(flag, limit string) {
+	if args.limits[flag] {
+		return
+	}
+	if args.limits == nil {
+		args.limits = make(map[string]bool)
+	}
+	args.limits[flag] = true
+	log.Printf("Reached %s %s. Not removing duplicates that would go over it",
+		flag, limit)
+}
+
+// applySettings takes settings from the configuration file unless the command
+// line gave them. The order of precedence is: command line, configuration
+// file, default. For lists such as -exclude, the command line replaces the
+// configuration file's list rather than adding to it.
+func applySettings(args *Args, config *Config) {
+	if config.Live != nil && !args.explicit["live"] {
+		args.Live = *config.Live
+	}
+	if config.Paranoid != nil && !args.explicit["paranoid"] {
+		args.Paranoid = *config.Paranoid
+	}
+	if config.Backup != nil && !args.explicit["backup"] {
+		args.Backup = *config.Backup
+	}
+	if config.Shred != nil && !args.explicit["shred"] {
+		args.Shred = *config.Shred
+	}
+	if config.SkipOpen != nil && !args.explicit["skip-open"] {
+		args.SkipOpen = *config.SkipOpen
+	}
+	if config.RewriteLinks != nil && !args.explicit["rewrite-symlinks"] {
+		args.RewriteLinks = *config.RewriteLinks
+	}
+	if config.BrokenLinks != nil && !args.explicit["broken-symlinks"] {
+		args.BrokenLinks = *config.BrokenLinks
+	}
+	if config.ListSpecial != nil && !args.explicit["report-special-files"] {
+		args.ListSpecial = *config.ListSpecial
+	}
+	if config.Progress != nil && !args.explicit["progress-interval"] {
+		args.Progress = config.Progress.Duration
+	}
+	if config.StatusListen != nil && !args.explicit["status-listen"] {
+		args.StatusListen = *config.StatusListen
+	}
+	if config.LogFile != nil && !args.explicit["log-file"] {
+		args.LogFile = *config.LogFile
+	}
+	if config.LogMaxSize != nil && !args.explicit["log-max-size"] {
+		args.LogMaxSize = *config.LogMaxSize
+	}
+	if config.LogEvery != nil && !args.explicit["log-rotate-every"] {
+		args.LogEvery = config.LogEvery.Duration
+	}
+	if config.LogKeep != nil && !args.explicit["log-keep"] {
+		args.LogKeep = *config.LogKeep
+	}
+	if config.MaxFiles != nil && !args.explicit["max-files"] {
+		args.MaxFiles = *config.MaxFiles
+	}
+	if config.MaxBytes != nil && !args.explicit["max-bytes"] {
+		args.MaxBytes = *config.MaxBytes
+	}
+	if config.Retries != nil && !args.explicit["retries"] {
+		args.Retries = *config.Retries
+	}
+	if config.RetryDelay != nil && !args.explicit["retry-delay"] {
+		args.RetryDelay = config.RetryDelay.Duration
+	}
+	if config.Workers != nil && !args.explicit["workers"] {
+		args.Workers = *config.Workers
+	}
+	if config.Walkers != nil && !args.explicit["walkers"] {
+		args.Walkers = *config.Walkers
+	}
+	if config.MaxOpenFiles != nil && !args.explicit["max-open-files"] {
+		args.MaxOpen = *config.MaxOpenFiles
+	}
+	if config.Hash != nil && !args.explicit["hash"] {
+		args.Hash = *config.Hash
+	}
+	if config.SecondHash != nil && !args.explicit["second-hash"] {
+		args.SecondHash = *config.SecondHash
+	}
+	if config.TrustHash != nil && !args.explicit["trust-hash"] {
+		args.TrustHash = *config.TrustHash
+	}
+	if config.Stages != nil && !args.explicit["stages"] {
+		args.Stages = config.Stages
+	}
+	if config.Mmap != nil && !args.explicit["mmap"] {
+		args.Mmap = *config.Mmap
+	}
+	if config.BufferSize != nil && !args.explicit["buffer-size"] {
+		args.BufferSize = *config.BufferSize
+	}
+	if config.IOUring != nil && !args.explicit["io-uring"] {
+		args.IOUring = *config.IOUring
+	}
+	if config.IndexDir != nil && !args.explicit["index-dir"] {
+		args.IndexDir = *config.IndexDir
+	}
+	if config.IndexType != nil && !args.explicit["index-type"] {
+		args.IndexType = *config.IndexType
+	}
+	if config.StateFile != nil && !args.explicit["state-file"] {
+		args.StateFile = *config.StateFile
+	}
+	if config.MaxDuration != nil && !args.explicit["max-duration"] {
+		args.MaxDuration = config.MaxDuration.Duration
+	}
+	if config.StrictIdentity != nil && !args.explicit["strict-identity"] {
+		args.Strict = *config.StrictIdentity
+	}
+	if config.CompareXattrs != nil && !args.explicit["compare-xattrs"] {
+		args.Xattrs = *config.CompareXattrs
+	}
+	if config.BloomFile != nil && !args.explicit["bloom-file"] {
+		args.BloomFile = *config.BloomFile
+	}
+	if config.LocalConfig != nil && !args.explicit["local-config"] {
+		args.LocalConfig = *config.LocalConfig
+	}
+	if config.RuleMatch != nil && !args.explicit["rule-match"] {
+		args.RuleMatch = *config.RuleMatch
+	}
+	if config.Output != nil && !args.explicit["output"] {
+		args.Output = *config.Output
+	}
+	if config.Analyze != nil && !args.explicit["analyze"] {
+		args.Analyze = *config.Analyze
+	}
+	if config.SummaryJSON != nil && !args.explicit["summary-json"] {
+		args.SummaryJSON = *config.SummaryJSON
+	}
+	if config.Format != nil && !args.explicit["format"] {
+		args.Format = *config.Format
+	}
+	if config.LargestFirst != nil && !args.explicit["largest-first"] {
+		args.LargestFirst = *config.LargestFirst
+	}
+	if config.Sort != nil && !args.explicit["sort"] {
+		args.Sort = *config.Sort
+	}
+	if config.Top != nil && !args.explicit["top"] {
+		args.Top = *config.Top
+	}
+	if config.Color != nil && !args.explicit["color"] {
+		args.Color = *config.Color
+	}
+	if config.Exclude != nil && !args.explicit["exclude"] {
+		args.Exclude = config.Exclude
+	}
+}
+
+// checkArgs validates the settings once we've combined the command line and
+// the configuration file.
+func checkArgs(args *Args) error {
+	if args.Retries < 0 {
+		return fmt.Errorf("retries must not be negative")
+	}
+
+	if args.Workers < 1 {
+		return fmt.Errorf("workers must be at least 1")
+	}
+
+	if args.Walkers < 1 {
+		return fmt.Errorf("walkers must be at least 1")
+	}
+
+	if args.BufferSize < 1 {
+		return fmt.Errorf("buffer size must be at least 1")
+	}
+
+	if args.LargestFirst && args.IndexDir != "" {
+		return fmt.Errorf("you can't use both -largest-first and -index-dir")
+	}
+
+	if args.Top < 0 {
+		return fmt.Errorf("-top must not be negative")
+	}
+	if args.Top > 0 && args.LargestFirst {
+		return fmt.Errorf("you can't use both -top and -largest-first, as we need every group to choose the top ones")
+	}
+
+	if args.MaxFiles < 0 || args.MaxBytes < 0 {
+		return fmt.Errorf("-max-files and -max-bytes must not be negative")
+	}
+
+	if args.MaxDuration < 0 {
+		return fmt.Errorf("max duration must not be negative")
+	}
+
+	if args.Progress < 0 {
+		return fmt.Errorf("progress interval must not be negative")
+	}
+
+	if args.LogMaxSize < 0 || args.LogEvery < 0 || args.LogKeep < 0 {
+		return fmt.Errorf("-log-max-size, -log-rotate-every, and -log-keep must not be negative")
+	}
+
+	if args.MaxDuration > 0 && args.StateFile == "" {
+		return fmt.Errorf("-max-duration needs a -state-file to save what we checksummed to")
+	}
+
+	// Backing a file up would keep a copy of what we overwrite.
+	if args.Shred && args.Backup != "" {
+		return fmt.Errorf("-shred and -backup can't be used together")
+	}
+
+	// We would find the backups the next time we looked for duplicates.
+	if args.Backup != "" && args.Dir != "" {
+		backup, err := filepath.Abs(args.Backup)
 		if err != nil {
-			return fmt.Errorf("open: %s: %s", file.Path, err)
+			return fmt.Errorf("unable to find the absolute path of %s: %s",
+				args.Backup, err)
 		}
+		dir, err := filepath.Abs(args.Dir)
+		if err != nil {
+			return fmt.Errorf("unable to find the absolute path of %s: %s",
+				args.Dir, err)
+		}
+		if isWithin(backup, dir) {
+			return fmt.Errorf("the backup directory must not be in %s", args.Dir)
+		}
+	}
+
+	if args.IndexType != indexBolt && args.IndexType != indexSort {
+		return fmt.Errorf("unknown index type: %s", args.IndexType)
+	}
 
-		reader := bufio.NewReader(fh)
+	if args.Interactive && args.DeletePrompt {
+		return fmt.Errorf("you can't use both -interactive and -delete-prompt")
+	}
 
-		hasher := md5.New()
+	if args.Plan != "" && args.Live {
+		return fmt.Errorf("-plan only plans, so it can't be used with -live")
+	}
 
-		n, err := reader.WriteTo(hasher)
-		if err != nil {
-			_ = fh.Close()
-			return fmt.Errorf("writing to hash failed: %s: %s", file.Path, err)
+	if args.SaveAnswers != "" && !args.Interactive && !args.DeletePrompt {
+		return fmt.Errorf("-save-answers needs -interactive or -delete-prompt")
+	}
+
+	if args.Xattrs && !xattrsSupported {
+		return fmt.Errorf("comparing extended attributes is only supported on Linux")
+	}
+
+	if args.SkipOpen && !openFilesSupported {
+		return fmt.Errorf("-skip-open is only supported on Linux and Windows")
+	}
+
+	if args.IOUring && !uringSupported {
+		return fmt.Errorf("io_uring is only supported on Linux on amd64 and arm64")
+	}
+
+	if _, ok := hashAlgorithms[args.Hash]; !ok {
+		return fmt.Errorf("unknown hash algorithm: %s", args.Hash)
+	}
+
+	if args.SecondHash != "" {
+		if _, ok := hashAlgorithms[args.SecondHash]; !ok {
+			return fmt.Errorf("unknown hash algorithm: %s", args.SecondHash)
 		}
+		if args.SecondHash == args.Hash {
+			return fmt.Errorf("the second hash algorithm must differ from the first")
+		}
+	}
 
-		if n != file.Size {
-			_ = fh.Close()
-			return fmt.Errorf("short read/write: %s", file.Path)
+	if args.TrustHash && !trustedHashes[args.Hash] {
+		return fmt.Errorf("-trust-hash needs a -hash of %s, not %s",
+			strings.Join(trustedHashNames(), " or "), args.Hash)
+	}
+
+	if err := checkStages(args.Stages); err != nil {
+		return err
+	}
+	if len(args.Stages) > 0 {
+		if args.TrustHash && hasStage(args.Stages, stageByteCompare) {
+			return fmt.Errorf("-trust-hash skips the %s stage, but -stages has it",
+				stageByteCompare)
 		}
+		if !hasStage(args.Stages, stageByteCompare) && args.SecondHash == "" &&
+			!trustedHashes[args.Hash] {
+			return fmt.Errorf("stages without %s need a -hash of %s or a -second-hash, not %s",
+				stageByteCompare, strings.Join(trustedHashNames(), " or "), args.Hash)
+		}
+	}
 
-		file.Hash = hasher.Sum(nil)
+	if args.RuleMatch != ruleMatchFirst && args.RuleMatch != ruleMatchSpecific {
+		return fmt.Errorf("unknown rule match mode: %s", args.RuleMatch)
+	}
 
-		if err := fh.Close(); err != nil {
-			return fmt.Errorf("close: %s: %s", file.Path, err)
+	switch args.BrokenLinks {
+	case brokenSymlinksIgnore, brokenSymlinksReport:
+	case brokenSymlinksDelete:
+		if args.scanOnly {
+			return fmt.Errorf("scan doesn't delete broken symbolic links. Use resolve")
 		}
+	default:
+		return fmt.Errorf("unknown -broken-symlinks setting: %s", args.BrokenLinks)
+	}
+
+	if args.Format != reportText && args.Format != reportCSV &&
+		args.Format != reportJSON {
+		return fmt.Errorf("unknown report format: %s", args.Format)
+	}
+
+	if _, ok := groupOrders[args.Sort]; args.Sort != "" && !ok {
+		return fmt.Errorf("unknown sort order: %s", args.Sort)
+	}
+
+	if args.Color != colorAuto && args.Color != colorAlways &&
+		args.Color != colorNever {
+		return fmt.Errorf("unknown colour mode: %s", args.Color)
+	}
 
-		fmt.Fprintf(os.Stderr, "\r%d/%d", i+1, fileCount)
+	if args.Porcelain && args.Output == "-" {
+		return fmt.Errorf("-porcelain and -output - both write to stdout")
+	}
+	if args.Events == "-" && (args.Porcelain || args.Output == "-") {
+		return fmt.Errorf("-events - and -porcelain or -output - both write to stdout")
+	}
+	if args.Analyze == "-" && (args.Porcelain || args.Output == "-" ||
+		args.Events == "-") {
+		return fmt.Errorf("-analyze - and -porcelain, -output -, or -events - all write to stdout")
 	}
 
-	// Complete the status/count line.
-	fmt.Printf("\n")
+	for _, pattern := range args.Exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid exclude pattern: %s: %s", pattern, err)
+		}
+	}
 
 	return nil
 }
 
-func reportAndResolveDuplicates(rules []Rule, files []*File, live bool) error {
-	checksumToFile := make(map[[md5.Size]byte]*File)
+// stringsFlag is a flag that may be given more than once.
+type stringsFlag []string
 
-	for _, file := range files {
-		// Make a []byte array with a defined size for a key lookup.
-		var checksum [md5.Size]byte
-		for i, b := range file.Hash {
-			checksum[i] = b
-		}
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ", ")
+}
 
-		// Is this a possible duplicate? We can tell by whether we've seen a file
-		// with the same checksum yet.
-		foundFile, ok := checksumToFile[checksum]
-		if !ok {
-			checksumToFile[checksum] = file
-			continue
-		}
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
 
-		// Hash collision. Deep compare to determine whether the files are really
-		// the same.
-		identical, err := isIdentical(foundFile, file)
-		if err != nil {
-			return fmt.Errorf("unable to compare files: %s %s: %s", foundFile.Path,
-				file.Path, err)
+// isExcluded checks whether a path matches one of the exclude patterns. A
+// pattern without a / matches the name. Others match the full path.
+func isExcluded(patterns []string, filePath string) bool {
+	for _, pattern := range patterns {
+		name := filePath
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(filePath)
 		}
-		if !identical {
-			return fmt.Errorf(
-				"hash collision but the files are not identical! %s and %s",
-				file.Path, foundFile.Path)
+
+		// We validated the patterns in checkArgs.
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
 		}
+	}
+	return false
+}
 
-		fmt.Printf("Duplicate files found: %s and %s\n", file.Path, foundFile.Path)
-		foundRule, err := resolveDuplicate(rules, foundFile, file, live)
-		if err != nil {
-			return err
+// calculateChecksums hashes the files with the function using args.Workers
+// goroutines. It stops at the first error. Files that vanished since we found
+// them aren't errors. We mark them instead.
+func calculateChecksums(
+	args *Args,
+	files []*File,
+	hash func(*Args, *File) error,
+) error {
+	return calculateChecksumsInBatches(args, files, 1,
+		func(args *Args, batch []*File) error {
+			return skipVanished(batch[0],
+				retry(args, func() error { return hash(args, batch[0]) }))
+		})
+}
+
+// calculateChecksumsInBatches is like calculateChecksums but hands each
+// goroutine up to batchSize files at once.
+func calculateChecksumsInBatches(
+	args *Args,
+	files []*File,
+	batchSize int,
+	hashBatch func(*Args, []*File) error,
+) error {
+	progress := startProgress(files, args.Progress)
+	setHashProgress(progress)
+	defer setHashProgress(nil)
+
+	jobs := make(chan []*File)
+	quit := make(chan struct{})
+	var quitOnce sync.Once
+	var wg sync.WaitGroup
+
+	var mu sync.Mutex
+	var firstErr error
+
+	for i := 0; i < args.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for batch := range jobs {
+				if err := hashBatch(args, batch); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					quitOnce.Do(func() { close(quit) })
+					return
+				}
+
+				progress.add(len(batch))
+				emitFileHashed(batch)
+			}
+		}()
+	}
+
+Feed:
+	for len(files) > 0 {
+		if outOfTime(args) {
+			mu.Lock()
+			if firstErr == nil {
+				firstErr = errOutOfTime
+			}
+			mu.Unlock()
+			break
 		}
 
-		if !foundRule {
-			log.Printf("No rule found for duplicate files: %s and %s", file.Path,
-				foundFile.Path)
+		n := batchSize
+		if n > len(files) {
+			n = len(files)
+		}
+		select {
+		case jobs <- files[:n]:
+			files = files[n:]
+		case <-quit:
+			break Feed
 		}
 	}
+	close(jobs)
 
-	return nil
+	wg.Wait()
+
+	progress.finish()
+
+	return firstErr
 }
 
-func isIdentical(file1, file2 *File) (bool, error) {
-	contents1, err := readFile(file1)
+func hashFile(args *Args, file *File) error {
+	fh, err := fds.open(file.Path)
 	if err != nil {
-		return false, err
+		return fmt.Errorf("open: %s: %w", file.Path, err)
+	}
+
+	hasher := hashAlgorithms[args.Hash]()
+
+	// Feed both hashes from the one read of the file.
+	var w io.Writer = hasher
+	var secondHasher hash.Hash
+	if args.SecondHash != "" {
+		secondHasher = hashAlgorithms[args.SecondHash]()
+		w = io.MultiWriter(hasher, secondHasher)
+	}
+	if progress := hashProgress(); progress != nil {
+		w = io.MultiWriter(w, progress)
 	}
 
-	contents2, err := readFile(file2)
+	n, err := readInto(args, fh, file.Size, w)
 	if err != nil {
-		return false, err
+		_ = fds.close(fh)
+		return fmt.Errorf("writing to hash failed: %s: %w", file.Path, err)
 	}
 
-	if len(contents1) != len(contents2) {
-		return false, nil
+	if n != file.Size {
+		_ = fds.close(fh)
+		return fmt.Errorf("short read/write: %s", file.Path)
 	}
 
-	for i := range contents1 {
-		if contents1[i] != contents2[i] {
-			return false, nil
-		}
+	file.Hash = hasher.Sum(nil)
+	if secondHasher != nil {
+		file.SecondHash = secondHasher.Sum(nil)
 	}
 
-	return true, nil
+	if err := fds.close(fh); err != nil {
+		return fmt.Errorf("close: %s: %w", file.Path, err)
+	}
+
+	return nil
 }
 
-func readFile(file *File) ([]byte, error) {
-	fh, err := os.Open(file.Path)
-	if err != nil {
-		return nil, fmt.Errorf("open: %s: %s", file, err)
+// setHashes checksums the file from its contents, already in memory.
+func setHashes(args *Args, file *File, contents []byte) {
+	hasher := hashAlgorithms[args.Hash]()
+	_, _ = hasher.Write(contents)
+	file.Hash = hasher.Sum(nil)
+
+	if args.SecondHash != "" {
+		secondHasher := hashAlgorithms[args.SecondHash]()
+		_, _ = secondHasher.Write(contents)
+		file.SecondHash = secondHasher.Sum(nil)
 	}
+}
 
-	contents, err := ioutil.ReadAll(fh)
-	if err != nil {
-		_ = fh.Close()
-		return nil, fmt.Errorf("failed ReadAll: %s: %s", file.Path, err)
+// readInto writes the contents of the file to w. With -mmap, we map the file
+// into memory if we can rather than reading it. Otherwise we read large files
+// ahead of writing them. See readAhead.
+//
+// Mapping is faster on some systems, especially when the file is already in
+// the page cache. However if another program truncates the file while it is
+// mapped, reading the missing part kills us with SIGBUS. That is why it is not
+// the default.
+func readInto(args *Args, fh *os.File, size int64, w io.Writer) (int64,
+	error) {
+	if args.Mmap {
+		if data, ok := mapFile(fh, size); ok {
+			n, err := w.Write(data)
+			if unmapErr := unmapFile(data); err == nil {
+				err = unmapErr
+			}
+			return int64(n), err
+		}
 	}
 
-	if err := fh.Close(); err != nil {
-		return nil, fmt.Errorf("close: %s: %s", file.Path, err)
+	if size > int64(args.BufferSize) {
+		return readAhead(fh, w, args.BufferSize)
 	}
 
-	if int64(len(contents)) != file.Size {
-		return nil, fmt.Errorf("short read: %s", file.Path)
+	return bufio.NewReaderSize(fh, args.BufferSize).WriteTo(w)
+}
+
+// retry runs fn until it succeeds, fails with an error that retrying will not
+// fix, or we run out of retries. We wait between attempts, doubling the wait
+// each time.
+func retry(args *Args, fn func() error) error {
+	delay := args.RetryDelay
+
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		if attempt == args.Retries || !isTransient(err) {
+			return err
+		}
+
+		log.Printf("Retrying in %s: %s", delay, err)
+		time.Sleep(delay)
+		delay *= 2
 	}
+}
 
-	return contents, nil
+// transientErrnos are the errors from the system that might go away if we try
+// again: interrupted or timed out calls, a busy or flaky disk or network
+// filesystem, and running out of file descriptors for the moment.
+var transientErrnos = []syscall.Errno{
+	syscall.EINTR,
+	syscall.EAGAIN,
+	syscall.EIO,
+	syscall.ETIMEDOUT,
+	syscall.ESTALE,
+	syscall.EBUSY,
+	syscall.ENFILE,
+	syscall.EMFILE,
+	syscall.ECONNRESET,
+	syscall.ECONNABORTED,
+	syscall.EHOSTDOWN,
+	syscall.EHOSTUNREACH,
+	syscall.ENETDOWN,
+	syscall.ENETUNREACH,
 }
 
-// Return whether there was a rule. If there was a rule (true), then return
-// whether there was an error. Not having a rule is not an error (because we may
-// want to just report).
-func resolveDuplicate(
-	rules []Rule,
-	file1,
-	file2 *File,
-	live bool,
-) (bool, error) {
-	dir1, _ := path.Split(file1.Path)
-	dir2, _ := path.Split(file2.Path)
-
-	for _, rule := range rules {
-		if dir1 == rule.KeepDir && dir2 == rule.RemoveDir {
-			if live {
-				log.Printf("Deleting %s", file2.Path)
-				if err := os.Remove(file2.Path); err != nil {
-					return true, fmt.Errorf("unable to remove: %s: %s", file2.Path, err)
-				}
-			} else {
-				log.Printf("Non-live mode. Would delete %s", file2.Path)
-			}
-			return true, nil
+// isTransient decides whether an I/O error might go away if we try again. We
+// only retry errors we know may be transient, as retrying others, such as a
+// file being gone or a directory where we expected a file, only wastes time.
+func isTransient(err error) bool {
+	for _, errno := range transientErrnos {
+		if errors.Is(err, errno) {
+			return true
 		}
+	}
+	var timeout interface{ Timeout() bool }
+	return errors.As(err, &timeout) && timeout.Timeout()
+}
 
-		if dir1 == rule.RemoveDir && dir2 == rule.KeepDir {
-			if live {
-				log.Printf("Deleting %s", file1.Path)
-				if err := os.Remove(file1.Path); err != nil {
-					return true, fmt.Errorf("unable to remove: %s: %s", file1.Path, err)
-				}
-			} else {
-				log.Printf("Non-live mode. Would delete %s", file2.Path)
-			}
+func isIdentical(args *Args, file1, file2 *File) (bool, error) {
+	var identical bool
+	if err := retry(args, func() error {
+		var err error
+		identical, err = compareFiles(args, file1, file2)
+		return err
+	}); err != nil {
+		return false, err
+	}
+	return identical, nil
+}
+
+// compareFiles reads the two files a block at a time and compares the blocks.
+// It stops at the first difference, so we rarely read all of files that
+// differ.
+func compareFiles(args *Args, file1, file2 *File) (bool, error) {
+	if file1.Size != file2.Size {
+		return false, nil
+	}
+
+	if sameFile(file1, file2) {
+		return true, nil
+	}
+
+	fh1, err := fds.open(file1.Path)
+	if err != nil {
+		return false, fmt.Errorf("open: %s: %w", file1.Path, err)
+	}
+	defer func() { _ = fds.close(fh1) }()
+
+	fh2, err := fds.open(file2.Path)
+	if err != nil {
+		return false, fmt.Errorf("open: %s: %w", file2.Path, err)
+	}
+	defer func() { _ = fds.close(fh2) }()
+
+	buf1 := make([]byte, args.BufferSize)
+	buf2 := make([]byte, args.BufferSize)
+	var read int64
 
-			return true, nil
+	for {
+		n1, err1 := io.ReadFull(fh1, buf1)
+		if err1 != nil && err1 != io.EOF && err1 != io.ErrUnexpectedEOF {
+			return false, fmt.Errorf("read: %s: %w", file1.Path, err1)
+		}
+
+		n2, err2 := io.ReadFull(fh2, buf2)
+		if err2 != nil && err2 != io.EOF && err2 != io.ErrUnexpectedEOF {
+			return false, fmt.Errorf("read: %s: %w", file2.Path, err2)
+		}
+
+		if !bytes.Equal(buf1[:n1], buf2[:n2]) {
+			return false, nil
+		}
+		read += int64(n1)
+
+		if err1 != nil || err2 != nil {
+			break
 		}
 	}
 
-	return false, nil
+	if read != file1.Size {
+		return false, fmt.Errorf("short read: %s", file1.Path)
+	}
+
+	return true, nil
 }
 
 func (f *File) String() string {
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+// Email says how to mail the run's report.
+type Email struct {
+	// Server is the SMTP server's host and port.
+	Server string `json:"server" yaml:"server" toml:"server"`
+
+	// Username and Password authenticate us to the server, if it needs it. We
+	// only send them over TLS or to a server on this machine.
+	Username string `json:"username" yaml:"username" toml:"username"`
+	Password string `json:"password" yaml:"password" toml:"password"`
+
+	From string   `json:"from" yaml:"from" toml:"from"`
+	To   []string `json:"to" yaml:"to" toml:"to"`
+
+	// Attach lists report formats to attach, such as csv or json.
+	Attach []string `json:"attach" yaml:"attach" toml:"attach"`
+}
+
+// sendEmail mails a summary of the run along with any attachments.
+func sendEmail(email *Email, report *Report) error {
+	message, err := emailMessage(email, report)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if email.Username != "" {
+		host, _, err := net.SplitHostPort(email.Server)
+		if err != nil {
+			return fmt.Errorf("invalid email server: %s: %s", email.Server, err)
+		}
+		auth = smtp.PlainAuth("", email.Username, email.Password, host)
+	}
+
+	// SendMail uses STARTTLS if the server supports it.
+	if err := smtp.SendMail(email.Server, auth, email.From, email.To,
+		message); err != nil {
+		return fmt.Errorf("unable to send email: %s", err)
+	}
+
+	return nil
+}
+
+// emailMessage builds the MIME message. The body summarises the run as a
+// Slack notification would, leaving the details to the attachments.
+func emailMessage(email *Email, report *Report) ([]byte, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	hostname, _ := os.Hostname()
+
+	headers := []string{
+		"From: " + email.From,
+		"To: " + strings.Join(email.To, ", "),
+		"Subject: dupefile report for " + hostname,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/mixed; boundary=" + mw.Boundary(),
+	}
+	header := strings.Join(headers, "\r\n") + "\r\n\r\n"
+
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to build email: %s", err)
+	}
+	qp := quotedprintable.NewWriter(part)
+	if _, err := qp.Write([]byte(summaryText(report.Summary, nil) +
+		"\n")); err != nil {
+		return nil, fmt.Errorf("unable to build email: %s", err)
+	}
+	if err := qp.Close(); err != nil {
+		return nil, fmt.Errorf("unable to build email: %s", err)
+	}
+
+	for _, format := range email.Attach {
+		var attachment bytes.Buffer
+		if err := writeReport(&attachment, format, report); err != nil {
+			return nil, err
+		}
+
+		contentType := "text/csv"
+		if format == reportJSON {
+			contentType = "application/json"
+		}
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {contentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition": {
+				fmt.Sprintf("attachment; filename=\"dupefile-report.%s\"", format),
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to build email: %s", err)
+		}
+		if err := writeBase64Lines(part, attachment.Bytes()); err != nil {
+			return nil, fmt.Errorf("unable to build email: %s", err)
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, fmt.Errorf("unable to build email: %s", err)
+	}
+
+	return append([]byte(header), buf.Bytes()...), nil
+}
+
+// writeBase64Lines encodes the data as base64 in lines of 76 characters, the
+// longest MIME allows.
+func writeBase64Lines(w io.Writer, data []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 0 {
+		n := 76
+		if len(encoded) < n {
+			n = len(encoded)
+		}
+		if _, err := w.Write([]byte(encoded[:n] + "\r\n")); err != nil {
+			return err
+		}
+		encoded = encoded[n:]
+	}
+	return nil
+}
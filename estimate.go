@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// estimate implements the estimate subcommand. It finds the duplicates in the
+// tree and says how much space removing them would free with each action,
+// without applying any rules, so it needs no configuration.
+func estimate(argv []string) error {
+	args := defaultArgs()
+	args.scanOnly = true
+
+	fs := flag.NewFlagSet("estimate", flag.ExitOnError)
+	fs.StringVar(&args.Dir, "dir", "", "Directory to search.")
+	fs.StringVar(&args.Hash, "hash", args.Hash,
+		fmt.Sprintf("Hash algorithm to use. One of: %s.",
+			strings.Join(hashAlgorithmNames(), ", ")))
+	fs.StringVar(&args.Output, "output", "-",
+		"File to write the estimate to, or - for stdout.")
+	fs.StringVar(&args.Format, "format", args.Format,
+		fmt.Sprintf("Format of the estimate. One of: %s.",
+			strings.Join(reportFormatNames(), ", ")))
+	fs.IntVar(&args.Workers, "workers", args.Workers,
+		"Number of files to checksum at once.")
+	fs.IntVar(&args.MaxOpen, "max-open-files", args.MaxOpen,
+		"Maximum number of files to have open at once.")
+	fs.IntVar(&args.Retries, "retries", args.Retries,
+		"Number of times to retry opening/reading a file after a transient error.")
+	fs.DurationVar(&args.RetryDelay, "retry-delay", args.RetryDelay,
+		"Delay before the first retry. It doubles with each subsequent retry.")
+	fs.IntVar(&args.BufferSize, "buffer-size", args.BufferSize,
+		"Size in bytes of each read when checksumming files.")
+	fs.BoolVar(&args.Mmap, "mmap", args.Mmap,
+		"Checksum files by mapping them into memory rather than reading them.")
+	fs.Var((*stringsFlag)(&args.Exclude), "exclude",
+		"Skip files and directories matching this pattern. You may give this more than once.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s estimate -dir DIR\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	_ = fs.Parse(argv)
+
+	if args.Dir == "" {
+		fs.Usage()
+		return fmt.Errorf("you must provide a directory")
+	}
+
+	if err := checkArgs(args); err != nil {
+		return err
+	}
+
+	if args.MaxOpen > 0 {
+		fds = newFDBudget(args.MaxOpen)
+	}
+
+	log.Print("Looking for files...")
+	var files []*File
+	if _, err := findFiles(args, args.Dir, args.Exclude, func(file *File) error {
+		files = append(files, file)
+		return nil
+	}); err != nil {
+		return fmt.Errorf("unable to find files: %s", err)
+	}
+
+	groups, err := findDuplicatesInTiers(args, files)
+	if err != nil {
+		return fmt.Errorf("unable to find duplicates: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeEstimate(&buf, args.Format,
+		newEstimate(files, groups)); err != nil {
+		return err
+	}
+
+	if args.Output == "-" {
+		if _, err := os.Stdout.Write(buf.Bytes()); err != nil {
+			return fmt.Errorf("unable to write estimate: %s", err)
+		}
+		return nil
+	}
+
+	if err := writeFileAtomically(args.Output, buf.Bytes()); err != nil {
+		return fmt.Errorf("unable to write estimate: %s", err)
+	}
+	return nil
+}
+
+// Estimate says how much space removing the duplicates in a tree would free.
+type Estimate struct {
+	Files           int `json:"files"`
+	DuplicateGroups int `json:"duplicate_groups"`
+	DuplicateFiles  int `json:"duplicate_files"`
+
+	// LogicalBytes is the total size of the files, counting each path.
+	// UniqueBytes counts each distinct content once. Ratio is the one over
+	// the other.
+	LogicalBytes int64   `json:"logical_bytes"`
+	UniqueBytes  int64   `json:"unique_bytes"`
+	Ratio        float64 `json:"ratio"`
+
+	// Savings is how much space each action would free.
+	Savings EstimateSavings `json:"savings"`
+}
+
+// EstimateSavings is how much space removing all but one copy of each
+// duplicate would free with each action. Copies that are already hard links
+// to each other free nothing.
+//
+// Deleting frees every other copy. Hard links and reflinks only work within
+// a filesystem, so they free all but one copy on each filesystem. Reflinks
+// need a filesystem that supports them, such as Btrfs, XFS, or APFS, which we
+// don't check. On platforms where we can't make reflinks, Reflink is 0.
+type EstimateSavings struct {
+	Delete   int64 `json:"delete"`
+	Hardlink int64 `json:"hardlink"`
+	Reflink  int64 `json:"reflink"`
+}
+
+// newEstimate works out the estimate for the files and the groups of
+// duplicates among them.
+func newEstimate(files []*File, groups [][]*File) *Estimate {
+	est := &Estimate{
+		Files:           len(files),
+		DuplicateGroups: len(groups),
+	}
+	for _, file := range files {
+		est.LogicalBytes += file.Size
+	}
+	est.UniqueBytes = est.LogicalBytes
+
+	for _, group := range groups {
+		size := group[0].Size
+		est.DuplicateFiles += len(group) - 1
+		est.UniqueBytes -= int64(len(group)-1) * size
+
+		// We count each file on disk once, however many paths it has, and
+		// note which filesystem it is on. We can't tell which filesystem a
+		// file without an ID is on, so we don't count linking it.
+		seen := make(map[linkKey]bool)
+		devices := make(map[uint64]int)
+		distinct := 0
+		for _, file := range group {
+			if !file.hasID {
+				distinct++
+				continue
+			}
+			key := linkKey{file.dev, file.ino}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			distinct++
+			devices[file.dev]++
+		}
+
+		est.Savings.Delete += int64(distinct-1) * size
+		var linked int64
+		for _, count := range devices {
+			linked += int64(count-1) * size
+		}
+		est.Savings.Hardlink += linked
+		if reflinkSupported {
+			est.Savings.Reflink += linked
+		}
+	}
+
+	if est.UniqueBytes > 0 {
+		est.Ratio = float64(est.LogicalBytes) / float64(est.UniqueBytes)
+	}
+	return est
+}
+
+// writeEstimate writes the estimate in the format, which is one of the
+// -format formats.
+func writeEstimate(w io.Writer, format string, est *Estimate) error {
+	switch format {
+	case reportText:
+		return writeEstimateText(w, est)
+	case reportCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.WriteAll([][]string{
+			{"files", "duplicate_groups", "duplicate_files", "logical_bytes",
+				"unique_bytes", "ratio", "delete", "hardlink", "reflink"},
+			{
+				strconv.Itoa(est.Files),
+				strconv.Itoa(est.DuplicateGroups),
+				strconv.Itoa(est.DuplicateFiles),
+				strconv.FormatInt(est.LogicalBytes, 10),
+				strconv.FormatInt(est.UniqueBytes, 10),
+				strconv.FormatFloat(est.Ratio, 'f', 2, 64),
+				strconv.FormatInt(est.Savings.Delete, 10),
+				strconv.FormatInt(est.Savings.Hardlink, 10),
+				strconv.FormatInt(est.Savings.Reflink, 10),
+			},
+		}); err != nil {
+			return fmt.Errorf("unable to write estimate: %s", err)
+		}
+		return nil
+	case reportJSON:
+		buf, err := json.MarshalIndent(est, "", "  ")
+		if err != nil {
+			return fmt.Errorf("unable to encode estimate: %s", err)
+		}
+		if _, err := w.Write(append(buf, '\n')); err != nil {
+			return fmt.Errorf("unable to write estimate: %s", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown report format: %s", format)
+	}
+}
+
+// writeEstimateText writes the estimate for people to read.
+func writeEstimateText(w io.Writer, est *Estimate) error {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Files: %d, of which %d are duplicates in %d groups\n",
+		est.Files, est.DuplicateFiles, est.DuplicateGroups)
+	fmt.Fprintf(&b, "Logical size: %d bytes\n", est.LogicalBytes)
+	fmt.Fprintf(&b, "Unique content: %d bytes (a ratio of %.2f)\n",
+		est.UniqueBytes, est.Ratio)
+	b.WriteString("Potential savings:\n")
+	for _, saving := range []struct {
+		action string
+		bytes  int64
+	}{
+		{actionDelete, est.Savings.Delete},
+		{actionHardlink, est.Savings.Hardlink},
+		{actionReflink, est.Savings.Reflink},
+	} {
+		percent := 0.0
+		if est.LogicalBytes > 0 {
+			percent = float64(saving.bytes) * 100 / float64(est.LogicalBytes)
+		}
+		fmt.Fprintf(&b, "  %-10s %d bytes (%.1f%%)\n", saving.action+":",
+			saving.bytes, percent)
+	}
+	if !reflinkSupported {
+		b.WriteString("Reflinks are not supported on this platform.\n")
+	}
+
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return fmt.Errorf("unable to write estimate: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With -events, we write a stream of events describing the run as it
+// happens, for programs such as graphical frontends that wrap this one. Each
+// event is a JSON object on its own line. Unlike our log messages, the format
+// is stable and described in the README.
+
+// eventsVersion is the version of the event format. We change it only if we
+// change the format in a way that could break a program reading it.
+const eventsVersion = 1
+
+// Kinds of events.
+const (
+	eventRunStarted  = "run_started"
+	eventPhase       = "phase"
+	eventFileHashed  = "file_hashed"
+	eventGroupFound  = "group_found"
+	eventAction      = "action"
+	eventRunFinished = "run_finished"
+)
+
+// Event is one line of the event stream.
+type Event struct {
+	Version int         `json:"version"`
+	Event   string      `json:"event"`
+	Time    time.Time   `json:"time"`
+	Data    interface{} `json:"data"`
+}
+
+// runStartedData is the data of a run_started event.
+type runStartedData struct {
+	Command string `json:"command"`
+	Dir     string `json:"dir"`
+	Live    bool   `json:"live"`
+}
+
+// phaseData is the data of a phase event.
+type phaseData struct {
+	Name string `json:"name"`
+}
+
+// fileHashedData is the data of a file_hashed event.
+type fileHashedData struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	Hash string `json:"hash"`
+}
+
+// groupFoundData is the data of a group_found event.
+type groupFoundData struct {
+	Hash  string   `json:"hash"`
+	Size  int64    `json:"size"`
+	Files []string `json:"files"`
+}
+
+// actionData is the data of an action event.
+type actionData struct {
+	actionHookContext
+	Live bool `json:"live"`
+}
+
+// runFinishedData is the data of a run_finished event.
+type runFinishedData struct {
+	OK       bool     `json:"ok"`
+	Error    string   `json:"error,omitempty"`
+	Complete bool     `json:"complete"`
+	Summary  *Summary `json:"summary"`
+}
+
+// events is where we write events, if anywhere. Events come from several
+// goroutines, so mu guards it.
+var events struct {
+	mu  sync.Mutex
+	w   io.WriteCloser
+	enc *json.Encoder
+}
+
+// openEvents starts writing events to the destination: - for stdout,
+// unix:PATH or tcp:ADDRESS for a socket a frontend is listening on, or
+// otherwise a file, which may be a named pipe.
+func openEvents(dest string) error {
+	var w io.WriteCloser
+	switch {
+	case dest == "-":
+		w = os.Stdout
+	case strings.HasPrefix(dest, "unix:"), strings.HasPrefix(dest, "tcp:"):
+		network := dest[:strings.Index(dest, ":")]
+		conn, err := net.Dial(network, dest[len(network)+1:])
+		if err != nil {
+			return fmt.Errorf("unable to connect to events socket: %s", err)
+		}
+		w = conn
+	default:
+		fh, err := os.Create(dest)
+		if err != nil {
+			return fmt.Errorf("unable to open events file: %s", err)
+		}
+		w = fh
+	}
+
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	events.w = w
+	events.enc = json.NewEncoder(w)
+	return nil
+}
+
+// emit writes an event. If we can't, we warn and stop writing events rather
+// than fail the run.
+func emit(kind string, data interface{}) {
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	if events.enc == nil {
+		return
+	}
+
+	if err := events.enc.Encode(Event{
+		Version: eventsVersion,
+		Event:   kind,
+		Time:    time.Now().UTC(),
+		Data:    data,
+	}); err != nil {
+		events.enc = nil
+		// Not warnf, as that records the warning under currentRun's lock,
+		// which we may be holding.
+		log.Printf("WARNING: Unable to write event, so no longer writing them: %s",
+			err)
+	}
+}
+
+// emitFileHashed notes the files in the batch we checksummed.
+func emitFileHashed(files []*File) {
+	if !emitting() {
+		return
+	}
+	for _, file := range files {
+		if file.vanished || len(file.Hash) == 0 {
+			continue
+		}
+		emit(eventFileHashed, fileHashedData{
+			Path: file.Path,
+			Size: file.Size,
+			Hash: hex.EncodeToString(file.Hash),
+		})
+	}
+}
+
+// emitGroupFound notes a group of duplicates.
+func emitGroupFound(group []*File) {
+	if !emitting() {
+		return
+	}
+	data := groupFoundData{
+		Hash: hex.EncodeToString(group[0].Hash),
+		Size: group[0].Size,
+	}
+	for _, file := range group {
+		data.Files = append(data.Files, file.Path)
+	}
+	emit(eventGroupFound, data)
+}
+
+// emitting says whether we're writing events.
+func emitting() bool {
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	return events.enc != nil
+}
+
+// closeEvents finishes the stream.
+func closeEvents() {
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	if events.w == nil {
+		return
+	}
+	if events.w != os.Stdout {
+		_ = events.w.Close()
+	}
+	events.w, events.enc = nil, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// explain implements the explain subcommand. It says which rule applies to a
+// pair of files and what we would do with them. This helps debug why a
+// duplicate was reported with no rule found.
+func explain(argv []string) error {
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	configFile := fs.String("conf", "", "Path to a configuration file.")
+	ruleMatch := fs.String("rule-match", ruleMatchFirst,
+		"How to choose between rules of equal priority. See the resolve command.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s explain -conf FILE FILE1 FILE2\n",
+			os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	_ = fs.Parse(argv)
+
+	if len(*configFile) == 0 || fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("you must provide a configuration file and two files")
+	}
+
+	args := defaultArgs()
+	args.Config = *configFile
+	args.RuleMatch = *ruleMatch
+	fs.Visit(func(f *flag.Flag) { args.explicit[f.Name] = true })
+
+	config, err := readConfig(args.Config)
+	if err != nil {
+		return fmt.Errorf("unable to read config: %s: %s", args.Config, err)
+	}
+
+	applySettings(args, config)
+	if err := checkArgs(args); err != nil {
+		return err
+	}
+
+	var files []*File
+	for _, name := range fs.Args() {
+		file, err := explainFile(name)
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+	}
+
+	dir1, _ := path.Split(files[0].Path)
+	dir2, _ := path.Split(files[1].Path)
+	fmt.Printf("File 1: %s (directory %s)\n", files[0].Path, dir1)
+	fmt.Printf("File 2: %s (directory %s)\n", files[1].Path, dir2)
+
+	if files[0].Size >= 0 && files[1].Size >= 0 {
+		identical, err := isIdentical(args, files[0], files[1])
+		if err != nil {
+			fmt.Printf("Unable to compare the files: %s\n", err)
+		} else if identical {
+			fmt.Printf("The files are identical.\n")
+		} else {
+			fmt.Printf("The files are not identical, so no rule would apply to them.\n")
+		}
+	}
+
+	ruleIndex, keep, remove, ok := matchRule(args, config.Rules, files[0],
+		files[1])
+	if !ok {
+		fmt.Printf("No rule applies.\n")
+		explainNearMisses(config.Rules, dir1, dir2)
+		if config.decider != nil {
+			keep, remove, decided, err := config.decider.decide(files[0], files[1])
+			switch {
+			case err != nil:
+				fmt.Printf("The decide script failed: %s\n", err)
+			case !decided:
+				fmt.Printf("The decide script has no opinion.\n")
+			case keep == nil:
+				fmt.Printf("The decide script says to leave both files alone.\n")
+			default:
+				fmt.Printf("The decide script says to keep %s and remove %s.\n",
+					keep.Path, remove.Path)
+			}
+		}
+		return nil
+	}
+
+	rule := config.Rules[ruleIndex]
+	fmt.Printf("Rule: %s (keep %s, remove %s, recursive %t, priority %d)\n",
+		rule.source, rule.KeepDir, rule.RemoveDir, rule.Recursive, rule.Priority)
+
+	if pattern, ok := protectedBy(config, remove.Path); ok {
+		fmt.Printf("Action: none. The rule would delete %s but it is protected by %s.\n",
+			remove.Path, pattern)
+		return nil
+	}
+
+	fmt.Printf("Action: keep %s, delete %s.\n", keep.Path, remove.Path)
+
+	if config.MinCopies > 1 {
+		fmt.Printf("Note: we would not delete it if that left fewer than %d copies.\n",
+			config.MinCopies)
+	}
+
+	return nil
+}
+
+// explainFile builds the File to explain. The file need not exist. We only
+// need its path to match rules. If it does exist, we fill in its details so we
+// can compare it. Size is -1 if it doesn't.
+func explainFile(name string) (*File, error) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to make path absolute: %s: %s", name, err)
+	}
+	abs = filepath.ToSlash(abs)
+
+	file := &File{
+		Basename: path.Base(abs),
+		Path:     abs,
+		Size:     -1,
+	}
+
+	fi, err := os.Stat(abs)
+	if err != nil {
+		fmt.Printf("Unable to stat %s: %s\n", abs, err)
+		return file, nil
+	}
+
+	file.Size = fi.Size()
+	file.ModTime = fi.ModTime()
+	file.dev, file.ino, file.hasID = fileID(abs, fi)
+	return file, nil
+}
+
+// explainNearMisses points out rules that almost apply to the directories.
+// These are probably what the user meant.
+func explainNearMisses(rules []Rule, dir1, dir2 string) {
+	trim := func(dir string) string { return strings.TrimSuffix(dir, "/") }
+
+	for _, rule := range rules {
+		keep, remove := trim(rule.KeepDir), trim(rule.RemoveDir)
+		if (keep != trim(dir1) || remove != trim(dir2)) &&
+			(keep != trim(dir2) || remove != trim(dir1)) {
+			continue
+		}
+
+		fmt.Printf("%s names these directories but doesn't apply. Its directories must end with a / to match: keep %s, remove %s\n",
+			rule.source, rule.KeepDir, rule.RemoveDir)
+	}
+}
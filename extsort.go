@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+)
+
+// A sortedRuns holds the files we find on disk using an external merge sort.
+// We collect files in memory until we have sortRunSize of them, sort them by
+// size, and write them to a file, a run. To visit all the files in order of
+// size, we merge the runs.
+//
+// Compared with fileIndex, this only ever reads and writes files sequentially,
+// which is much faster for hundreds of millions of files.
+type sortedRuns struct {
+	dir   string
+	runs  []string
+	files []*File
+	n     int
+}
+
+// sortRunSize is how many files we sort in memory at a time.
+const sortRunSize = 500000
+
+func newSortedRuns(dir string) (*sortedRuns, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &sortedRuns{dir: dir}, nil
+}
+
+func (s *sortedRuns) add(file *File) error {
+	s.files = append(s.files, file)
+	s.n++
+	if len(s.files) >= sortRunSize {
+		return s.writeRun()
+	}
+	return nil
+}
+
+func (s *sortedRuns) len() int {
+	return s.n
+}
+
+// writeRun sorts the files in memory and writes them to a new run.
+func (s *sortedRuns) writeRun() error {
+	if len(s.files) == 0 {
+		return nil
+	}
+
+	sort.Slice(s.files, func(i, j int) bool {
+		if s.files[i].Size != s.files[j].Size {
+			return s.files[i].Size < s.files[j].Size
+		}
+		return s.files[i].Path < s.files[j].Path
+	})
+
+	fh, err := ioutil.TempFile(s.dir, "dupefile-run-*")
+	if err != nil {
+		return fmt.Errorf("unable to create sort run: %s", err)
+	}
+	s.runs = append(s.runs, fh.Name())
+
+	w := bufio.NewWriter(fh)
+	for _, file := range s.files {
+		if err := writeRecord(w, file); err != nil {
+			_ = fh.Close()
+			return fmt.Errorf("unable to write sort run: %s", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		_ = fh.Close()
+		return fmt.Errorf("unable to write sort run: %s", err)
+	}
+	if err := fh.Close(); err != nil {
+		return fmt.Errorf("unable to write sort run: %s", err)
+	}
+
+	s.files = nil
+	return nil
+}
+
+// A record is a file's size, what encodeStored writes, and path. The path is
+// preceded by its length.
+func writeRecord(w *bufio.Writer, file *File) error {
+	var header [recordHeaderSize + binary.MaxVarintLen64]byte
+	binary.BigEndian.PutUint64(header[0:], uint64(file.Size))
+	encodeStored(header[8:recordHeaderSize], file)
+	n := binary.PutUvarint(header[recordHeaderSize:], uint64(len(file.Path)))
+	if _, err := w.Write(header[:recordHeaderSize+n]); err != nil {
+		return err
+	}
+	_, err := w.WriteString(file.Path)
+	return err
+}
+
+// readRecord reads a record. It returns io.EOF at the end of the run.
+func readRecord(r *bufio.Reader) (*File, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	pathLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	filePath := make([]byte, pathLen)
+	if _, err := io.ReadFull(r, filePath); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	file := &File{
+		Basename: path.Base(string(filePath)),
+		Path:     string(filePath),
+		Size:     int64(binary.BigEndian.Uint64(header[0:])),
+	}
+	decodeStored(header[8:], file)
+	return file, nil
+}
+
+// recordHeaderSize is the size of a record before its path's length.
+const recordHeaderSize = 8 + storedSize
+
+// findDuplicates merges the runs to visit the files in order of size.
+func (s *sortedRuns) findDuplicates(args *Args) ([][]*File, error) {
+	if err := s.writeRun(); err != nil {
+		return nil, err
+	}
+
+	return findDuplicatesInSizeOrder(args, func(found func(*File) error) error {
+		var readers []*bufio.Reader
+		for _, run := range s.runs {
+			fh, err := os.Open(run)
+			if err != nil {
+				return fmt.Errorf("unable to open sort run: %s", err)
+			}
+			defer func() { _ = fh.Close() }()
+			readers = append(readers, bufio.NewReader(fh))
+		}
+
+		h := &runHeap{}
+		for _, r := range readers {
+			if err := h.pushNext(r); err != nil {
+				return err
+			}
+		}
+
+		for h.Len() > 0 {
+			head := heap.Pop(h).(runHead)
+			if err := found(head.file); err != nil {
+				return err
+			}
+			if err := h.pushNext(head.reader); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sortedRuns) remove() {
+	for _, run := range s.runs {
+		_ = os.Remove(run)
+	}
+}
+
+// runHead is the next file from a run.
+type runHead struct {
+	file   *File
+	reader *bufio.Reader
+}
+
+// runHeap holds the next file from each run, smallest first.
+type runHeap []runHead
+
+func (h runHeap) Len() int { return len(h) }
+
+func (h runHeap) Less(i, j int) bool {
+	if h[i].file.Size != h[j].file.Size {
+		return h[i].file.Size < h[j].file.Size
+	}
+	return h[i].file.Path < h[j].file.Path
+}
+
+func (h runHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(runHead)) }
+
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// pushNext reads the next file from the run and adds it to the heap, unless
+// the run has ended.
+func (h *runHeap) pushNext(r *bufio.Reader) error {
+	file, err := readRecord(r)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read sort run: %s", err)
+	}
+	heap.Push(h, runHead{file: file, reader: r})
+	return nil
+}
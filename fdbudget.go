@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// fdBudget bounds how many file descriptors we hold open at once.
+//
+// Every open of a file or directory we scan goes through it. When the budget is
+// used up, opens wait until another goroutine closes something rather than
+// failing partway through a run with EMFILE.
+type fdBudget struct {
+	tokens chan struct{}
+}
+
+// Descriptors we leave for everything else: stdio, the config file, log files,
+// and whatever the runtime needs.
+const fdReserve = 32
+
+// How long we keep retrying an open that fails with EMFILE/ENFILE even though
+// we are within our budget. This can happen if the limit is shared with other
+// processes (ENFILE) or if we guessed the limit wrong.
+const fdExhaustedTimeout = time.Minute
+
+// fds is the budget for the process. The descriptor limit is process wide so
+// the budget is too. main may replace it if the user asks for a specific size.
+var fds = newFDBudget(defaultFDBudget())
+
+func newFDBudget(n int) *fdBudget {
+	// Comparing files holds two open at once.
+	if n < 2 {
+		n = 2
+	}
+	return &fdBudget{tokens: make(chan struct{}, n)}
+}
+
+// defaultFDBudget decides the budget from the process's descriptor limit.
+func defaultFDBudget() int {
+	limit, ok := fdLimit()
+	if !ok {
+		return 256
+	}
+	return limit - fdReserve
+}
+
+// open opens a file for reading once the budget allows it. Release the
+// descriptor with close.
+func (b *fdBudget) open(name string) (*os.File, error) {
+	b.tokens <- struct{}{}
+
+	delay := 10 * time.Millisecond
+	deadline := time.Now().Add(fdExhaustedTimeout)
+
+	for {
+		fh, err := os.Open(name)
+		if err == nil {
+			return fh, nil
+		}
+
+		if !isFDExhausted(err) || time.Now().After(deadline) {
+			<-b.tokens
+			return nil, err
+		}
+
+		time.Sleep(delay)
+		if delay < time.Second {
+			delay *= 2
+		}
+	}
+}
+
+// close closes a file opened with open and returns its descriptor to the
+// budget.
+func (b *fdBudget) close(fh *os.File) error {
+	err := fh.Close()
+	<-b.tokens
+	return err
+}
+
+func (b *fdBudget) String() string {
+	return fmt.Sprintf("%d file descriptors", cap(b.tokens))
+}
+
+func isFDExhausted(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
@@ -0,0 +1,10 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package main
+
+// fdLimit returns the limit on open file descriptors. We don't know how to
+// find it on this platform.
+func fdLimit() (int, bool) {
+	return 0, false
+}
@@ -0,0 +1,22 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import "syscall"
+
+// fdLimit returns the soft limit on open file descriptors.
+func fdLimit() (int, bool) {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 0, false
+	}
+
+	// RLIM_INFINITY or something close to it. There is no point in a budget
+	// this large and it doesn't fit in an int on some platforms.
+	if rlimit.Cur > 1<<20 {
+		return 1 << 20, true
+	}
+
+	return int(rlimit.Cur), true
+}
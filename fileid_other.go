@@ -0,0 +1,30 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris && !windows
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris,!windows
+
+package main
+
+import "os"
+
+// fileID returns the device and inode of the file. We don't know how to find
+// them on this platform, so we treat every path as a separate file.
+func fileID(filePath string, fi os.FileInfo) (uint64, uint64, bool) {
+	return 0, 0, false
+}
+
+// linkCount returns how many hard links the file has. We don't know how to
+// find out on this platform.
+func linkCount(filePath string, fi os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+// deviceNumber returns the number of the device a device file is for. We don't
+// know how to find it on this platform.
+func deviceNumber(fi os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+// fileOwner returns the user and group owning the file. We don't know how to
+// find them on this platform.
+func fileOwner(fi os.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
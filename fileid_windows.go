@@ -0,0 +1,68 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileID returns the volume serial number and file index of the file. Paths
+// with the same ones are hard links to the same file.
+func fileID(filePath string, fi os.FileInfo) (uint64, uint64, bool) {
+	info, err := fileInformation(filePath)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return uint64(info.VolumeSerialNumber),
+		uint64(info.FileIndexHigh)<<32 | uint64(info.FileIndexLow), true
+}
+
+// linkCount returns how many hard links the file has.
+func linkCount(filePath string, fi os.FileInfo) (uint64, bool) {
+	info, err := fileInformation(filePath)
+	if err != nil {
+		return 0, false
+	}
+	return uint64(info.NumberOfLinks), true
+}
+
+// fileInformation asks Windows about the file. It doesn't report what we need
+// when listing a directory, so we open the file to ask. We open a link rather
+// than what it points at.
+func fileInformation(filePath string) (*syscall.ByHandleFileInformation,
+	error) {
+	name, err := syscall.UTF16PtrFromString(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := syscall.CreateFile(name, 0,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE,
+		nil, syscall.OPEN_EXISTING,
+		syscall.FILE_FLAG_BACKUP_SEMANTICS|syscall.FILE_FLAG_OPEN_REPARSE_POINT, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = syscall.CloseHandle(h) }()
+
+	var info syscall.ByHandleFileInformation
+	if err := syscall.GetFileInformationByHandle(h, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// deviceNumber returns the number of the device a device file is for. Windows
+// has no device files.
+func deviceNumber(fi os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+// fileOwner returns the user and group owning the file. Windows files have
+// security descriptors rather than numeric owners.
+func fileOwner(fi os.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
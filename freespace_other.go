@@ -0,0 +1,15 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux
+// +build !darwin,!dragonfly,!freebsd,!linux
+
+package main
+
+import "fmt"
+
+// freeSpaceSupported says whether freeSpace works on this platform.
+const freeSpaceSupported = false
+
+// freeSpace returns the bytes available to us on the filesystem holding the
+// path. We don't know how to find them on this platform.
+func freeSpace(path string) (uint64, error) {
+	return 0, fmt.Errorf("finding free space is not supported on this platform")
+}
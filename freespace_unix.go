@@ -0,0 +1,19 @@
+//go:build darwin || dragonfly || freebsd || linux
+// +build darwin dragonfly freebsd linux
+
+package main
+
+import "syscall"
+
+// freeSpaceSupported says whether freeSpace works on this platform.
+const freeSpaceSupported = true
+
+// freeSpace returns the bytes available to us on the filesystem holding the
+// path.
+func freeSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"unsafe"
+)
+
+// A minimal FUSE server for the mount subcommand. It speaks just enough of
+// the kernel's protocol, described in linux/fuse.h and fuse(4), to serve a
+// read-only tree of directories and symbolic links.
+
+// FUSE operations we handle.
+const (
+	fuseLookup      = 1
+	fuseForget      = 2
+	fuseGetattr     = 3
+	fuseReadlink    = 5
+	fuseOpen        = 14
+	fuseRelease     = 18
+	fuseStatfs      = 17
+	fuseFlush       = 25
+	fuseInit        = 26
+	fuseOpendir     = 27
+	fuseReaddir     = 28
+	fuseReleasedir  = 29
+	fuseAccess      = 34
+	fuseInterrupt   = 36
+	fuseDestroy     = 38
+	fuseBatchForget = 42
+)
+
+// Sizes of parts of FUSE messages.
+const (
+	fuseInHeaderSize  = 40
+	fuseOutHeaderSize = 16
+	fuseAttrSize      = 88
+)
+
+// fuseBufferSize is how large a request we read. The kernel needs room for
+// its largest write, though we never accept writes.
+const fuseBufferSize = 128*1024 + 4096
+
+// fuseTimeout is how long the kernel may cache what we tell it, in seconds.
+// Nothing changes, so it can be long.
+const fuseTimeout = 3600
+
+// native is the byte order of the kernel's messages, which is the machine's.
+var native binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 0 {
+		native = binary.BigEndian
+	}
+}
+
+// serveView mounts the view at the mountpoint and answers the kernel's
+// requests until something unmounts it. An interrupt unmounts it.
+func serveView(mountpoint string, v *view) error {
+	fd, err := fuseMount(mountpoint)
+	if err != nil {
+		return fmt.Errorf("unable to mount %s: %s", mountpoint, err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		if err := fuseUnmount(mountpoint); err != nil {
+			warnf("Unable to unmount %s: %s", mountpoint, err)
+		}
+	}()
+
+	server := &fuseServer{fd: fd, view: v, uid: uint32(os.Getuid()),
+		gid: uint32(os.Getgid())}
+	err = server.serve()
+	_ = syscall.Close(fd)
+	return err
+}
+
+// fuseMount mounts a FUSE filesystem and returns the file descriptor to serve
+// it with. As root we mount it ourselves. Otherwise fusermount does it for us
+// and passes us the descriptor.
+func fuseMount(mountpoint string) (int, error) {
+	if os.Geteuid() == 0 {
+		fd, err := syscall.Open("/dev/fuse", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return -1, err
+		}
+		options := fmt.Sprintf("fd=%d,rootmode=40000,user_id=0,group_id=0", fd)
+		if err := syscall.Mount("dupefile", mountpoint, "fuse.dupefile",
+			syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV,
+			options); err != nil {
+			_ = syscall.Close(fd)
+			return -1, err
+		}
+		return fd, nil
+	}
+
+	program, err := fusermount()
+	if err != nil {
+		return -1, err
+	}
+
+	pair, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return -1, err
+	}
+	ours := os.NewFile(uintptr(pair[0]), "fusermount")
+	defer func() { _ = ours.Close() }()
+	theirs := os.NewFile(uintptr(pair[1]), "fusermount")
+
+	cmd := exec.Command(program, "-o", "ro,nosuid,nodev,fsname=dupefile", "--",
+		mountpoint)
+	cmd.ExtraFiles = []*os.File{theirs}
+	cmd.Env = append(os.Environ(), "_FUSE_COMMFD=3")
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		_ = theirs.Close()
+		return -1, err
+	}
+	_ = theirs.Close()
+
+	// fusermount sends the descriptor and exits. If it fails, it exits without
+	// sending anything.
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, recvErr := syscall.Recvmsg(pair[0], buf, oob, 0)
+	if err := cmd.Wait(); err != nil {
+		return -1, fmt.Errorf("%s failed: %s", program, err)
+	}
+	if recvErr != nil {
+		return -1, recvErr
+	}
+
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(messages) == 0 {
+		return -1, fmt.Errorf("%s didn't pass us a file descriptor", program)
+	}
+	fds, err := syscall.ParseUnixRights(&messages[0])
+	if err != nil || len(fds) == 0 {
+		return -1, fmt.Errorf("%s didn't pass us a file descriptor", program)
+	}
+	return fds[0], nil
+}
+
+// fuseUnmount unmounts the filesystem, which ends fuseServer.serve.
+func fuseUnmount(mountpoint string) error {
+	if os.Geteuid() == 0 {
+		return syscall.Unmount(mountpoint, 0)
+	}
+
+	program, err := fusermount()
+	if err != nil {
+		return err
+	}
+	return exec.Command(program, "-u", mountpoint).Run()
+}
+
+// fusermount finds the fusermount program.
+func fusermount() (string, error) {
+	for _, name := range []string{"fusermount3", "fusermount"} {
+		if p, err := exec.LookPath(name); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("unable to find fusermount. Install FUSE or run as root")
+}
+
+// fuseServer answers the kernel's requests about the view.
+type fuseServer struct {
+	fd       int
+	view     *view
+	uid, gid uint32
+}
+
+// serve reads and answers requests until the filesystem is unmounted.
+func (s *fuseServer) serve() error {
+	buf := make([]byte, fuseBufferSize)
+	for {
+		n, err := syscall.Read(s.fd, buf)
+		if err != nil {
+			switch err {
+			case syscall.EINTR, syscall.EAGAIN, syscall.ENOENT:
+				// ENOENT means the kernel gave up on the request.
+				continue
+			case syscall.ENODEV:
+				// Unmounted.
+				return nil
+			default:
+				return fmt.Errorf("unable to read FUSE request: %s", err)
+			}
+		}
+		if n < fuseInHeaderSize {
+			return fmt.Errorf("short FUSE request")
+		}
+
+		done, err := s.handle(buf[:n])
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// handle answers one request. It returns whether the kernel is done with us.
+func (s *fuseServer) handle(request []byte) (bool, error) {
+	opcode := native.Uint32(request[4:])
+	unique := native.Uint64(request[8:])
+	nodeID := native.Uint64(request[16:])
+	body := request[fuseInHeaderSize:]
+
+	reply := func(errno syscall.Errno, payload []byte) error {
+		return s.reply(unique, errno, payload)
+	}
+
+	switch opcode {
+	case fuseForget, fuseBatchForget, fuseInterrupt:
+		// These get no reply. We never forget nodes, as there are few and they
+		// never change.
+		return false, nil
+
+	case fuseInit:
+		return false, reply(0, fuseInitReply(body))
+
+	case fuseDestroy:
+		return true, reply(0, nil)
+	}
+
+	node := s.view.node(nodeID)
+	if node == nil {
+		return false, reply(syscall.ENOENT, nil)
+	}
+
+	switch opcode {
+	case fuseLookup:
+		name := body
+		if i := bytes.IndexByte(name, 0); i >= 0 {
+			name = name[:i]
+		}
+		id, ok := node.children[string(name)]
+		if !node.isDir() || !ok {
+			return false, reply(syscall.ENOENT, nil)
+		}
+		return false, reply(0, s.entry(id))
+
+	case fuseGetattr:
+		out := make([]byte, 16+fuseAttrSize)
+		native.PutUint64(out[0:], fuseTimeout)
+		s.attr(out[16:], nodeID)
+		return false, reply(0, out)
+
+	case fuseReadlink:
+		if node.isDir() {
+			return false, reply(syscall.EINVAL, nil)
+		}
+		return false, reply(0, []byte(node.target))
+
+	case fuseOpendir:
+		if !node.isDir() {
+			return false, reply(syscall.ENOTDIR, nil)
+		}
+		return false, reply(0, make([]byte, 16))
+
+	case fuseReaddir:
+		if len(body) < 20 {
+			return false, reply(syscall.EINVAL, nil)
+		}
+		return false, reply(0, s.readdir(nodeID, native.Uint64(body[8:]),
+			int(native.Uint32(body[16:]))))
+
+	case fuseRelease, fuseReleasedir, fuseFlush:
+		return false, reply(0, nil)
+
+	case fuseOpen:
+		// There are no regular files to open. The kernel follows symbolic
+		// links itself.
+		return false, reply(syscall.EISDIR, nil)
+
+	case fuseAccess:
+		if len(body) >= 4 && native.Uint32(body)&2 != 0 {
+			return false, reply(syscall.EROFS, nil)
+		}
+		return false, reply(0, nil)
+
+	case fuseStatfs:
+		out := make([]byte, 80)
+		native.PutUint64(out[24:], uint64(len(s.view.nodes)))
+		native.PutUint32(out[40:], 4096)
+		native.PutUint32(out[44:], 255)
+		native.PutUint32(out[48:], 4096)
+		return false, reply(0, out)
+
+	default:
+		return false, reply(syscall.ENOSYS, nil)
+	}
+}
+
+// reply sends the answer to a request.
+func (s *fuseServer) reply(unique uint64, errno syscall.Errno,
+	payload []byte) error {
+	out := make([]byte, fuseOutHeaderSize+len(payload))
+	native.PutUint32(out[0:], uint32(len(out)))
+	native.PutUint32(out[4:], uint32(-int32(errno)))
+	native.PutUint64(out[8:], unique)
+	copy(out[fuseOutHeaderSize:], payload)
+
+	if _, err := syscall.Write(s.fd, out); err != nil {
+		// ENOENT means the kernel no longer wants the answer.
+		if err == syscall.ENOENT {
+			return nil
+		}
+		return fmt.Errorf("unable to answer FUSE request: %s", err)
+	}
+	return nil
+}
+
+// fuseInitReply agrees to the kernel's protocol version. We ask for no
+// optional features.
+func fuseInitReply(body []byte) []byte {
+	minor := uint32(31)
+	readahead := uint32(0)
+	if len(body) >= 12 {
+		if native.Uint32(body[4:]) < minor {
+			minor = native.Uint32(body[4:])
+		}
+		readahead = native.Uint32(body[8:])
+	}
+
+	// Before 7.23 the reply was shorter.
+	size := 64
+	if minor < 23 {
+		size = 24
+	}
+
+	out := make([]byte, size)
+	native.PutUint32(out[0:], 7)
+	native.PutUint32(out[4:], minor)
+	native.PutUint32(out[8:], readahead)
+	native.PutUint32(out[20:], 128*1024)
+	if size == 64 {
+		native.PutUint32(out[24:], 1)
+	}
+	return out
+}
+
+// entry describes a node in answer to a lookup.
+func (s *fuseServer) entry(id uint64) []byte {
+	out := make([]byte, 40+fuseAttrSize)
+	native.PutUint64(out[0:], id)
+	native.PutUint64(out[16:], fuseTimeout)
+	native.PutUint64(out[24:], fuseTimeout)
+	s.attr(out[40:], id)
+	return out
+}
+
+// attr writes a node's attributes to out.
+func (s *fuseServer) attr(out []byte, id uint64) {
+	node := s.view.node(id)
+
+	mode := uint32(syscall.S_IFDIR | 0555)
+	nlink := uint32(2)
+	size := uint64(0)
+	if !node.isDir() {
+		mode = syscall.S_IFLNK | 0777
+		nlink = 1
+		size = uint64(len(node.target))
+	} else {
+		for _, child := range node.order {
+			if s.view.node(child).isDir() {
+				nlink++
+			}
+		}
+	}
+
+	created := uint64(s.view.created.Unix())
+	native.PutUint64(out[0:], id)
+	native.PutUint64(out[8:], size)
+	native.PutUint64(out[24:], created)
+	native.PutUint64(out[32:], created)
+	native.PutUint64(out[40:], created)
+	native.PutUint32(out[60:], mode)
+	native.PutUint32(out[64:], nlink)
+	native.PutUint32(out[68:], s.uid)
+	native.PutUint32(out[72:], s.gid)
+	native.PutUint32(out[80:], 4096)
+}
+
+// readdir lists a directory's entries from the offset on, as many as fit in
+// size bytes. An entry's offset is the offset of the one after it.
+func (s *fuseServer) readdir(id, offset uint64, size int) []byte {
+	node := s.view.node(id)
+
+	type dirent struct {
+		id   uint64
+		name string
+	}
+	entries := []dirent{{id, "."}, {node.parent, ".."}}
+	for _, child := range node.order {
+		entries = append(entries, dirent{child, s.view.node(child).name})
+	}
+
+	var out []byte
+	for i := offset; i < uint64(len(entries)); i++ {
+		entry := entries[i]
+		length := 24 + len(entry.name)
+		padded := (length + 7) &^ 7
+		if len(out)+padded > size {
+			break
+		}
+
+		kind := uint32(syscall.DT_DIR)
+		if !s.view.node(entry.id).isDir() {
+			kind = syscall.DT_LNK
+		}
+
+		buf := make([]byte, padded)
+		native.PutUint64(buf[0:], entry.id)
+		native.PutUint64(buf[8:], i+1)
+		native.PutUint32(buf[16:], uint32(len(entry.name)))
+		native.PutUint32(buf[20:], kind)
+		copy(buf[24:], entry.name)
+		out = append(out, buf...)
+	}
+	return out
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "fmt"
+
+// serveView mounts the view at the mountpoint. We only know how to do this on
+// Linux.
+func serveView(mountpoint string, v *view) error {
+	return fmt.Errorf("mount is only supported on Linux")
+}
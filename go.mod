@@ -1,3 +1,12 @@
 module github.com/horgh/dupefile
 
 go 1.16
+
+require (
+	github.com/BurntSushi/toml v1.3.2
+	github.com/cespare/xxhash/v2 v2.2.0
+	go.etcd.io/bbolt v1.3.6
+	go.starlark.net v0.0.0-20220328144851-d1966c6b9fcd
+	golang.org/x/sys v0.0.0-20200930185726-fdedc70b468f
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,53 @@
+package main
+
+// linkKey identifies a file on disk, however many paths it has.
+type linkKey struct {
+	dev, ino uint64
+}
+
+// distinctFiles returns one path for each file on disk among the files.
+// Paths that are hard links to the same file have the same contents, so there
+// is no need to read more than one of them. Call shareChecksums once they're
+// hashed to give the other paths the same checksums.
+func distinctFiles(files []*File) []*File {
+	seen := make(map[linkKey]bool)
+	var distinct []*File
+	for _, file := range files {
+		if file.hasID {
+			key := linkKey{file.dev, file.ino}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		distinct = append(distinct, file)
+	}
+	return distinct
+}
+
+// shareChecksums copies checksums from the path of each file on disk that we
+// hashed to its other paths.
+func shareChecksums(files []*File) {
+	hashed := make(map[linkKey]*File)
+	for _, file := range files {
+		if !file.hasID {
+			continue
+		}
+		key := linkKey{file.dev, file.ino}
+		first, ok := hashed[key]
+		if !ok {
+			hashed[key] = file
+			continue
+		}
+		file.prefix = first.prefix
+		file.Hash = first.Hash
+		file.SecondHash = first.SecondHash
+		file.vanished = first.vanished
+	}
+}
+
+// sameFile says whether the two paths are hard links to the same file.
+func sameFile(file1, file2 *File) bool {
+	return file1.hasID && file2.hasID && file1.dev == file2.dev &&
+		file1.ino == file2.ino
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+	"sort"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// hashAlgorithms holds the algorithms we can checksum files with.
+var hashAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+
+	// Much faster than the others but not cryptographic. It's a good choice
+	// alongside one of them with -second-hash.
+	"xxhash": func() hash.Hash { return xxhash.New() },
+}
+
+// trustedHashes holds the algorithms -trust-hash allows. Nobody knows how to
+// make two files with the same checksum with these, unlike with md5 and sha1,
+// and xxhash isn't meant to resist it at all.
+var trustedHashes = map[string]bool{
+	"sha256": true,
+	"sha512": true,
+}
+
+func trustedHashNames() []string {
+	var names []string
+	for name := range trustedHashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func hashAlgorithmNames() []string {
+	var names []string
+	for name := range hashAlgorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// hashCommand implements the hash subcommand. It lists every file in the tree
+// with its size and checksum, without looking for duplicates, so it needs no
+// configuration. This is for building manifests and for other programs to
+// use.
+func hashCommand(argv []string) error {
+	args := defaultArgs()
+
+	fs := flag.NewFlagSet("hash", flag.ExitOnError)
+	fs.StringVar(&args.Dir, "dir", "", "Directory to checksum.")
+	fs.StringVar(&args.Hash, "hash", args.Hash,
+		fmt.Sprintf("Hash algorithm to use. One of: %s.",
+			strings.Join(hashAlgorithmNames(), ", ")))
+	host, _ := os.Hostname()
+	fs.StringVar(&host, "host", host,
+		"Name of this machine in the header of -format json output. The default is its hostname.")
+	fs.StringVar(&args.Output, "output", "-",
+		"File to write the list to, or - for stdout.")
+	fs.StringVar(&args.Format, "format", args.Format,
+		fmt.Sprintf("Format of the list. One of: %s.",
+			strings.Join(reportFormatNames(), ", ")))
+	fs.IntVar(&args.Workers, "workers", args.Workers,
+		"Number of files to checksum at once.")
+	fs.IntVar(&args.MaxOpen, "max-open-files", args.MaxOpen,
+		"Maximum number of files to have open at once.")
+	fs.IntVar(&args.Retries, "retries", args.Retries,
+		"Number of times to retry opening/reading a file after a transient error.")
+	fs.DurationVar(&args.RetryDelay, "retry-delay", args.RetryDelay,
+		"Delay before the first retry. It doubles with each subsequent retry.")
+	fs.IntVar(&args.BufferSize, "buffer-size", args.BufferSize,
+		"Size in bytes of each read when checksumming files.")
+	fs.BoolVar(&args.Mmap, "mmap", args.Mmap,
+		"Checksum files by mapping them into memory rather than reading them.")
+	fs.Var((*stringsFlag)(&args.Exclude), "exclude",
+		"Skip files and directories matching this pattern. You may give this more than once.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s hash -dir DIR\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	_ = fs.Parse(argv)
+
+	if args.Dir == "" {
+		fs.Usage()
+		return fmt.Errorf("you must provide a directory")
+	}
+
+	if err := checkArgs(args); err != nil {
+		return err
+	}
+
+	if args.MaxOpen > 0 {
+		fds = newFDBudget(args.MaxOpen)
+	}
+
+	files, err := checksumTree(args)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+
+	header := agentHeader{
+		Version:   agentProtocolVersion,
+		Host:      host,
+		Dir:       args.Dir,
+		Algorithm: args.Hash,
+	}
+
+	var buf bytes.Buffer
+	if err := writeChecksums(&buf, args.Format, header, files); err != nil {
+		return err
+	}
+
+	if args.Output == "-" {
+		if _, err := os.Stdout.Write(buf.Bytes()); err != nil {
+			return fmt.Errorf("unable to write checksums: %s", err)
+		}
+		return nil
+	}
+
+	if err := writeFileAtomically(args.Output, buf.Bytes()); err != nil {
+		return fmt.Errorf("unable to write checksums: %s", err)
+	}
+	return nil
+}
+
+// writeChecksums lists the files in the format, which is one of the -format
+// formats. Text has a line for each file with its checksum, size, and path,
+// separated by two spaces. The path comes last so that spaces in it don't
+// matter. JSON is what agents send, the header and then an object for each
+// file on its own line, so a coordinator can read it.
+func writeChecksums(w io.Writer, format string, header agentHeader,
+	files []*File) error {
+	switch format {
+	case reportText:
+		for _, file := range files {
+			if _, err := fmt.Fprintf(w, "%s  %d  %s\n",
+				hex.EncodeToString(file.Hash), file.Size, file.Path); err != nil {
+				return fmt.Errorf("unable to write checksums: %s", err)
+			}
+		}
+		return nil
+	case reportCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write([]string{"path", "size", "hash"}); err != nil {
+			return fmt.Errorf("unable to write checksums: %s", err)
+		}
+		for _, file := range files {
+			if err := cw.Write([]string{
+				file.Path,
+				strconv.FormatInt(file.Size, 10),
+				hex.EncodeToString(file.Hash),
+			}); err != nil {
+				return fmt.Errorf("unable to write checksums: %s", err)
+			}
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return fmt.Errorf("unable to write checksums: %s", err)
+		}
+		return nil
+	case reportJSON:
+		return writeAgentRecords(w, header, files)
+	default:
+		return fmt.Errorf("unknown format: %s", format)
+	}
+}
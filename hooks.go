@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// Hooks holds commands to run at points during a run. Each is a program
+// followed by its arguments.
+//
+// A hook receives what happened as a JSON object on its standard input. The
+// event's name is in the DUPEFILE_EVENT environment variable.
+type Hooks struct {
+	// BeforeDelete runs before we delete or otherwise replace a duplicate in
+	// live mode. If it fails, we leave that duplicate alone. This lets a hook
+	// veto a deletion or, say, snapshot the filesystem before the first one.
+	BeforeDelete []string `json:"before_delete" yaml:"before_delete" toml:"before_delete"`
+
+	// AfterDelete runs after we delete or replace a duplicate.
+	AfterDelete []string `json:"after_delete" yaml:"after_delete" toml:"after_delete"`
+
+	// OnFinish runs at the end of the run. It receives the run's Summary.
+	OnFinish []string `json:"on_finish" yaml:"on_finish" toml:"on_finish"`
+}
+
+// actionHookContext is what before_delete and after_delete hooks receive.
+type actionHookContext struct {
+	Action string `json:"action"`
+	Keep   string `json:"keep"`
+	Remove string `json:"remove"`
+	Size   int64  `json:"size"`
+}
+
+// runHook runs the hook's command, if it has one, with the context on its
+// standard input.
+func runHook(command []string, event string, context interface{}) error {
+	if len(command) == 0 {
+		return nil
+	}
+
+	input, err := json.Marshal(context)
+	if err != nil {
+		return fmt.Errorf("unable to encode %s hook context: %s", event, err)
+	}
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = bytes.NewReader(append(input, '\n'))
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "DUPEFILE_EVENT="+event)
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s hook failed: %s", event, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"image"
+	// Register the formats we can read the dimensions of.
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+// The highest-resolution keep strategy chooses the best of several versions
+// of the same picture, such as the original over a resized copy. Identical
+// files are the same picture, so this is for groups a matcher plugin (see
+// plugins.go) found by a perceptual hash.
+
+// losslessImageFormats are the image formats, as image.DecodeConfig names
+// them, that don't lose detail.
+var losslessImageFormats = map[string]bool{
+	"png": true,
+}
+
+// keepHighestResolution keeps the image with more pixels. If they have as
+// many, it keeps the one in a lossless format over one in a lossy format, and
+// otherwise the larger file, as it is likely the less compressed. We read the
+// dimensions of JPEG, PNG, and GIF images. If we can't tell for either, we
+// compare the others.
+func keepHighestResolution(file1, file2 *File) (*File, *File, error) {
+	pixels1, format1 := imageInfo(file1)
+	pixels2, format2 := imageInfo(file2)
+	if pixels1 != pixels2 {
+		if pixels2 > pixels1 {
+			return file2, file1, nil
+		}
+		return file1, file2, nil
+	}
+
+	if losslessImageFormats[format1] != losslessImageFormats[format2] {
+		if losslessImageFormats[format2] {
+			return file2, file1, nil
+		}
+		return file1, file2, nil
+	}
+
+	if file2.Size > file1.Size {
+		return file2, file1, nil
+	}
+	return file1, file2, nil
+}
+
+// imageInfo returns the number of pixels in the image and its format, or 0
+// and "" if we can't tell.
+func imageInfo(file *File) (int64, string) {
+	fh, err := fds.open(file.Path)
+	if err != nil {
+		return 0, ""
+	}
+	defer func() { _ = fds.close(fh) }()
+
+	config, format, err := image.DecodeConfig(bufio.NewReader(fh))
+	if err != nil {
+		return 0, ""
+	}
+	return int64(config.Width) * int64(config.Height), format
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// A fileStore holds the files we find until we look for duplicates among
+// them.
+type fileStore interface {
+	add(file *File) error
+	len() int
+	findDuplicates(args *Args) ([][]*File, error)
+	remove()
+}
+
+// Kinds of file store, as given with -index-type.
+const (
+	indexBolt = "bolt"
+	indexSort = "sort"
+)
+
+// newFileStore creates a file store of the kind in the directory.
+func newFileStore(dir, kind string) (fileStore, error) {
+	if kind == indexSort {
+		return newSortedRuns(dir)
+	}
+	return newFileIndex(dir)
+}
+
+// A fileIndex holds what we know about the files we find on disk rather than
+// in memory. On trees of tens of millions of files, holding them all in memory
+// is too much.
+//
+// Its keys are each file's size followed by its path, so iterating over them
+// visits files of the same size together. Its values are the rest of what we
+// know about the file. See encodeStored. Once we've found all the files, we
+// bring them back into memory only a batch of sizes at a time.
+type fileIndex struct {
+	db   *bolt.DB
+	file string
+	n    int
+
+	// Writes we haven't committed yet. Committing each file on its own would be
+	// far too slow.
+	pending []*File
+}
+
+var indexBucket = []byte("files")
+
+// indexCommitSize is how many files we write to the index in each transaction.
+const indexCommitSize = 10000
+
+// indexBatchSize is roughly how many files we bring back into memory at a
+// time to look for duplicates among. We always bring back all files of the
+// same size together, so a batch can be larger.
+const indexBatchSize = 100000
+
+// newFileIndex creates an index in a new file in the directory.
+func newFileIndex(dir string) (*fileIndex, error) {
+	fh, err := ioutil.TempFile(dir, "dupefile-index-*.db")
+	if err != nil {
+		return nil, err
+	}
+	name := fh.Name()
+	if err := fh.Close(); err != nil {
+		_ = os.Remove(name)
+		return nil, err
+	}
+
+	// The index only lasts the run, so there is no point in waiting for it to
+	// reach the disk.
+	db, err := bolt.Open(name, 0600, &bolt.Options{NoSync: true})
+	if err != nil {
+		_ = os.Remove(name)
+		return nil, err
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket(indexBucket)
+		return err
+	}); err != nil {
+		_ = db.Close()
+		_ = os.Remove(name)
+		return nil, err
+	}
+
+	return &fileIndex{db: db, file: name}, nil
+}
+
+// add records a file.
+func (ix *fileIndex) add(file *File) error {
+	ix.pending = append(ix.pending, file)
+	ix.n++
+	if len(ix.pending) >= indexCommitSize {
+		return ix.flush()
+	}
+	return nil
+}
+
+func (ix *fileIndex) len() int {
+	return ix.n
+}
+
+func (ix *fileIndex) flush() error {
+	if len(ix.pending) == 0 {
+		return nil
+	}
+
+	if err := ix.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(indexBucket)
+		for _, file := range ix.pending {
+			value := make([]byte, storedSize)
+			encodeStored(value, file)
+			if err := bucket.Put(indexKey(file.Size, file.Path), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("unable to write to index: %s", err)
+	}
+
+	ix.pending = ix.pending[:0]
+	return nil
+}
+
+// storedSize is the size of what indexes store about a file besides its size
+// and path: its modification time, device and inode, whether we know those,
+// owner, mode, and the kind of network filesystem it is on, if any.
+const storedSize = 8 + 8 + 8 + 1 + 4 + 4 + 4 + networkFSSize
+
+// networkFSSize is how much of the kind of network filesystem a file is on we
+// store. That is enough for the names BSD gives filesystems, and we only need
+// to know whether there is one.
+const networkFSSize = 16
+
+// encodeStored writes what indexes store about the file to buf, which must be
+// storedSize bytes.
+func encodeStored(buf []byte, file *File) {
+	binary.BigEndian.PutUint64(buf[0:], uint64(file.ModTime.UnixNano()))
+	binary.BigEndian.PutUint64(buf[8:], file.dev)
+	binary.BigEndian.PutUint64(buf[16:], file.ino)
+	buf[24] = 0
+	if file.hasID {
+		buf[24] = 1
+	}
+	binary.BigEndian.PutUint32(buf[25:], file.uid)
+	binary.BigEndian.PutUint32(buf[29:], file.gid)
+	binary.BigEndian.PutUint32(buf[33:], uint32(file.mode))
+	networkFS := buf[37 : 37+networkFSSize]
+	for i := range networkFS {
+		networkFS[i] = 0
+	}
+	copy(networkFS, file.networkFS)
+}
+
+// decodeStored reads what encodeStored wrote into the file.
+func decodeStored(buf []byte, file *File) {
+	file.ModTime = time.Unix(0, int64(binary.BigEndian.Uint64(buf[0:])))
+	file.dev = binary.BigEndian.Uint64(buf[8:])
+	file.ino = binary.BigEndian.Uint64(buf[16:])
+	file.hasID = buf[24] == 1
+	file.uid = binary.BigEndian.Uint32(buf[25:])
+	file.gid = binary.BigEndian.Uint32(buf[29:])
+	file.mode = os.FileMode(binary.BigEndian.Uint32(buf[33:]))
+	file.networkFS = string(bytes.TrimRight(buf[37:37+networkFSSize], "\x00"))
+}
+
+func indexKey(size int64, filePath string) []byte {
+	key := make([]byte, 8, 8+len(filePath))
+	binary.BigEndian.PutUint64(key, uint64(size))
+	return append(key, filePath...)
+}
+
+// findDuplicates finds the groups of identical files in the index.
+func (ix *fileIndex) findDuplicates(args *Args) ([][]*File, error) {
+	if err := ix.flush(); err != nil {
+		return nil, err
+	}
+
+	return findDuplicatesInSizeOrder(args, func(found func(*File) error) error {
+		return ix.db.View(func(tx *bolt.Tx) error {
+			cursor := tx.Bucket(indexBucket).Cursor()
+			for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+				filePath := string(key[8:])
+				file := &File{
+					Basename: path.Base(filePath),
+					Path:     filePath,
+					Size:     int64(binary.BigEndian.Uint64(key[:8])),
+				}
+				decodeStored(value, file)
+				if err := found(file); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// findDuplicatesInSizeOrder finds the groups of identical files among those
+// visit calls found with. visit must give them in order of size. We look for
+// duplicates among a batch of sizes at a time, so only that batch and the
+// duplicates we find need to be in memory. Files whose size no other file has
+// we drop straight away.
+func findDuplicatesInSizeOrder(
+	args *Args,
+	visit func(found func(*File) error) error,
+) ([][]*File, error) {
+	var groups [][]*File
+	var batch []*File
+	var sizeGroup []*File
+
+	endBatch := func() error {
+		batchGroups, err := findDuplicatesInTiers(args, batch)
+		if err != nil {
+			return err
+		}
+		groups = append(groups, batchGroups...)
+		batch = nil
+		return nil
+	}
+
+	endSizeGroup := func() error {
+		if len(sizeGroup) > 1 {
+			batch = append(batch, sizeGroup...)
+		}
+		sizeGroup = nil
+
+		if len(batch) < indexBatchSize {
+			return nil
+		}
+		return endBatch()
+	}
+
+	if err := visit(func(file *File) error {
+		if len(sizeGroup) > 0 && sizeGroup[0].Size != file.Size {
+			if err := endSizeGroup(); err != nil {
+				return err
+			}
+		}
+		sizeGroup = append(sizeGroup, file)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := endSizeGroup(); err != nil {
+		return nil, err
+	}
+	if len(batch) > 0 {
+		if err := endBatch(); err != nil {
+			return nil, err
+		}
+	}
+
+	return groups, nil
+}
+
+// remove deletes the index.
+func (ix *fileIndex) remove() {
+	_ = ix.db.Close()
+	_ = os.Remove(ix.file)
+}
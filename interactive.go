@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+var stdin = bufio.NewReader(os.Stdin)
+
+// decideInteractively asks the user what to do with two duplicate files that
+// no rule covers. It returns the file to keep and the file to remove, or nils
+// to leave both.
+//
+// The user may choose to always prefer one file's directory over the other's.
+// In that case we add a rule to the configuration file and to the running
+// configuration so later duplicates in those directories don't need asking
+// about. We only offer that with a configuration file.
+func decideInteractively(
+	args *Args,
+	config *Config,
+	file1,
+	file2 *File,
+) (*File, *File, error) {
+	dir1, _ := path.Split(file1.Path)
+	dir2, _ := path.Split(file2.Path)
+	// Without a configuration file, there is nowhere to keep a rule.
+	canLearn := dir1 != dir2 && args.Config != ""
+
+	fmt.Printf("No rule covers these duplicates:\n")
+	fmt.Printf("  1) %s\n", file1.Path)
+	fmt.Printf("  2) %s\n", file2.Path)
+
+	for {
+		fmt.Printf("Keep [1], keep [2], ")
+		if canLearn {
+			fmt.Printf("always keep from this directory over the other [a1/a2], ")
+		}
+		fmt.Printf("[s]kip, or [q]uit asking? ")
+
+		line, err := stdin.ReadString('\n')
+		if err == io.EOF {
+			// Nobody is there to ask.
+			fmt.Println()
+			args.Interactive = false
+			return nil, nil, nil
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to read answer: %s", err)
+		}
+
+		switch strings.TrimSpace(line) {
+		case "1":
+			return file1, file2, nil
+		case "2":
+			return file2, file1, nil
+		case "s":
+			return nil, nil, nil
+		case "q":
+			args.Interactive = false
+			return nil, nil, nil
+		case "a1", "a2":
+			if dir1 == dir2 {
+				break
+			}
+			if args.Config == "" {
+				fmt.Printf("There is no configuration file to add a rule to. Use -conf to give one.\n")
+				break
+			}
+
+			keep, remove := file1, file2
+			if strings.TrimSpace(line) == "a2" {
+				keep, remove = file2, file1
+			}
+
+			if err := learnRule(args, config, keep, remove); err != nil {
+				return nil, nil, err
+			}
+			return keep, remove, nil
+		}
+	}
+}
+
+// learnRule adds a rule keeping files in keep's directory over those in
+// remove's directory.
+func learnRule(args *Args, config *Config, keep, remove *File) error {
+	keepDir, removeDir := fileDir(keep), fileDir(remove)
+
+	rule := Rule{
+		KeepDir:   escapeVariables(keepDir),
+		RemoveDir: escapeVariables(removeDir),
+		source: fmt.Sprintf("rules[%d] in %s (added interactively)",
+			len(config.Rules), args.Config),
+	}
+
+	rules := append(config.Rules[:len(config.Rules):len(config.Rules)], rule)
+	if err := compileRules(rules[len(rules)-1:], nil); err != nil {
+		return fmt.Errorf("unable to add rule: %s", err)
+	}
+	if err := checkRuleConflicts(rules); err != nil {
+		return fmt.Errorf("unable to add rule: %s", err)
+	}
+
+	if err := appendRuleToConfig(args.Config, rule); err != nil {
+		return fmt.Errorf("unable to add rule to %s: %s", args.Config, err)
+	}
+
+	config.Rules = rules
+	fmt.Printf("Added rule to %s: keep %s, remove %s\n", args.Config, keepDir,
+		removeDir)
+	return nil
+}
+
+// appendRuleToConfig adds a rule to the end of the rules in the configuration
+// file.
+//
+// We try to disturb the rest of the file as little as possible. For YAML we
+// edit the document tree, which keeps comments. For TOML we append a table to
+// the file. JSON has no comments to lose so we decode and encode it again,
+// though that does sort the keys.
+func appendRuleToConfig(configFile string, rule Rule) error {
+	buf, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+
+	newRule := struct {
+		Keep   string `json:"keep" yaml:"keep"`
+		Remove string `json:"remove" yaml:"remove"`
+	}{rule.KeepDir, rule.RemoveDir}
+
+	var out []byte
+
+	switch strings.ToLower(path.Ext(configFile)) {
+	case ".yaml", ".yml":
+		var doc yaml.Node
+		if err := yaml.Unmarshal(buf, &doc); err != nil {
+			return err
+		}
+		if len(doc.Content) != 1 || doc.Content[0].Kind != yaml.MappingNode {
+			return fmt.Errorf("the document is not a mapping")
+		}
+		root := doc.Content[0]
+
+		var rules *yaml.Node
+		for i := 0; i+1 < len(root.Content); i += 2 {
+			if root.Content[i].Value == "rules" {
+				rules = root.Content[i+1]
+			}
+		}
+		if rules == nil {
+			rules = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+			root.Content = append(root.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "rules"}, rules)
+		}
+
+		ruleNode := &yaml.Node{}
+		if err := ruleNode.Encode(newRule); err != nil {
+			return err
+		}
+		rules.Content = append(rules.Content, ruleNode)
+
+		var b bytes.Buffer
+		enc := yaml.NewEncoder(&b)
+		enc.SetIndent(2)
+		if err := enc.Encode(&doc); err != nil {
+			return err
+		}
+		if err := enc.Close(); err != nil {
+			return err
+		}
+		out = b.Bytes()
+	case ".toml":
+		out = append([]byte(nil), buf...)
+		if len(out) > 0 && out[len(out)-1] != '\n' {
+			out = append(out, '\n')
+		}
+		out = append(out, fmt.Sprintf("\n[[rules]]\nkeep = %q\nremove = %q\n",
+			rule.KeepDir, rule.RemoveDir)...)
+
+		// If the rules are an inline array, adding a table of the same name is
+		// invalid.
+		var check Config
+		if _, err := toml.Decode(string(out), &check); err != nil {
+			return fmt.Errorf("unable to append a rule table: %s", err)
+		}
+	default:
+		var doc map[string]json.RawMessage
+		if err := json.Unmarshal(buf, &doc); err != nil {
+			return err
+		}
+
+		var rules []json.RawMessage
+		if raw, ok := doc["rules"]; ok {
+			if err := json.Unmarshal(raw, &rules); err != nil {
+				return err
+			}
+		}
+
+		raw, err := json.Marshal(newRule)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, raw)
+
+		if doc["rules"], err = json.Marshal(rules); err != nil {
+			return err
+		}
+
+		if out, err = json.MarshalIndent(doc, "", "  "); err != nil {
+			return err
+		}
+		out = append(out, '\n')
+	}
+
+	return writeFileAtomically(configFile, out)
+}
+
+// writeFileAtomically replaces the file's contents by writing a new file and
+// renaming it over the old one. That way a crash can't leave the file half
+// written.
+func writeFileAtomically(name string, contents []byte) error {
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(name); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, contents, mode); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, name); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// lint implements the lint subcommand. It checks the rules for likely mistakes
+// without scanning anything.
+func lint(argv []string) error {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	configFile := fs.String("conf", "", "Path to a configuration file.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s lint -conf FILE\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	_ = fs.Parse(argv)
+
+	if len(*configFile) == 0 || fs.NArg() != 0 {
+		fs.Usage()
+		return fmt.Errorf("you must provide a configuration file")
+	}
+
+	// We don't use readConfig as it stops at conflicting rules. We want to
+	// report every problem.
+	config, err := loadConfig(*configFile, nil, nil)
+	if err != nil {
+		return fmt.Errorf("unable to read config: %s: %s", *configFile, err)
+	}
+
+	if err := compileRules(config.Rules, config.Variables); err != nil {
+		return fmt.Errorf("unable to read config: %s: %s", *configFile, err)
+	}
+
+	ruleMatch := ruleMatchFirst
+	if config.RuleMatch != nil {
+		ruleMatch = *config.RuleMatch
+	}
+
+	problems := lintRules(config.Rules, ruleMatch)
+	if len(config.Rules) == 0 {
+		problems = append(problems, "no rules found")
+	}
+	if err := checkRuleCycles(config.Rules); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problem(s)", len(problems))
+	}
+
+	fmt.Println("No problems found.")
+	return nil
+}
+
+// lintRules checks each rule on its own and against the rules before it.
+func lintRules(rules []Rule, ruleMatch string) []string {
+	var problems []string
+
+	for i, rule := range rules {
+		report := func(format string, a ...interface{}) {
+			problems = append(problems,
+				rule.source+": "+fmt.Sprintf(format, a...))
+		}
+
+		// We can't say much about directories containing variables as they stand
+		// for many directories.
+		if rule.keepPattern != nil {
+			continue
+		}
+
+		// Nor about those naming filesystems or other machines, as we can't see
+		// what they hold, or those removing copies anywhere.
+		if elsewhere(rule.KeepDir) || elsewhere(rule.RemoveDir) ||
+			rule.RemoveDir == removeAnywhere {
+			continue
+		}
+
+		type location struct {
+			field string
+			path  string
+		}
+		locations := []location{{"keep", rule.KeepDir}, {"remove", rule.RemoveDir}}
+		collapse := rule.KeepDir == rule.RemoveDir
+		if collapse {
+			locations = []location{{"collapse", rule.KeepDir}}
+		}
+
+		for _, dir := range locations {
+			if !rule.Recursive && !strings.HasSuffix(dir.path, "/") {
+				report("%s: %s does not end with a /, so it will never match", dir.field,
+					dir.path)
+			}
+
+			if clean := path.Clean(dir.path); clean != strings.TrimSuffix(dir.path, "/") &&
+				dir.path != "/" {
+				report("%s: %s is not in normal form (%s), so it will never match",
+					dir.field, dir.path, clean+"/")
+			}
+
+			fi, err := os.Stat(dir.path)
+			if err != nil {
+				report("%s: %s", dir.field, err)
+			} else if !fi.IsDir() {
+				report("%s: %s is not a directory", dir.field, dir.path)
+			}
+		}
+
+		if !collapse && rule.Recursive && (rule.matchesDir(rule.KeepDir, withSlash(rule.RemoveDir)) ||
+			rule.matchesDir(rule.RemoveDir, withSlash(rule.KeepDir))) {
+			report("keep and remove overlap, so the rule applies to some pairs of files both ways")
+		}
+
+		for _, other := range rules[:i] {
+			if other.keepPattern != nil || elsewhere(other.KeepDir) ||
+				elsewhere(other.RemoveDir) || other.RemoveDir == removeAnywhere {
+				continue
+			}
+
+			if covers(other, rule.KeepDir, rule.RemoveDir, rule.Recursive) {
+				if other.Priority > rule.Priority ||
+					(other.Priority == rule.Priority && ruleMatch == ruleMatchFirst) {
+					report("unreachable: %s comes first and applies to every file this rule does",
+						other.source)
+				} else if other.Priority == rule.Priority {
+					report("overlaps %s", other.source)
+				}
+				continue
+			}
+
+			if covers(other, rule.RemoveDir, rule.KeepDir, rule.Recursive) ||
+				covers(rule, other.RemoveDir, other.KeepDir, other.Recursive) {
+				report("contradicts %s: one keeps what the other removes", other.source)
+				continue
+			}
+
+			if covers(rule, other.KeepDir, other.RemoveDir, other.Recursive) &&
+				(rule.Priority > other.Priority ||
+					(rule.Priority == other.Priority && ruleMatch == ruleMatchFirst)) {
+				problems = append(problems, fmt.Sprintf(
+					"%s: unreachable: %s has higher priority and applies to every file this rule does",
+					other.source, rule.source))
+			}
+		}
+	}
+
+	return problems
+}
+
+// covers checks whether the rule applies to every pair of files that a rule
+// keeping keepDir over removeDir would.
+func covers(rule Rule, keepDir, removeDir string, recursive bool) bool {
+	if (recursive && !rule.Recursive) || rule.filtered() {
+		return false
+	}
+	return rule.matchesDir(rule.KeepDir, withSlash(keepDir)) &&
+		rule.matchesDir(rule.RemoveDir, withSlash(removeDir))
+}
+
+// elsewhere checks whether a rule location names a filesystem or another
+// machine rather than a local directory.
+func elsewhere(location string) bool {
+	host, _ := splitHost(location)
+	return host != "" || isFilesystemLocation(location)
+}
+
+func withSlash(dir string) string {
+	return strings.TrimSuffix(dir, "/") + "/"
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// localConfigName is the configuration file we look for in the directories we
+// scan when -local-config is on.
+const localConfigName = ".dupefile.json"
+
+// localConfig holds what a configuration file inside a scanned directory may
+// set. This lets people manage their own areas of a shared volume. Everything
+// in it applies only to the directory's subtree.
+type localConfig struct {
+	// Paths in rules may be relative to the directory. Either way they must be
+	// inside it. Their include and exclude patterns with a / are relative to
+	// it, as with Exclude. They can't set an action, command, or rename.
+	Rules []Rule `json:"rules"`
+
+	// Patterns with a / are relative to the directory.
+	Exclude []string `json:"exclude"`
+}
+
+// readLocalConfig reads the local configuration file in dir.
+func readLocalConfig(dir string) (*localConfig, error) {
+	configFile := path.Join(dir, localConfigName)
+
+	buf, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read local config: %s", err)
+	}
+
+	config := &localConfig{}
+	if err := decodeJSON(buf, config); err != nil {
+		return nil, fmt.Errorf("unable to decode local config: %s: %s", configFile,
+			err)
+	}
+
+	var errs []string
+
+	for i := range config.Rules {
+		rule := &config.Rules[i]
+		field := fmt.Sprintf("rules[%d]", i)
+
+		// Whoever can write to the directory may not be who runs us, so what
+		// a rule does is up to the main configuration. Rules here can only
+		// delete.
+		if rule.Action != "" {
+			errs = append(errs, fieldError{field + ".action",
+				"not allowed in a local config"}.Error())
+		}
+		if len(rule.Command) > 0 {
+			errs = append(errs, fieldError{field + ".command",
+				"not allowed in a local config"}.Error())
+		}
+		if rule.Rename != "" {
+			errs = append(errs, fieldError{field + ".rename",
+				"not allowed in a local config"}.Error())
+		}
+
+		var keep, remove string
+		if rule.Collapse != "" {
+			for _, err := range validateCollapse(field, *rule) {
+				errs = append(errs, err.Error())
+			}
+			collapse, err := localPath(dir, rule.Collapse)
+			if err != nil {
+				errs = append(errs, fieldError{field + ".collapse",
+					err.Error()}.Error())
+			}
+			keep, remove = collapse, collapse
+		} else {
+			var err error
+			keep, err = localPath(dir, rule.KeepDir)
+			if err != nil {
+				errs = append(errs, fieldError{field + ".keep", err.Error()}.Error())
+			}
+			remove, err = localPath(dir, rule.RemoveDir)
+			if err != nil {
+				errs = append(errs, fieldError{field + ".remove", err.Error()}.Error())
+			}
+		}
+
+		// See canonicalDir. Directories that are different paths to the same one
+		// only become the same here, so we check for those after.
+		rule.KeepDir = canonicalDir(keep)
+		rule.RemoveDir = canonicalDir(remove)
+		if rule.Collapse == "" {
+			for _, err := range validateSameDir(field, *rule) {
+				errs = append(errs, err.Error())
+			}
+		}
+		for _, err := range validateFilters(field, *rule) {
+			errs = append(errs, err.Error())
+		}
+		localPatterns(dir, rule.Include)
+		localPatterns(dir, rule.Exclude)
+		rule.source = fmt.Sprintf("%s in %s", field, configFile)
+	}
+
+	for i, pattern := range config.Exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fieldError{fmt.Sprintf("exclude[%d]", i),
+				fmt.Sprintf("invalid pattern: %s", err)}.Error())
+		}
+	}
+	localPatterns(dir, config.Exclude)
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid local config: %s:\n  %s", configFile,
+			strings.Join(errs, "\n  "))
+	}
+
+	if err := compileRules(config.Rules, nil); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// localPatterns makes the patterns matching full paths relative to the
+// directory.
+func localPatterns(dir string, patterns []string) {
+	for i, pattern := range patterns {
+		if strings.Contains(pattern, "/") {
+			patterns[i] = path.Join(dir, pattern)
+		}
+	}
+}
+
+// localPath resolves a path from a local configuration file and checks it is
+// inside the directory holding the file.
+func localPath(dir, p string) (string, error) {
+	dir = path.Clean(dir)
+
+	if p == "" {
+		return "", fmt.Errorf("missing")
+	}
+	if p == removeAnywhere {
+		return "", fmt.Errorf("* would remove copies outside %s", dir)
+	}
+
+	if !path.IsAbs(p) {
+		p = path.Join(dir, p)
+	}
+	p = path.Clean(p)
+
+	if p != dir && !strings.HasPrefix(p, dir+"/") {
+		return "", fmt.Errorf("%s is outside %s", p, dir)
+	}
+
+	return p, nil
+}
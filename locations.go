@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// A rule's keep or remove location may name a filesystem rather than a
+// directory:
+//
+//   - dev:/dev/md0 means files on the filesystem on that device.
+//   - mount:/mnt/usb means files on the filesystem mounted at that directory.
+//
+// This lets a rule say to keep copies on one disk over copies on another
+// wherever they are on each. We find the filesystem's device number when we
+// load the rules and compare it with each file's.
+
+// Prefixes of filesystem locations.
+const (
+	locationDev   = "dev:"
+	locationMount = "mount:"
+)
+
+// filesystem is a filesystem a rule names. If we couldn't find it, such as
+// because the disk isn't attached, it matches nothing.
+type filesystem struct {
+	dev   uint64
+	found bool
+}
+
+// isFilesystemLocation checks whether a rule location names a filesystem.
+func isFilesystemLocation(location string) bool {
+	return strings.HasPrefix(location, locationDev) ||
+		strings.HasPrefix(location, locationMount)
+}
+
+// filesystemPath returns the path in a filesystem location, or the location
+// itself if it's a directory.
+func filesystemPath(location string) string {
+	for _, prefix := range []string{locationDev, locationMount} {
+		if strings.HasPrefix(location, prefix) {
+			return strings.TrimPrefix(location, prefix)
+		}
+	}
+	return location
+}
+
+// resolveFilesystems finds the filesystems the rules name. A filesystem we
+// can't find is not an error, as a removable disk may come and go. We warn and
+// the rule doesn't apply to it.
+func resolveFilesystems(rules []Rule) {
+	for i := range rules {
+		rule := &rules[i]
+		for _, side := range []struct {
+			location string
+			fs       **filesystem
+		}{{rule.KeepDir, &rule.keepFS}, {rule.RemoveDir, &rule.removeFS}} {
+			if !isFilesystemLocation(side.location) {
+				continue
+			}
+
+			dev, err := findFilesystem(side.location)
+			if err != nil {
+				warnf("%s: %s. The rule matches no files there.", rule.source, err)
+				*side.fs = &filesystem{}
+				continue
+			}
+			*side.fs = &filesystem{dev: dev, found: true}
+		}
+	}
+}
+
+// findFilesystem returns the device number of the filesystem a location
+// names.
+func findFilesystem(location string) (uint64, error) {
+	p := filesystemPath(location)
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		return 0, err
+	}
+
+	if strings.HasPrefix(location, locationDev) {
+		if fi.Mode()&os.ModeDevice == 0 {
+			return 0, fmt.Errorf("%s is not a device", p)
+		}
+		dev, ok := deviceNumber(fi)
+		if !ok {
+			return 0, fmt.Errorf("unable to find the device number of %s", p)
+		}
+		return dev, nil
+	}
+
+	if !fi.IsDir() {
+		return 0, fmt.Errorf("%s is not a directory", p)
+	}
+	dev, _, ok := fileID(p, fi)
+	if !ok {
+		return 0, fmt.Errorf("unable to find the filesystem of %s", p)
+	}
+
+	// If nothing is mounted there, the directory is on the filesystem of its
+	// parent. Treating that as the filesystem the rule means could remove
+	// files from the wrong disk.
+	if p != "/" {
+		parentPath := path.Dir(path.Clean(p))
+		parent, err := os.Stat(parentPath)
+		if err != nil {
+			return 0, err
+		}
+		if parentDev, _, ok := fileID(parentPath, parent); ok && parentDev == dev {
+			return 0, fmt.Errorf("nothing is mounted at %s", p)
+		}
+	}
+
+	return dev, nil
+}
+
+// matches checks whether the file is on the filesystem.
+func (fs *filesystem) matches(file *File) bool {
+	return fs.found && file.hasID && file.dev == fs.dev
+}
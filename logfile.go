@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// With -log-file, we write log messages to a file rather than to stderr, so
+// long runs such as the coordinator's don't depend on the shell redirecting
+// stderr. We rotate the file once it reaches -log-max-size bytes, and with
+// -log-rotate-every, when a new period such as a day starts. Rotating renames
+// the file to FILE.1, the previous FILE.1 to FILE.2, and so on, keeping
+// -log-keep old files.
+
+// rotatingLog is a log file we rotate.
+type rotatingLog struct {
+	mu sync.Mutex
+
+	path    string
+	maxSize int64
+	every   time.Duration
+	keep    int
+
+	file *os.File
+	size int64
+
+	// period is the start of the period the file's messages are from.
+	period time.Time
+}
+
+// openRotatingLog opens the log file, appending to it if it exists.
+func openRotatingLog(path string, maxSize int64, every time.Duration,
+	keep int) (*rotatingLog, error) {
+	l := &rotatingLog{
+		path:    path,
+		maxSize: maxSize,
+		every:   every,
+		keep:    keep,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *rotatingLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open log file: %s", err)
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("unable to stat log file: %s: %s", l.path, err)
+	}
+
+	l.file = file
+	l.size = fi.Size()
+
+	// A file we carry on with is from the period it was last written in.
+	l.period = l.periodOf(time.Now())
+	if l.size > 0 {
+		l.period = l.periodOf(fi.ModTime())
+	}
+	return nil
+}
+
+// periodOf returns the start of the rotation period the time is in.
+func (l *rotatingLog) periodOf(t time.Time) time.Time {
+	if l.every <= 0 {
+		return time.Time{}
+	}
+	return t.Truncate(l.every)
+}
+
+// Write writes a message, rotating the file first if it's time to.
+func (l *rotatingLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	full := l.maxSize > 0 && l.size > 0 && l.size+int64(len(p)) > l.maxSize
+	stale := !l.periodOf(time.Now()).Equal(l.period)
+	if (full || stale) && l.file != os.Stderr {
+		if err := l.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to rotate log file: %s\n", err)
+		}
+	}
+
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotate moves the file aside and starts a new one.
+func (l *rotatingLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+
+	var renameErr error
+	if l.keep > 0 {
+		_ = os.Remove(fmt.Sprintf("%s.%d", l.path, l.keep))
+		for i := l.keep - 1; i >= 1; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", l.path, i),
+				fmt.Sprintf("%s.%d", l.path, i+1))
+		}
+		renameErr = os.Rename(l.path, l.path+".1")
+	} else {
+		renameErr = os.Remove(l.path)
+	}
+
+	// Whether or not we moved it, we need a file to write to. If we can't
+	// open one, we fall back to stderr rather than lose messages.
+	if err := l.open(); err != nil {
+		l.file = os.Stderr
+		return err
+	}
+	l.period = l.periodOf(time.Now())
+	if renameErr != nil {
+		// We carry on writing to the full file. Rather than try again on
+		// every message, we try again once we've written another
+		// -log-max-size bytes to it or the next period starts.
+		l.size = 0
+	}
+	return renameErr
+}
+
+// setupLogFile sends log messages to the -log-file, if there is one. We
+// checked its settings in checkArgs.
+func setupLogFile(args *Args) error {
+	if args.LogFile == "" {
+		return nil
+	}
+
+	l, err := openRotatingLog(args.LogFile, args.LogMaxSize, args.LogEvery,
+		args.LogKeep)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(l)
+
+	// Colour codes have no place in a file, unless asked for.
+	if args.Color != colorAlways {
+		colorStderr = false
+	}
+
+	// The messages in the file run together across runs, so we note the time.
+	log.SetFlags(log.LstdFlags)
+	return nil
+}
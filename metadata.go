@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// What to do with file metadata when we replace a file with a link. Media
+// managers and backup tools may otherwise see every replaced file as modified.
+const (
+	// Leave it as the link gets it (the default).
+	metadataNone = "none"
+
+	// Give the link the replaced file's metadata where it can have its own. A
+	// reflink has its own modification time, permissions, ownership, and
+	// extended attributes. A symbolic link has its own ownership and
+	// modification time. A hard link shares everything with the kept file.
+	metadataReplaced = "replaced"
+
+	// As replaced, and also give the kept file the older modification time of
+	// the two when the link shares its metadata or points at it. Then the path
+	// we replaced still looks as old as it was.
+	metadataOldest = "oldest"
+)
+
+func linkMetadataNames() []string {
+	return []string{metadataNone, metadataReplaced, metadataOldest}
+}
+
+// isLinkAction checks whether the action replaces the file with a link of
+// some kind to the kept file.
+func isLinkAction(action string) bool {
+	return action == actionHardlink || action == actionSymlink ||
+		action == actionReflink
+}
+
+// fileMetadata holds the metadata of a file we're about to replace.
+type fileMetadata struct {
+	fi     os.FileInfo
+	xattrs map[string][]byte
+}
+
+// readMetadata records the metadata of the file before we replace it.
+func readMetadata(path string) (*fileMetadata, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs, err := readXattrs(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read extended attributes: %s", err)
+	}
+
+	return &fileMetadata{fi: fi, xattrs: xattrs}, nil
+}
+
+// preserveMetadata applies the link_metadata setting once the action has
+// replaced remove with a link to keep. meta is remove's metadata from before.
+// Failing to preserve some of it doesn't undo the link, so we return each
+// problem for the caller to warn about.
+func preserveMetadata(mode, action string, keep, remove *File,
+	meta *fileMetadata) []error {
+	if mode == "" || mode == metadataNone {
+		return nil
+	}
+
+	var errs []error
+	uid, gid, hasOwner := fileOwner(meta.fi)
+	mtime := meta.fi.ModTime()
+
+	switch action {
+	case actionReflink:
+		if err := os.Chmod(remove.Path, meta.fi.Mode().Perm()); err != nil {
+			errs = append(errs, err)
+		}
+		if hasOwner {
+			if err := os.Lchown(remove.Path, uid, gid); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if err := writeXattrs(remove.Path, meta.xattrs); err != nil {
+			errs = append(errs, fmt.Errorf("unable to set extended attributes: %s: %s",
+				remove.Path, err))
+		}
+		if err := os.Chtimes(remove.Path, time.Now(), mtime); err != nil {
+			errs = append(errs, err)
+		}
+	case actionSymlink:
+		if hasOwner {
+			if err := os.Lchown(remove.Path, uid, gid); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if err := setSymlinkModTime(remove.Path, mtime); err != nil {
+			errs = append(errs, fmt.Errorf("unable to set modification time: %s: %s",
+				remove.Path, err))
+		}
+	}
+
+	if mode == metadataOldest && action != actionReflink &&
+		mtime.Before(keep.ModTime) {
+		if err := os.Chtimes(keep.Path, time.Now(), mtime); err != nil {
+			errs = append(errs, err)
+		} else {
+			// So that we don't think it changed if we consider it again.
+			keep.ModTime = mtime
+		}
+	}
+
+	return errs
+}
+
+// What merge_metadata may give the kept file of the metadata of a copy we
+// remove, so that removing it doesn't lose what only it had.
+const (
+	// The older modification time of the two.
+	mergeModTime = "mtime"
+
+	// The extended attributes the kept file doesn't have, such as tags and
+	// comments a file manager added to the other copy.
+	mergeXattrs = "xattrs"
+)
+
+func mergeMetadataNames() []string {
+	return []string{mergeModTime, mergeXattrs}
+}
+
+// merges checks whether the merge_metadata setting includes what.
+func merges(merge []string, what string) bool {
+	for _, m := range merge {
+		if m == what {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeMetadata applies the merge_metadata setting once we've removed remove,
+// giving keep what it asks for of remove's metadata from before. As with
+// preserveMetadata, we return each problem for the caller to warn about.
+func mergeMetadata(merge []string, keep *File, meta *fileMetadata) []error {
+	// We can't reach a copy on another machine.
+	if keep.remote {
+		return nil
+	}
+
+	var errs []error
+	for _, what := range merge {
+		switch what {
+		case mergeModTime:
+			mtime := meta.fi.ModTime()
+			if !mtime.Before(keep.ModTime) {
+				continue
+			}
+			if err := setModTime(keep.Path, mtime); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			// So that we don't think it changed if we consider it again.
+			keep.ModTime = mtime
+		case mergeXattrs:
+			have, err := readXattrs(keep.Path)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("unable to read extended attributes: %s: %s",
+					keep.Path, err))
+				continue
+			}
+			missing := make(map[string][]byte)
+			for name, value := range meta.xattrs {
+				if _, ok := have[name]; !ok {
+					missing[name] = value
+				}
+			}
+			if err := writeXattrs(keep.Path, missing); err != nil {
+				errs = append(errs, fmt.Errorf("unable to set extended attributes: %s: %s",
+					keep.Path, err))
+			}
+		}
+	}
+	return errs
+}
+
+// setModTime sets the file's modification time, leaving when it was last
+// accessed as it was where we can tell that.
+func setModTime(filePath string, mtime time.Time) error {
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	atime, ok := accessTime(fi)
+	if !ok {
+		atime = time.Now()
+	}
+	return os.Chtimes(filePath, atime, mtime)
+}
@@ -0,0 +1,16 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package main
+
+import "os"
+
+// mapFile maps the file into memory. We don't know how to on this platform,
+// so the caller reads the file instead.
+func mapFile(fh *os.File, size int64) ([]byte, bool) {
+	return nil, false
+}
+
+func unmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,30 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps the file into memory read only. It returns false if it can't,
+// in which case the caller should read the file instead.
+func mapFile(fh *os.File, size int64) ([]byte, bool) {
+	// Empty files can't be mapped. Files too large for our address space can't
+	// be either, and their size may not even fit in an int.
+	if size <= 0 || int64(int(size)) != size {
+		return nil, false
+	}
+
+	data, err := syscall.Mmap(int(fh.Fd()), 0, int(size), syscall.PROT_READ,
+		syscall.MAP_SHARED)
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+func unmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
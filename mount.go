@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// The mount subcommand shows the groups of duplicates in a JSON report as a
+// read-only filesystem. It has a directory for each group, named after the
+// group's checksum, holding a symbolic link to each copy. You can then look
+// through the groups with the usual tools before deciding what to do with
+// them. This is experimental.
+
+// viewNode is a directory or symbolic link in the filesystem. Its ID is its
+// index in the view's nodes plus one, so the root is 1.
+type viewNode struct {
+	name   string
+	parent uint64
+
+	// target is where a symbolic link points. Directories have none.
+	target string
+
+	// A directory's entries, by name and in the order we list them.
+	children map[string]uint64
+	order    []uint64
+}
+
+// view is the filesystem's contents. They never change.
+type view struct {
+	nodes   []*viewNode
+	created time.Time
+}
+
+// isDir checks whether the node is a directory.
+func (n *viewNode) isDir() bool {
+	return n.target == ""
+}
+
+// node returns the node with the ID, or nil if there isn't one.
+func (v *view) node(id uint64) *viewNode {
+	if id == 0 || id > uint64(len(v.nodes)) {
+		return nil
+	}
+	return v.nodes[id-1]
+}
+
+// add adds a node to the directory with the ID and returns the node's ID.
+func (v *view) add(parent uint64, name, target string) uint64 {
+	v.nodes = append(v.nodes, &viewNode{
+		name:     name,
+		parent:   parent,
+		target:   target,
+		children: make(map[string]uint64),
+	})
+	id := uint64(len(v.nodes))
+	dir := v.node(parent)
+	dir.children[name] = id
+	dir.order = append(dir.order, id)
+	return id
+}
+
+// newView lays out the report's groups. Links point at absolute paths. We
+// take relative paths in the report to be relative to the current directory.
+// Each link's name is its position in the group and the file's name, as in
+// 1-a.jpg, so that it is unique and still says what the file is.
+func newView(report *Report) (*view, error) {
+	v := &view{
+		nodes:   []*viewNode{{name: "/", parent: 1, children: map[string]uint64{}}},
+		created: time.Now(),
+	}
+
+	for _, group := range report.Groups {
+		name := group.Hash
+		for i := 2; v.nodes[0].children[name] != 0; i++ {
+			name = fmt.Sprintf("%s-%d", group.Hash, i)
+		}
+		dir := v.add(1, name, "")
+
+		for i, file := range group.Files {
+			target, err := filepath.Abs(file.Path)
+			if err != nil {
+				return nil, fmt.Errorf("unable to find the absolute path of %s: %s",
+					file.Path, err)
+			}
+			v.add(dir, fmt.Sprintf("%d-%s", i+1, path.Base(file.Path)), target)
+		}
+	}
+
+	return v, nil
+}
+
+// mount implements the mount subcommand.
+func mount(argv []string) error {
+	fs := flag.NewFlagSet("mount", flag.ExitOnError)
+	reportFile := fs.String("report", "",
+		"Path to a report written with -output and -format json.")
+	mountpoint := fs.String("mountpoint", "",
+		"Empty directory to show the groups in.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(),
+			"Usage: %s mount -report FILE -mountpoint DIR\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	_ = fs.Parse(argv)
+
+	if *reportFile == "" || *mountpoint == "" {
+		fs.Usage()
+		return fmt.Errorf("you must provide a report and a mountpoint")
+	}
+
+	buf, err := ioutil.ReadFile(*reportFile)
+	if err != nil {
+		return fmt.Errorf("unable to read report: %s", err)
+	}
+
+	var report Report
+	if err := json.Unmarshal(buf, &report); err != nil {
+		return fmt.Errorf("unable to parse report: %s: %s", *reportFile, err)
+	}
+
+	v, err := newView(&report)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Showing %d groups at %s. Interrupt to unmount.",
+		len(report.Groups), *mountpoint)
+	return serveView(*mountpoint, v)
+}
@@ -0,0 +1,46 @@
+//go:build darwin || dragonfly || freebsd
+// +build darwin dragonfly freebsd
+
+package main
+
+import "syscall"
+
+// detectsNetworkFilesystems says whether networkFilesystem can tell on this
+// platform.
+const detectsNetworkFilesystems = true
+
+// networkFilesystems holds the names statfs(2) reports for network
+// filesystems. We count FUSE as one, as it is most often used for remote
+// storage, such as with sshfs and rclone.
+var networkFilesystems = map[string]bool{
+	"nfs":     true,
+	"smbfs":   true,
+	"afpfs":   true,
+	"webdav":  true,
+	"cifs":    true,
+	"fusefs":  true,
+	"osxfuse": true,
+	"macfuse": true,
+}
+
+// networkFilesystem returns the kind of network filesystem holding the path,
+// or a blank string if it is not on one.
+func networkFilesystem(path string) (string, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return "", err
+	}
+
+	var name []byte
+	for _, c := range st.Fstypename {
+		if c == 0 {
+			break
+		}
+		name = append(name, byte(c))
+	}
+
+	if networkFilesystems[string(name)] {
+		return string(name), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import "syscall"
+
+// detectsNetworkFilesystems says whether networkFilesystem can tell on this
+// platform.
+const detectsNetworkFilesystems = true
+
+// networkFilesystems holds the magic numbers Linux's statfs(2) reports for
+// network filesystems, and their names. We count FUSE as one, as it is most
+// often used for remote storage, such as with sshfs and rclone.
+var networkFilesystems = map[uint32]string{
+	0x6969:     "nfs",
+	0x517b:     "smb",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+	0x5346414f: "afs",
+	0x73757245: "coda",
+	0x01021997: "9p",
+	0x00c36400: "ceph",
+	0x65735546: "fuse",
+}
+
+// networkFilesystem returns the kind of network filesystem holding the path,
+// or a blank string if it is not on one.
+func networkFilesystem(path string) (string, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return "", err
+	}
+	return networkFilesystems[uint32(st.Type)], nil
+}
@@ -0,0 +1,14 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux
+// +build !darwin,!dragonfly,!freebsd,!linux
+
+package main
+
+// detectsNetworkFilesystems says whether networkFilesystem can tell on this
+// platform.
+const detectsNetworkFilesystems = false
+
+// networkFilesystem returns the kind of network filesystem holding the path.
+// We don't know how to tell on this platform, so we assume it is local.
+func networkFilesystem(path string) (string, error) {
+	return "", nil
+}
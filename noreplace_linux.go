@@ -0,0 +1,19 @@
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// renameNoReplace renames oldPath to newPath, failing if newPath exists. We
+// use renameat2(2) with RENAME_NOREPLACE, and if the filesystem or kernel
+// doesn't support that, a hard link.
+func renameNoReplace(oldPath, newPath string) error {
+	err := unix.Renameat2(unix.AT_FDCWD, oldPath, unix.AT_FDCWD, newPath,
+		unix.RENAME_NOREPLACE)
+	if errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOSYS) {
+		return linkRename(oldPath, newPath)
+	}
+	return err
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// renameNoReplace renames oldPath to newPath, failing if newPath exists.
+func renameNoReplace(oldPath, newPath string) error {
+	return linkRename(oldPath, newPath)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Notifications says where to send a report when a run finishes.
+type Notifications struct {
+	Webhooks []Webhook `json:"webhooks" yaml:"webhooks" toml:"webhooks"`
+	Email    *Email    `json:"email" yaml:"email" toml:"email"`
+}
+
+// Webhook is an endpoint we POST the run's summary to.
+type Webhook struct {
+	URL string `json:"url" yaml:"url" toml:"url"`
+
+	// Format is json (the default) or slack. json sends the Summary and any
+	// deletions as they are. slack sends a message that Slack's incoming
+	// webhooks, and the many services compatible with them, can show.
+	Format string `json:"format" yaml:"format" toml:"format"`
+
+	// Deletions includes every duplicate we deleted or replaced, not only the
+	// counts.
+	Deletions bool `json:"deletions" yaml:"deletions" toml:"deletions"`
+}
+
+// Webhook formats.
+const (
+	webhookJSON  = "json"
+	webhookSlack = "slack"
+)
+
+// How long we wait for an endpoint to respond.
+const webhookTimeout = 30 * time.Second
+
+// webhookPayload is what the json format sends.
+type webhookPayload struct {
+	Summary   *Summary            `json:"summary"`
+	Deletions []actionHookContext `json:"deletions,omitempty"`
+}
+
+// notify sends the summary to each webhook and mails the report. The run has
+// already happened by this point, so one of these failing doesn't stop us
+// trying the others. We return every failure.
+func notify(config *Config, summary *Summary) []error {
+	var errs []error
+
+	if config.Notifications.Email != nil {
+		if err := sendEmail(config.Notifications.Email,
+			newReport(summary)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	client := &http.Client{Timeout: webhookTimeout}
+
+	for _, webhook := range config.Notifications.Webhooks {
+		body, err := webhookBody(webhook, summary)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if err := postWebhook(client, webhook.URL, body); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+func webhookBody(webhook Webhook, summary *Summary) ([]byte, error) {
+	var deletions []actionHookContext
+	if webhook.Deletions {
+		deletions = summary.deletions
+	}
+
+	var payload interface{}
+	if webhook.Format == webhookSlack {
+		payload = map[string]string{"text": summaryText(summary, deletions)}
+	} else {
+		payload = webhookPayload{Summary: summary, Deletions: deletions}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode notification: %s", err)
+	}
+	return body, nil
+}
+
+// summaryText describes the run as text, listing the deletions.
+func summaryText(summary *Summary, deletions []actionHookContext) string {
+	var b strings.Builder
+
+	mode := "live"
+	if !summary.Live {
+		mode = "non-live"
+	}
+	fmt.Fprintf(&b, "dupefile finished a %s run. ", mode)
+	fmt.Fprintf(&b, "Found %d files, %d duplicates (%d bytes) in %d groups. ",
+		summary.Files, summary.DuplicateFiles, summary.DuplicateBytes,
+		summary.DuplicateGroups)
+	if summary.Live {
+		fmt.Fprintf(&b, "Removed %d duplicates (%d bytes).", summary.Removed,
+			summary.RemovedBytes)
+	} else {
+		fmt.Fprintf(&b, "Would remove %d duplicates (%d bytes).", summary.Removed,
+			summary.RemovedBytes)
+	}
+
+	for _, deletion := range deletions {
+		fmt.Fprintf(&b, "\n%s %s (keeping %s)", deletion.Action, deletion.Remove,
+			deletion.Keep)
+	}
+
+	return b.String()
+}
+
+func postWebhook(client *http.Client, url string, body []byte) error {
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// The URL may hold a secret, and the error includes it.
+		return fmt.Errorf("unable to send notification: %s", redactURL(err, url))
+	}
+
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if err := resp.Body.Close(); err != nil {
+		return fmt.Errorf("unable to send notification: %s", redactURL(err, url))
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("notification endpoint responded with %s", resp.Status)
+	}
+
+	return nil
+}
+
+// redactURL removes the URL from an error's message.
+func redactURL(err error, url string) string {
+	return strings.Replace(err.Error(), url, "<webhook URL>", -1)
+}
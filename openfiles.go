@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// With -skip-open, we don't remove duplicates that another program has open,
+// so that a live run doesn't pull files out from under running programs such
+// as a database or a media server. We check right before removing each one.
+// How we tell depends on the platform. See openElsewhere.
+
+// inUse checks whether another process has the file open or locked. It
+// returns why we shouldn't remove it, or a blank string if we can.
+func inUse(file *File) string {
+	open, err := openElsewhere(file)
+	if err != nil {
+		return fmt.Sprintf("unable to tell whether another process has it open: %s",
+			err)
+	}
+	if open {
+		return "another process has it open"
+	}
+	return ""
+}
+
+// reportInUse lists the duplicates we didn't remove because other processes
+// had them open. A later run may be able to.
+func reportInUse(args *Args, summary *Summary) {
+	summary.InUse = len(args.inUse)
+	summary.inUse = args.inUse
+	if len(args.inUse) == 0 {
+		return
+	}
+
+	log.Printf("Skipped %d duplicates other processes had open:",
+		len(args.inUse))
+	for _, name := range args.inUse {
+		log.Printf("  %s", name)
+	}
+}
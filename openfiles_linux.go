@@ -0,0 +1,190 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const openFilesSupported = true
+
+// On Linux, we look through /proc the way lsof does: the files each process
+// has open in /proc/PID/fd, those it has mapped into memory in /proc/PID/maps,
+// and the locks in /proc/locks. We only see the descriptors and mappings of
+// processes we may look at, which without root means our own user's. Locks
+// are listed for every process.
+//
+// Looking through /proc for each file would be slow with many duplicates and
+// many processes, so we look at most once every openFilesMaxAge and remember
+// what we saw.
+const openFilesMaxAge = time.Second
+
+// openFiles is what we last saw open.
+var openFiles struct {
+	mu    sync.Mutex
+	taken time.Time
+	ids   map[[2]uint64]bool
+}
+
+// openElsewhere checks whether a process other than us has the file open,
+// mapped, or locked.
+func openElsewhere(file *File) (bool, error) {
+	dev, ino := file.dev, file.ino
+	if !file.hasID {
+		fi, err := os.Lstat(file.Path)
+		if err != nil {
+			return false, err
+		}
+		var ok bool
+		dev, ino, ok = fileID(file.Path, fi)
+		if !ok {
+			return false, nil
+		}
+	}
+
+	openFiles.mu.Lock()
+	defer openFiles.mu.Unlock()
+
+	if openFiles.ids == nil || time.Since(openFiles.taken) > openFilesMaxAge {
+		ids, err := findOpenFiles()
+		if err != nil {
+			return false, err
+		}
+		openFiles.ids = ids
+		openFiles.taken = time.Now()
+	}
+
+	return openFiles.ids[[2]uint64{dev, ino}], nil
+}
+
+// findOpenFiles returns the device and inode of each file a process other
+// than us has open, mapped, or locked. Processes may exit while we look, and
+// we may not be allowed to look at some, so we skip those we can't read.
+func findOpenFiles() (map[[2]uint64]bool, error) {
+	dh, err := os.Open("/proc")
+	if err != nil {
+		return nil, err
+	}
+	names, err := dh.Readdirnames(-1)
+	_ = dh.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	self := strconv.Itoa(os.Getpid())
+	ids := make(map[[2]uint64]bool)
+	for _, name := range names {
+		if _, err := strconv.Atoi(name); err != nil || name == self {
+			continue
+		}
+		findProcessFiles(filepath.Join("/proc", name), ids)
+	}
+
+	if err := findLockedFiles(ids); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// findProcessFiles adds the files the process has open or mapped.
+func findProcessFiles(dir string, ids map[[2]uint64]bool) {
+	fdDir := filepath.Join(dir, "fd")
+	if dh, err := os.Open(fdDir); err == nil {
+		fds, _ := dh.Readdirnames(-1)
+		_ = dh.Close()
+		for _, fd := range fds {
+			var st syscall.Stat_t
+			if err := syscall.Stat(filepath.Join(fdDir, fd), &st); err != nil {
+				continue
+			}
+			ids[[2]uint64{uint64(st.Dev), uint64(st.Ino)}] = true
+		}
+	}
+
+	fh, err := os.Open(filepath.Join(dir, "maps"))
+	if err != nil {
+		return
+	}
+	defer func() { _ = fh.Close() }()
+
+	// Each line is: address perms offset major:minor inode path
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		if id, ok := parseDeviceInode(fields[3], fields[4]); ok {
+			ids[id] = true
+		}
+	}
+}
+
+// findLockedFiles adds the files with locks on them.
+func findLockedFiles(ids map[[2]uint64]bool) error {
+	fh, err := os.Open("/proc/locks")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer func() { _ = fh.Close() }()
+
+	// Each line is like: 1: POSIX ADVISORY WRITE 1234 08:02:131 0 EOF
+	// Blocked requests for locks have -> after the number.
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && fields[1] == "->" {
+			fields = fields[1:]
+		}
+		if len(fields) < 6 {
+			continue
+		}
+		pid := fields[4]
+		if pid == strconv.Itoa(os.Getpid()) {
+			continue
+		}
+		i := strings.LastIndex(fields[5], ":")
+		if i == -1 {
+			continue
+		}
+		if id, ok := parseDeviceInode(fields[5][:i], fields[5][i+1:]); ok {
+			ids[id] = true
+		}
+	}
+	return scanner.Err()
+}
+
+// parseDeviceInode parses a device as major:minor in hexadecimal, and an inode
+// in decimal, as /proc lists them. Inode 0 means no file.
+func parseDeviceInode(device, inode string) ([2]uint64, bool) {
+	parts := strings.Split(device, ":")
+	if len(parts) != 2 {
+		return [2]uint64{}, false
+	}
+	major, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil {
+		return [2]uint64{}, false
+	}
+	minor, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return [2]uint64{}, false
+	}
+	ino, err := strconv.ParseUint(inode, 10, 64)
+	if err != nil || ino == 0 {
+		return [2]uint64{}, false
+	}
+	return [2]uint64{unix.Mkdev(uint32(major), uint32(minor)), ino}, true
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+
+import "fmt"
+
+const openFilesSupported = false
+
+// openElsewhere checks whether another process has the file open. We don't
+// know how to tell on this platform.
+func openElsewhere(file *File) (bool, error) {
+	return false, fmt.Errorf("unable to find open files on this platform")
+}
@@ -0,0 +1,36 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+const openFilesSupported = true
+
+// openElsewhere checks whether another process has the file open. On Windows,
+// we try to open it without sharing it. That fails if any other handle to it
+// is open, whether or not the program holding it allowed others to share it.
+// Programs hold their locks through handles, so a file with none has no locks
+// on it either.
+func openElsewhere(file *File) (bool, error) {
+	name, err := syscall.UTF16PtrFromString(file.Path)
+	if err != nil {
+		return false, err
+	}
+
+	h, err := syscall.CreateFile(name, syscall.GENERIC_READ, 0, nil,
+		syscall.OPEN_EXISTING, syscall.FILE_FLAG_OPEN_REPARSE_POINT, 0)
+	if err != nil {
+		if errors.Is(err, windows.ERROR_SHARING_VIOLATION) {
+			return true, nil
+		}
+		return false, err
+	}
+	_ = syscall.CloseHandle(h)
+	return false, nil
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// A plan says what a run would do, so that it can be looked over, changed, and
+// carried out later with the apply subcommand. resolve -plan writes one.
+//
+// A plan is JSON. Each entry is about a group of duplicates and names the copy
+// to keep, the copies to remove, and what to do with them. The group's
+// checksum and size say what the files held when we planned. apply checks
+// them again before changing anything and refuses entries that no longer
+// match, so it is safe to edit a plan with your own scripts: moving a path
+// from remove to keep, dropping entries, or changing actions.
+
+// planVersion is the version of the plan format.
+const planVersion = 1
+
+// Plan is the contents of a plan file.
+type Plan struct {
+	Version int `json:"version"`
+
+	// Algorithm is the hash algorithm the checksums are from.
+	Algorithm string `json:"algorithm"`
+
+	Entries []PlanEntry `json:"entries"`
+}
+
+// PlanEntry is what to do with some of the files in a group of duplicates.
+// Group numbers the group in the run that planned it. A group can have more
+// than one entry if rules keep different copies or take different actions.
+//
+// KeepHost names the machine the copy to keep is on, if it is another one.
+// Only the coordinator plans those (see coordinator.go).
+type PlanEntry struct {
+	Group    int      `json:"group"`
+	Hash     string   `json:"hash"`
+	Size     int64    `json:"size"`
+	Action   string   `json:"action"`
+	Keep     string   `json:"keep"`
+	KeepHost string   `json:"keep_host,omitempty"`
+	Remove   []string `json:"remove"`
+}
+
+// planActions holds the actions a plan can have. A plan can't say what
+// command an exec rule would run, so it has none of those.
+var planActions = map[string]bool{
+	actionDelete:   true,
+	actionHardlink: true,
+	actionSymlink:  true,
+	actionReflink:  true,
+}
+
+// newPlan returns an empty plan for checksums with the algorithm.
+func newPlan(algorithm string) *Plan {
+	return &Plan{
+		Version:   planVersion,
+		Algorithm: algorithm,
+		Entries:   []PlanEntry{},
+	}
+}
+
+// add plans to carry out the action on remove, a duplicate of keep in the
+// numbered group.
+func (p *Plan) add(group int, action string, keep, remove *File) {
+	if !planActions[action] {
+		log.Printf("Leaving %s out of the plan: plans can't hold %s actions",
+			remove.Path, action)
+		return
+	}
+
+	for i := range p.Entries {
+		entry := &p.Entries[i]
+		if entry.Group == group && entry.Keep == keep.Path &&
+			entry.Action == action {
+			entry.Remove = append(entry.Remove, remove.Path)
+			return
+		}
+	}
+
+	p.Entries = append(p.Entries, PlanEntry{
+		Group:  group,
+		Hash:   hex.EncodeToString(keep.Hash),
+		Size:   keep.Size,
+		Action: action,
+		Keep:   keep.Path,
+		Remove: []string{remove.Path},
+	})
+}
+
+// save writes the plan to the file.
+func (p *Plan) save(name string) error {
+	buf, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode plan: %s", err)
+	}
+	if err := writeFileAtomically(name, append(buf, '\n')); err != nil {
+		return fmt.Errorf("unable to write plan: %s", err)
+	}
+	return nil
+}
+
+// apply implements the apply subcommand. It carries out a plan, after
+// checking that each entry still holds.
+func apply(argv []string) error {
+	args := defaultArgs()
+
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	planFile := fs.String("plan", "", "Path to a plan written with resolve -plan.")
+	fs.StringVar(&args.Config, "conf", args.Config,
+		"Path to a configuration file. We don't remove the paths it protects, and carry out actions with its settings. We ignore its rules.")
+	fs.BoolVar(&args.Live, "live", args.Live, "Enable file deletion.")
+	fs.BoolVar(&args.Paranoid, "paranoid", args.Paranoid,
+		"Compare each file with the copy we keep again immediately before deleting it.")
+	fs.StringVar(&args.Backup, "backup", args.Backup,
+		"Copy each file to its absolute path under this directory before deleting or replacing it.")
+	fs.BoolVar(&args.Shred, "shred", args.Shred,
+		"Overwrite the contents of files we delete with random data first.")
+	fs.BoolVar(&args.TrustHash, "trust-hash", args.TrustHash,
+		fmt.Sprintf("Remove files with the plan's checksum without comparing them byte by byte with the copy we keep. This needs a plan with checksums from %s.",
+			strings.Join(trustedHashNames(), " or ")))
+	fs.BoolVar(&args.SkipOpen, "skip-open", args.SkipOpen,
+		"Don't remove duplicates that other processes have open or locked. We list them at the end.")
+	fs.IntVar(&args.MaxFiles, "max-files", args.MaxFiles,
+		"Remove at most this many duplicates. 0 means no limit.")
+	fs.Int64Var(&args.MaxBytes, "max-bytes", args.MaxBytes,
+		"Remove at most this many bytes of duplicates. 0 means no limit.")
+	fs.IntVar(&args.Retries, "retries", args.Retries,
+		"Number of times to retry opening/reading a file after a transient error.")
+	fs.DurationVar(&args.RetryDelay, "retry-delay", args.RetryDelay,
+		"Delay before the first retry. It doubles with each subsequent retry.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s apply -plan FILE [-conf FILE] [-live]\n",
+			os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	_ = fs.Parse(argv)
+
+	if *planFile == "" {
+		fs.Usage()
+		return fmt.Errorf("you must provide a plan")
+	}
+
+	// Backing a file up would keep a copy of what we overwrite.
+	if args.Shred && args.Backup != "" {
+		return fmt.Errorf("-shred and -backup can't be used together")
+	}
+
+	if args.SkipOpen && !openFilesSupported {
+		return fmt.Errorf("-skip-open is only supported on Linux and Windows")
+	}
+
+	buf, err := ioutil.ReadFile(*planFile)
+	if err != nil {
+		return fmt.Errorf("unable to read plan: %s", err)
+	}
+
+	var plan Plan
+	if err := json.Unmarshal(buf, &plan); err != nil {
+		return fmt.Errorf("unable to parse plan: %s: %s", *planFile, err)
+	}
+	if plan.Version != planVersion {
+		return fmt.Errorf("%s: unsupported plan version %d", *planFile,
+			plan.Version)
+	}
+	if _, ok := hashAlgorithms[plan.Algorithm]; !ok {
+		return fmt.Errorf("%s: unknown hash algorithm: %s", *planFile,
+			plan.Algorithm)
+	}
+	args.Hash = plan.Algorithm
+	if args.TrustHash && !trustedHashes[args.Hash] {
+		return fmt.Errorf("-trust-hash needs a plan with checksums from %s, not %s",
+			strings.Join(trustedHashNames(), " or "), args.Hash)
+	}
+
+	config := &Config{}
+	if args.Config != "" {
+		config, err = readConfig(args.Config)
+		if err != nil {
+			return fmt.Errorf("unable to read config: %s: %s", args.Config, err)
+		}
+	}
+	summary := &Summary{Live: args.Live}
+	// We carry out entries in order. Paths earlier entries remove, or would
+	// have if we hadn't refused them, are off limits to later ones, as are the
+	// copies they make symbolic links to.
+	removed := make(map[string]bool)
+	linked := make(map[string]bool)
+
+	refused := 0
+	for _, entry := range plan.Entries {
+		keep, removes, problem := checkPlanEntry(args, entry, removed, linked)
+		for _, name := range entry.Remove {
+			removed[name] = true
+		}
+		if entry.Action == actionSymlink {
+			linked[entry.Keep] = true
+		}
+		if problem != "" {
+			fmt.Printf("Refusing group %d: %s\n", entry.Group, problem)
+			refused++
+			continue
+		}
+
+		for _, remove := range removes {
+			if pattern, ok := protectedBy(config, remove.Path); ok {
+				warnf("Group %d would remove %s but it is protected by %s. Skipping it.",
+					entry.Group, remove.Path, pattern)
+				continue
+			}
+			if !withinLimits(args, summary, remove) {
+				continue
+			}
+			gone, err := applyAction(args, config, entry.Action, nil, keep, remove,
+				args.Live)
+			if err != nil {
+				return err
+			}
+			if gone {
+				summary.recordRemoval(entry.Action, keep, remove)
+			}
+		}
+	}
+
+	reportInUse(args, summary)
+
+	verb := "Removed"
+	if !args.Live {
+		verb = "Would remove"
+	}
+	log.Printf("%s %d files (%d bytes).", verb, summary.Removed,
+		summary.RemovedBytes)
+
+	if refused > 0 {
+		return fmt.Errorf("refused %d of %d entries", refused, len(plan.Entries))
+	}
+	return nil
+}
+
+// checkPlanEntry checks that we can carry out the entry: that it makes sense,
+// and that the files it names are still regular files with the size and
+// checksum it says, and that no earlier entry removes them or removes a file
+// it makes a symbolic link to. Unless -trust-hash says not to, we also compare
+// the files to remove with the one to keep byte by byte, as the checksum may
+// be one that is easy to collide. It returns the files to keep and remove, or
+// a description of the problem.
+func checkPlanEntry(args *Args, entry PlanEntry,
+	removed, linked map[string]bool) (*File, []*File, string) {
+	if !planActions[entry.Action] {
+		return nil, nil, fmt.Sprintf("unknown action: %s", entry.Action)
+	}
+	if entry.Keep == "" {
+		return nil, nil, "it keeps no file"
+	}
+	if len(entry.Remove) == 0 {
+		return nil, nil, "it removes no files"
+	}
+	hash, err := hex.DecodeString(entry.Hash)
+	if err != nil || len(hash) == 0 {
+		return nil, nil, fmt.Sprintf("invalid checksum: %q", entry.Hash)
+	}
+
+	names := append([]string{entry.Keep}, entry.Remove...)
+
+	// We can't reach a copy kept on another machine, so all we can check is
+	// that the files to remove still have its checksum.
+	var keep *File
+	if entry.KeepHost != "" {
+		if entry.Action != actionDelete {
+			return nil, nil, fmt.Sprintf("a %s can't reach %s on %s", entry.Action,
+				entry.Keep, entry.KeepHost)
+		}
+		if !args.TrustHash {
+			return nil, nil, fmt.Sprintf(
+				"it keeps the copy on %s, so we can't compare with it. Use -trust-hash to trust the checksums",
+				entry.KeepHost)
+		}
+		if args.Paranoid {
+			return nil, nil, fmt.Sprintf(
+				"it keeps the copy on %s, so -paranoid can't compare with it",
+				entry.KeepHost)
+		}
+		keep = &File{
+			Basename: path.Base(entry.Keep),
+			Path:     entry.KeepHost + ":" + entry.Keep,
+			Size:     entry.Size,
+			Hash:     hash,
+			remote:   true,
+		}
+		names = entry.Remove
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			return nil, nil, fmt.Sprintf("it names %s more than once", name)
+		}
+		seen[name] = true
+		if removed[name] {
+			return nil, nil, fmt.Sprintf("an earlier entry removes %s", name)
+		}
+	}
+	for _, name := range entry.Remove {
+		if linked[name] {
+			return nil, nil, fmt.Sprintf(
+				"an earlier entry makes symbolic links to %s", name)
+		}
+	}
+
+	var files []*File
+	for _, name := range names {
+		fi, err := os.Lstat(name)
+		if err != nil {
+			return nil, nil, fmt.Sprintf("%s: %s", name, err)
+		}
+		if !fi.Mode().IsRegular() {
+			return nil, nil, fmt.Sprintf("%s is not a regular file", name)
+		}
+		if fi.Size() != entry.Size {
+			return nil, nil, fmt.Sprintf("%s: size changed from %d to %d", name,
+				entry.Size, fi.Size())
+		}
+
+		file := &File{
+			Basename: fi.Name(),
+			Path:     name,
+			Size:     fi.Size(),
+			ModTime:  fi.ModTime(),
+		}
+		if err := retry(args, func() error {
+			return hashFile(args, file)
+		}); err != nil {
+			return nil, nil, fmt.Sprintf("unable to checksum: %s", err)
+		}
+		if !bytes.Equal(file.Hash, hash) {
+			return nil, nil, fmt.Sprintf("%s no longer has checksum %s", name,
+				entry.Hash)
+		}
+		files = append(files, file)
+	}
+
+	if keep != nil {
+		return keep, files, ""
+	}
+
+	if !args.TrustHash {
+		for _, file := range files[1:] {
+			identical, err := isIdentical(args, files[0], file)
+			if err != nil {
+				return nil, nil, fmt.Sprintf("unable to compare %s with %s: %s",
+					file.Path, files[0].Path, err)
+			}
+			if !identical {
+				return nil, nil, fmt.Sprintf("%s differs from %s", file.Path,
+					files[0].Path)
+			}
+		}
+	}
+
+	return files[0], files[1:], ""
+}
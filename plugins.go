@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+	"time"
+)
+
+// Plugins are programs that add logic we don't have, so that it doesn't need
+// a fork: matchers that decide which files are duplicates, such as DICOM
+// images with the same pixels but different headers, and actions that deal
+// with a duplicate in their own way.
+//
+// We start each plugin the first time we need it and keep it running for the
+// rest of the run. We talk to it over its standard input and output, a JSON
+// object per line: we send a request and it answers with a response. What it
+// writes to stderr goes to ours. The protocol is described in the README.
+
+// pluginProtocolVersion is the version of the protocol. We change it only if
+// we change the protocol in a way that could break a plugin.
+const pluginProtocolVersion = 1
+
+// Kinds of plugin requests.
+const (
+	pluginKey    = "key"
+	pluginAction = "action"
+)
+
+// Plugin is a plugin in the configuration.
+type Plugin struct {
+	// Command is the program to run and its arguments.
+	Command []string `json:"command" yaml:"command" toml:"command"`
+
+	// The running plugin, once we start it. mu serialises requests.
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	enc    *json.Encoder
+	stdout *bufio.Scanner
+}
+
+// Matcher says to ask a plugin which of the files matching Include are
+// duplicates, rather than comparing their contents. A pattern without a /
+// matches the name. Others match the full path.
+type Matcher struct {
+	Plugin  string   `json:"plugin" yaml:"plugin" toml:"plugin"`
+	Include []string `json:"include" yaml:"include" toml:"include"`
+}
+
+// pluginFile describes a file to a plugin.
+type pluginFile struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// pluginRequest is a request to a plugin.
+type pluginRequest struct {
+	Version int    `json:"version"`
+	Request string `json:"request"`
+
+	// For key requests.
+	File *pluginFile `json:"file,omitempty"`
+
+	// For action requests.
+	Action string      `json:"action,omitempty"`
+	Keep   *pluginFile `json:"keep,omitempty"`
+	Remove *pluginFile `json:"remove,omitempty"`
+}
+
+// pluginResponse is a plugin's answer. Error says the plugin couldn't do what
+// we asked for this file, which doesn't stop the run.
+type pluginResponse struct {
+	Error string `json:"error"`
+
+	// For key requests, files with the same key are duplicates. A blank key
+	// says the plugin doesn't know, so we compare the file as usual.
+	Key string `json:"key"`
+
+	// For action requests, Done says the file to remove is gone as a separate
+	// copy.
+	Done bool `json:"done"`
+}
+
+func newPluginFile(file *File) *pluginFile {
+	return &pluginFile{Path: file.Path, Size: file.Size, ModTime: file.ModTime}
+}
+
+// request sends the plugin a request and reads its response, starting it if
+// it isn't running. An error means we can't talk to it.
+func (p *Plugin) request(req pluginRequest) (*pluginResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cmd == nil {
+		if err := p.start(); err != nil {
+			return nil, err
+		}
+	}
+
+	req.Version = pluginProtocolVersion
+	if err := p.enc.Encode(req); err != nil {
+		return nil, fmt.Errorf("unable to send request: %s", err)
+	}
+
+	if !p.stdout.Scan() {
+		if err := p.stdout.Err(); err != nil {
+			return nil, fmt.Errorf("unable to read response: %s", err)
+		}
+		return nil, fmt.Errorf("it exited without responding")
+	}
+	var resp pluginResponse
+	if err := json.Unmarshal(p.stdout.Bytes(), &resp); err != nil {
+		return nil, fmt.Errorf("invalid response: %s", err)
+	}
+	return &resp, nil
+}
+
+// start runs the plugin. The caller must hold mu.
+func (p *Plugin) start() error {
+	cmd := exec.Command(p.Command[0], p.Command[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("unable to start: %s", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("unable to start: %s", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("unable to start: %s", err)
+	}
+
+	p.cmd = cmd
+	p.stdin = stdin
+	p.enc = json.NewEncoder(stdin)
+	p.stdout = bufio.NewScanner(stdout)
+	p.stdout.Buffer(nil, 1<<20)
+	return nil
+}
+
+// stop closes the plugin's standard input, telling it we're done, and waits
+// for it to exit.
+func (p *Plugin) stop() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cmd == nil {
+		return nil
+	}
+
+	_ = p.stdin.Close()
+	err := p.cmd.Wait()
+	p.cmd = nil
+	return err
+}
+
+// stopPlugins stops the plugins we started.
+func stopPlugins(config *Config) {
+	for name, plugin := range config.Plugins {
+		if err := plugin.stop(); err != nil {
+			warnf("Plugin %s failed: %s", name, err)
+		}
+	}
+}
+
+// matchWithPlugins asks the matchers' plugins for the keys of the files they
+// include, and groups the files with the same key. It returns the files left
+// for comparing as usual and the groups of duplicates. Each file goes to the
+// first matcher including it.
+func matchWithPlugins(args *Args, config *Config,
+	files []*File) ([]*File, [][]*File, error) {
+	if len(config.Matchers) == 0 {
+		return files, nil, nil
+	}
+
+	type key struct {
+		matcher int
+		key     string
+	}
+	keyed := make(map[key][]*File)
+	var order []key
+	var rest []*File
+
+Files:
+	for _, file := range files {
+		for i, matcher := range config.Matchers {
+			if !isExcluded(matcher.Include, file.Path) {
+				continue
+			}
+			resp, err := config.Plugins[matcher.Plugin].request(pluginRequest{
+				Request: pluginKey,
+				File:    newPluginFile(file),
+			})
+			if err != nil {
+				return nil, nil, fmt.Errorf("plugin %s: %s", matcher.Plugin, err)
+			}
+			if resp.Error != "" {
+				warnf("Plugin %s was unable to match %s: %s. Comparing it as usual.",
+					matcher.Plugin, file.Path, resp.Error)
+				break
+			}
+			if resp.Key == "" {
+				break
+			}
+
+			k := key{i, resp.Key}
+			if _, ok := keyed[k]; !ok {
+				order = append(order, k)
+			}
+			keyed[k] = append(keyed[k], file)
+			continue Files
+		}
+		rest = append(rest, file)
+	}
+
+	// The key stands in for the checksum in reports and the like, so we make
+	// it look like one.
+	var groups [][]*File
+	for _, k := range order {
+		group := keyed[k]
+		if len(group) < 2 {
+			rest = append(rest, group...)
+			continue
+		}
+		hasher := hashAlgorithms[args.Hash]()
+		_, _ = io.WriteString(hasher, config.Matchers[k.matcher].Plugin+"\x00"+k.key)
+		sum := hasher.Sum(nil)
+		for _, file := range group {
+			file.Hash = sum
+			file.matcher = config.Matchers[k.matcher].Plugin
+		}
+		groups = append(groups, group)
+	}
+	return rest, groups, nil
+}
+
+// stillDuplicates checks that keep and remove are still duplicates before we
+// remove one. For files a matcher found, we ask its plugin again. Otherwise
+// we compare them byte by byte.
+func stillDuplicates(args *Args, config *Config, keep, remove *File) (bool,
+	error) {
+	if keep.matcher == "" || keep.matcher != remove.matcher {
+		return isIdentical(args, keep, remove)
+	}
+
+	plugin := config.Plugins[keep.matcher]
+	var keys []string
+	for _, file := range []*File{keep, remove} {
+		resp, err := plugin.request(pluginRequest{
+			Request: pluginKey,
+			File:    newPluginFile(file),
+		})
+		if err != nil {
+			return false, fmt.Errorf("plugin %s: %s", keep.matcher, err)
+		}
+		if resp.Error != "" {
+			return false, fmt.Errorf("plugin %s: %s", keep.matcher, resp.Error)
+		}
+		keys = append(keys, resp.Key)
+	}
+	return keys[0] != "" && keys[0] == keys[1], nil
+}
+
+// pluginDuplicate asks the action's plugin to deal with remove. As with the
+// exec action, the plugin failing for this pair is a problem with the pair
+// rather than the run, so we report it and carry on.
+func pluginDuplicate(config *Config, action string, keep, remove *File) (bool,
+	error) {
+	resp, err := config.Plugins[action].request(pluginRequest{
+		Request: pluginAction,
+		Action:  action,
+		Keep:    newPluginFile(keep),
+		Remove:  newPluginFile(remove),
+	})
+	if err != nil {
+		return false, fmt.Errorf("plugin %s: %s", action, err)
+	}
+	if resp.Error != "" {
+		warnf("Plugin %s failed for %s: %s", action, remove.Path, resp.Error)
+		return false, nil
+	}
+	return resp.Done, nil
+}
+
+// validatePlugins checks the plugins and matchers.
+func validatePlugins(config *Config) []error {
+	var errs []error
+
+	for name, plugin := range config.Plugins {
+		field := fmt.Sprintf("plugins.%s", name)
+		switch name {
+		case actionDelete, actionHardlink, actionSymlink, actionReflink,
+			actionExec, actionReport:
+			errs = append(errs, fieldError{field,
+				"must not have the name of an action"})
+		}
+		if plugin == nil || len(plugin.Command) == 0 || plugin.Command[0] == "" {
+			errs = append(errs, fieldError{field + ".command", "missing"})
+		}
+	}
+
+	for i, matcher := range config.Matchers {
+		field := fmt.Sprintf("matchers[%d]", i)
+		if _, ok := config.Plugins[matcher.Plugin]; !ok {
+			errs = append(errs, fieldError{field + ".plugin",
+				fmt.Sprintf("no such plugin: %q", matcher.Plugin)})
+		}
+		if len(matcher.Include) == 0 {
+			errs = append(errs, fieldError{field + ".include", "missing"})
+		}
+		for j, pattern := range matcher.Include {
+			if _, err := path.Match(pattern, ""); err != nil {
+				errs = append(errs, fieldError{
+					fmt.Sprintf("%s.include[%d]", field, j),
+					fmt.Sprintf("invalid pattern: %s", err)})
+			}
+		}
+	}
+	return errs
+}
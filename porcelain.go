@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// porcelainVersion is the version of the -porcelain format. We change it only
+// if we change the format in a way that could break a script reading it. Adding
+// a new kind of line is not such a change.
+const porcelainVersion = 1
+
+// The -porcelain format is lines of tab-separated fields. The first field says
+// what the line is:
+//
+//   version  VERSION
+//   group    HASH  SIZE  COUNT
+//   file     HASH  STATUS  ACTION  PATH
+//   in-use   PATH
+//   broken-symlink  PATH
+//   special  KIND  PATH
+//   summary  FILES  GROUPS  DUPLICATE_FILES  DUPLICATE_BYTES  REMOVED  REMOVED_BYTES
+//
+// The version line comes first. Each group line is followed by a file line for
+// each of its files. STATUS is kept, removed, would-remove (in non-live mode or
+// for a dry run rule), or untouched. ACTION is delete, hardlink, exec, or - if
+// we didn't remove the file. In paths, backslash, tab and newline are written
+// as \\, \t and \n.
+//
+// With -skip-open, an in-use line before the summary names each duplicate we
+// didn't remove because another process had it open. Its file line says it is
+// untouched or kept. With -broken-symlinks, a broken-symlink line before the
+// summary names each symbolic link pointing at nothing. With
+// -report-special-files, a special line before the summary names each special
+// file we skipped. KIND is fifo, socket, char-device, block-device, or
+// irregular.
+
+func writePorcelainVersion(w io.Writer) error {
+	return writePorcelainLine(w, "version", fmt.Sprint(porcelainVersion))
+}
+
+func writePorcelainGroup(w io.Writer, group []*File,
+	removed map[*File]removal) error {
+	hash := fmt.Sprintf("%x", group[0].Hash)
+
+	if err := writePorcelainLine(w, "group", hash, fmt.Sprint(group[0].Size),
+		fmt.Sprint(len(group))); err != nil {
+		return err
+	}
+
+	for _, file := range group {
+		status, action := "untouched", "-"
+		if r, ok := removed[file]; ok {
+			status, action = "removed", r.action
+			if !r.live {
+				status = "would-remove"
+			}
+		} else if len(removed) > 0 {
+			status = "kept"
+		}
+
+		if err := writePorcelainLine(w, "file", hash, status, action,
+			escapePorcelain(file.Path)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writePorcelainInUse(w io.Writer, summary *Summary) error {
+	for _, name := range summary.inUse {
+		if err := writePorcelainLine(w, "in-use",
+			escapePorcelain(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writePorcelainBrokenSymlinks(w io.Writer, summary *Summary) error {
+	for _, name := range summary.brokenSymlinks {
+		if err := writePorcelainLine(w, "broken-symlink",
+			escapePorcelain(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writePorcelainSpecialFiles(w io.Writer, summary *Summary) error {
+	for _, file := range summary.specialFiles {
+		if err := writePorcelainLine(w, "special", file.Kind,
+			escapePorcelain(file.Path)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writePorcelainSummary(w io.Writer, summary *Summary) error {
+	return writePorcelainLine(w, "summary",
+		fmt.Sprint(summary.Files),
+		fmt.Sprint(summary.DuplicateGroups),
+		fmt.Sprint(summary.DuplicateFiles),
+		fmt.Sprint(summary.DuplicateBytes),
+		fmt.Sprint(summary.Removed),
+		fmt.Sprint(summary.RemovedBytes),
+	)
+}
+
+func writePorcelainLine(w io.Writer, fields ...string) error {
+	if _, err := io.WriteString(w, strings.Join(fields, "\t")+"\n"); err != nil {
+		return fmt.Errorf("unable to write output: %s", err)
+	}
+	return nil
+}
+
+var porcelainEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`)
+
+func escapePorcelain(s string) string {
+	return porcelainEscaper.Replace(s)
+}
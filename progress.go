@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// When stderr is a terminal, we show how many files we've checksummed on one
+// line we keep rewriting. Elsewhere, such as in cron mail or a redirected log,
+// the carriage returns that does this with would only make a mess, so we log
+// a plain line now and then instead.
+//
+// We update progress every -progress-interval rather than after each file,
+// which would be far too often for millions of small files. As we also count
+// the bytes we read, progress moves while we read a huge file too.
+
+// How often we update progress if -progress-interval doesn't say.
+const (
+	terminalProgressInterval = 200 * time.Millisecond
+	plainProgressInterval    = time.Minute
+)
+
+// hashing holds the progress of the checksumming under way, if any. hashFile
+// counts the bytes it reads in it. Status snapshots read it from another
+// goroutine, so mu guards it.
+var hashing struct {
+	mu       sync.Mutex
+	progress *progress
+}
+
+// setHashProgress says what checksumming is under way, or nil if none.
+func setHashProgress(p *progress) {
+	hashing.mu.Lock()
+	defer hashing.mu.Unlock()
+	hashing.progress = p
+}
+
+// hashProgress returns the progress of the checksumming under way, if any.
+func hashProgress() *progress {
+	hashing.mu.Lock()
+	defer hashing.mu.Unlock()
+	return hashing.progress
+}
+
+// progress reports how far through a set of files we are.
+type progress struct {
+	// done counts the files we finished, and bytes the bytes we read from
+	// them. Only hashFile counts bytes. Others, such as reading just the start
+	// of files, read too little to need to. These come first so they're
+	// aligned for atomic access on 32-bit platforms.
+	done  int64
+	bytes int64
+
+	total      int
+	totalBytes int64
+	started    time.Time
+
+	// terminal says whether stderr is one.
+	terminal bool
+
+	stop    chan struct{}
+	stopped sync.WaitGroup
+
+	// shown is what we last showed, so we don't show the same again.
+	shown string
+}
+
+// startProgress starts reporting progress through the files every interval,
+// or if that is 0, at the default interval for where stderr goes.
+func startProgress(files []*File, interval time.Duration) *progress {
+	p := &progress{
+		total:    len(files),
+		terminal: isTerminal(os.Stderr),
+		stop:     make(chan struct{}),
+		started:  time.Now(),
+	}
+	for _, file := range files {
+		p.totalBytes += file.Size
+	}
+
+	if interval <= 0 {
+		interval = plainProgressInterval
+		if p.terminal {
+			interval = terminalProgressInterval
+		}
+	}
+
+	p.stopped.Add(1)
+	go func() {
+		defer p.stopped.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.show()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+
+	return p
+}
+
+// add counts files we finished.
+func (p *progress) add(n int) {
+	atomic.AddInt64(&p.done, int64(n))
+}
+
+// Write counts bytes we read.
+func (p *progress) Write(buf []byte) (int, error) {
+	atomic.AddInt64(&p.bytes, int64(len(buf)))
+	return len(buf), nil
+}
+
+// show shows how far we are, if that changed since we last did.
+func (p *progress) show() {
+	var data string
+	if bytes := atomic.LoadInt64(&p.bytes); bytes > 0 && p.totalBytes > 0 {
+		data = fmt.Sprintf(" (%d%% of the data)", bytes*100/p.totalBytes)
+	}
+	status := fmt.Sprintf("%d/%d", atomic.LoadInt64(&p.done), p.total)
+	if status+data == p.shown {
+		return
+	}
+	p.shown = status + data
+
+	if p.terminal {
+		fmt.Fprintf(os.Stderr, "\r%s%s", status, data)
+		return
+	}
+	log.Printf("Checksummed %s files%s", status, data)
+}
+
+// finish stops reporting progress. On a terminal, we show where we finished
+// and end the line.
+func (p *progress) finish() {
+	close(p.stop)
+	p.stopped.Wait()
+
+	if p.terminal {
+		p.show()
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+}
+
+// status describes how far we are, how fast we're going, and how long is
+// left, for status snapshots. We estimate by bytes if we're counting them,
+// and otherwise by files.
+func (p *progress) status() string {
+	done := atomic.LoadInt64(&p.done)
+	bytes := atomic.LoadInt64(&p.bytes)
+	elapsed := time.Since(p.started)
+
+	status := fmt.Sprintf("checksummed %d/%d files", done, p.total)
+	if bytes > 0 && p.totalBytes > 0 {
+		status += fmt.Sprintf(" and %d/%d bytes", bytes, p.totalBytes)
+	}
+
+	seconds := elapsed.Seconds()
+	if seconds <= 0 {
+		return status
+	}
+
+	var left time.Duration
+	if bytes > 0 {
+		rate := float64(bytes) / seconds
+		status += fmt.Sprintf(", %.0f bytes/s", rate)
+		left = time.Duration(float64(p.totalBytes-bytes) / rate * float64(time.Second))
+	} else if done > 0 {
+		rate := float64(done) / seconds
+		status += fmt.Sprintf(", %.1f files/s", rate)
+		left = time.Duration(float64(int64(p.total)-done) / rate * float64(time.Second))
+	} else {
+		return status
+	}
+	return status + fmt.Sprintf(", about %s left", left.Round(time.Second))
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// With -delete-prompt, we ask which copies in each group to keep and delete
+// the rest, as fdupes -d does. Rules don't apply to the groups we ask about.
+
+// resolveGroupByPrompt asks which of the group's copies to keep and deletes
+// the others. It returns whether we asked. If the user chooses to stop being
+// asked, we didn't, and the rules decide as usual.
+func resolveGroupByPrompt(
+	args *Args,
+	config *Config,
+	group []*File,
+	summary *Summary,
+) (bool, error) {
+	keepers, err := promptForKeepers(group)
+	if err != nil {
+		return false, err
+	}
+	if keepers == nil {
+		args.DeletePrompt = false
+		return false, nil
+	}
+
+	if args.newAnswers != nil {
+		var keep, remove []*File
+		for i, file := range group {
+			if keepers[i] {
+				keep = append(keep, file)
+			} else {
+				remove = append(remove, file)
+			}
+		}
+		if err := args.newAnswers.record(group, keep, remove); err != nil {
+			return false, err
+		}
+	}
+
+	var keep *File
+	for i, file := range group {
+		if keepers[i] {
+			keep = file
+			break
+		}
+	}
+
+	minCopies := config.minCopies()
+	remaining := len(group)
+	fates := make(map[*File]removal)
+
+	for i, remove := range group {
+		if keepers[i] {
+			continue
+		}
+
+		if pattern, ok := protectedBy(config, remove.Path); ok {
+			warnf("You chose to delete %s but it is protected by %s. Skipping it.",
+				remove.Path, pattern)
+			continue
+		}
+
+		if remaining-1 < minCopies {
+			log.Printf("Not deleting %s: we keep at least %d copies", remove.Path,
+				minCopies)
+			continue
+		}
+
+		if !withinLimits(args, summary, remove) {
+			continue
+		}
+
+		gone, err := applyAction(args, config, actionDelete, nil, keep, remove,
+			args.Live)
+		if err != nil {
+			return true, err
+		}
+		if gone {
+			remaining--
+			fates[remove] = removal{action: actionDelete, live: args.Live}
+			summary.recordRemoval(actionDelete, keep, remove)
+			if args.plan != nil {
+				args.plan.add(summary.resolving, actionDelete, keep, remove)
+			}
+		}
+	}
+
+	return true, reportGroup(args, group, fates)
+}
+
+// promptForKeepers lists the group's files and asks which to keep. It returns
+// the positions in the group of the files to keep, or nil if the user wants
+// to stop being asked.
+func promptForKeepers(group []*File) (map[int]bool, error) {
+	fmt.Printf("%d copies of %x (%d bytes each):\n", len(group), group[0].Hash,
+		group[0].Size)
+	for i, file := range group {
+		fmt.Printf("  [%d] %s\n", i+1, file.Path)
+	}
+
+	for {
+		fmt.Printf("Keep which? Give numbers and ranges such as 1,3-4, [all], or [q]uit asking: ")
+
+		line, err := stdin.ReadString('\n')
+		if err == io.EOF {
+			// Nobody is there to ask.
+			fmt.Println()
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read answer: %s", err)
+		}
+
+		answer := strings.TrimSpace(line)
+		if answer == "q" {
+			return nil, nil
+		}
+
+		keepers, err := parseKeepers(answer, len(group))
+		if err != nil {
+			fmt.Printf("%s\n", err)
+			continue
+		}
+		return keepers, nil
+	}
+}
+
+// parseKeepers reads a list of positions in a group of count files, such as
+// "1,3-4" or "all". Positions start at 1, and we return them starting at 0.
+// Commas or spaces separate the items. The list must name at least one file.
+func parseKeepers(answer string, count int) (map[int]bool, error) {
+	keepers := make(map[int]bool)
+
+	items := strings.FieldsFunc(answer, func(c rune) bool {
+		return c == ',' || c == ' '
+	})
+	for _, item := range items {
+		if item == "all" {
+			for i := 0; i < count; i++ {
+				keepers[i] = true
+			}
+			continue
+		}
+
+		first, last := item, item
+		if i := strings.Index(item, "-"); i > 0 {
+			first, last = item[:i], item[i+1:]
+		}
+
+		start, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a number or range", item)
+		}
+		end, err := strconv.Atoi(last)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a number or range", item)
+		}
+		if start < 1 || end > count || start > end {
+			return nil, fmt.Errorf("%s is not between 1 and %d", item, count)
+		}
+
+		for i := start; i <= end; i++ {
+			keepers[i-1] = true
+		}
+	}
+
+	if len(keepers) == 0 {
+		return nil, fmt.Errorf("choose at least one copy to keep")
+	}
+	return keepers, nil
+}
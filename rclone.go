@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The rclone subcommand lists the files on an rclone remote and sends them to
+// a coordinator as an agent would (see agent.go). rclone can reach dozens of
+// cloud storage providers, and many tell it each file's checksum, so we can
+// look for copies of local files there without downloading them.
+
+// rcloneEntry is a file as rclone lsjson describes it. Hashes holds the
+// checksums the remote knows, by rclone's name for the algorithm.
+type rcloneEntry struct {
+	Path    string            `json:"Path"`
+	Size    int64             `json:"Size"`
+	ModTime time.Time         `json:"ModTime"`
+	IsDir   bool              `json:"IsDir"`
+	Hashes  map[string]string `json:"Hashes"`
+}
+
+// rcloneHashes holds the hash algorithms both we and rclone know. rclone uses
+// the same names for them.
+var rcloneHashes = map[string]bool{
+	"md5":    true,
+	"sha1":   true,
+	"sha256": true,
+}
+
+func rcloneHashNames() []string {
+	var names []string
+	for name := range rcloneHashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// rclone implements the rclone subcommand.
+func rclone(argv []string) error {
+	fs := flag.NewFlagSet("rclone", flag.ExitOnError)
+	remote := fs.String("remote", "",
+		"rclone remote and path to list, such as gdrive:Photos.")
+	coordinator := fs.String("coordinator", "",
+		"URL of the coordinator to send records to, or - to write them to stdout.")
+	host := fs.String("host", "",
+		"Name of the remote in the coordinator's report. The default is the remote's name.")
+	hashName := fs.String("hash", "md5",
+		fmt.Sprintf("Checksum to ask the remote for. One of: %s. The coordinator needs every agent to use the same one.",
+			strings.Join(rcloneHashNames(), ", ")))
+	program := fs.String("rclone", "rclone", "Path to the rclone program.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(),
+			"Usage: %s rclone -remote REMOTE:PATH -coordinator URL\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	_ = fs.Parse(argv)
+
+	if *remote == "" || *coordinator == "" {
+		fs.Usage()
+		return fmt.Errorf("you must provide a remote and a coordinator")
+	}
+
+	i := strings.Index(*remote, ":")
+	if i < 1 {
+		return fmt.Errorf("%s is not an rclone remote. Give it as REMOTE:PATH",
+			*remote)
+	}
+	if *host == "" {
+		*host = (*remote)[:i]
+	}
+	if strings.ContainsAny(*host, ":/") {
+		return fmt.Errorf("invalid host: %q", *host)
+	}
+
+	if !rcloneHashes[*hashName] {
+		return fmt.Errorf("rclone doesn't support the %s hash", *hashName)
+	}
+
+	if *coordinator != "-" {
+		if err := checkCoordinatorURL(*coordinator); err != nil {
+			return err
+		}
+	}
+
+	dir := path.Join("/", (*remote)[i+1:])
+
+	log.Printf("Listing files on %s...", *remote)
+	files, unchecksummed, err := listRemote(*program, *remote, dir, *hashName)
+	if err != nil {
+		return err
+	}
+	if unchecksummed > 0 {
+		log.Printf("Skipping %d files the remote has no %s checksum for",
+			unchecksummed, *hashName)
+	}
+
+	header := agentHeader{
+		Version:   agentProtocolVersion,
+		Host:      *host,
+		Dir:       dir,
+		Algorithm: *hashName,
+	}
+
+	return deliverAgentRecords(*coordinator, header, files)
+}
+
+// listRemote runs rclone lsjson to list the files under the remote, which is
+// at dir on the remote. It also returns how many files had no checksum of the
+// kind we asked for. Some remotes have none, and some have none for some
+// files, such as those uploaded in several parts.
+func listRemote(program, remote, dir, hashName string) ([]*File, int, error) {
+	cmd := exec.Command(program, "lsjson", "--recursive", "--files-only",
+		"--hash", "--hash-type", hashName, remote)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to run rclone: %s", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, 0, fmt.Errorf("unable to run rclone: %s", err)
+	}
+
+	files, unchecksummed, err := readRcloneEntries(bufio.NewReader(stdout),
+		dir, hashName)
+	if err != nil {
+		// Let rclone exit rather than block writing to us.
+		_, _ = io.Copy(ioutil.Discard, stdout)
+		_ = cmd.Wait()
+		return nil, 0, err
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return nil, 0, fmt.Errorf("rclone failed: %s", err)
+	}
+
+	return files, unchecksummed, nil
+}
+
+// readRcloneEntries reads rclone lsjson's output. It is a JSON array with one
+// element per file, each with a path relative to dir. We decode one element
+// at a time, as a remote may have more files than we would like to hold as
+// JSON at once.
+func readRcloneEntries(r io.Reader, dir,
+	hashName string) ([]*File, int, error) {
+	decoder := json.NewDecoder(r)
+
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		return nil, 0, fmt.Errorf("invalid output from rclone: expected a list")
+	}
+
+	var files []*File
+	unchecksummed := 0
+	for decoder.More() {
+		var entry rcloneEntry
+		if err := decoder.Decode(&entry); err != nil {
+			return nil, 0, fmt.Errorf("invalid output from rclone: %s", err)
+		}
+		if entry.IsDir {
+			continue
+		}
+
+		checksum := entry.Hashes[hashName]
+		if checksum == "" {
+			unchecksummed++
+			continue
+		}
+		hash, err := hex.DecodeString(checksum)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid checksum from rclone for %s: %s",
+				entry.Path, err)
+		}
+
+		filePath := path.Join(dir, entry.Path)
+		files = append(files, &File{
+			Basename: path.Base(filePath),
+			Path:     filePath,
+			Size:     entry.Size,
+			ModTime:  entry.ModTime,
+			Hash:     hash,
+		})
+	}
+
+	if _, err := decoder.Token(); err != nil {
+		return nil, 0, fmt.Errorf("invalid output from rclone: %s", err)
+	}
+
+	return files, unchecksummed, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import "io"
+
+// readAhead copies from r to w, reading the next block in one goroutine while
+// another writes the current block. When w is a hash, this overlaps waiting on
+// the disk with hashing rather than taking turns. That matters most on
+// spinning disks and network filesystems, where each read waits a long time.
+func readAhead(r io.Reader, w io.Writer, blockSize int) (int64, error) {
+	type block struct {
+		buf []byte
+		n   int
+		err error
+	}
+
+	// Two buffers: one being filled, one being written. Each goes back to the
+	// reader once we've written it.
+	free := make(chan []byte, 2)
+	free <- make([]byte, blockSize)
+	free <- make([]byte, blockSize)
+
+	blocks := make(chan block, 1)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		defer close(blocks)
+		for {
+			var buf []byte
+			select {
+			case buf = <-free:
+			case <-done:
+				return
+			}
+
+			n, err := io.ReadFull(r, buf)
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+
+			select {
+			case blocks <- block{buf: buf, n: n, err: err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var written int64
+	for b := range blocks {
+		if b.n > 0 {
+			n, err := w.Write(b.buf[:b.n])
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+		}
+
+		if b.err == io.EOF {
+			return written, nil
+		}
+		if b.err != nil {
+			return written, b.err
+		}
+
+		free <- b.buf
+	}
+
+	return written, nil
+}
@@ -0,0 +1,16 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// reflinkSupported says whether cloneFile works on this platform.
+const reflinkSupported = true
+
+// cloneFile creates dst as an APFS clone of src, sharing its data on disk,
+// with clonefile(2). It fails on filesystems other than APFS or if the files
+// are on different volumes.
+//
+// The clone gets src's permissions, ownership, and extended attributes rather
+// than the file it replaces. See link_metadata.
+func cloneFile(src, dst string) error {
+	return unix.Clonefile(src, dst, unix.CLONE_NOFOLLOW)
+}
@@ -0,0 +1,15 @@
+//go:build !darwin && !linux
+// +build !darwin,!linux
+
+package main
+
+import "fmt"
+
+// reflinkSupported says whether cloneFile works on this platform.
+const reflinkSupported = false
+
+// cloneFile creates dst sharing src's data on disk. We don't know how to on
+// this platform.
+func cloneFile(src, dst string) error {
+	return fmt.Errorf("reflinks are not supported on this platform")
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// A long-running command, such as a coordinator listening for agents or
+// serve, reads its configuration file again on SIGHUP. That way rules can
+// change without restarting it and losing what it has gathered so far. If the
+// file no longer holds a valid configuration, we say so and carry on with the
+// one we have.
+//
+// A new configuration replaces the old one entirely: a setting it leaves out
+// goes back to what the command's flags or our defaults say, rather than
+// keeping the old configuration's value.
+
+// configReloader holds the configuration, replacing it on SIGHUP.
+type configReloader struct {
+	mu     sync.Mutex
+	file   string
+	args   *Args
+	config *Config
+
+	// files holds what the configuration files held when we read the
+	// configuration. See readConfigFiles.
+	files configFiles
+
+	// stopped says the command is using the configuration we have, so we no
+	// longer reload it.
+	stopped bool
+
+	signals chan os.Signal
+}
+
+// watchConfigReload starts reloading the configuration file on SIGHUP. args
+// are the settings the command started with before applying any
+// configuration's, to check the settings of a new configuration against.
+// files, if the command needs them, are what the configuration files held.
+func watchConfigReload(
+	file string,
+	args *Args,
+	config *Config,
+	files configFiles,
+) *configReloader {
+	r := &configReloader{
+		file:    file,
+		args:    args,
+		config:  config,
+		files:   files,
+		signals: make(chan os.Signal, 1),
+	}
+	signal.Notify(r.signals, syscall.SIGHUP)
+	go func() {
+		for range r.signals {
+			r.reload()
+		}
+	}()
+	return r
+}
+
+// reload reads and checks the configuration file, and if it is valid,
+// replaces the configuration with it.
+func (r *configReloader) reload() {
+	r.mu.Lock()
+	stopped := r.stopped
+	r.mu.Unlock()
+	if stopped {
+		log.Printf("Not reloading %s: we are already using the configuration we have",
+			r.file)
+		return
+	}
+
+	files := configFiles{}
+	config, err := readConfigFiles(r.file, files)
+	if err != nil {
+		warnf("Not reloading %s: %s. Carrying on with the configuration we have.",
+			r.file, err)
+		return
+	}
+
+	// A configuration that only holds settings would leave the command with
+	// nothing to decide what to do with duplicates.
+	if r.config.decides() && !config.decides() {
+		warnf("Not reloading %s: it has no rules. Carrying on with the configuration we have.",
+			r.file)
+		return
+	}
+
+	// Whether the command is live stays as it started.
+	trial := *r.args
+	applySettings(&trial, config)
+	trial.Live = r.args.Live
+	if err := checkArgs(&trial); err != nil {
+		warnf("Not reloading %s: %s. Carrying on with the configuration we have.",
+			r.file, err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		log.Printf("Not reloading %s: we are already using the configuration we have",
+			r.file)
+		return
+	}
+	r.config = config
+	r.files = files
+	log.Printf("Reloaded %s (%d rules)", r.file, len(config.Rules))
+}
+
+// current returns the configuration we have now, and the command's settings
+// with its settings applied.
+func (r *configReloader) current() (*Config, *Args) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	args := *r.args
+	applySettings(&args, r.config)
+	return r.config, &args
+}
+
+// contents returns what the configuration files held when we read the
+// configuration we have now.
+func (r *configReloader) contents() configFiles {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.files
+}
+
+// stop stops reloading on SIGHUP. We go on catching it until the command
+// exits, as otherwise it would kill us.
+func (r *configReloader) stop() {
+	r.mu.Lock()
+	r.stopped = true
+	r.mu.Unlock()
+}
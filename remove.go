@@ -0,0 +1,459 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// What we can do with a duplicate.
+const (
+	// Only report it.
+	actionReport = "report"
+
+	actionDelete = "delete"
+
+	// Replace it with a hard link to the copy we keep.
+	actionHardlink = "hardlink"
+
+	// Replace it with a symbolic link to the copy we keep.
+	actionSymlink = "symlink"
+
+	// Replace it with a copy of the one we keep that shares its data on disk.
+	// Only some filesystems support this, such as Btrfs, XFS, and APFS.
+	actionReflink = "reflink"
+
+	// Run a command to deal with it.
+	actionExec = "exec"
+)
+
+// applyAction deletes remove, a duplicate of keep, or otherwise carries out
+// the action on it. It returns whether remove is gone as a separate copy (or,
+// if not live, whether it would be). command is the command template for the
+// exec action.
+//
+// If not live, we only report what we would do. This is the case in non-live
+// mode and for rules marked as dry runs. If live, we first check that it is
+// still safe to replace the file. If it is not, we skip it and say why. That is
+// not an error as the run can carry on with other duplicates.
+func applyAction(
+	args *Args,
+	config *Config,
+	action string,
+	command []string,
+	keep,
+	remove *File,
+	live bool,
+) (bool, error) {
+	var doing, would, not string
+	var argv []string
+	switch action {
+	case actionExec:
+		argv = expandCommand(command, keep, remove)
+		doing = fmt.Sprintf("Running %s", strings.Join(argv, " "))
+		would = fmt.Sprintf("run %s", strings.Join(argv, " "))
+		not = fmt.Sprintf("Not running the command for %s", remove.Path)
+	case actionHardlink:
+		doing = fmt.Sprintf("Replacing %s with a hard link to %s", remove.Path,
+			keep.Path)
+		would = fmt.Sprintf("replace %s with a hard link to %s", remove.Path,
+			keep.Path)
+		not = fmt.Sprintf("Not replacing %s", remove.Path)
+
+		if alreadyLinked(keep, remove) {
+			log.Printf("%s is already a hard link to %s", remove.Path, keep.Path)
+			return true, nil
+		}
+	case actionSymlink:
+		doing = fmt.Sprintf("Replacing %s with a symbolic link to %s",
+			remove.Path, keep.Path)
+		would = fmt.Sprintf("replace %s with a symbolic link to %s", remove.Path,
+			keep.Path)
+		not = fmt.Sprintf("Not replacing %s", remove.Path)
+	case actionReflink:
+		doing = fmt.Sprintf("Replacing %s with a reflink to %s", remove.Path,
+			keep.Path)
+		would = fmt.Sprintf("replace %s with a reflink to %s", remove.Path,
+			keep.Path)
+		not = fmt.Sprintf("Not replacing %s", remove.Path)
+	default:
+		if _, ok := config.Plugins[action]; ok {
+			doing = fmt.Sprintf("Running plugin %s for %s", action, remove.Path)
+			would = fmt.Sprintf("run plugin %s for %s", action, remove.Path)
+			not = fmt.Sprintf("Not running plugin %s for %s", action, remove.Path)
+			break
+		}
+		doing = fmt.Sprintf("Deleting %s", remove.Path)
+		would = fmt.Sprintf("delete %s", remove.Path)
+		if args.Shred {
+			doing = fmt.Sprintf("Shredding %s", remove.Path)
+			would = fmt.Sprintf("shred %s", remove.Path)
+		}
+		not = fmt.Sprintf("Not deleting %s", remove.Path)
+	}
+
+	if !live {
+		if args.Live {
+			log.Printf("Dry run rule. Would %s", would)
+		} else {
+			log.Printf("Non-live mode. Would %s", would)
+		}
+		if action == actionDelete {
+			rewriteSymlinks(args, keep, remove, false)
+			if sidecar, ok := appleDoubleFor(remove.Path); ok {
+				if pattern, ok := protectedBy(config, sidecar); ok {
+					log.Printf("Would leave AppleDouble file %s: it is protected by %s",
+						sidecar, pattern)
+				} else {
+					log.Printf("Would delete its AppleDouble file %s", sidecar)
+				}
+			}
+			handleSidecars(args, config, keep, remove, false)
+		}
+		if merges(config.MergeMetadata, mergeModTime) &&
+			remove.ModTime.Before(keep.ModTime) {
+			log.Printf("Would give %s the older modification time of %s",
+				keep.Path, remove.Path)
+		}
+		return true, nil
+	}
+
+	if reason := changedSinceHashing(remove); reason != "" {
+		log.Printf("%s: %s", not, reason)
+		return false, nil
+	}
+
+	if reason := keptCopyUnavailable(keep); reason != "" {
+		log.Printf("%s: the copy we keep, %s, is unavailable: %s", not, keep.Path,
+			reason)
+		return false, nil
+	}
+
+	if args.SkipOpen {
+		if reason := inUse(remove); reason != "" {
+			log.Printf("%s: %s", not, reason)
+			args.inUse = append(args.inUse, remove.Path)
+			return false, nil
+		}
+	}
+
+	if args.Shred && action == actionDelete {
+		if reason := unshreddable(remove); reason != "" {
+			log.Printf("%s: unable to shred it: %s", not, reason)
+			return false, nil
+		}
+	}
+
+	if args.Paranoid {
+		identical, err := stillDuplicates(args, config, keep, remove)
+		if err != nil {
+			log.Printf("%s: unable to compare with %s: %s", not, keep.Path, err)
+			return false, nil
+		}
+		if !identical {
+			log.Printf("%s: it is no longer identical to %s", not, keep.Path)
+			return false, nil
+		}
+	}
+
+	hookContext := actionHookContext{
+		Action: action,
+		Keep:   keep.Path,
+		Remove: remove.Path,
+		Size:   remove.Size,
+	}
+
+	if err := runHook(config.Hooks.BeforeDelete, "before_delete",
+		hookContext); err != nil {
+		log.Printf("%s: %s", not, err)
+		return false, nil
+	}
+
+	var meta *fileMetadata
+	if (isLinkAction(action) && config.LinkMetadata != "" &&
+		config.LinkMetadata != metadataNone) || len(config.MergeMetadata) > 0 {
+		var err error
+		meta, err = readMetadata(remove.Path)
+		if err != nil {
+			log.Printf("%s: unable to read its metadata: %s", not, err)
+			return false, nil
+		}
+	}
+
+	_, plugin := config.Plugins[action]
+	if args.Backup != "" && action != actionExec && !plugin {
+		dest, err := backupFile(args.Backup, remove)
+		if err != nil {
+			log.Printf("%s: unable to back it up: %s", not, err)
+			return false, nil
+		}
+		log.Printf("Backed up %s to %s", remove.Path, dest)
+	}
+
+	log.Print(doing)
+
+	var gone bool
+	var err error
+	switch action {
+	case actionHardlink:
+		gone, err = hardlinkDuplicate(keep, remove, not)
+	case actionSymlink:
+		gone, err = symlinkDuplicate(keep, remove, not)
+	case actionReflink:
+		gone, err = reflinkDuplicate(keep, remove, not)
+	case actionExec:
+		gone, err = execDuplicate(argv, keep, remove, config.Sidecars)
+	default:
+		if plugin {
+			gone, err = pluginDuplicate(config, action, keep, remove)
+			break
+		}
+		if args.Shred {
+			if err := shredFile(remove); err != nil {
+				return false, fmt.Errorf("unable to shred: %s: %s", remove.Path, err)
+			}
+		}
+		if err := os.Remove(remove.Path); err != nil {
+			return false, fmt.Errorf("unable to remove: %s: %s", remove.Path, err)
+		}
+		gone = true
+
+		rewriteSymlinks(args, keep, remove, true)
+
+		if sidecar, ok := appleDoubleFor(remove.Path); ok {
+			if pattern, ok := protectedBy(config, sidecar); ok {
+				log.Printf("Leaving AppleDouble file %s: it is protected by %s",
+					sidecar, pattern)
+			} else {
+				log.Printf("Deleting its AppleDouble file %s", sidecar)
+				if err := removeFile(args, sidecar); err != nil {
+					warnf("Unable to remove AppleDouble file: %s: %s", sidecar, err)
+				}
+			}
+		}
+
+		handleSidecars(args, config, keep, remove, true)
+	}
+
+	if gone && meta != nil {
+		for _, err := range preserveMetadata(config.LinkMetadata, action, keep,
+			remove, meta) {
+			warnf("Unable to preserve metadata of %s: %s", remove.Path, err)
+		}
+		for _, err := range mergeMetadata(config.MergeMetadata, keep, meta) {
+			warnf("Unable to give %s the metadata of %s: %s", keep.Path,
+				remove.Path, err)
+		}
+	}
+
+	if gone {
+		if err := runHook(config.Hooks.AfterDelete, "after_delete",
+			hookContext); err != nil {
+			warnf("%s", err)
+		}
+	}
+
+	return gone, err
+}
+
+// expandCommand fills in the exec action's command template. {keep} and
+// {remove} become the paths of the files.
+func expandCommand(command []string, keep, remove *File) []string {
+	replacer := strings.NewReplacer("{keep}", keep.Path, "{remove}", remove.Path)
+
+	var argv []string
+	for _, arg := range command {
+		argv = append(argv, replacer.Replace(arg))
+	}
+	return argv
+}
+
+// execDuplicate runs the exec action's command. We trust it to deal with
+// remove if it succeeds. The paths are also in the environment as
+// DUPEFILE_KEEP and DUPEFILE_REMOVE. If remove has an AppleDouble file, its
+// path is in DUPEFILE_REMOVE_APPLEDOUBLE so that a command moving remove can
+// move it too. Likewise the paths of its sidecars are in
+// DUPEFILE_REMOVE_SIDECARS, one per line.
+//
+// The command failing is a problem with this pair rather than the run, so we
+// report it and carry on.
+func execDuplicate(argv []string, keep, remove *File,
+	sidecars []string) (bool, error) {
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	sidecar, _ := appleDoubleFor(remove.Path)
+	cmd.Env = append(os.Environ(),
+		"DUPEFILE_KEEP="+keep.Path,
+		"DUPEFILE_REMOVE="+remove.Path,
+		"DUPEFILE_REMOVE_APPLEDOUBLE="+sidecar,
+		"DUPEFILE_REMOVE_SIDECARS="+sidecarPaths(sidecars, remove.Path),
+	)
+
+	if err := cmd.Run(); err != nil {
+		log.Printf("Command for %s failed: %s", remove.Path, err)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// alreadyLinked checks whether the two paths are the same file.
+func alreadyLinked(file1, file2 *File) bool {
+	fi1, err := os.Stat(file1.Path)
+	if err != nil {
+		return false
+	}
+
+	fi2, err := os.Stat(file2.Path)
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(fi1, fi2)
+}
+
+// hardlinkDuplicate replaces remove with a hard link to keep.
+//
+// We create the link beside remove and then rename it over remove. The rename
+// is atomic, so there is no moment where remove's path doesn't exist.
+func hardlinkDuplicate(keep, remove *File, not string) (bool, error) {
+	tmp := remove.Path + ".dupefile-link"
+
+	// This fails if the files are on different filesystems. That is a problem
+	// with this pair rather than with the run.
+	if err := os.Link(keep.Path, tmp); err != nil {
+		log.Printf("%s: unable to create hard link: %s", not, err)
+		return false, nil
+	}
+
+	if err := os.Rename(tmp, remove.Path); err != nil {
+		_ = os.Remove(tmp)
+		return false, fmt.Errorf("unable to replace %s with hard link: %s",
+			remove.Path, err)
+	}
+
+	return true, nil
+}
+
+// symlinkDuplicate replaces remove with a symbolic link to keep. The link
+// holds keep's absolute path so that it still works if remove's directory
+// moves. As with hard links, we rename the link over remove.
+func symlinkDuplicate(keep, remove *File, not string) (bool, error) {
+	target, err := filepath.Abs(keep.Path)
+	if err != nil {
+		log.Printf("%s: unable to find the absolute path of %s: %s", not,
+			keep.Path, err)
+		return false, nil
+	}
+
+	tmp := remove.Path + ".dupefile-link"
+	if err := os.Symlink(target, tmp); err != nil {
+		log.Printf("%s: unable to create symbolic link: %s", not, err)
+		return false, nil
+	}
+
+	if err := os.Rename(tmp, remove.Path); err != nil {
+		_ = os.Remove(tmp)
+		return false, fmt.Errorf("unable to replace %s with symbolic link: %s",
+			remove.Path, err)
+	}
+
+	return true, nil
+}
+
+// reflinkDuplicate replaces remove with a reflink to keep: a new file sharing
+// keep's data on disk. Unlike a hard link, it is a separate file, so changing
+// one copy later doesn't change the other.
+//
+// We clone keep beside remove and then rename the clone over remove.
+func reflinkDuplicate(keep, remove *File, not string) (bool, error) {
+	tmp := remove.Path + ".dupefile-link"
+
+	// This fails if the filesystem doesn't support reflinks or the files are on
+	// different filesystems. That is a problem with this pair rather than with
+	// the run.
+	if err := cloneFile(keep.Path, tmp); err != nil {
+		log.Printf("%s: unable to create reflink: %s", not, err)
+		return false, nil
+	}
+
+	if err := os.Rename(tmp, remove.Path); err != nil {
+		_ = os.Remove(tmp)
+		return false, fmt.Errorf("unable to replace %s with reflink: %s",
+			remove.Path, err)
+	}
+
+	return true, nil
+}
+
+// changedSinceHashing checks whether the file still has the size and
+// modification time it had when we found it. If not, it may no longer be a
+// duplicate. It returns how the file changed, or a blank string if it did not.
+func changedSinceHashing(file *File) string {
+	fi, err := os.Lstat(file.Path)
+	if err != nil {
+		return fmt.Sprintf("unable to stat: %s", err)
+	}
+
+	if fi.Size() != file.Size {
+		return fmt.Sprintf("size changed from %d to %d since hashing", file.Size,
+			fi.Size())
+	}
+
+	if !fi.ModTime().Equal(file.ModTime) {
+		return fmt.Sprintf("modification time changed from %s to %s since hashing",
+			file.ModTime, fi.ModTime())
+	}
+
+	return ""
+}
+
+// keptCopyUnavailable checks that the copy we are keeping still exists and is
+// readable. Not being able to read it might mean that the file we are about to
+// delete is the only good copy. It returns what is wrong with the copy, or a
+// blank string if nothing is.
+func keptCopyUnavailable(keep *File) string {
+	// A copy on another machine is out of reach. See checkPlanEntry.
+	if keep.remote {
+		return ""
+	}
+
+	fh, err := fds.open(keep.Path)
+	if err != nil {
+		return fmt.Sprintf("unable to open: %s", err)
+	}
+
+	fi, err := fh.Stat()
+	if err != nil {
+		_ = fds.close(fh)
+		return fmt.Sprintf("unable to stat: %s", err)
+	}
+
+	if !fi.Mode().IsRegular() {
+		_ = fds.close(fh)
+		return "it is no longer a regular file"
+	}
+
+	if fi.Size() != keep.Size {
+		_ = fds.close(fh)
+		return fmt.Sprintf("size changed from %d to %d", keep.Size, fi.Size())
+	}
+
+	if keep.Size > 0 {
+		buf := make([]byte, 1)
+		if _, err := fh.Read(buf); err != nil {
+			_ = fds.close(fh)
+			return fmt.Sprintf("unable to read: %s", err)
+		}
+	}
+
+	if err := fds.close(fh); err != nil {
+		return fmt.Sprintf("close: %s", err)
+	}
+
+	return ""
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A rule's rename is a template for the name of the copy it keeps, so that
+// after removing photo.jpg in favour of photo (1).jpg, we can rename the copy
+// we kept to photo.jpg. We only rename a copy once its group is resolved and
+// we removed at least one of its duplicates.
+//
+// The template may contain these variables. {{ is a literal {.
+//
+//   - {name}: the copy's name.
+//   - {stem}: its name without its extension and anything marking it as a
+//     copy, so photo for photo (1).jpg or Copy of photo.jpg.
+//   - {ext}: its extension, such as .jpg.
+//   - {year}, {month}, and {day}: when it was last modified.
+
+// renameVariables lists the variables rename templates may contain.
+var renameVariables = []string{"name", "stem", "ext", "year", "month", "day"}
+
+// copyNameStem captures the name of the original in names that file managers
+// and browsers give copies. See copyName.
+var copyNameStem = regexp.MustCompile(
+	`^(?:Copy (?:\(\d+\) )?of (.+)|(.+?)(?: \(\d+\)| - Copy(?: \(\d+\))?| copy(?: \d+)?))$`)
+
+// nameStem returns the name without its extension and anything marking it as
+// a copy.
+func nameStem(name string) string {
+	stem := strings.TrimSuffix(name, path.Ext(name))
+	if m := copyNameStem.FindStringSubmatch(stem); m != nil {
+		return m[1] + m[2]
+	}
+	return stem
+}
+
+// expandRename fills in the template for the file. It returns an error if the
+// template is invalid.
+func expandRename(template string, file *File) (string, error) {
+	values := map[string]string{
+		"name":  file.Basename,
+		"stem":  nameStem(file.Basename),
+		"ext":   path.Ext(file.Basename),
+		"year":  file.ModTime.Format("2006"),
+		"month": file.ModTime.Format("01"),
+		"day":   file.ModTime.Format("02"),
+	}
+
+	var b strings.Builder
+	for s := template; len(s) > 0; {
+		i := strings.IndexByte(s, '{')
+		if i == -1 {
+			b.WriteString(s)
+			break
+		}
+		b.WriteString(s[:i])
+		s = s[i:]
+
+		if strings.HasPrefix(s, "{{") {
+			b.WriteByte('{')
+			s = s[2:]
+			continue
+		}
+		end := strings.IndexByte(s, '}')
+		if end == -1 {
+			return "", fmt.Errorf("unterminated variable: %s", s)
+		}
+		value, ok := values[s[1:end]]
+		if !ok {
+			return "", fmt.Errorf("unknown variable: %s. Variables are: %s",
+				s[:end+1], strings.Join(renameVariables, ", "))
+		}
+		b.WriteString(value)
+		s = s[end+1:]
+	}
+	return b.String(), nil
+}
+
+// validateRename checks a rule's rename template. It is a name rather than a
+// path, as we rename the copy within its directory.
+func validateRename(field, template string) []error {
+	if template == "" {
+		return nil
+	}
+	if strings.ContainsAny(template, `/\`) {
+		return []error{fieldError{field + ".rename",
+			"must be a name, not a path"}}
+	}
+	if _, err := expandRename(template, &File{Basename: "a.jpg"}); err != nil {
+		return []error{fieldError{field + ".rename", err.Error()}}
+	}
+	return nil
+}
+
+// pendingRename is a copy we kept that its rule says to rename once we've
+// resolved its group.
+type pendingRename struct {
+	template string
+	reason   string
+	live     bool
+}
+
+// renameKept renames the copies we kept in a group as their rules say. We
+// leave protected copies alone. We don't rename a copy others are now
+// symbolic links to, as that would break them, and we never replace an
+// existing file. freed holds the paths of the
+// copies we deleted, which in non-live mode are still there. With
+// -rewrite-symlinks, we point the links in the tree to a copy at its new name,
+// and its sidecars go with it.
+func renameKept(args *Args, config *Config, renames map[*File]pendingRename,
+	linked map[*File]bool, freed map[string]bool) {
+	var files []*File
+	for file := range renames {
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+
+	for _, file := range files {
+		rename := renames[file]
+		// We validated the template when loading it.
+		name, _ := expandRename(rename.template, file)
+		if name == "" || name == file.Basename {
+			continue
+		}
+		if pattern, ok := protectedBy(config, file.Path); ok {
+			log.Printf("Not renaming %s to %s: it is protected by %s", file.Path,
+				name, pattern)
+			continue
+		}
+		if linked[file] {
+			warnf("Not renaming %s to %s: copies are symbolic links to it",
+				file.Path, name)
+			continue
+		}
+
+		newPath := filepath.Join(filepath.Dir(file.Path), name)
+		if rename.live || !freed[newPath] {
+			if _, err := os.Lstat(newPath); err == nil {
+				warnf("Not renaming %s: %s exists", file.Path, newPath)
+				continue
+			} else if !os.IsNotExist(err) {
+				warnf("Not renaming %s: %s", file.Path, err)
+				continue
+			}
+		}
+
+		renamed := &File{Path: newPath}
+		sidecars := sidecarsFor(config.Sidecars, file.Path)
+		if !rename.live {
+			log.Printf("Non-live mode. %s would rename %s to %s", rename.reason,
+				file.Path, name)
+			rewriteSymlinks(args, renamed, file, false)
+			renameSidecars(config, sidecars, newPath, false)
+			continue
+		}
+		// Something may create newPath after we looked, so we rename in a way
+		// that fails rather than replaces it.
+		if err := renameNoReplace(file.Path, newPath); err != nil {
+			warnf("Unable to rename %s: %s", file.Path, err)
+			continue
+		}
+		log.Printf("%s: renamed %s to %s", rename.reason, file.Path, name)
+		rewriteSymlinks(args, renamed, file, true)
+		renameSidecars(config, sidecars, newPath, true)
+		file.Path = newPath
+		file.Basename = name
+	}
+}
+
+// linkRename renames oldPath to newPath by making a hard link and removing the
+// old name. Unlike os.Rename, it fails if newPath exists.
+func linkRename(oldPath, newPath string) error {
+	if err := os.Link(oldPath, newPath); err != nil {
+		return err
+	}
+	if err := os.Remove(oldPath); err != nil {
+		_ = os.Remove(newPath)
+		return err
+	}
+	return nil
+}
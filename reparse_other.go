@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "os"
+
+// isReparseLink checks whether the file is a Windows junction or similar. There
+// are none on this platform.
+func isReparseLink(fi os.FileInfo) bool {
+	return false
+}
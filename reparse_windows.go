@@ -0,0 +1,24 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// isReparseLink checks whether the file is a junction, symbolic link, or
+// other reparse point that stands in for another path. Following one could
+// take us around a loop or to files we find elsewhere anyway.
+//
+// Other reparse points, such as deduplicated files and OneDrive files, hold
+// their own data. Go reports those as regular files and directories, so we
+// look at them as usual.
+func isReparseLink(fi os.FileInfo) bool {
+	attrs, ok := fi.Sys().(*syscall.Win32FileAttributeData)
+	if !ok || attrs.FileAttributes&syscall.FILE_ATTRIBUTE_REPARSE_POINT == 0 {
+		return false
+	}
+	return !fi.Mode().IsRegular() && !fi.IsDir()
+}
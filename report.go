@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// reportFormatNames lists the report formats.
+func reportFormatNames() []string {
+	return []string{reportText, reportCSV, reportJSON}
+}
+
+// Report describes the duplicates a run found and what it did with them.
+type Report struct {
+	Summary *Summary      `json:"summary"`
+	Groups  []ReportGroup `json:"groups"`
+
+	// With -compare-xattrs, these are the groups of files with identical
+	// contents but different extended attributes.
+	XattrsDiffer []ReportGroup `json:"xattrs_differ,omitempty"`
+
+	// With -skip-open, these are the duplicates we didn't remove because other
+	// processes had them open.
+	InUse []string `json:"in_use,omitempty"`
+
+	// With -broken-symlinks, these are the symbolic links pointing at nothing.
+	BrokenSymlinks []string `json:"broken_symlinks,omitempty"`
+
+	// With -report-special-files, these are the special files we skipped.
+	SpecialFiles []*SpecialFile `json:"special_files,omitempty"`
+}
+
+// ReportGroup is a set of identical files.
+type ReportGroup struct {
+	Hash  string       `json:"hash"`
+	Size  int64        `json:"size"`
+	Files []ReportFile `json:"files"`
+}
+
+// ReportFile is one file in a group. Action is what we did with it, if
+// anything. In non-live mode, it is what we would have done.
+type ReportFile struct {
+	Path   string `json:"path"`
+	Action string `json:"action,omitempty"`
+}
+
+// Report formats.
+const (
+	reportText = "text"
+	reportCSV  = "csv"
+	reportJSON = "json"
+)
+
+// newReport builds the report from what the run recorded in its summary.
+func newReport(summary *Summary) *Report {
+	actions := make(map[string]string)
+	for _, deletion := range summary.deletions {
+		actions[deletion.Remove] = deletion.Action
+	}
+
+	report := &Report{
+		Summary: summary,
+		Groups:  []ReportGroup{},
+		InUse:   summary.inUse,
+
+		BrokenSymlinks: summary.brokenSymlinks,
+		SpecialFiles:   summary.specialFiles,
+	}
+	for _, group := range summary.groups {
+		reportGroup := ReportGroup{
+			Hash: hex.EncodeToString(group[0].Hash),
+			Size: group[0].Size,
+		}
+		for _, file := range group {
+			reportGroup.Files = append(reportGroup.Files, ReportFile{
+				Path:   file.Path,
+				Action: actions[file.Path],
+			})
+		}
+		report.Groups = append(report.Groups, reportGroup)
+	}
+
+	for _, group := range summary.differing {
+		reportGroup := ReportGroup{
+			Hash: hex.EncodeToString(group[0].Hash),
+			Size: group[0].Size,
+		}
+		for _, file := range group {
+			reportGroup.Files = append(reportGroup.Files,
+				ReportFile{Path: file.Path})
+		}
+		report.XattrsDiffer = append(report.XattrsDiffer, reportGroup)
+	}
+
+	return report
+}
+
+// writeReport writes the report in the format.
+func writeReport(w io.Writer, format string, report *Report) error {
+	switch format {
+	case reportText:
+		return writeReportText(w, report)
+	case reportCSV:
+		return writeReportCSV(w, report)
+	case reportJSON:
+		buf, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return fmt.Errorf("unable to encode report: %s", err)
+		}
+		if _, err := w.Write(append(buf, '\n')); err != nil {
+			return fmt.Errorf("unable to write report: %s", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown report format: %s", format)
+	}
+}
+
+// writeReportText writes each group as its hash and size followed by its
+// files, one per line.
+func writeReportText(w io.Writer, report *Report) error {
+	var b strings.Builder
+
+	for i, group := range report.Groups {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "%s (%d bytes, %d files)\n", group.Hash, group.Size,
+			len(group.Files))
+		for _, file := range group.Files {
+			if file.Action == "" {
+				fmt.Fprintf(&b, "  %s\n", file.Path)
+				continue
+			}
+			fmt.Fprintf(&b, "  %s (%s)\n", file.Path, file.Action)
+		}
+	}
+
+	for _, group := range report.XattrsDiffer {
+		fmt.Fprintf(&b, "\n%s (%d bytes, %d files, extended attributes differ)\n",
+			group.Hash, group.Size, len(group.Files))
+		for _, file := range group.Files {
+			fmt.Fprintf(&b, "  %s\n", file.Path)
+		}
+	}
+
+	if len(report.InUse) > 0 {
+		b.WriteString("\nNot removed as other processes had them open:\n")
+		for _, name := range report.InUse {
+			fmt.Fprintf(&b, "  %s\n", name)
+		}
+	}
+
+	if len(report.BrokenSymlinks) > 0 {
+		b.WriteString("\nBroken symbolic links:\n")
+		for _, name := range report.BrokenSymlinks {
+			fmt.Fprintf(&b, "  %s\n", name)
+		}
+	}
+
+	if len(report.SpecialFiles) > 0 {
+		b.WriteString("\nSpecial files skipped:\n")
+		for _, file := range report.SpecialFiles {
+			fmt.Fprintf(&b, "  %s (%s)\n", file.Path, file.Kind)
+		}
+	}
+
+	if len(report.Summary.Rules) > 0 {
+		b.WriteString("\nRules:\n")
+		for _, stats := range report.Summary.Rules {
+			fmt.Fprintf(&b, "  %s: matched %d, removed %d (%d bytes), skipped %d, failed %d\n",
+				stats.Rule, stats.Matched, stats.Removed, stats.RemovedBytes,
+				stats.Skipped, stats.Failed)
+		}
+	}
+
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return fmt.Errorf("unable to write report: %s", err)
+	}
+	return nil
+}
+
+// writeReportCSV writes a row for each file in each group. Files in the same
+// group have the same hash.
+func writeReportCSV(w io.Writer, report *Report) error {
+	cw := csv.NewWriter(w)
+
+	if err := cw.Write([]string{"hash", "size", "path", "action"}); err != nil {
+		return fmt.Errorf("unable to write report: %s", err)
+	}
+
+	for _, group := range report.Groups {
+		for _, file := range group.Files {
+			if err := cw.Write([]string{
+				group.Hash,
+				strconv.FormatInt(group.Size, 10),
+				file.Path,
+				file.Action,
+			}); err != nil {
+				return fmt.Errorf("unable to write report: %s", err)
+			}
+		}
+	}
+
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return fmt.Errorf("unable to write report: %s", err)
+	}
+	return nil
+}
+
+// saveReport writes the report to the file, or to stdout if the file is -.
+func saveReport(output, format string, report *Report) error {
+	var buf bytes.Buffer
+	if err := writeReport(&buf, format, report); err != nil {
+		return err
+	}
+
+	if output == "-" {
+		if _, err := os.Stdout.Write(buf.Bytes()); err != nil {
+			return fmt.Errorf("unable to write report: %s", err)
+		}
+		return nil
+	}
+
+	if err := writeFileAtomically(output, buf.Bytes()); err != nil {
+		return fmt.Errorf("unable to write report: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+func reportAndResolveDuplicates(
+	args *Args,
+	config *Config,
+	groups [][]*File,
+	summary *Summary,
+) error {
+	sortGroups(groups, args.Sort)
+	if args.analysis != nil {
+		args.analysis.groups = append(args.analysis.groups, groups...)
+	}
+
+	// We count every group, though with -top we only go on with some.
+	for _, group := range groups {
+		summary.DuplicateGroups++
+		summary.DuplicateFiles += len(group) - 1
+		summary.DuplicateBytes += reclaimable(group)
+	}
+	groups = topGroups(groups, args.Top)
+	summary.groups = append(summary.groups, groups...)
+
+	for _, group := range groups {
+		emitGroupFound(group)
+		summary.resolving++
+		if err := resolveGroup(args, config, group, summary); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// findDuplicates groups files with identical contents. Each group it returns
+// has at least two files.
+//
+// With -strict-identity, files with different owners, groups, or mode bits
+// are never duplicates however identical their contents.
+//
+// With a second hash, files are identical if both their checksums match. Two
+// independent algorithms colliding on the same pair of files is unlikely
+// enough that we skip comparing them byte by byte. With -trust-hash, we skip
+// it for one strong checksum, and -stages may skip it too.
+func findDuplicates(args *Args, files []*File) ([][]*File, error) {
+	checksumToGroup := make(map[string]int)
+	var groups [][]*File
+
+Files:
+	for _, file := range files {
+		// Is this a possible duplicate? We can tell by whether we've seen a file
+		// with the same checksum yet.
+		key := string(file.Hash) + string(file.SecondHash)
+		if args.Strict {
+			key += fmt.Sprintf("/%d:%d:%o", file.uid, file.gid, uint32(file.mode))
+		}
+		groupIndex, ok := checksumToGroup[key]
+		if !ok {
+			checksumToGroup[key] = len(groups)
+			groups = append(groups, []*File{file})
+			continue
+		}
+
+		if !args.runsStage(stageByteCompare) {
+			groups[groupIndex] = append(groups[groupIndex], file)
+			continue
+		}
+
+		// Hash collision. Deep compare to determine whether the files are really
+		// the same.
+		for {
+			foundFile := groups[groupIndex][0]
+			identical, err := isIdentical(args, foundFile, file)
+			if errors.Is(err, os.ErrNotExist) {
+				// One of them vanished since we checksummed it. If it was the first
+				// of the group, we compare with the next.
+				if _, statErr := os.Lstat(foundFile.Path); statErr == nil {
+					file.vanished = true
+					withoutVanished(args, []*File{file})
+					continue Files
+				}
+				foundFile.vanished = true
+				withoutVanished(args, []*File{foundFile})
+				groups[groupIndex] = groups[groupIndex][1:]
+				if len(groups[groupIndex]) == 0 {
+					groups[groupIndex] = []*File{file}
+					continue Files
+				}
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("unable to compare files: %s %s: %s",
+					foundFile.Path, file.Path, err)
+			}
+			if !identical {
+				return nil, fmt.Errorf(
+					"hash collision but the files are not identical! %s and %s",
+					file.Path, foundFile.Path)
+			}
+			break
+		}
+
+		groups[groupIndex] = append(groups[groupIndex], file)
+	}
+
+	var duplicates [][]*File
+	for _, group := range groups {
+		if len(group) > 1 {
+			duplicates = append(duplicates, group)
+		}
+	}
+
+	return duplicates, nil
+}
+
+// removal records what we did with a file we removed from its group. If not
+// live, we only would have.
+type removal struct {
+	action string
+	live   bool
+}
+
+// describeGroup lists the group's files beneath their shared hash and size,
+// along with what we did with those we removed. If we removed any, we mark the
+// copies we kept too. color says whether to colour the kept and removed paths.
+func describeGroup(group []*File, removed map[*File]removal, color bool) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Duplicate files found: %d copies of %x (%d bytes each):\n",
+		len(group), group[0].Hash, group[0].Size)
+	for _, file := range group {
+		switch {
+		case removed[file].action != "":
+			label := "removed"
+			if !removed[file].live {
+				label = "would remove"
+			}
+			fmt.Fprintf(&b, "  %s\n",
+				colorize(color, ansiRed, file.Path+" ("+label+")"))
+		case len(removed) > 0:
+			fmt.Fprintf(&b, "  %s\n", colorize(color, ansiGreen, file.Path+" (kept)"))
+		default:
+			fmt.Fprintf(&b, "  %s\n", file.Path)
+		}
+	}
+	return b.String()
+}
+
+// reportGroup lists the group and what we did with its files.
+func reportGroup(args *Args, group []*File, removed map[*File]removal) error {
+	if args.Porcelain {
+		if err := writePorcelainGroup(os.Stdout, group, removed); err != nil {
+			return err
+		}
+	}
+
+	// With -output, -porcelain, or -events -, stdout is for them, so this joins
+	// the log messages on stderr.
+	if args.Output != "" || args.Porcelain || args.Events == "-" {
+		log.Print(strings.TrimSuffix(describeGroup(group, removed, colorStderr),
+			"\n"))
+	} else {
+		fmt.Print(describeGroup(group, removed, colorStdout))
+	}
+
+	return nil
+}
+
+// resolveGroup applies the rules to each pair of files in a group of
+// duplicates and then reports the group. For pairs no rule covers, we run the
+// decide script if there is one. If it has no opinion, we ask the user if
+// we're interactive, or otherwise take the default action.
+//
+// We never reduce the group below the configured minimum number of copies.
+// Once we delete a file (or would in non-live mode), it is out of
+// consideration for the remaining pairs. A dry run rule never deletes the
+// file, so that a run goes on as it would without the rule.
+func resolveGroup(
+	args *Args,
+	config *Config,
+	group []*File,
+	summary *Summary,
+) error {
+	if args.scanOnly {
+		return reportGroup(args, group, nil)
+	}
+
+	if args.DeletePrompt && (args.answers == nil || !args.answers.covers(group)) {
+		asked, err := resolveGroupByPrompt(args, config, group, summary)
+		if asked || err != nil {
+			return err
+		}
+	}
+
+	minCopies := config.minCopies()
+
+	remaining := len(group)
+	removed := make(map[*File]bool)
+	covered := make(map[*File]bool)
+	fates := make(map[*File]removal)
+	renames := make(map[*File]pendingRename)
+	linked := make(map[*File]bool)
+	freed := make(map[string]bool)
+	// Dry run rules only say what they would remove, so what they remove is
+	// still there for other rules, and we keep track of it apart.
+	wouldRemove := make(map[*File]bool)
+
+	for i := 0; i < len(group); i++ {
+		for j := i + 1; j < len(group); j++ {
+			if removed[group[i]] || removed[group[j]] {
+				continue
+			}
+
+			var reason string
+			live := args.Live
+			dryRun := false
+			action := actionDelete
+			var command []string
+			var keep, remove *File
+			var ruleIndex int
+			answered, ok := false, false
+			if args.answers != nil {
+				keep, remove, answered = args.answers.decide(group[i], group[j])
+			}
+			if !answered {
+				ruleIndex, keep, remove, ok = matchRule(args, config.Rules, group[i],
+					group[j])
+			}
+			decided := false
+			if !answered && !ok && config.decider != nil {
+				var err error
+				keep, remove, decided, err = config.decider.decide(group[i], group[j])
+				if err != nil {
+					return err
+				}
+			}
+			if answered {
+				if keep == nil {
+					continue
+				}
+				reason = "Your saved choice"
+			} else if ok {
+				rule := config.Rules[ruleIndex]
+				reason = rule.source
+				if rule.DryRun {
+					live = false
+					dryRun = true
+				}
+				if rule.Action != "" {
+					action = rule.Action
+					command = rule.Command
+				}
+			} else if decided {
+				if keep == nil {
+					continue
+				}
+				reason = "decide"
+				if config.DecideAction != "" {
+					action = config.DecideAction
+				}
+			} else if args.Interactive {
+				var err error
+				keep, remove, err = decideInteractively(args, config, group[i],
+					group[j])
+				if err != nil {
+					return err
+				}
+				// We record a pair the user skipped too, as keeping both, so
+				// that -answers doesn't ask about it again.
+				if args.newAnswers != nil {
+					if err := recordPair(args.newAnswers, group, group[i], group[j],
+						keep, remove); err != nil {
+						return err
+					}
+				}
+				if keep == nil {
+					continue
+				}
+				reason = "Your choice"
+			} else if config.DefaultAction != "" &&
+				config.DefaultAction != actionReport {
+				var err error
+				keep, remove, err = keepStrategies[config.DefaultKeep](group[i],
+					group[j])
+				if err != nil {
+					return err
+				}
+				reason = "default_action"
+				action = config.DefaultAction
+			} else {
+				continue
+			}
+			covered[keep] = true
+			covered[remove] = true
+			if dryRun && wouldRemove[remove] {
+				continue
+			}
+
+			var stats *RuleStats
+			if ok {
+				stats = summary.ruleStats(ruleIndex)
+			}
+			if stats != nil {
+				stats.Matched++
+			}
+			skip := func() {
+				if stats != nil {
+					stats.Skipped++
+				}
+			}
+
+			if pattern, ok := protectedBy(config, remove.Path); ok {
+				warnf("%s would delete %s but it is protected by %s. Skipping it.",
+					reason, remove.Path, pattern)
+				skip()
+				continue
+			}
+
+			// Copies we replaced with symbolic links point at the copy we kept,
+			// so removing it would leave them dangling.
+			if linked[remove] {
+				warnf("%s would remove %s but copies are now symbolic links to it. Skipping it.",
+					reason, remove.Path)
+				skip()
+				continue
+			}
+
+			if remaining-1 < minCopies {
+				log.Printf("Not deleting %s: we keep at least %d copies", remove.Path,
+					minCopies)
+				skip()
+				continue
+			}
+
+			if action == actionReport {
+				log.Printf("%s: reporting %s, a duplicate of %s", reason, remove.Path,
+					keep.Path)
+				continue
+			}
+
+			// Dry run rules remove nothing, so the limits don't apply to them.
+			if !dryRun && !withinLimits(args, summary, remove) {
+				skip()
+				continue
+			}
+
+			if ok && !args.runsStage(stageByteCompare) &&
+				len(config.Rules[ruleIndex].Stages) > 0 &&
+				hasStage(config.Rules[ruleIndex].Stages, stageByteCompare) {
+				identical, err := stillDuplicates(args, config, keep, remove)
+				if err != nil {
+					warnf("Not acting on %s: unable to compare it with %s: %s",
+						remove.Path, keep.Path, err)
+					skip()
+					continue
+				}
+				if !identical {
+					warnf("Not acting on %s: %s wants it compared byte by byte, and it differs from %s despite their checksums",
+						remove.Path, reason, keep.Path)
+					skip()
+					continue
+				}
+			}
+
+			gone, err := applyAction(args, config, action, command, keep, remove,
+				live)
+			if err != nil {
+				if stats != nil {
+					stats.Failed++
+				}
+				return err
+			}
+			if gone {
+				fates[remove] = removal{action: action, live: live}
+				if dryRun {
+					wouldRemove[remove] = true
+				} else {
+					removed[remove] = true
+					remaining--
+					summary.recordRemoval(action, keep, remove)
+					switch action {
+					case actionDelete:
+						freed[remove.Path] = true
+					case actionSymlink:
+						linked[keep] = true
+					}
+				}
+				if _, pending := renames[keep]; ok && !pending &&
+					config.Rules[ruleIndex].Rename != "" {
+					renames[keep] = pendingRename{
+						template: config.Rules[ruleIndex].Rename,
+						reason:   reason,
+						live:     live,
+					}
+				}
+				emit(eventAction, actionData{
+					actionHookContext: actionHookContext{
+						Action: action,
+						Keep:   keep.Path,
+						Remove: remove.Path,
+						Size:   remove.Size,
+					},
+					Live: live,
+				})
+				if stats != nil {
+					stats.Removed++
+					stats.RemovedBytes += remove.Size
+				}
+				if args.plan != nil && !dryRun {
+					args.plan.add(summary.resolving, action, keep, remove)
+				}
+			} else if stats != nil {
+				stats.Failed++
+			}
+		}
+	}
+
+	var uncovered []string
+	for _, file := range group {
+		if !covered[file] {
+			uncovered = append(uncovered, file.Path)
+		}
+	}
+	if len(uncovered) > 0 {
+		log.Printf("No rule found for duplicate files: %s",
+			strings.Join(uncovered, " and "))
+	}
+
+	// A copy we kept for one pair may be one we removed for a later pair.
+	for file := range renames {
+		if removed[file] {
+			delete(renames, file)
+		}
+	}
+	renameKept(args, config, renames, linked, freed)
+
+	return reportGroup(args, group, fates)
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How to choose between rules with the same priority that apply to the same
+// pair of files.
+const (
+	// The rule that comes first in the configuration wins.
+	ruleMatchFirst = "first"
+
+	// The rule naming the deepest directories wins. Ties go to the rule that
+	// comes first.
+	ruleMatchSpecific = "specific"
+)
+
+// removeAnywhere as a rule's remove directory means copies anywhere outside
+// its keep directory. One such rule says to keep a canonical copy, such as one
+// in a library, over all others.
+const removeAnywhere = "*"
+
+// matchRule finds the rule that applies to the two files. If there is one, it
+// returns the rule's index and which of the files to keep and which to remove.
+// Not having a rule is not an error (because we may want to just report).
+//
+// When several rules apply, the one with the highest priority wins. Between
+// rules of equal priority we decide according to -rule-match.
+func matchRule(args *Args, rules []Rule, file1, file2 *File) (int, *File,
+	*File, bool) {
+	best := -1
+	var keep, remove *File
+
+	for i, rule := range rules {
+		if !rule.selects(file1) || !rule.selects(file2) {
+			continue
+		}
+
+		var k, r *File
+		if rule.KeepDir == rule.RemoveDir {
+			var ok bool
+			if k, r, ok = rule.collapse(file1, file2); !ok {
+				continue
+			}
+		} else if rule.appliesTo(file1, file2) {
+			k, r = file1, file2
+		} else if rule.appliesTo(file2, file1) {
+			k, r = file2, file1
+		} else {
+			continue
+		}
+
+		if best == -1 || ruleBeats(args, rule, rules[best]) {
+			best, keep, remove = i, k, r
+		}
+	}
+
+	if best == -1 {
+		return -1, nil, nil, false
+	}
+
+	return best, keep, remove, true
+}
+
+// appliesTo checks whether the rule says to keep keep over remove.
+func (r Rule) appliesTo(keep, remove *File) bool {
+	keepVars, ok := r.sideMatches(r.KeepDir, r.keepPattern, r.keepFS, keep)
+	if !ok {
+		return false
+	}
+
+	// The copy to remove can be anywhere the one to keep couldn't be.
+	if r.RemoveDir == removeAnywhere {
+		_, ok := r.sideMatches(r.KeepDir, r.keepPattern, r.keepFS, remove)
+		return !ok
+	}
+
+	removeVars, ok := r.sideMatches(r.RemoveDir, r.removePattern, r.removeFS,
+		remove)
+	if !ok {
+		return false
+	}
+
+	for name, value := range keepVars {
+		if other, ok := removeVars[name]; ok && other != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// selects checks whether the file passes the rule's include and exclude
+// patterns and meets its conditions.
+func (r Rule) selects(file *File) bool {
+	if len(r.Include) > 0 && !isExcluded(r.Include, file.Path) {
+		return false
+	}
+	if isExcluded(r.Exclude, file.Path) {
+		return false
+	}
+
+	if r.MinSize != nil && file.Size < *r.MinSize {
+		return false
+	}
+	if r.MaxSize != nil && file.Size > *r.MaxSize {
+		return false
+	}
+	if r.OlderThan != nil && time.Since(file.ModTime) <= r.OlderThan.Duration {
+		return false
+	}
+	return true
+}
+
+// filtered says whether the rule applies to only some of the files in its
+// directories.
+func (r Rule) filtered() bool {
+	return len(r.Include) > 0 || len(r.Exclude) > 0 || r.MinSize != nil ||
+		r.MaxSize != nil || r.OlderThan != nil
+}
+
+// sameFilters checks whether two rules limit themselves to the same files.
+func sameFilters(a, b Rule) bool {
+	return strings.Join(a.Include, "\x00") == strings.Join(b.Include, "\x00") &&
+		strings.Join(a.Exclude, "\x00") == strings.Join(b.Exclude, "\x00") &&
+		sameInt64(a.MinSize, b.MinSize) && sameInt64(a.MaxSize, b.MaxSize) &&
+		sameDuration(a.OlderThan, b.OlderThan)
+}
+
+func sameInt64(a, b *int64) bool {
+	return (a == nil) == (b == nil) && (a == nil || *a == *b)
+}
+
+func sameDuration(a, b *duration) bool {
+	return (a == nil) == (b == nil) && (a == nil || a.Duration == b.Duration)
+}
+
+// collapse applies a collapse rule. These apply to copies in the same
+// directory, and their tiebreak decides which to keep. It returns the file to
+// keep and the file to remove, or false if the rule doesn't apply.
+func (r Rule) collapse(file1, file2 *File) (*File, *File, bool) {
+	if path.Dir(file1.Path) != path.Dir(file2.Path) ||
+		!r.appliesTo(file1, file2) {
+		return nil, nil, false
+	}
+
+	keep, remove, err := keepStrategies[r.Tiebreak](file1, file2)
+	if err != nil {
+		warnf("%s: %s", r.source, err)
+		return nil, nil, false
+	}
+	return keep, remove, true
+}
+
+// sideMatches checks whether one of the rule's locations applies to the file.
+// fs is the filesystem the location names, if it names one. If the location
+// contains variables, pattern is its compiled form, and we return what each
+// variable matched.
+func (r Rule) sideMatches(
+	location string,
+	pattern *dirPattern,
+	fs *filesystem,
+	file *File,
+) (map[string]string, bool) {
+	if fs != nil {
+		return nil, fs.matches(file)
+	}
+
+	// A location without a machine applies on every machine.
+	dir := fileDir(file)
+	if host, _ := splitHost(location); host == "" {
+		_, dir = splitHost(dir)
+	}
+
+	if pattern != nil {
+		return pattern.match(dir)
+	}
+
+	return nil, r.matchesDir(location, dir)
+}
+
+// matchesDir checks whether one of the rule's directories applies to a file in
+// fileDir. Both are in the form canonicalDir gives.
+func (r Rule) matchesDir(ruleDir, fileDir string) bool {
+	if fileDir == ruleDir {
+		return true
+	}
+
+	if !r.Recursive {
+		return false
+	}
+
+	return strings.HasPrefix(fileDir, strings.TrimSuffix(ruleDir, "/")+"/")
+}
+
+// canonicalDir returns the form of a directory we match rules against, so that
+// a rule applies however it or the file's path spells the directory: the
+// absolute path with no . or .. elements or symbolic links, ending with a /.
+// If we can't resolve the symbolic links, such as in a directory that doesn't
+// exist, we leave them be.
+//
+// A directory on another machine (see coordinator.go) we can only clean. For
+// a rule directory containing variables, we resolve the part before the first
+// variable.
+func canonicalDir(dir string) string {
+	if dir == "" || isFilesystemLocation(dir) {
+		return dir
+	}
+
+	host, local := splitHost(dir)
+	if host != "" {
+		return host + ":" + withSlash(path.Clean(local))
+	}
+
+	rest := ""
+	if hasVariables(local) {
+		i := strings.LastIndexByte(local[:strings.IndexByte(local, '{')], '/')
+		local, rest = local[:i+1], local[i+1:]
+	}
+
+	resolved, err := filepath.Abs(local)
+	if err != nil {
+		return withSlash(path.Join(local, rest))
+	}
+	if real, err := filepath.EvalSymlinks(resolved); err == nil {
+		resolved = real
+	}
+	return withSlash(path.Join(filepath.ToSlash(resolved), rest))
+}
+
+// canonicalDirs holds the canonical forms of the directories holding the files
+// we've matched rules against, by directory.
+var canonicalDirs sync.Map
+
+// fileDir returns the canonical form of the directory holding the file. See
+// canonicalDir.
+func fileDir(file *File) string {
+	dir, _ := path.Split(file.Path)
+	if dir == "" {
+		dir = "./"
+	}
+	if canonical, ok := canonicalDirs.Load(dir); ok {
+		return canonical.(string)
+	}
+
+	canonical := canonicalDir(dir)
+	canonicalDirs.Store(dir, canonical)
+	return canonical
+}
+
+// resolvedDirs holds the directories canonicalPath resolved, by directory.
+var resolvedDirs sync.Map
+
+// canonicalPath returns the file's path with its directory in the form
+// canonicalDir gives. Unlike canonicalDir, it fails if it can't resolve the
+// directory's symbolic links, so that we can't mistake where the file is.
+func canonicalPath(filePath string) (string, bool) {
+	dir, name := path.Split(filePath)
+	if dir == "" {
+		dir = "./"
+	}
+	if resolved, ok := resolvedDirs.Load(dir); ok {
+		return resolved.(string) + name, true
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false
+	}
+	real, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return "", false
+	}
+	resolved := withSlash(filepath.ToSlash(real))
+	resolvedDirs.Store(dir, resolved)
+	return resolved + name, true
+}
+
+// canonicalPattern returns the form of a protected or always_keep path
+// pattern we match canonical paths against. We resolve the part before the
+// first wildcard as canonicalDir does.
+func canonicalPattern(pattern string) string {
+	if host, _ := splitHost(pattern); host != "" {
+		return path.Clean(pattern)
+	}
+
+	dir, rest := pattern, ""
+	if i := strings.IndexAny(pattern, "*?[\\"); i != -1 {
+		j := strings.LastIndexByte(pattern[:i], '/')
+		dir, rest = pattern[:j+1], pattern[j+1:]
+	}
+	return path.Join(canonicalDir(dir), rest)
+}
+
+// ruleBeats decides whether rule takes precedence over other, a rule earlier
+// in the configuration.
+func ruleBeats(args *Args, rule, other Rule) bool {
+	if rule.Priority != other.Priority {
+		return rule.Priority > other.Priority
+	}
+
+	if args.RuleMatch != ruleMatchSpecific {
+		return false
+	}
+
+	if rule.specificity() != other.specificity() {
+		return rule.specificity() > other.specificity()
+	}
+
+	// A rule for exactly these directories is more specific than one for the
+	// same directories and everything beneath them.
+	return !rule.Recursive && other.Recursive
+}
+
+// specificity measures how deep the rule's directories are. Anywhere is the
+// least specific remove directory there is.
+func (r Rule) specificity() int {
+	if r.RemoveDir == removeAnywhere {
+		return pathDepth(r.KeepDir)
+	}
+	return pathDepth(r.KeepDir) + pathDepth(r.RemoveDir)
+}
+
+func pathDepth(p string) int {
+	return len(strings.FieldsFunc(p, func(c rune) bool { return c == '/' }))
+}
+
+// checkRuleConflicts looks for rules that repeat another rule or that
+// contradict each other. Both are likely mistakes, especially once rules are
+// spread across several files. Without this, which rule wins would silently
+// depend on the order we see duplicates in.
+func checkRuleConflicts(rules []Rule) error {
+	for i, rule := range rules {
+		for _, other := range rules[:i] {
+			// Rules for different files don't conflict, such as one keeping /a
+			// over /b for *.tif and another keeping /b over /a for *.xmp.
+			if !sameFilters(rule, other) {
+				continue
+			}
+			if rule.KeepDir == other.KeepDir && rule.RemoveDir == other.RemoveDir &&
+				rule.Recursive == other.Recursive {
+				return fmt.Errorf("%s duplicates %s", rule.source, other.source)
+			}
+			// A collapse rule is the same both ways round but decides which copy
+			// to keep itself.
+			if rule.KeepDir == other.RemoveDir && rule.RemoveDir == other.KeepDir &&
+				rule.Priority == other.Priority && rule.KeepDir != rule.RemoveDir {
+				return fmt.Errorf("%s contradicts %s", rule.source, other.source)
+			}
+			// Each keeps its copies over the other's.
+			if rule.RemoveDir == removeAnywhere && other.RemoveDir == removeAnywhere &&
+				rule.Priority == other.Priority {
+				return fmt.Errorf("%s contradicts %s: both remove copies anywhere. Give them different priorities to say which wins",
+					rule.source, other.source)
+			}
+		}
+	}
+
+	return checkRuleCycles(rules)
+}
+
+// checkRuleCycles looks for rules that prefer directories in a cycle, such as
+// keeping A over B, B over C, and C over A. For a file in all three, what we
+// keep would depend on the order we consider the pairs in.
+func checkRuleCycles(rules []Rule) error {
+	// Rules keeping each directory over others. Collapse rules keep copies
+	// within one directory, so they can't be part of a cycle. Rules with
+	// filters may each apply to different files, so we leave them out too.
+	keeps := make(map[string][]Rule)
+	for _, rule := range rules {
+		if rule.KeepDir != rule.RemoveDir && !rule.filtered() {
+			keeps[rule.KeepDir] = append(keeps[rule.KeepDir], rule)
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	var stack []Rule
+
+	var visit func(dir string) error
+	visit = func(dir string) error {
+		state[dir] = visiting
+
+		for _, rule := range keeps[dir] {
+			stack = append(stack, rule)
+
+			switch state[rule.RemoveDir] {
+			case visiting:
+				var cycle []Rule
+				for i := len(stack) - 1; i >= 0; i-- {
+					cycle = append([]Rule{stack[i]}, cycle...)
+					if stack[i].KeepDir == rule.RemoveDir {
+						break
+					}
+				}
+
+				// Two rules contradicting each other is fine if their priorities say
+				// which wins. That doesn't help with longer cycles as each rule
+				// applies to a different pair of directories.
+				if len(cycle) == 2 && cycle[0].Priority != cycle[1].Priority {
+					break
+				}
+
+				var sources []string
+				for _, r := range cycle {
+					sources = append(sources, r.source)
+				}
+				return fmt.Errorf("rules form a cycle: %s",
+					strings.Join(sources, ", "))
+			case unvisited:
+				if err := visit(rule.RemoveDir); err != nil {
+					return err
+				}
+			}
+
+			stack = stack[:len(stack)-1]
+		}
+
+		state[dir] = visited
+		return nil
+	}
+
+	for _, rule := range rules {
+		if state[rule.KeepDir] == unvisited {
+			if err := visit(rule.KeepDir); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
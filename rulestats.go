@@ -0,0 +1,76 @@
+package main
+
+import "log"
+
+// We count what each rule did and list it at the end of the run, and in the
+// summary and reports. In a large configuration this shows which rules do the
+// work and which do nothing, whether before turning on -live or later when
+// auditing what a run did with each rule.
+
+// RuleStats counts what one rule did.
+type RuleStats struct {
+	Rule string `json:"rule"`
+
+	// Matched is how many pairs of duplicates the rule applied to.
+	Matched int `json:"matched"`
+
+	// Removed is how many duplicates the rule deleted or replaced with links,
+	// or in non-live mode would have. RemovedBytes is their total size.
+	Removed      int   `json:"removed"`
+	RemovedBytes int64 `json:"removed_bytes"`
+
+	// Skipped is how many duplicates we left alone without trying to remove
+	// them, as they were protected, removing them would have left too few
+	// copies, or the run reached its limits.
+	Skipped int `json:"skipped"`
+
+	// Failed is how many duplicates we tried to remove but didn't, such as
+	// because they changed since we checksummed them or we couldn't delete
+	// them.
+	Failed int `json:"failed"`
+}
+
+// newRuleStats starts counting for each of the rules.
+func newRuleStats(rules []Rule) []*RuleStats {
+	var stats []*RuleStats
+	for _, rule := range rules {
+		stats = append(stats, &RuleStats{Rule: rule.source})
+	}
+	return stats
+}
+
+// ruleStats returns the counts for the rule, or nil if we're not counting.
+func (s *Summary) ruleStats(ruleIndex int) *RuleStats {
+	if ruleIndex < 0 || ruleIndex >= len(s.Rules) {
+		return nil
+	}
+	return s.Rules[ruleIndex]
+}
+
+// reportRuleStats lists what each rule did, including the rules that did
+// nothing.
+func reportRuleStats(args *Args, summary *Summary) {
+	if args.scanOnly || len(summary.Rules) == 0 {
+		return
+	}
+
+	if !args.Live {
+		log.Printf("What each rule would delete:")
+		for _, stats := range summary.Rules {
+			if stats.Removed == 0 {
+				log.Printf("  %s: nothing", stats.Rule)
+				continue
+			}
+			log.Printf("  %s: %d files (%d bytes)", stats.Rule, stats.Removed,
+				stats.RemovedBytes)
+		}
+		return
+	}
+
+	log.Printf("What each rule did:")
+	for _, stats := range summary.Rules {
+		log.Printf("  %s: matched %d, removed %d (%d bytes), skipped %d, failed %d",
+			stats.Rule, stats.Matched, stats.Removed, stats.RemovedBytes,
+			stats.Skipped, stats.Failed)
+	}
+}
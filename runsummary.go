@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// With -summary-json, we write a summary of the run to a file when it
+// finishes, for monitoring systems to read after each scheduled run. We write
+// it whether the run succeeds or fails.
+
+// runSummaryVersion is the version of the -summary-json format. We change it
+// only if we change the format in a way that could break a program reading it.
+const runSummaryVersion = 1
+
+// runSummary is the contents of a -summary-json file.
+type runSummary struct {
+	Version  int       `json:"version"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Seconds  float64   `json:"seconds"`
+
+	// OK says whether the run finished. If not, Error says why.
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+
+	// Complete is false if the run stopped after its -max-duration before
+	// getting through every file.
+	Complete bool `json:"complete"`
+
+	// Summary counts what we found and removed. It is null if the run failed
+	// before looking for duplicates.
+	Summary *Summary `json:"summary"`
+
+	// Phases holds how long each part of the run took, in order.
+	Phases []runPhase `json:"phases"`
+
+	// Warnings holds the problems we warned about but carried on after.
+	Warnings []string `json:"warnings"`
+}
+
+// runPhase is how long part of the run took.
+type runPhase struct {
+	Name    string  `json:"name"`
+	Seconds float64 `json:"seconds"`
+}
+
+// currentRun is the summary of the run we're writing one for, if we are.
+// Warnings may come from any goroutine, so mu guards it.
+var currentRun struct {
+	mu      sync.Mutex
+	file    string
+	summary *runSummary
+	phase   string
+	since   time.Time
+
+	incomplete bool
+
+	// counts is what the run found and removed, for the run_finished event.
+	counts *Summary
+
+	// For status snapshots, we note these whether or not we're writing a
+	// summary: when the run started, the phase it's in and since when, and
+	// how many warnings there have been.
+	started      time.Time
+	current      string
+	currentSince time.Time
+	warnings     int
+
+	// For -status-listen, we also note the latest warnings, when we last
+	// finished looking for files, and how many agents the coordinator is
+	// still waiting for.
+	recent  []string
+	scanned time.Time
+	queue   int
+}
+
+// startRunSummary starts timing the run, to write a summary of it to the file
+// when it finishes.
+func startRunSummary(file string) {
+	currentRun.mu.Lock()
+	defer currentRun.mu.Unlock()
+
+	now := time.Now()
+	currentRun.file = file
+	currentRun.summary = &runSummary{
+		Version:  runSummaryVersion,
+		Started:  now,
+		Phases:   []runPhase{},
+		Warnings: []string{},
+	}
+	currentRun.phase = "setup"
+	currentRun.since = now
+}
+
+// startPhase starts timing a part of the run, ending the one before.
+func startPhase(name string) {
+	emit(eventPhase, phaseData{Name: name})
+
+	currentRun.mu.Lock()
+	defer currentRun.mu.Unlock()
+	currentRun.current, currentRun.currentSince = name, time.Now()
+	if currentRun.summary == nil {
+		return
+	}
+
+	endPhase(time.Now())
+	currentRun.phase = name
+}
+
+// endPhase records how long the current phase took. The caller must hold mu.
+func endPhase(now time.Time) {
+	if currentRun.phase != "" {
+		currentRun.summary.Phases = append(currentRun.summary.Phases, runPhase{
+			Name:    currentRun.phase,
+			Seconds: now.Sub(currentRun.since).Seconds(),
+		})
+	}
+	currentRun.phase = ""
+	currentRun.since = now
+}
+
+// recordWarning adds a warning to the summary.
+func recordWarning(message string) {
+	currentRun.mu.Lock()
+	defer currentRun.mu.Unlock()
+	currentRun.warnings++
+	currentRun.recent = append(currentRun.recent, message)
+	if len(currentRun.recent) > recentWarnings {
+		currentRun.recent = currentRun.recent[1:]
+	}
+	if currentRun.summary == nil {
+		return
+	}
+
+	currentRun.summary.Warnings = append(currentRun.summary.Warnings, message)
+}
+
+// markRunIncomplete says the run stopped before getting through every file.
+func markRunIncomplete() {
+	currentRun.mu.Lock()
+	defer currentRun.mu.Unlock()
+	currentRun.incomplete = true
+}
+
+// setRunCounts says what the run found and removed.
+func setRunCounts(summary *Summary) {
+	currentRun.mu.Lock()
+	defer currentRun.mu.Unlock()
+	currentRun.counts = summary
+	if currentRun.summary == nil {
+		return
+	}
+
+	currentRun.summary.Summary = summary
+}
+
+// finishRunSummary writes the summary. err is why the run failed, or nil if it
+// didn't.
+func finishRunSummary(runErr error) error {
+	currentRun.mu.Lock()
+	defer currentRun.mu.Unlock()
+
+	finished := runFinishedData{
+		OK:       runErr == nil,
+		Complete: runErr == nil && !currentRun.incomplete,
+		Summary:  currentRun.counts,
+	}
+	if runErr != nil {
+		finished.Error = runErr.Error()
+	}
+	emit(eventRunFinished, finished)
+	closeEvents()
+
+	s := currentRun.summary
+	if s == nil {
+		return nil
+	}
+
+	now := time.Now()
+	endPhase(now)
+	s.Finished = now
+	s.Seconds = now.Sub(s.Started).Seconds()
+	s.OK = runErr == nil
+	s.Complete = s.OK && !currentRun.incomplete
+	if runErr != nil {
+		s.Error = runErr.Error()
+	}
+
+	buf, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode run summary: %s", err)
+	}
+	if err := writeFileAtomically(currentRun.file, append(buf, '\n')); err != nil {
+		return fmt.Errorf("unable to write run summary: %s", err)
+	}
+	return nil
+}
+
+// fatalf logs the error and exits, as log.Fatalf does, after recording the
+// failure in the run summary.
+func fatalf(format string, v ...interface{}) {
+	message := fmt.Sprintf(format, v...)
+	if err := finishRunSummary(errors.New(message)); err != nil {
+		log.Print(err)
+	}
+	log.Print(message)
+	os.Exit(1)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// serveRunEnv is set in the environment of the processes serve starts for
+// each run.
+const serveRunEnv = "DUPEFILE_SERVE_RUN"
+
+// serve implements the serve subcommand. It resolves duplicates again and
+// again, waiting -every between runs, for keeping a tree tidy as a service.
+//
+// Each run is a process of its own: we run ourselves again with the same
+// flags and serveRunEnv set, and that process resolves once, as the resolve
+// subcommand does. A run exits when it is done or when something goes wrong,
+// so a failed run doesn't take us down with it. Each run uses the
+// configuration we have, which we read again on SIGHUP. We serve /healthz and
+// /status with -status-listen ourselves, for as long as we're up, rather than
+// each run doing so.
+func serve(argv []string) error {
+	args, err := getArgs("serve", argv)
+	if err != nil {
+		return err
+	}
+
+	if args.Every <= 0 {
+		return fmt.Errorf("you must say how long to wait between runs with -every")
+	}
+	if args.Interactive || args.DeletePrompt {
+		return fmt.Errorf("serve runs unattended, so it can't ask with -interactive or -delete-prompt")
+	}
+	if len(args.Config) == 0 && args.Answers == "" {
+		return fmt.Errorf("you must provide a configuration file")
+	}
+
+	// A run takes the configuration files as we last read them from its
+	// stdin, so that changes to them apply once we reload them.
+	files := configFiles{}
+	if os.Getenv(serveRunEnv) != "" {
+		// The run stops when we do, not when our terminal goes away.
+		signal.Ignore(syscall.SIGHUP)
+		if err := json.NewDecoder(os.Stdin).Decode(&files); err != nil {
+			return fmt.Errorf("unable to read the configuration: %s", err)
+		}
+	}
+
+	// We check the settings now rather than finding out from the first run.
+	config := &Config{}
+	if len(args.Config) > 0 {
+		config, err = readConfigFiles(args.Config, files)
+		if err != nil {
+			return fmt.Errorf("unable to read config: %s: %s", args.Config, err)
+		}
+	}
+	if !config.decides() && args.Answers == "" {
+		return fmt.Errorf("no rules found in %s", args.Config)
+	}
+	flagArgs := *args
+	applySettings(args, config)
+	if err := checkArgs(args); err != nil {
+		return err
+	}
+
+	if os.Getenv(serveRunEnv) != "" {
+		args.StatusListen = ""
+		args.explicit["status-listen"] = true
+		run(args, config)
+		return nil
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("unable to find our executable: %s", err)
+	}
+
+	startStatus()
+	if args.StatusListen != "" {
+		if err := serveStatus(args.StatusListen); err != nil {
+			return err
+		}
+	}
+
+	// On SIGHUP we read the configuration again, and the next run uses it.
+	var reloader *configReloader
+	if args.Config != "" {
+		reloader = watchConfigReload(args.Config, &flagArgs, config, files)
+	} else {
+		signal.Ignore(syscall.SIGHUP)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	for {
+		startPhase("resolve")
+		log.Printf("Resolving duplicates in %s", args.Dir)
+		cmd := exec.Command(executable, append([]string{"serve"}, argv...)...)
+		if reloader != nil {
+			files = reloader.contents()
+		}
+		stdin, err := json.Marshal(files)
+		if err != nil {
+			return fmt.Errorf("unable to encode the configuration: %s", err)
+		}
+		cmd.Env = append(os.Environ(), serveRunEnv+"=1")
+		cmd.Stdin = bytes.NewReader(stdin)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Start(); err != nil {
+			return fmt.Errorf("unable to start a run: %s", err)
+		}
+
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+
+		stopping := false
+		select {
+		case err = <-done:
+		case sig := <-signals:
+			// Stopping the run partway could leave a file half replaced, so we
+			// let it finish.
+			log.Printf("Received %s. Stopping once the current run finishes", sig)
+			stopping = true
+			err = <-done
+		}
+		if err != nil {
+			warnf("Run failed: %s", err)
+		} else {
+			noteScanned()
+		}
+		if stopping {
+			return nil
+		}
+
+		startPhase("waiting")
+		log.Printf("Resolving again in %s", args.Every)
+		select {
+		case <-time.After(args.Every):
+		case sig := <-signals:
+			log.Printf("Received %s. Stopping", sig)
+			return nil
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+)
+
+// With -shred, we overwrite a file's contents with random data before deleting
+// it, so that they can't be read back from the disk afterwards. This only
+// helps where writing to a file writes over its old blocks. Copy-on-write
+// filesystems such as Btrfs and ZFS, journals, snapshots, and SSDs remapping
+// blocks may all keep the old contents.
+
+// unshreddable checks whether we can overwrite the file. We can't if it has
+// other hard links, as overwriting it would overwrite them too, and one of
+// them may be the copy we keep. It returns why not, or a blank string if we
+// can.
+func unshreddable(file *File) string {
+	fi, err := os.Lstat(file.Path)
+	if err != nil {
+		return fmt.Sprintf("unable to stat: %s", err)
+	}
+	if !fi.Mode().IsRegular() {
+		return "it is not a regular file"
+	}
+
+	links, ok := linkCount(file.Path, fi)
+	if !ok {
+		return "unable to tell whether it has other hard links"
+	}
+	if links > 1 {
+		return "it has other hard links"
+	}
+
+	return ""
+}
+
+// shredFile overwrites the file's contents.
+func shredFile(file *File) error {
+	fh, err := os.OpenFile(file.Path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	n, err := io.CopyN(fh, rand.Reader, file.Size)
+	if err == nil && n != file.Size {
+		err = fmt.Errorf("overwrote %d bytes but expected %d", n, file.Size)
+	}
+	if err == nil {
+		err = fh.Sync()
+	}
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// removeFile deletes the file, a sidecar of one we deleted, first overwriting
+// it with -shred. Sidecars such as AppleDouble files and XMP may hold as much
+// that is sensitive as the file itself.
+func removeFile(args *Args, filePath string) error {
+	if args.Shred {
+		fi, err := os.Lstat(filePath)
+		if err != nil {
+			return err
+		}
+		file := &File{Path: filePath, Size: fi.Size()}
+		if reason := unshreddable(file); reason != "" {
+			return fmt.Errorf("unable to shred it: %s", reason)
+		}
+		if err := shredFile(file); err != nil {
+			return fmt.Errorf("unable to shred: %s", err)
+		}
+	}
+	return os.Remove(filePath)
+}
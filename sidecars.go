@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Sidecars are files holding what other programs know about a file beside it,
+// such as XMP from photo editors, subtitles, thumbnails, and the JSON Google
+// Takeout writes. The sidecars setting lists their extensions. A sidecar of
+// photo.jpg with the extension .xmp is photo.xmp or photo.jpg.xmp.
+//
+// photo.xmp is also the sidecar of any other file named photo, such as the
+// RAW file beside a JPEG, so we only count it as one of photo.jpg's when no
+// other file in the directory has that name without its extension.
+//
+// When we delete a file, we deal with its sidecars too so they aren't left
+// describing nothing. If the copy we keep has no sidecar of the same kind, we
+// move the sidecar beside it, named after it, so we lose nothing. If it has
+// one with the same contents, we delete ours. If it has one that differs, we
+// leave ours where it is and warn, as it may hold edits the other doesn't. We
+// leave a protected sidecar where it is. Links replace a file at the same
+// path, so they leave its sidecars as they are. When we rename the copy we
+// keep, its sidecars go with it.
+
+// sidecar is a sidecar of a file.
+type sidecar struct {
+	path string
+	ext  string
+
+	// full says the sidecar's name is the file's full name and the extension,
+	// as in photo.jpg.xmp, rather than its name without its extension.
+	full bool
+}
+
+// sidecarPath returns the path of the file's sidecar with the extension.
+func sidecarPath(filePath, ext string, full bool) string {
+	if full {
+		return filePath + ext
+	}
+	return strings.TrimSuffix(filePath, filepath.Ext(filePath)) + ext
+}
+
+// sidecarsFor returns the file's sidecars with the extensions.
+func sidecarsFor(exts []string, filePath string) []sidecar {
+	var sidecars []sidecar
+	seen := make(map[string]bool)
+	shared := stemShared(exts, filePath)
+	for _, ext := range exts {
+		for _, full := range []bool{false, true} {
+			if !full && shared {
+				continue
+			}
+			p := sidecarPath(filePath, ext, full)
+			if p == filePath || seen[p] {
+				continue
+			}
+			fi, err := os.Lstat(p)
+			if err != nil || !fi.Mode().IsRegular() {
+				continue
+			}
+			seen[p] = true
+			sidecars = append(sidecars, sidecar{path: p, ext: ext, full: full})
+		}
+	}
+	return sidecars
+}
+
+// stemShared says whether another file in the file's directory has its name
+// without its extension, so that sidecars named that way may be the other
+// file's. We don't count sidecars.
+func stemShared(exts []string, filePath string) bool {
+	entries, err := ioutil.ReadDir(filepath.Dir(filePath))
+	if err != nil {
+		// If we can't tell, we assume another file has it.
+		return true
+	}
+
+	isSidecar := make(map[string]bool)
+	for _, ext := range exts {
+		isSidecar[strings.ToLower(ext)] = true
+	}
+	name := filepath.Base(filePath)
+	stem := strings.TrimSuffix(name, filepath.Ext(name))
+	for _, entry := range entries {
+		other := entry.Name()
+		ext := filepath.Ext(other)
+		if other == name || isSidecar[strings.ToLower(ext)] {
+			continue
+		}
+		if strings.TrimSuffix(other, ext) == stem {
+			return true
+		}
+	}
+	return false
+}
+
+// sidecarPaths returns the paths of the file's sidecars, one per line, for
+// the exec action's environment.
+func sidecarPaths(exts []string, filePath string) string {
+	var paths []string
+	for _, s := range sidecarsFor(exts, filePath) {
+		paths = append(paths, s.path)
+	}
+	return strings.Join(paths, "\n")
+}
+
+// handleSidecars deals with the sidecars of remove, which we deleted in
+// favour of keep, or would have if not live. Problems with sidecars don't
+// undo deleting the file, so we warn about them and carry on.
+func handleSidecars(args *Args, config *Config, keep, remove *File,
+	live bool) {
+	for _, s := range sidecarsFor(config.Sidecars, remove.Path) {
+		if pattern, ok := protectedBy(config, s.path); ok {
+			log.Printf("Leaving sidecar %s: it is protected by %s", s.path, pattern)
+			continue
+		}
+		if keep.remote {
+			log.Printf("Leaving sidecar %s: the copy we keep is on another machine",
+				s.path)
+			continue
+		}
+
+		// If keep's name without its extension is another file's too, a
+		// sidecar named that way would be ambiguous, so we use its full name.
+		dest := sidecarPath(keep.Path, s.ext,
+			s.full || stemShared(config.Sidecars, keep.Path))
+		_, err := os.Lstat(dest)
+		move := os.IsNotExist(err)
+
+		if !move {
+			identical, err := sameContents(args, s.path, dest)
+			if err != nil {
+				warnf("Leaving sidecar %s: unable to compare it with %s: %s", s.path,
+					dest, err)
+				continue
+			}
+			if !identical {
+				warnf("Leaving sidecar %s: it differs from %s", s.path, dest)
+				continue
+			}
+		}
+
+		if !live {
+			if move {
+				log.Printf("Would move its sidecar %s to %s", s.path, dest)
+			} else {
+				log.Printf("Would delete its sidecar %s", s.path)
+			}
+			continue
+		}
+
+		if move {
+			log.Printf("Moving its sidecar %s to %s", s.path, dest)
+			if err := renameNoReplace(s.path, dest); err != nil {
+				warnf("Unable to move sidecar %s: %s", s.path, err)
+			}
+			continue
+		}
+
+		if args.Backup != "" {
+			backup, err := backupFile(args.Backup, &File{Path: s.path})
+			if err != nil {
+				warnf("Not deleting sidecar %s: unable to back it up: %s", s.path, err)
+				continue
+			}
+			log.Printf("Backed up %s to %s", s.path, backup)
+		}
+		log.Printf("Deleting its sidecar %s", s.path)
+		if err := removeFile(args, s.path); err != nil {
+			warnf("Unable to remove sidecar: %s: %s", s.path, err)
+		}
+	}
+}
+
+// renameSidecars moves the sidecars of a copy we kept, which was at oldPath,
+// to go with its new name, newPath. If not live, we only say what we would do.
+// sidecars are the ones it had before we renamed it.
+func renameSidecars(config *Config, sidecars []sidecar, newPath string,
+	live bool) {
+	for _, s := range sidecars {
+		if pattern, ok := protectedBy(config, s.path); ok {
+			log.Printf("Leaving sidecar %s: it is protected by %s", s.path, pattern)
+			continue
+		}
+
+		dest := sidecarPath(newPath, s.ext,
+			s.full || stemShared(config.Sidecars, newPath))
+		if !live {
+			log.Printf("Would rename its sidecar %s to %s", s.path, dest)
+			continue
+		}
+		log.Printf("Renaming its sidecar %s to %s", s.path, dest)
+		if err := renameNoReplace(s.path, dest); err != nil {
+			warnf("Unable to rename sidecar %s: %s", s.path, err)
+		}
+	}
+}
+
+// sameContents says whether the two files hold the same bytes.
+func sameContents(args *Args, path1, path2 string) (bool, error) {
+	var files []*File
+	for _, p := range []string{path1, path2} {
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return false, err
+		}
+		if !fi.Mode().IsRegular() {
+			return false, nil
+		}
+		files = append(files, &File{Path: p, Size: fi.Size()})
+	}
+	return isIdentical(args, files[0], files[1])
+}
+
+// validateSidecars checks the sidecar extensions.
+func validateSidecars(exts []string) []error {
+	var errs []error
+	for i, ext := range exts {
+		if !strings.HasPrefix(ext, ".") || len(ext) < 2 ||
+			strings.ContainsAny(ext, `/\`) {
+			errs = append(errs, fieldError{fmt.Sprintf("sidecars[%d]", i),
+				"must be an extension such as .xmp"})
+		}
+	}
+	return errs
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// A groupOrder says whether one group of duplicates comes before another.
+type groupOrder func(group1, group2 []*File) bool
+
+// groupOrders holds the ways to sort groups of duplicates by the names used
+// with -sort. Sorting applies to what we list and report and to the order we
+// resolve the groups in.
+var groupOrders = map[string]groupOrder{
+	// The space we'd get back by keeping one copy.
+	"size-desc": func(group1, group2 []*File) bool {
+		return reclaimable(group1) > reclaimable(group2)
+	},
+	"size-asc": func(group1, group2 []*File) bool {
+		return reclaimable(group1) < reclaimable(group2)
+	},
+
+	// The path of the group's first file.
+	"path": func(group1, group2 []*File) bool {
+		return group1[0].Path < group2[0].Path
+	},
+
+	// The number of copies.
+	"count-desc": func(group1, group2 []*File) bool {
+		return len(group1) > len(group2)
+	},
+	"count-asc": func(group1, group2 []*File) bool {
+		return len(group1) < len(group2)
+	},
+
+	// The most recent modification time of any copy.
+	"mtime-desc": func(group1, group2 []*File) bool {
+		return newestModTime(group1).After(newestModTime(group2))
+	},
+	"mtime-asc": func(group1, group2 []*File) bool {
+		return newestModTime(group1).Before(newestModTime(group2))
+	},
+}
+
+// sortGroups sorts the groups in place. Groups that are equal by the order
+// stay in the order we found them.
+func sortGroups(groups [][]*File, order string) {
+	less, ok := groupOrders[order]
+	if !ok {
+		return
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return less(groups[i], groups[j])
+	})
+}
+
+// topUsage describes -top, which several commands take.
+const topUsage = "Only list, report and resolve this many groups of duplicates that waste the most space. 0 means every group."
+
+// topGroups returns the n groups that waste the most space, keeping them in
+// the order they're in. Groups that waste the same space are chosen in that
+// order too.
+func topGroups(groups [][]*File, n int) [][]*File {
+	if n <= 0 || len(groups) <= n {
+		return groups
+	}
+
+	order := make([]int, len(groups))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return reclaimable(groups[order[i]]) > reclaimable(groups[order[j]])
+	})
+	sort.Ints(order[:n])
+
+	var top [][]*File
+	for _, i := range order[:n] {
+		top = append(top, groups[i])
+	}
+	return top
+}
+
+func reclaimable(group []*File) int64 {
+	return int64(len(group)-1) * group[0].Size
+}
+
+func newestModTime(group []*File) time.Time {
+	newest := group[0].ModTime
+	for _, file := range group[1:] {
+		if file.ModTime.After(newest) {
+			newest = file.ModTime
+		}
+	}
+	return newest
+}
+
+func groupOrderNames() string {
+	var names []string
+	for name := range groupOrders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
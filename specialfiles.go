@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log"
+	"os"
+)
+
+// Special files are named pipes (FIFOs), sockets, and device files. They hold
+// no data of their own to compare, and opening a named pipe to read it waits
+// until something writes to it, so we skip them while looking for files. With
+// -report-special-files, we list those we skipped.
+
+// SpecialFile is a special file we skipped.
+type SpecialFile struct {
+	Path string `json:"path"`
+	Kind string `json:"kind"`
+}
+
+// specialKind says what kind of special file the file is, or returns a blank
+// string if it is a regular file.
+func specialKind(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeCharDevice != 0:
+		return "char-device"
+	case mode&os.ModeDevice != 0:
+		return "block-device"
+	case !mode.IsRegular():
+		return "irregular"
+	}
+	return ""
+}
+
+// reportSpecialFiles lists the special files we skipped.
+func reportSpecialFiles(args *Args, summary *Summary) {
+	summary.SpecialFiles = len(args.specialFiles)
+	summary.specialFiles = args.specialFiles
+	if len(args.specialFiles) == 0 {
+		return
+	}
+
+	log.Printf("Skipped %d special files:", len(args.specialFiles))
+	for _, file := range args.specialFiles {
+		log.Printf("  %s (%s)", file.Path, file.Kind)
+	}
+}
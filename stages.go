@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// -stages chooses which of the tiers in tiers.go we go through, trading
+// speed against how sure we are that files are identical. A rule may ask for
+// stages the run skips, which we then carry out for the files it would
+// remove.
+
+// The stages, in the order we go through them.
+const (
+	stageSize        = "size"
+	stagePrefixHash  = "prefix-hash"
+	stageFullHash    = "full-hash"
+	stageByteCompare = "byte-compare"
+)
+
+// stageNames lists the stages in order.
+var stageNames = []string{
+	stageSize,
+	stagePrefixHash,
+	stageFullHash,
+	stageByteCompare,
+}
+
+// checkStages checks a list of stages. They must be in order, and they must
+// include size and full-hash, as we group files by their sizes and
+// checksums.
+func checkStages(stages []string) error {
+	next := 0
+	for _, stage := range stages {
+		i := stageIndex(stage)
+		if i == -1 {
+			return fmt.Errorf("unknown stage: %s. Stages are: %s", stage,
+				strings.Join(stageNames, ", "))
+		}
+		if i < next {
+			return fmt.Errorf("stage %s is out of order or repeated. The order is: %s",
+				stage, strings.Join(stageNames, ", "))
+		}
+		next = i + 1
+	}
+
+	if len(stages) > 0 && (!hasStage(stages, stageSize) ||
+		!hasStage(stages, stageFullHash)) {
+		return fmt.Errorf("the stages must include %s and %s", stageSize,
+			stageFullHash)
+	}
+	return nil
+}
+
+func stageIndex(stage string) int {
+	for i, name := range stageNames {
+		if name == stage {
+			return i
+		}
+	}
+	return -1
+}
+
+// hasStage says whether the list has the stage. An empty list has every
+// stage.
+func hasStage(stages []string, stage string) bool {
+	if len(stages) == 0 {
+		return true
+	}
+	for _, name := range stages {
+		if name == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// runsStage says whether the run goes through the stage. A second hash or
+// -trust-hash replaces comparing files byte by byte.
+func (args *Args) runsStage(stage string) bool {
+	if stage == stageByteCompare && (args.SecondHash != "" || args.TrustHash) {
+		return false
+	}
+	return hasStage(args.Stages, stage)
+}
+
+// stagesFlag is a flag holding a comma separated list of stages.
+type stagesFlag []string
+
+func (s *stagesFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stagesFlag) Set(value string) error {
+	*s = nil
+	for _, stage := range strings.Split(value, ",") {
+		*s = append(*s, strings.TrimSpace(stage))
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// With -state-file, we keep the checksums we calculate between runs. A file
+// with the same path, size, and modification time as when we checksummed it
+// isn't read again. This is what lets -max-duration spread a scan of a giant
+// tree across several runs: each run saves what it checksummed before
+// stopping, and the next carries on from there.
+
+// stateVersion is the version of the state file format.
+const stateVersion = 1
+
+// errOutOfTime means the run used up its -max-duration.
+var errOutOfTime = errors.New("out of time")
+
+// stateFile is the contents of a state file.
+type stateFile struct {
+	Version    int          `json:"version"`
+	Algorithm  string       `json:"algorithm"`
+	SecondHash string       `json:"second_hash,omitempty"`
+	Files      []stateEntry `json:"files"`
+}
+
+// stateEntry is a file we checksummed.
+type stateEntry struct {
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"mod_time"`
+	Hash       string    `json:"hash"`
+	SecondHash string    `json:"second_hash,omitempty"`
+}
+
+// hashState holds the checksums from earlier runs and those from this one.
+type hashState struct {
+	algorithm  string
+	secondHash string
+	files      map[string]stateEntry
+
+	// seen holds the paths this run checksummed or found checksums for.
+	seen map[string]bool
+
+	// trusted is false if we can't trust modification times to tell us a file
+	// is unchanged. We then checksum every file again, though we still save the
+	// checksums.
+	trusted bool
+
+	// hashed counts the files this run checksummed.
+	hashed int
+}
+
+// loadHashState reads the state file. If there isn't one yet, or it is for
+// other hash algorithms, we know no checksums.
+func loadHashState(name, algorithm, secondHash string) (*hashState, error) {
+	state := &hashState{
+		algorithm:  algorithm,
+		secondHash: secondHash,
+		files:      make(map[string]stateEntry),
+		seen:       make(map[string]bool),
+		trusted:    true,
+	}
+
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, err
+	}
+
+	var contents stateFile
+	if err := json.Unmarshal(buf, &contents); err != nil {
+		return nil, fmt.Errorf("unable to parse state: %s: %s", name, err)
+	}
+	if contents.Version != stateVersion {
+		return nil, fmt.Errorf("%s: unsupported state version %d", name,
+			contents.Version)
+	}
+	if contents.Algorithm != algorithm || contents.SecondHash != secondHash {
+		log.Printf("%s holds checksums from other hash algorithms. Starting again",
+			name)
+		return state, nil
+	}
+
+	for _, entry := range contents.Files {
+		state.files[entry.Path] = entry
+	}
+	return state, nil
+}
+
+// fill gives files we checksummed before, and that haven't changed since,
+// their checksums. It returns the files still to checksum.
+func (s *hashState) fill(files []*File) []*File {
+	if !s.trusted {
+		return files
+	}
+
+	var rest []*File
+	for _, file := range files {
+		entry, ok := s.files[file.Path]
+		if !ok || file.networkFS != "" || entry.Size != file.Size ||
+			!entry.ModTime.Equal(file.ModTime) {
+			rest = append(rest, file)
+			continue
+		}
+
+		hash, err := hex.DecodeString(entry.Hash)
+		if err != nil {
+			rest = append(rest, file)
+			continue
+		}
+		secondHash, err := hex.DecodeString(entry.SecondHash)
+		if err != nil {
+			rest = append(rest, file)
+			continue
+		}
+
+		file.Hash = hash
+		if s.secondHash != "" {
+			file.SecondHash = secondHash
+		}
+		s.seen[file.Path] = true
+	}
+	return rest
+}
+
+// record remembers the checksums of the files we have checksummed. Those we
+// didn't get to have none.
+func (s *hashState) record(files []*File) {
+	for _, file := range files {
+		if file.Hash == nil || s.seen[file.Path] {
+			continue
+		}
+		s.files[file.Path] = stateEntry{
+			Path:       file.Path,
+			Size:       file.Size,
+			ModTime:    file.ModTime,
+			Hash:       hex.EncodeToString(file.Hash),
+			SecondHash: hex.EncodeToString(file.SecondHash),
+		}
+		s.seen[file.Path] = true
+		s.hashed++
+	}
+}
+
+// save writes the checksums for the next run. After a complete run, we keep
+// only those of files this run saw, so that files that have since gone don't
+// fill the file up. After an unfinished one, we keep everything, as the run
+// may not have got to some of the files.
+func (s *hashState) save(name string, complete bool) error {
+	contents := stateFile{
+		Version:    stateVersion,
+		Algorithm:  s.algorithm,
+		SecondHash: s.secondHash,
+		Files:      []stateEntry{},
+	}
+	for filePath, entry := range s.files {
+		if complete && !s.seen[filePath] {
+			continue
+		}
+		contents.Files = append(contents.Files, entry)
+	}
+	sort.Slice(contents.Files, func(i, j int) bool {
+		return contents.Files[i].Path < contents.Files[j].Path
+	})
+
+	buf, err := json.Marshal(contents)
+	if err != nil {
+		return fmt.Errorf("unable to encode state: %s", err)
+	}
+	if err := writeFileAtomically(name, append(buf, '\n')); err != nil {
+		return fmt.Errorf("unable to save state: %s", err)
+	}
+	return nil
+}
+
+// outOfTime checks whether the run has used up its -max-duration.
+func outOfTime(args *Args) bool {
+	return !args.deadline.IsZero() && time.Now().After(args.deadline)
+}
+
+// stopOutOfTime ends a run that used up its -max-duration while
+// checksumming. We save what we checksummed for the next run rather than
+// resolving duplicates we may have found only some copies of.
+func stopOutOfTime(args *Args) {
+	if err := args.state.save(args.StateFile, false); err != nil {
+		fatalf("%s", err)
+	}
+
+	log.Printf("Stopping after %s: checksummed %d files this run, and %s now has checksums for %d. Run again to carry on.",
+		args.MaxDuration, args.state.hashed, args.StateFile,
+		len(args.state.files))
+
+	markRunIncomplete()
+	if err := finishRunSummary(nil); err != nil {
+		log.Fatalf("%s", err)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// We log a snapshot of how the run is going when asked, such as with SIGUSR1,
+// without interrupting it. This is for checking on a long run in the
+// background, such as one under nohup.
+//
+// With -status-listen, we also serve /healthz and /status over HTTP, so that
+// whatever runs us as a service, such as a container orchestrator or a
+// monitoring system, can check on us without reading our log. There is no
+// authentication, and the warnings /status lists may name files, so the
+// address should be one only those who may see that can reach.
+
+// recentWarnings is how many of the latest warnings /status lists.
+const recentWarnings = 10
+
+// statusListenUsage describes -status-listen, which several commands take.
+const statusListenUsage = "Address to serve /healthz and /status on over HTTP while we run, such as 127.0.0.1:8001. Anyone who can reach it can read /status, whose warnings may name files."
+
+// startStatus starts timing the run for status snapshots and starts waiting
+// for requests for them.
+func startStatus() {
+	currentRun.mu.Lock()
+	now := time.Now()
+	currentRun.started = now
+	currentRun.current, currentRun.currentSince = "setup", now
+	currentRun.mu.Unlock()
+
+	watchStatusSignal()
+}
+
+// statusSnapshot describes how the run is going.
+func statusSnapshot() string {
+	currentRun.mu.Lock()
+	phase := currentRun.current
+	inPhase := time.Since(currentRun.currentSince).Round(time.Second)
+	running := time.Since(currentRun.started).Round(time.Second)
+	warnings := currentRun.warnings
+	currentRun.mu.Unlock()
+
+	status := fmt.Sprintf("Status: running for %s, in phase %s for %s, %d warnings",
+		running, phase, inPhase, warnings)
+	if progress := hashProgress(); progress != nil {
+		status += ", " + progress.status()
+	}
+	return status
+}
+
+// logStatus logs a status snapshot.
+func logStatus() {
+	log.Print(statusSnapshot())
+}
+
+// runStatus is what /status serves.
+type runStatus struct {
+	Started      time.Time `json:"started"`
+	Phase        string    `json:"phase"`
+	PhaseStarted time.Time `json:"phase_started"`
+
+	// LastScan is when we last finished looking for files, or for the
+	// coordinator, last received an agent's records. It is null until then.
+	LastScan *time.Time `json:"last_scan"`
+
+	// Queue is how many files we have left to checksum, or for the
+	// coordinator, how many agents it is still waiting for.
+	Queue int `json:"queue"`
+
+	Warnings     int      `json:"warnings"`
+	LastWarnings []string `json:"last_warnings"`
+}
+
+// noteScanned records that we finished looking for files, or received an
+// agent's records.
+func noteScanned() {
+	currentRun.mu.Lock()
+	defer currentRun.mu.Unlock()
+	currentRun.scanned = time.Now()
+}
+
+// setStatusQueue records how much work is waiting that isn't checksumming,
+// such as agents the coordinator hasn't heard from.
+func setStatusQueue(n int) {
+	currentRun.mu.Lock()
+	defer currentRun.mu.Unlock()
+	currentRun.queue = n
+}
+
+// currentStatus describes how the run is going, for /status.
+func currentStatus() runStatus {
+	currentRun.mu.Lock()
+	status := runStatus{
+		Started:      currentRun.started.UTC(),
+		Phase:        currentRun.current,
+		PhaseStarted: currentRun.currentSince.UTC(),
+		Queue:        currentRun.queue,
+		Warnings:     currentRun.warnings,
+		LastWarnings: append([]string{}, currentRun.recent...),
+	}
+	if !currentRun.scanned.IsZero() {
+		scanned := currentRun.scanned.UTC()
+		status.LastScan = &scanned
+	}
+	currentRun.mu.Unlock()
+
+	if progress := hashProgress(); progress != nil {
+		status.Queue = progress.total - int(atomic.LoadInt64(&progress.done))
+	}
+	return status
+}
+
+// addStatusHandlers adds the /healthz and /status handlers to the mux.
+// /healthz answers as long as we're running, so it only says we haven't hung
+// or died. /status says how we're doing.
+func addStatusHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "ok\n")
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(currentStatus()); err != nil {
+			log.Printf("Unable to send status to %s: %s", r.RemoteAddr, err)
+		}
+	})
+}
+
+// serveStatus starts serving /healthz and /status on the address for the rest
+// of the run.
+func serveStatus(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("unable to listen for status requests: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	addStatusHandlers(mux)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			warnf("Unable to serve status requests: %s", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,7 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package main
+
+// watchStatusSignal does nothing, as there is no SIGUSR1 on this platform.
+func watchStatusSignal() {}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A keepStrategy decides which of two duplicate files to keep when no rule
+// says. It returns the file to keep and then the file to remove.
+type keepStrategy func(file1, file2 *File) (*File, *File, error)
+
+// keepStrategies holds the strategies by the names used in the configuration.
+var keepStrategies = map[string]keepStrategy{
+	// Keep the file we found first.
+	"first": func(file1, file2 *File) (*File, *File, error) {
+		return file1, file2, nil
+	},
+
+	// Keep the file modified longest ago. It is most likely the original.
+	"oldest": func(file1, file2 *File) (*File, *File, error) {
+		if file2.ModTime.Before(file1.ModTime) {
+			return file2, file1, nil
+		}
+		return file1, file2, nil
+	},
+
+	"newest": func(file1, file2 *File) (*File, *File, error) {
+		if file2.ModTime.After(file1.ModTime) {
+			return file2, file1, nil
+		}
+		return file1, file2, nil
+	},
+
+	// Keep the file whose name isn't that of a copy, such as a.jpg over
+	// a (1).jpg. If neither or both are, keep the first.
+	"original-name": func(file1, file2 *File) (*File, *File, error) {
+		if isCopyName(file1.Basename) && !isCopyName(file2.Basename) {
+			return file2, file1, nil
+		}
+		return file1, file2, nil
+	},
+
+	// Keep the file with the shorter name, such as a.jpg over a-1.jpg.
+	"shortest-name": func(file1, file2 *File) (*File, *File, error) {
+		if len(file2.Basename) < len(file1.Basename) {
+			return file2, file1, nil
+		}
+		return file1, file2, nil
+	},
+
+	"shortest-path": func(file1, file2 *File) (*File, *File, error) {
+		if len(file2.Path) < len(file1.Path) {
+			return file2, file1, nil
+		}
+		return file1, file2, nil
+	},
+
+	"longest-path": func(file1, file2 *File) (*File, *File, error) {
+		if len(file2.Path) > len(file1.Path) {
+			return file2, file1, nil
+		}
+		return file1, file2, nil
+	},
+
+	// Keep the better recording of the same music. See audio.go.
+	"lossless":        keepLossless,
+	"highest-bitrate": keepHighestBitrate,
+
+	// Keep the best version of the same picture. See images.go.
+	"highest-resolution": keepHighestResolution,
+
+	// Keep the file on the filesystem with more free space, and so remove the one
+	// on the fuller filesystem. This evens out how full they are rather than
+	// only freeing space. We check each time, as removing files changes it.
+	"most-free-space": func(file1, file2 *File) (*File, *File, error) {
+		free1, err := freeSpace(file1.Path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to find free space: %s: %s",
+				file1.Path, err)
+		}
+		free2, err := freeSpace(file2.Path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to find free space: %s: %s",
+				file2.Path, err)
+		}
+		if free2 > free1 {
+			return file2, file1, nil
+		}
+		return file1, file2, nil
+	},
+}
+
+func keepStrategyNames() string {
+	var names []string
+	for name := range keepStrategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// tiebreakNames lists the strategies collapse rules may use.
+func tiebreakNames() []string {
+	var names []string
+	for name := range keepStrategies {
+		if name != "most-free-space" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// copyName matches the names, without extensions, that file managers and
+// browsers give copies of files: "a (1)", "a - Copy", "a - Copy (2)",
+// "a copy", "a copy 2", and "Copy of a".
+var copyName = regexp.MustCompile(
+	`^(?:Copy (?:\(\d+\) )?of .+|.+(?: \(\d+\)| - Copy(?: \(\d+\))?| copy(?: \d+)?))$`)
+
+// isCopyName checks whether the file name looks like that of a copy.
+func isCopyName(name string) bool {
+	return copyName.MatchString(strings.TrimSuffix(name, path.Ext(name)))
+}
@@ -0,0 +1,92 @@
+package main
+
+import "fmt"
+
+// Summary counts what happened during a run.
+type Summary struct {
+	Live bool `json:"live"`
+
+	// Files is how many files we found.
+	Files int `json:"files"`
+
+	// DuplicateGroups is how many sets of identical files we found.
+	DuplicateGroups int `json:"duplicate_groups"`
+
+	// DuplicateFiles is how many files were duplicates of another, not
+	// counting the first file in each group. DuplicateBytes is their total
+	// size.
+	DuplicateFiles int   `json:"duplicate_files"`
+	DuplicateBytes int64 `json:"duplicate_bytes"`
+
+	// Removed is how many duplicates we deleted or replaced with links, or in
+	// non-live mode would have. RemovedBytes is their total size.
+	Removed      int   `json:"removed"`
+	RemovedBytes int64 `json:"removed_bytes"`
+
+	// Vanished is how many files disappeared after we found them, so that we
+	// skipped them.
+	Vanished int `json:"vanished"`
+
+	// InUse is how many duplicates we didn't remove because other processes
+	// had them open. See -skip-open.
+	InUse int `json:"in_use"`
+
+	// BrokenSymlinks is how many symbolic links pointing at nothing we found.
+	// See -broken-symlinks.
+	BrokenSymlinks int `json:"broken_symlinks"`
+
+	// SpecialFiles is how many named pipes, sockets, and device files we
+	// skipped. See -report-special-files.
+	SpecialFiles int `json:"special_files"`
+
+	// Rules counts what each rule did, in the order of the configuration.
+	Rules []*RuleStats `json:"rules,omitempty"`
+
+	// What we found and removed, for reports and notifications.
+	groups    [][]*File
+	deletions []actionHookContext
+
+	// differing holds groups of files with identical contents but different
+	// extended attributes. See -compare-xattrs.
+	differing [][]*File
+
+	// inUse holds the paths of the duplicates other processes had open.
+	inUse []string
+
+	// brokenSymlinks holds the paths of the broken symbolic links.
+	brokenSymlinks []string
+
+	// specialFiles holds the special files we skipped.
+	specialFiles []*SpecialFile
+
+	// resolving numbers the group we're resolving, from 1, for plans.
+	resolving int
+}
+
+// recordRemoval counts a duplicate we removed, or would have.
+func (s *Summary) recordRemoval(action string, keep, remove *File) {
+	s.Removed++
+	s.RemovedBytes += remove.Size
+	s.deletions = append(s.deletions, actionHookContext{
+		Action: action,
+		Keep:   keep.Path,
+		Remove: remove.Path,
+		Size:   remove.Size,
+	})
+}
+
+// withinLimits checks whether removing the file would keep the run within
+// -max-files and -max-bytes. The first time it wouldn't, we say so. Later
+// duplicates that are small enough may still fit within -max-bytes. The
+// limits are on what we remove, not what we checksum.
+func withinLimits(args *Args, summary *Summary, remove *File) bool {
+	if args.MaxFiles > 0 && summary.Removed+1 > args.MaxFiles {
+		args.limitReached("-max-files", fmt.Sprint(args.MaxFiles))
+		return false
+	}
+	if args.MaxBytes > 0 && summary.RemovedBytes+remove.Size > args.MaxBytes {
+		args.limitReached("-max-bytes", fmt.Sprint(args.MaxBytes))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// With -rewrite-symlinks, when we delete a duplicate, we point the symbolic
+// links in the tree that pointed at it at the copy we keep instead. Otherwise
+// deleting duplicates would leave trees of links, such as ones a package
+// manager or media library builds, full of broken links.
+//
+// When we rename a copy we keep, we point its links at its new name the same
+// way.
+//
+// We only know about links beneath -dir, and we match a link to a file by the
+// path it holds. A link reaching the file through another link, such as one
+// to its directory, isn't rewritten.
+//
+// With -broken-symlinks, we also note the links pointing at nothing while we
+// look for files, as a run over the whole tree is a good time to find them.
+
+// symlink is a symbolic link we found.
+type symlink struct {
+	path string
+
+	// target is the path the link holds, which may be relative to its
+	// directory.
+	target string
+
+	// broken says whether it pointed at nothing when we found it.
+	broken bool
+}
+
+// symlinkIndex holds the links we found by the absolute path they point at.
+type symlinkIndex struct {
+	links map[string][]*symlink
+}
+
+func newSymlinkIndex() *symlinkIndex {
+	return &symlinkIndex{links: make(map[string][]*symlink)}
+}
+
+// add remembers the link.
+func (x *symlinkIndex) add(link *symlink) {
+	target, ok := linkTarget(link)
+	if !ok {
+		return
+	}
+	x.links[target] = append(x.links[target], link)
+}
+
+// linkTarget returns the absolute path the link points at.
+func linkTarget(link *symlink) (string, bool) {
+	target := link.target
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(link.path), target)
+	}
+	abs, err := filepath.Abs(target)
+	if err != nil {
+		return "", false
+	}
+	return abs, true
+}
+
+// rewriteSymlinks points the links to remove, a duplicate we deleted, at keep.
+// A link that held a relative path gets a relative path to keep, and one that
+// held an absolute path gets an absolute one. If not live, we only say what we
+// would do.
+//
+// We replace each link by creating the new one beside it and renaming it into
+// place, so the link's path always exists. Failing to replace one is a
+// problem with that link rather than the run, so we warn and carry on.
+func rewriteSymlinks(args *Args, keep, remove *File, live bool) {
+	if args.symlinks == nil {
+		return
+	}
+
+	removePath, err := filepath.Abs(remove.Path)
+	if err != nil {
+		return
+	}
+	keepPath, err := filepath.Abs(keep.Path)
+	if err != nil {
+		warnf("Unable to find the absolute path of %s: %s", keep.Path, err)
+		return
+	}
+
+	links := args.symlinks.links[removePath]
+	delete(args.symlinks.links, removePath)
+
+	for _, link := range links {
+		target := keepPath
+		if !filepath.IsAbs(link.target) {
+			linkDir, err := filepath.Abs(filepath.Dir(link.path))
+			if err == nil {
+				target, err = filepath.Rel(linkDir, keepPath)
+			}
+			if err != nil {
+				warnf("Unable to point %s at %s: %s", link.path, keep.Path, err)
+				continue
+			}
+		}
+
+		if !live {
+			log.Printf("Would point symbolic link %s at %s", link.path, target)
+			// We go on as if we had, so that we say what we would do with it if
+			// we go on to remove or rename keep.
+			args.symlinks.links[keepPath] = append(args.symlinks.links[keepPath],
+				link)
+			continue
+		}
+
+		log.Printf("Pointing symbolic link %s at %s", link.path, target)
+		if err := replaceSymlink(link, target); err != nil {
+			warnf("Unable to point %s at %s: %s", link.path, keep.Path, err)
+			continue
+		}
+
+		link.target = target
+		args.symlinks.links[keepPath] = append(args.symlinks.links[keepPath], link)
+	}
+}
+
+// replaceSymlink replaces the link with one holding the target. We check that
+// it is still the link we found first.
+func replaceSymlink(link *symlink, target string) error {
+	current, err := os.Readlink(link.path)
+	if err != nil {
+		return err
+	}
+	if current != link.target {
+		return fmt.Errorf("it changed to point at %s", current)
+	}
+
+	tmp := link.path + ".dupefile-link"
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, link.path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// What to do with broken symbolic links, with -broken-symlinks.
+const (
+	brokenSymlinksIgnore = "ignore"
+
+	// List them at the end of the run and in reports.
+	brokenSymlinksReport = "report"
+
+	// As report, and with resolve -live, delete them.
+	brokenSymlinksDelete = "delete"
+)
+
+// isBrokenSymlink checks whether the link points at nothing, or around a
+// loop of links.
+func isBrokenSymlink(linkPath string) bool {
+	_, err := os.Stat(linkPath)
+	return os.IsNotExist(err) || errors.Is(err, syscall.ELOOP)
+}
+
+// dealWithBrokenSymlinks lists the broken links we found and, if asked to,
+// deletes them. We check that each is still a broken link first, as one may
+// have been fixed since we found it.
+func dealWithBrokenSymlinks(args *Args, config *Config, summary *Summary) {
+	for _, link := range args.brokenLinks {
+		summary.brokenSymlinks = append(summary.brokenSymlinks, link.path)
+	}
+	summary.BrokenSymlinks = len(summary.brokenSymlinks)
+	if len(args.brokenLinks) == 0 {
+		return
+	}
+
+	log.Printf("Found %d broken symbolic links:", len(args.brokenLinks))
+	for _, link := range args.brokenLinks {
+		log.Printf("  %s -> %s", link.path, link.target)
+	}
+
+	if args.BrokenLinks != brokenSymlinksDelete || args.scanOnly {
+		return
+	}
+
+	for _, link := range args.brokenLinks {
+		if pattern, ok := protectedBy(config, link.path); ok {
+			warnf("Not deleting broken symbolic link %s: it is protected by %s",
+				link.path, pattern)
+			continue
+		}
+
+		if !args.Live {
+			log.Printf("Non-live mode. Would delete broken symbolic link %s",
+				link.path)
+			continue
+		}
+
+		current, err := os.Readlink(link.path)
+		if err != nil || current != link.target || !isBrokenSymlink(link.path) {
+			log.Printf("Not deleting %s: it is no longer the broken link we found",
+				link.path)
+			continue
+		}
+
+		log.Printf("Deleting broken symbolic link %s", link.path)
+		if err := os.Remove(link.path); err != nil {
+			warnf("Unable to remove: %s: %s", link.path, err)
+		}
+	}
+}
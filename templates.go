@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A rule's directories may contain variables such as {year}. This lets one
+// rule cover many directories, such as keeping /archive/{year}/ over
+// /staging/{year}/.
+//
+// If the configuration defines the variable in its variables setting, we
+// substitute its value. Otherwise the variable matches any one path component
+// and the rule only applies if the same variable matches the same text in
+// both directories. {{ is a literal {.
+
+// dirPattern is a rule directory containing variables, compiled to a regular
+// expression.
+type dirPattern struct {
+	re *regexp.Regexp
+
+	// names holds the variable captured by each group in re.
+	names []string
+}
+
+var variableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// hasVariables checks whether a rule directory contains variables.
+func hasVariables(dir string) bool {
+	return strings.Contains(strings.Replace(dir, "{{", "", -1), "{")
+}
+
+// compileDirPattern compiles a rule directory containing variables. Directories
+// end with a / just like those matched against them. If the rule is recursive,
+// the pattern also matches subdirectories.
+func compileDirPattern(
+	dir string,
+	recursive bool,
+	vars map[string]string,
+) (*dirPattern, error) {
+	if recursive {
+		dir = strings.TrimSuffix(dir, "/")
+	}
+
+	var re strings.Builder
+	re.WriteString("^")
+	pattern := &dirPattern{}
+
+	for len(dir) > 0 {
+		i := strings.IndexByte(dir, '{')
+		if i == -1 {
+			re.WriteString(regexp.QuoteMeta(dir))
+			break
+		}
+
+		re.WriteString(regexp.QuoteMeta(dir[:i]))
+		dir = dir[i:]
+
+		if strings.HasPrefix(dir, "{{") {
+			re.WriteString(regexp.QuoteMeta("{"))
+			dir = dir[2:]
+			continue
+		}
+
+		end := strings.IndexByte(dir, '}')
+		if end == -1 {
+			return nil, fmt.Errorf("unterminated variable: %s", dir)
+		}
+
+		name := dir[1:end]
+		dir = dir[end+1:]
+
+		if !variableName.MatchString(name) {
+			return nil, fmt.Errorf("invalid variable name: %q", name)
+		}
+
+		if value, ok := vars[name]; ok {
+			re.WriteString(regexp.QuoteMeta(value))
+			continue
+		}
+
+		re.WriteString("([^/]+)")
+		pattern.names = append(pattern.names, name)
+	}
+
+	if recursive {
+		re.WriteString("/(?:.*/)?")
+	}
+	re.WriteString("$")
+
+	var err error
+	pattern.re, err = regexp.Compile(re.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return pattern, nil
+}
+
+// match checks whether the pattern matches the directory. If so it returns
+// what each variable matched.
+func (p *dirPattern) match(dir string) (map[string]string, bool) {
+	m := p.re.FindStringSubmatch(dir)
+	if m == nil {
+		return nil, false
+	}
+
+	captures := make(map[string]string)
+	for i, name := range p.names {
+		if value, ok := captures[name]; ok && value != m[i+1] {
+			return nil, false
+		}
+		captures[name] = m[i+1]
+	}
+
+	return captures, true
+}
+
+// compileRules compiles the directories of rules containing variables.
+func compileRules(rules []Rule, vars map[string]string) error {
+	for i := range rules {
+		rule := &rules[i]
+		if !hasVariables(rule.KeepDir) && !hasVariables(rule.RemoveDir) {
+			continue
+		}
+		if isFilesystemLocation(rule.KeepDir) ||
+			isFilesystemLocation(rule.RemoveDir) {
+			return fmt.Errorf("%s: a rule naming a filesystem can't contain variables",
+				rule.source)
+		}
+
+		var err error
+		rule.keepPattern, err = compileDirPattern(rule.KeepDir, rule.Recursive,
+			vars)
+		if err != nil {
+			return fmt.Errorf("%s: keep: %s", rule.source, err)
+		}
+
+		if rule.RemoveDir == removeAnywhere {
+			continue
+		}
+		rule.removePattern, err = compileDirPattern(rule.RemoveDir, rule.Recursive,
+			vars)
+		if err != nil {
+			return fmt.Errorf("%s: remove: %s", rule.source, err)
+		}
+	}
+
+	return nil
+}
+
+// escapeVariables makes a directory name safe to use in a rule, where { would
+// otherwise start a variable.
+func escapeVariables(dir string) string {
+	return strings.Replace(dir, "{", "{{", -1)
+}
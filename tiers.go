@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Finding duplicates happens in tiers. Each is more expensive than the last,
+// and only files that are still possible duplicates go on to the next:
+//
+//   - Files with different sizes can't be identical, and we know the sizes
+//     without reading anything.
+//   - A quick checksum of the start of large files usually tells files of the
+//     same size apart.
+//   - With -bloom-file, files an earlier run found to be unique. See bloom.go.
+//   - A checksum of all of each file.
+//   - Comparing files with the same checksum byte by byte. See findDuplicates.
+//
+// On trees with few duplicates, most files never get read at all. -stages
+// may skip the quick checksum and the comparison. See stages.go.
+//
+// With -largest-first, we go through the tiers for the largest files first,
+// and report and resolve their duplicates before moving on to smaller ones.
+
+// findDuplicatesInTiers finds the groups of identical files among the files.
+func findDuplicatesInTiers(args *Args, files []*File) ([][]*File, error) {
+	candidates := sameSize(files)
+
+	if args.runsStage(stagePrefixHash) {
+		// We only read one path of each set of hard links.
+		large := largeFiles(distinctFiles(candidates))
+		if len(large) > 0 {
+			log.Printf("Checksumming the start of %s...", countFiles(len(large)))
+		}
+		if err := calculateChecksums(args, large, prefixChecksum); err != nil {
+			return nil, fmt.Errorf("unable to calculate checksums: %w", err)
+		}
+		shareChecksums(candidates)
+		candidates = samePrefix(withoutVanished(args, candidates))
+	}
+	if args.known != nil {
+		candidates = args.known.skipKnown(candidates)
+	}
+
+	distinct := distinctFiles(candidates)
+	rest := distinct
+	if args.state != nil {
+		rest = args.state.fill(distinct)
+	}
+	if len(rest) > 0 {
+		log.Printf("Calculating checksums of %s...", countFiles(len(rest)))
+	}
+	err := checksumFiles(args, rest)
+	if args.state != nil {
+		args.state.record(distinct)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to calculate checksums: %w", err)
+	}
+	shareChecksums(candidates)
+	candidates = withoutVanished(args, candidates)
+
+	groups, err := findDuplicates(args, candidates)
+	if err != nil {
+		return nil, err
+	}
+	if args.known != nil {
+		args.known.recordUnique(candidates)
+	}
+	return groups, nil
+}
+
+// largestFirstBatchBytes is roughly how much data we checksum before handing
+// on the duplicates we find with -largest-first. Each batch holds every file
+// of its sizes.
+const largestFirstBatchBytes = 1 << 30
+
+// findDuplicatesLargestFirst finds the groups of identical files among the
+// files, starting with the largest. It passes the groups to handle a batch at
+// a time, as soon as it finds them, so that the largest duplicates are known
+// early on a long scan. Each batch has every file of its sizes, so it has all
+// copies of its groups.
+func findDuplicatesLargestFirst(
+	args *Args,
+	files []*File,
+	handle func([][]*File) error,
+) error {
+	candidates := sameSize(files)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Size > candidates[j].Size
+	})
+
+	for len(candidates) > 0 {
+		end := 0
+		var bytes int64
+		for end < len(candidates) && end < indexBatchSize &&
+			bytes < largestFirstBatchBytes {
+			size := candidates[end].Size
+			for end < len(candidates) && candidates[end].Size == size {
+				bytes += size
+				end++
+			}
+		}
+
+		groups, err := findDuplicatesInTiers(args, candidates[:end])
+		if err != nil {
+			return err
+		}
+		sort.SliceStable(groups, func(i, j int) bool {
+			return groups[i][0].Size > groups[j][0].Size
+		})
+		if err := handle(groups); err != nil {
+			return err
+		}
+
+		candidates = candidates[end:]
+	}
+
+	return nil
+}
+
+// checksumFiles calculates the full checksums of the files, with io_uring for
+// small files if we can.
+func checksumFiles(args *Args, files []*File) error {
+	rest := files
+	if args.IOUring {
+		var small []*File
+		small, rest = uringFiles(files)
+		if err := calculateChecksumsInBatches(args, small, uringBatch(args),
+			hashBatchURing); err != nil {
+			return err
+		}
+	}
+	return calculateChecksums(args, rest, hashFile)
+}
+
+// countFiles says how many files there are, as in "1 file" or "2 files".
+func countFiles(n int) string {
+	if n == 1 {
+		return "1 file"
+	}
+	return fmt.Sprintf("%d files", n)
+}
+
+// prefixSize is how much of the start of a file prefixChecksum reads. For
+// files no larger than this, the quick checksum would cost as much as the full
+// one, so we skip it.
+const prefixSize = 64 * 1024
+
+// sameSize returns the files that have the same size as another file. It keeps
+// them in the order we found them.
+func sameSize(files []*File) []*File {
+	counts := make(map[int64]int)
+	for _, file := range files {
+		counts[file.Size]++
+	}
+
+	var candidates []*File
+	for _, file := range files {
+		if counts[file.Size] > 1 {
+			candidates = append(candidates, file)
+		}
+	}
+	return candidates
+}
+
+// largeFiles returns the files the quick checksum applies to.
+func largeFiles(files []*File) []*File {
+	var large []*File
+	for _, file := range files {
+		if file.Size > prefixSize {
+			large = append(large, file)
+		}
+	}
+	return large
+}
+
+// prefixChecksum checksums the start of the file.
+func prefixChecksum(args *Args, file *File) error {
+	fh, err := fds.open(file.Path)
+	if err != nil {
+		return fmt.Errorf("open: %s: %w", file.Path, err)
+	}
+
+	hasher := xxhash.New()
+	if _, err := io.CopyN(hasher, fh, prefixSize); err != nil {
+		_ = fds.close(fh)
+		return fmt.Errorf("read: %s: %w", file.Path, err)
+	}
+
+	file.prefix = hasher.Sum64()
+
+	if err := fds.close(fh); err != nil {
+		return fmt.Errorf("close: %s: %w", file.Path, err)
+	}
+
+	return nil
+}
+
+// samePrefix returns the files that have the same size and quick checksum as
+// another file. Small files have no quick checksum, so this only drops large
+// ones.
+func samePrefix(files []*File) []*File {
+	type key struct {
+		size   int64
+		prefix uint64
+	}
+
+	counts := make(map[key]int)
+	for _, file := range files {
+		counts[key{file.Size, file.prefix}]++
+	}
+
+	var candidates []*File
+	for _, file := range files {
+		if counts[key{file.Size, file.prefix}] > 1 {
+			candidates = append(candidates, file)
+		}
+	}
+	return candidates
+}
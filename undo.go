@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// undo implements the undo subcommand. It puts back the files a live run
+// removed, going by its JSON report. A deleted file or one replaced with a
+// link becomes a copy of its own again. We copy it from where -backup put it
+// if it is there, and otherwise from a copy the run kept.
+//
+// Without -live, we only say what we would restore.
+func undo(argv []string) error {
+	args := defaultArgs()
+
+	fs := flag.NewFlagSet("undo", flag.ExitOnError)
+	reportFile := fs.String("report", "",
+		"Path to a report a live run wrote with -output and -format json.")
+	fs.StringVar(&args.Backup, "backup", args.Backup,
+		"Directory the run backed files up to with -backup.")
+	fs.BoolVar(&args.Live, "live", args.Live, "Enable restoring files.")
+	fs.IntVar(&args.Retries, "retries", args.Retries,
+		"Number of times to retry opening/reading a file after a transient error.")
+	fs.DurationVar(&args.RetryDelay, "retry-delay", args.RetryDelay,
+		"Delay before the first retry. It doubles with each subsequent retry.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(),
+			"Usage: %s undo -report FILE [-backup DIR] [-live]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	_ = fs.Parse(argv)
+
+	if len(*reportFile) == 0 {
+		fs.Usage()
+		return fmt.Errorf("you must provide a report")
+	}
+
+	buf, err := ioutil.ReadFile(*reportFile)
+	if err != nil {
+		return fmt.Errorf("unable to read report: %s", err)
+	}
+
+	var report Report
+	if err := json.Unmarshal(buf, &report); err != nil {
+		return fmt.Errorf("unable to parse report: %s: %s", *reportFile, err)
+	}
+	if report.Summary == nil || !report.Summary.Live {
+		return fmt.Errorf("%s is from a run that wasn't live, so there is nothing to undo",
+			*reportFile)
+	}
+
+	restored, failed := 0, 0
+	for _, group := range report.Groups {
+		for _, file := range group.Files {
+			if file.Action == "" {
+				continue
+			}
+			done, err := undoRemoval(args, group, file)
+			if err != nil {
+				warnf("Unable to restore %s: %s", file.Path, err)
+				failed++
+				continue
+			}
+			if done {
+				restored++
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("unable to restore %d files", failed)
+	}
+	if args.Live {
+		log.Printf("Restored %d files.", restored)
+	} else {
+		log.Printf("Non-live mode. Would restore %d files.", restored)
+	}
+	return nil
+}
+
+// undoRemoval restores a file the run removed, telling whether it did or
+// would have. A file with its contents still its own, such as one the run
+// replaced with a reflink, needs nothing. What a command or plugin did we
+// can't know, so we leave those be.
+func undoRemoval(args *Args, group ReportGroup, reportFile ReportFile) (
+	bool,
+	error,
+) {
+	switch reportFile.Action {
+	case actionDelete, actionSymlink, actionHardlink:
+	case actionReflink:
+		return false, nil
+	default:
+		log.Printf("Not restoring %s: we can't undo %s", reportFile.Path,
+			reportFile.Action)
+		return false, nil
+	}
+
+	// A file that is there and isn't a link to a kept copy is one someone put
+	// back or replaced since, and we leave it alone.
+	kept := keptCopies(group)
+	_, err := os.Lstat(reportFile.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err == nil && !linkedTo(reportFile.Path, kept) {
+		log.Printf("Not restoring %s: it is there and isn't a link to a copy we kept",
+			reportFile.Path)
+		return false, nil
+	}
+	replace := err == nil
+
+	src, err := undoSource(args, group, reportFile.Path, kept)
+	if err != nil {
+		return false, err
+	}
+
+	if !args.Live {
+		log.Printf("Would restore %s from %s", reportFile.Path, src)
+		return true, nil
+	}
+
+	log.Printf("Restoring %s from %s", reportFile.Path, src)
+	if err := restoreFile(src, reportFile.Path, group.Size, replace); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// keptCopies returns the files in the group the run kept.
+func keptCopies(group ReportGroup) []*File {
+	var kept []*File
+	for _, reportFile := range group.Files {
+		if reportFile.Action == "" {
+			kept = append(kept, &File{Path: reportFile.Path, Size: group.Size})
+		}
+	}
+	return kept
+}
+
+// linkedTo checks whether the path is a hard or symbolic link to one of the
+// files.
+func linkedTo(filePath string, files []*File) bool {
+	for _, file := range files {
+		if alreadyLinked(file, &File{Path: filePath}) {
+			return true
+		}
+	}
+	return false
+}
+
+// undoSource finds what to restore the file from: its backup if there is
+// one, and otherwise a copy the run kept. A backup must be identical to the
+// kept copies, as it may be from another run.
+func undoSource(args *Args, group ReportGroup, filePath string, kept []*File) (
+	string,
+	error,
+) {
+	var available []*File
+	for _, file := range kept {
+		fi, err := os.Stat(file.Path)
+		if err == nil && fi.Mode().IsRegular() && fi.Size() == group.Size {
+			available = append(available, file)
+		}
+	}
+
+	if args.Backup != "" {
+		backup, err := backupPath(args.Backup, filePath)
+		if err != nil {
+			return "", err
+		}
+		fi, err := os.Stat(backup)
+		if err == nil && fi.Size() == group.Size {
+			if len(available) == 0 {
+				return backup, nil
+			}
+			identical, err := isIdentical(args, available[0],
+				&File{Path: backup, Size: fi.Size()})
+			if err != nil {
+				return "", fmt.Errorf("unable to compare %s with %s: %s", backup,
+					available[0].Path, err)
+			}
+			if identical {
+				return backup, nil
+			}
+			log.Printf("Not restoring %s from %s: it differs from %s", filePath,
+				backup, available[0].Path)
+		}
+	}
+
+	if len(available) == 0 {
+		return "", fmt.Errorf("no copy of it is left to restore it from")
+	}
+	return available[0].Path, nil
+}
+
+// restoreFile copies src to dest, keeping the permissions and modification
+// time of src. We write the copy beside dest and rename it into place. If
+// replace is false we never replace a file at dest, and otherwise we replace
+// the link that is there.
+func restoreFile(src, dest string, size int64, replace bool) error {
+	in, err := fds.open(src)
+	if err != nil {
+		return err
+	}
+
+	fi, err := in.Stat()
+	if err != nil {
+		_ = fds.close(in)
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		_ = fds.close(in)
+		return err
+	}
+
+	tmp := dest + ".dupefile-undo"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+		fi.Mode().Perm())
+	if err != nil {
+		_ = fds.close(in)
+		return err
+	}
+
+	n, err := io.Copy(out, in)
+	_ = fds.close(in)
+	if err == nil && n != size {
+		err = fmt.Errorf("copied %d bytes but expected %d", n, size)
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(tmp, fi.ModTime(), fi.ModTime())
+	}
+	if err == nil {
+		if replace {
+			err = os.Rename(tmp, dest)
+		} else {
+			err = renameNoReplace(tmp, dest)
+		}
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
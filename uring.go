@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// uringMaxSize is the largest file we read with io_uring. Opening, reading
+// and closing many small files is where reading them one at a time spends
+// most of its time, so that's what batching helps. We read each file with a
+// single read, so this bounds the memory a batch takes too.
+const uringMaxSize = 64 * 1024
+
+// uringBatchSize is the most files we read with one system call.
+const uringBatchSize = 64
+
+var uringUnavailable sync.Once
+
+// uringFiles returns the files small enough to read with io_uring.
+func uringFiles(files []*File) (small, rest []*File) {
+	for _, file := range files {
+		if file.Size > 0 && file.Size <= uringMaxSize {
+			small = append(small, file)
+		} else {
+			rest = append(rest, file)
+		}
+	}
+	return small, rest
+}
+
+// uringBatch returns how many files each goroutine may read at once. Each file
+// in a batch is open until the batch finishes, so the goroutines' batches
+// together must fit in the file descriptor budget.
+func uringBatch(args *Args) int {
+	n := cap(fds.tokens) / args.Workers
+	if n > uringBatchSize {
+		n = uringBatchSize
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// hashBatchURing hashes a batch of small files, reading them with one
+// io_uring submission. Files we can't read that way, for example because the
+// kernel doesn't support io_uring, we hash the usual way.
+func hashBatchURing(args *Args, batch []*File) error {
+	var fallback []*File
+
+	ring, err := newURing(len(batch))
+	if err != nil {
+		uringUnavailable.Do(func() {
+			log.Printf("Unable to use io_uring, reading files normally: %s", err)
+		})
+		return hashEach(args, batch)
+	}
+	defer ring.close()
+
+	var opened []*File
+	var handles []*os.File
+	var descriptors []int
+	var bufs [][]byte
+	for _, file := range batch {
+		fh, err := fds.open(file.Path)
+		if err != nil {
+			fallback = append(fallback, file)
+			continue
+		}
+		opened = append(opened, file)
+		handles = append(handles, fh)
+		descriptors = append(descriptors, int(fh.Fd()))
+		bufs = append(bufs, make([]byte, file.Size))
+	}
+
+	results, err := ring.readAll(descriptors, bufs)
+	for i, file := range opened {
+		if err == nil && int64(results[i]) == file.Size {
+			setHashes(args, file, bufs[i])
+		} else {
+			fallback = append(fallback, file)
+		}
+		if err := fds.close(handles[i]); err != nil {
+			return fmt.Errorf("close: %s: %w", file.Path, err)
+		}
+	}
+
+	return hashEach(args, fallback)
+}
+
+// hashEach hashes the files one at a time the usual way.
+func hashEach(args *Args, files []*File) error {
+	for _, file := range files {
+		if err := skipVanished(file,
+			retry(args, func() error { return hashFile(args, file) })); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build !linux || (!amd64 && !arm64)
+// +build !linux !amd64,!arm64
+
+package main
+
+import "fmt"
+
+const uringSupported = false
+
+type uring struct{}
+
+func newURing(entries int) (*uring, error) {
+	return nil, fmt.Errorf("io_uring is not supported on this platform")
+}
+
+func (r *uring) close() {}
+
+func (r *uring) readAll(fds []int, bufs [][]byte) ([]int32, error) {
+	return nil, fmt.Errorf("io_uring is not supported on this platform")
+}
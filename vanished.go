@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+)
+
+// Files can disappear between our finding them and reading them, such as
+// when scanning a directory programs are working in. A file that is gone
+// can't be a duplicate, so rather than failing the run, we skip it and say
+// so.
+
+// skipVanished marks the file as gone if err says it no longer exists. It
+// returns err if it is about something else.
+func skipVanished(file *File, err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		file.vanished = true
+		return nil
+	}
+	return err
+}
+
+// withoutVanished returns the files that haven't vanished, noting those that
+// have. We read only one path of each set of hard links, so if that path
+// vanished, we skip the others for this run too.
+func withoutVanished(args *Args, files []*File) []*File {
+	var present []*File
+	for _, file := range files {
+		if !file.vanished {
+			present = append(present, file)
+			continue
+		}
+
+		if _, err := os.Lstat(file.Path); err == nil {
+			log.Printf("Skipping %s: the hard link to it we read vanished",
+				file.Path)
+		} else {
+			log.Printf("Skipping %s: it vanished after we found it", file.Path)
+		}
+		args.vanished++
+	}
+	return present
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// verify implements the verify subcommand. It checks that the groups in a
+// JSON report are still duplicates: that their files still exist and are
+// still identical. This tells you whether a report is safe to act on some
+// time after the scan that produced it.
+func verify(argv []string) error {
+	args := defaultArgs()
+
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	reportFile := fs.String("report", "",
+		"Path to a report written with -output and -format json.")
+	fs.IntVar(&args.Retries, "retries", args.Retries,
+		"Number of times to retry opening/reading a file after a transient error.")
+	fs.DurationVar(&args.RetryDelay, "retry-delay", args.RetryDelay,
+		"Delay before the first retry. It doubles with each subsequent retry.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s verify -report FILE\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	_ = fs.Parse(argv)
+
+	if len(*reportFile) == 0 {
+		fs.Usage()
+		return fmt.Errorf("you must provide a report")
+	}
+
+	buf, err := ioutil.ReadFile(*reportFile)
+	if err != nil {
+		return fmt.Errorf("unable to read report: %s", err)
+	}
+
+	var report Report
+	if err := json.Unmarshal(buf, &report); err != nil {
+		return fmt.Errorf("unable to parse report: %s: %s", *reportFile, err)
+	}
+	live := report.Summary != nil && report.Summary.Live
+
+	failed := 0
+	for _, group := range report.Groups {
+		problems := verifyGroup(args, group, live)
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		if len(problems) > 0 {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d groups are no longer duplicates", failed,
+			len(report.Groups))
+	}
+
+	log.Printf("All %d groups are still duplicates.", len(report.Groups))
+	return nil
+}
+
+// verifyGroup checks the group's files against its first file. If the report
+// is from a live run, we skip the files it removed. It returns a description of
+// each problem it finds.
+func verifyGroup(args *Args, group ReportGroup, live bool) []string {
+	var problems []string
+
+	var files []*File
+	for _, reportFile := range group.Files {
+		if live && reportFile.Action != "" {
+			continue
+		}
+
+		fi, err := os.Stat(reportFile.Path)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", reportFile.Path, err))
+			continue
+		}
+		if fi.Size() != group.Size {
+			problems = append(problems,
+				fmt.Sprintf("%s: size changed from %d to %d", reportFile.Path,
+					group.Size, fi.Size()))
+			continue
+		}
+
+		files = append(files, &File{
+			Path:    reportFile.Path,
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+		})
+	}
+
+	// A live run may have left only one copy.
+	if len(files) < 2 {
+		return problems
+	}
+
+	for _, file := range files[1:] {
+		identical, err := isIdentical(args, files[0], file)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("unable to compare %s with %s: %s",
+				file.Path, files[0].Path, err))
+			continue
+		}
+		if !identical {
+			problems = append(problems, fmt.Sprintf("%s is no longer identical to %s",
+				file.Path, files[0].Path))
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// Build information. Release builds set these with the linker, for example:
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = ""
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// versionString describes the build and what it supports.
+func versionString() string {
+	v := version
+	if v == "" {
+		// Someone installed us with go install, which records the module's
+		// version, or built us from a checkout, which doesn't.
+		v = "devel"
+		if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" &&
+			info.Main.Version != "(devel)" {
+			v = info.Main.Version
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "dupefile %s\n", v)
+	fmt.Fprintf(&b, "commit: %s\n", commit)
+	fmt.Fprintf(&b, "built: %s with %s for %s/%s\n", buildDate, runtime.Version(),
+		runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(&b, "hash algorithms: %s\n",
+		strings.Join(hashAlgorithmNames(), ", "))
+	fmt.Fprintf(&b, "config formats: json, toml, yaml\n")
+	fmt.Fprintf(&b, "actions: %s, %s, %s, %s, %s, %s\n", actionDelete,
+		actionExec, actionHardlink, actionReflink, actionReport, actionSymlink)
+	fmt.Fprintf(&b, "report formats: %s\n",
+		strings.Join(reportFormatNames(), ", "))
+	return b.String()
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// We walk the tree with several goroutines listing directories at once. On
+// fast disks and network filesystems, listing one directory at a time leaves
+// most of the time waiting on each listing in turn.
+//
+// Only one goroutine hands files on, and it does so in the same order as a
+// walk one directory at a time would: each directory's entries in the order
+// the filesystem lists them, with a subdirectory's files where it appears.
+// The order we find files in decides the order of groups without -sort, so it
+// shouldn't depend on which listing happens to finish first.
+//
+// When we reach a directory, we ask for each of its subdirectories to be
+// listed. So we hold the listings of the directories we've seen but not yet
+// reached rather than the whole tree.
+
+// walkDir is a directory we list.
+type walkDir struct {
+	path    string
+	exclude []string
+
+	// The device the directory is on, if hasDev, and the kind of network
+	// filesystem that is, if it is one. See checksMounts.
+	dev       uint64
+	hasDev    bool
+	networkFS string
+
+	// done is closed once the directory has been listed.
+	done chan struct{}
+
+	// What we found. Each entry is a file or a subdirectory.
+	entries []walkEntry
+	rules   []Rule
+	err     error
+}
+
+// walkEntry is a file, a subdirectory, or, with -rewrite-symlinks or
+// -broken-symlinks, a symbolic link in a directory. With
+// -report-special-files, it may be a special file we skip.
+type walkEntry struct {
+	file    *File
+	dir     *walkDir
+	link    *symlink
+	special *SpecialFile
+}
+
+// walkQueue holds the directories waiting to be listed.
+type walkQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	dirs    []*walkDir
+	stopped bool
+}
+
+func newWalkQueue() *walkQueue {
+	q := &walkQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *walkQueue) push(dirs []*walkDir) {
+	q.mu.Lock()
+	q.dirs = append(q.dirs, dirs...)
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// pop waits for a directory to list. It returns nil once the walk is over.
+func (q *walkQueue) pop() *walkDir {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.dirs) == 0 && !q.stopped {
+		q.cond.Wait()
+	}
+	if q.stopped {
+		return nil
+	}
+	dir := q.dirs[0]
+	q.dirs = q.dirs[1:]
+	return dir
+}
+
+func (q *walkQueue) stop() {
+	q.mu.Lock()
+	q.stopped = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// findFiles finds the files beneath dir, skipping those matching the exclude
+// patterns. It calls found with each file.
+//
+// With -local-config, a configuration file in a directory adds rules and
+// exclude patterns for its subtree. We return those rules.
+func findFiles(
+	args *Args,
+	dir string,
+	exclude []string,
+	found func(*File) error,
+) ([]Rule, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("stat: %s: %s", dir, err)
+	}
+
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+
+	queue := newWalkQueue()
+	defer queue.stop()
+
+	for i := 0; i < args.Walkers; i++ {
+		go func() {
+			for d := queue.pop(); d != nil; d = queue.pop() {
+				listDir(args, d)
+				close(d.done)
+			}
+		}()
+	}
+
+	// The directories we're part way through, and how far.
+	type position struct {
+		dir  *walkDir
+		next int
+	}
+
+	root := &walkDir{path: dir, exclude: exclude, done: make(chan struct{}),
+		networkFS: args.networkFS}
+	if checksMounts(args) {
+		root.dev, _, root.hasDev = fileID(dir, fi)
+	}
+	queue.push([]*walkDir{root})
+	stack := []*position{{dir: root}}
+	reached := true
+
+	var rules []Rule
+	for len(stack) > 0 {
+		top := stack[len(stack)-1]
+
+		if reached {
+			<-top.dir.done
+			if top.dir.err != nil {
+				return nil, top.dir.err
+			}
+			rules = append(rules, top.dir.rules...)
+
+			var subdirs []*walkDir
+			for _, entry := range top.dir.entries {
+				if entry.dir != nil {
+					subdirs = append(subdirs, entry.dir)
+				}
+			}
+			queue.push(subdirs)
+			reached = false
+		}
+
+		if top.next == len(top.dir.entries) {
+			// We're done with its listing.
+			top.dir.entries = nil
+			stack = stack[:len(stack)-1]
+			continue
+		}
+
+		entry := top.dir.entries[top.next]
+		top.next++
+
+		if entry.dir != nil {
+			stack = append(stack, &position{dir: entry.dir})
+			reached = true
+			continue
+		}
+
+		if entry.link != nil {
+			if args.symlinks != nil {
+				args.symlinks.add(entry.link)
+			}
+			if entry.link.broken {
+				args.brokenLinks = append(args.brokenLinks, entry.link)
+			}
+			continue
+		}
+
+		if entry.special != nil {
+			args.specialFiles = append(args.specialFiles, entry.special)
+			continue
+		}
+
+		if err := found(entry.file); err != nil {
+			return nil, err
+		}
+	}
+
+	return rules, nil
+}
+
+// listDir lists the directory, finding its files, subdirectories, and local
+// configuration.
+func listDir(args *Args, d *walkDir) {
+	dh, err := fds.open(d.path)
+	if err != nil {
+		d.err = fmt.Errorf("open: %s: %s", d.path, err)
+		return
+	}
+
+	fis, err := dh.Readdir(0)
+	if err != nil {
+		_ = fds.close(dh)
+		d.err = fmt.Errorf("readdir: %s: %s", d.path, err)
+		return
+	}
+
+	if err := fds.close(dh); err != nil {
+		d.err = fmt.Errorf("close: %s: %s", d.path, err)
+		return
+	}
+
+	exclude := d.exclude
+
+	if args.LocalConfig {
+		for _, fi := range fis {
+			if fi.Name() != localConfigName || fi.IsDir() {
+				continue
+			}
+
+			local, err := readLocalConfig(d.path)
+			if err != nil {
+				d.err = err
+				return
+			}
+
+			d.rules = local.Rules
+			exclude = append(exclude[:len(exclude):len(exclude)], local.Exclude...)
+			break
+		}
+	}
+
+	for _, fi := range fis {
+		if fi.Name() == "." || fi.Name() == ".." {
+			continue
+		}
+
+		filePath := path.Join(d.path, fi.Name())
+
+		if isExcluded(exclude, filePath) {
+			continue
+		}
+
+		if isReparseLink(fi) {
+			continue
+		}
+
+		if fi.IsDir() {
+			sub := &walkDir{
+				path:      filePath,
+				exclude:   exclude,
+				done:      make(chan struct{}),
+				networkFS: d.networkFS,
+			}
+			if checksMounts(args) {
+				sub.dev, _, sub.hasDev = fileID(filePath, fi)
+				if sub.hasDev && d.hasDev && sub.dev != d.dev {
+					sub.networkFS = mountedFilesystem(filePath, d.networkFS)
+				}
+			}
+			d.entries = append(d.entries, walkEntry{dir: sub})
+			continue
+		}
+
+		// Otherwise identical local configurations in different directories
+		// would be duplicates.
+		if args.LocalConfig && fi.Name() == localConfigName {
+			continue
+		}
+
+		// These go along with the files they describe. See appledouble.go.
+		if strings.HasPrefix(fi.Name(), "._") && fi.Mode().IsRegular() &&
+			isAppleDouble(filePath) {
+			continue
+		}
+
+		// A symbolic link isn't a copy of what it points at. If that is in the
+		// tree, we find it where it is.
+		if fi.Mode()&os.ModeSymlink != 0 {
+			findBroken := args.BrokenLinks != brokenSymlinksIgnore
+			if args.symlinks == nil && !findBroken {
+				continue
+			}
+
+			target, err := os.Readlink(filePath)
+			if err != nil {
+				warnf("Unable to read symbolic link: %s: %s", filePath, err)
+				continue
+			}
+			d.entries = append(d.entries, walkEntry{link: &symlink{
+				path:   filePath,
+				target: target,
+				broken: findBroken && isBrokenSymlink(filePath),
+			}})
+			continue
+		}
+
+		if kind := specialKind(fi.Mode()); kind != "" {
+			if args.ListSpecial {
+				d.entries = append(d.entries, walkEntry{
+					special: &SpecialFile{Path: filePath, Kind: kind},
+				})
+			}
+			continue
+		}
+
+		file := &File{
+			Basename: fi.Name(),
+			Path:     filePath,
+			Size:     fi.Size(),
+			ModTime:  fi.ModTime(),
+		}
+		file.dev, file.ino, file.hasID = fileID(filePath, fi)
+		if uid, gid, ok := fileOwner(fi); ok {
+			file.uid, file.gid = uint32(uid), uint32(gid)
+		}
+		file.mode = fi.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid |
+			os.ModeSticky)
+		file.networkFS = d.networkFS
+		d.entries = append(d.entries, walkEntry{file: file})
+	}
+}
+
+// checksMounts says whether we look for network filesystems mounted beneath
+// -dir as we walk it. Only the state file and the Bloom filter trust
+// modification times, so we only need to know with one of them. A directory
+// on another device than its parent is a mount point, and we ask what is
+// mounted there.
+func checksMounts(args *Args) bool {
+	return detectsNetworkFilesystems && (args.state != nil || args.known != nil)
+}
+
+// mountedFilesystem returns the kind of network filesystem mounted at the
+// directory, or a blank string if it is a local one. If we can't tell, we
+// assume it is the same as its parent's, parentFS.
+func mountedFilesystem(dir, parentFS string) string {
+	kind, err := networkFilesystem(dir)
+	if err != nil {
+		warnf("Unable to tell what filesystem %s is on: %s", dir, err)
+		return parentFS
+	}
+	if kind != "" && kind != parentFS {
+		warnf("%s is on a network filesystem (%s). Checksumming its files even if an earlier run did, as we can't trust modification times there",
+			dir, kind)
+	}
+	return kind
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// xattrsSupported says whether readXattrs can find extended attributes on this
+// platform.
+const xattrsSupported = true
+
+// readXattrs returns the file's extended attributes.
+func readXattrs(path string) (map[string][]byte, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+
+	list := make([]byte, size)
+	size, err = syscall.Listxattr(path, list)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string][]byte)
+	for _, name := range bytes.Split(list[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+
+		size, err := syscall.Getxattr(path, string(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		size, err = syscall.Getxattr(path, string(name), value)
+		if err != nil {
+			return nil, err
+		}
+		xattrs[string(name)] = value[:size]
+	}
+
+	return xattrs, nil
+}
+
+// writeXattrs sets extended attributes on the file.
+func writeXattrs(path string, xattrs map[string][]byte) error {
+	for name, value := range xattrs {
+		if err := syscall.Setxattr(path, name, value, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// atSymlinkNofollow makes utimensat change a symbolic link rather than what it
+// points to.
+const atSymlinkNofollow = 0x100
+
+// setSymlinkModTime sets the modification time of a symbolic link itself.
+func setSymlinkModTime(path string, mtime time.Time) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+
+	now := syscall.NsecToTimespec(time.Now().UnixNano())
+	times := [2]syscall.Timespec{now,
+		syscall.NsecToTimespec(mtime.UnixNano())}
+	atFDCWD := -100
+	if _, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(atFDCWD),
+		uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&times)),
+		atSymlinkNofollow, 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "time"
+
+// xattrsSupported says whether readXattrs can find extended attributes on this
+// platform.
+const xattrsSupported = false
+
+// readXattrs returns the file's extended attributes. We don't know how to read
+// them on this platform, so we act as though there are none.
+func readXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// writeXattrs sets extended attributes on the file.
+func writeXattrs(path string, xattrs map[string][]byte) error {
+	return nil
+}
+
+// setSymlinkModTime sets the modification time of a symbolic link itself. We
+// don't know how to on this platform, so we leave it.
+func setSymlinkModTime(path string, mtime time.Time) error {
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// With -compare-xattrs, files are only duplicates if their extended
+// attributes match too. These include ACLs and SELinux labels. Files with
+// identical contents but different attributes are not duplicates, but we
+// report them separately as they are often a mistake in labelling.
+
+// splitByXattrs splits each group of identical files into groups with the
+// same extended attributes. It returns the groups that are still duplicates,
+// and the groups whose files have identical contents but not all the same
+// attributes.
+func splitByXattrs(groups [][]*File) ([][]*File, [][]*File, error) {
+	var duplicates, differing [][]*File
+	for _, group := range groups {
+		index := make(map[string]int)
+		var split [][]*File
+		for _, file := range group {
+			key, err := xattrKey(file.Path)
+			if err != nil {
+				return nil, nil, err
+			}
+			i, ok := index[key]
+			if !ok {
+				index[key] = len(split)
+				split = append(split, []*File{file})
+				continue
+			}
+			split[i] = append(split[i], file)
+		}
+
+		if len(split) > 1 {
+			differing = append(differing, group)
+			log.Print(describeDifferingGroup(group))
+		}
+
+		for _, files := range split {
+			if len(files) > 1 {
+				duplicates = append(duplicates, files)
+			}
+		}
+	}
+	return duplicates, differing, nil
+}
+
+// xattrKey describes the file's extended attributes such that two files have
+// the same key only if they have the same attributes.
+func xattrKey(path string) (string, error) {
+	xattrs, err := readXattrs(path)
+	if err != nil {
+		return "", fmt.Errorf("unable to read extended attributes: %s: %s", path,
+			err)
+	}
+
+	var names []string
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s=%s\n", name, hex.EncodeToString(xattrs[name]))
+	}
+	return b.String(), nil
+}
+
+// describeDifferingGroup lists a group of files with identical contents but
+// different attributes.
+func describeDifferingGroup(group []*File) string {
+	var b strings.Builder
+	fmt.Fprintf(&b,
+		"Identical contents but different extended attributes: %d files of %x (%d bytes each):",
+		len(group), group[0].Hash, group[0].Size)
+	for _, file := range group {
+		fmt.Fprintf(&b, "\n  %s", file.Path)
+	}
+	return b.String()
+}